@@ -0,0 +1,464 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+
+	"vlu_infrastructure_management/models"
+)
+
+// AdminUserController serves /api/admin/users (admins only, see router policies).
+type AdminUserController struct{ web.Controller }
+
+type UserListResp struct {
+	Rows   []models.User `json:"rows"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+	Total  int           `json:"total"`
+}
+
+const userSelectCols = `id, username, full_name, email, role, last_login, create_at, disabled_at, must_change_password, locked_until`
+
+func validRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleLabManager, RoleTechnician, RoleStudent:
+		return true
+	}
+	return false
+}
+
+func (c *AdminUserController) userID() (int64, bool) {
+	id, err := strconv.ParseInt(c.Ctx.Input.Param(":id"), 10, 64)
+	if err != nil || id <= 0 {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+		return 0, false
+	}
+	return id, true
+}
+
+// load fetches a user or writes 404/500.
+func (c *AdminUserController) load(id int64) (*models.User, bool) {
+	var u models.User
+	err := srv.DB.Get(&u, "SELECT "+userSelectCols+" FROM "+usersTable+" WHERE id=? LIMIT 1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		jsonErr(c.Ctx, http.StatusNotFound, "user not found")
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("[admin-users] load id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return nil, false
+	}
+	return &u, true
+}
+
+// guardSelf stops admins from locking themselves (and possibly everyone) out.
+func (c *AdminUserController) guardSelf(id int64, what string) bool {
+	if id == currentUserID(c.Ctx) {
+		jsonErr(c.Ctx, http.StatusConflict, "you cannot "+what+" your own account")
+		return false
+	}
+	return true
+}
+
+// GET /api/admin/users?q=&role=&status=active|disabled&limit=50&offset=0
+func (c *AdminUserController) List() {
+	q := strings.TrimSpace(c.GetString("q"))
+	role := strings.TrimSpace(c.GetString("role"))
+	status := strings.TrimSpace(c.GetString("status"))
+	limit := 50
+	if v := c.GetString("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 500 {
+			limit = n
+		}
+	}
+	offset := 0
+	if v := c.GetString("offset"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			offset = n
+		}
+	}
+
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	if q != "" {
+		where += " AND (username LIKE ? OR email LIKE ? OR full_name LIKE ?)"
+		p := "%" + q + "%"
+		args = append(args, p, p, p)
+	}
+	if role != "" {
+		where += " AND role=?"
+		args = append(args, role)
+	}
+	switch status {
+	case "active":
+		where += " AND disabled_at IS NULL"
+	case "disabled":
+		where += " AND disabled_at IS NOT NULL"
+	}
+
+	var total int
+	if err := srv.DB.Get(&total, "SELECT COUNT(1) FROM "+usersTable+where, args...); err != nil {
+		log.Printf("[admin-users] count: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	rows := make([]models.User, 0)
+	if err := srv.DB.Select(&rows, "SELECT "+userSelectCols+" FROM "+usersTable+where+" ORDER BY id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...); err != nil {
+		log.Printf("[admin-users] list: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, UserListResp{Rows: rows, Limit: limit, Offset: offset, Total: total})
+}
+
+// GET /api/admin/users/:id
+func (c *AdminUserController) Get() {
+	id, ok := c.userID()
+	if !ok {
+		return
+	}
+	if u, ok := c.load(id); ok {
+		jsonOK(c.Ctx, u)
+	}
+}
+
+// POST /api/admin/users
+// { "username", "full_name", "email", "role", "password" (optional) }
+// Without a password a temporary one is generated and must be changed at first login.
+func (c *AdminUserController) Create() {
+	var in struct {
+		registerInput
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(c.Ctx.Request.Body).Decode(&in); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	in.FullName = strings.TrimSpace(in.FullName)
+	in.Username = strings.TrimSpace(in.Username)
+	in.Email = strings.TrimSpace(in.Email)
+	in.Role = strings.TrimSpace(in.Role)
+	if in.Role == "" {
+		in.Role = RoleStudent
+	}
+	if !validRole(in.Role) {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid role")
+		return
+	}
+	temp := ""
+	if in.Password == "" {
+		temp = newTempPassword()
+		in.Password = temp
+	}
+	if msg := validateRegister(in.registerInput); msg != "" {
+		jsonErr(c.Ctx, http.StatusBadRequest, msg)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(in.Password), bcrypt.DefaultCost)
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	res, err := srv.DB.Exec("INSERT INTO "+usersTable+
+		" (username, password_hash, full_name, email, role, must_change_password, create_at) VALUES (?,?,?,?,?,?, NOW())",
+		in.Username, string(hash), in.FullName, in.Email, in.Role, temp != "")
+	if err != nil {
+		var me *mysql.MySQLError
+		if errors.As(err, &me) && me.Number == 1062 {
+			jsonErr(c.Ctx, http.StatusConflict, "email or username already in use")
+			return
+		}
+		log.Printf("[admin-users] insert: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "insert error")
+		return
+	}
+	id, _ := res.LastInsertId()
+	logActivity(currentUserID(c.Ctx), fmt.Sprintf("Created user #%d %s (%s)", id, in.Username, in.Role))
+
+	out := map[string]interface{}{"ok": true, "id": id}
+	if temp != "" {
+		out["temporary_password"] = temp
+	}
+	jsonOK(c.Ctx, out)
+}
+
+// PATCH /api/admin/users/:id
+// Any of { "username", "full_name", "email", "role" }.
+func (c *AdminUserController) Update() {
+	id, ok := c.userID()
+	if !ok {
+		return
+	}
+	var in struct {
+		Username *string `json:"username"`
+		FullName *string `json:"full_name"`
+		Email    *string `json:"email"`
+		Role     *string `json:"role"`
+	}
+	if err := json.NewDecoder(c.Ctx.Request.Body).Decode(&in); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	u, ok := c.load(id)
+	if !ok {
+		return
+	}
+
+	sets := []string{}
+	args := []interface{}{}
+	changes := []string{}
+	if in.Username != nil {
+		v := strings.TrimSpace(*in.Username)
+		if len(v) < 3 {
+			jsonErr(c.Ctx, http.StatusBadRequest, "username must be at least 3 characters")
+			return
+		}
+		sets, args = append(sets, "username=?"), append(args, v)
+		changes = append(changes, "username")
+	}
+	if in.FullName != nil {
+		v := strings.TrimSpace(*in.FullName)
+		if v == "" {
+			jsonErr(c.Ctx, http.StatusBadRequest, "full_name cannot be empty")
+			return
+		}
+		sets, args = append(sets, "full_name=?"), append(args, v)
+		changes = append(changes, "full_name")
+	}
+	if in.Email != nil {
+		v := strings.TrimSpace(*in.Email)
+		if !strings.Contains(v, "@") {
+			jsonErr(c.Ctx, http.StatusBadRequest, "invalid email")
+			return
+		}
+		sets, args = append(sets, "email=?"), append(args, v)
+		changes = append(changes, "email")
+	}
+	if in.Role != nil {
+		v := strings.TrimSpace(*in.Role)
+		if !validRole(v) {
+			jsonErr(c.Ctx, http.StatusBadRequest, "invalid role")
+			return
+		}
+		if v != RoleAdmin && u.Role == RoleAdmin && !c.guardSelf(id, "demote") {
+			return
+		}
+		sets, args = append(sets, "role=?"), append(args, v)
+		changes = append(changes, fmt.Sprintf("role %s->%s", u.Role, v))
+	}
+	if len(sets) == 0 {
+		jsonErr(c.Ctx, http.StatusBadRequest, "nothing to update")
+		return
+	}
+
+	if _, err := srv.DB.Exec("UPDATE "+usersTable+" SET "+strings.Join(sets, ", ")+" WHERE id=?", append(args, id)...); err != nil {
+		var me *mysql.MySQLError
+		if errors.As(err, &me) && me.Number == 1062 {
+			jsonErr(c.Ctx, http.StatusConflict, "email or username already in use")
+			return
+		}
+		log.Printf("[admin-users] update id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivity(currentUserID(c.Ctx), fmt.Sprintf("Updated user #%d %s: %s", id, u.Username, strings.Join(changes, ", ")))
+	if u, ok := c.load(id); ok {
+		jsonOK(c.Ctx, u)
+	}
+}
+
+// DELETE /api/admin/users/:id
+// Users with borrow history are kept for the record; disable them instead.
+func (c *AdminUserController) Delete() {
+	id, ok := c.userID()
+	if !ok || !c.guardSelf(id, "delete") {
+		return
+	}
+	u, ok := c.load(id)
+	if !ok {
+		return
+	}
+	var n int
+	if err := srv.DB.Get(&n, `SELECT COUNT(1) FROM log_lab_borrow_records WHERE user_id=?`, id); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if n > 0 {
+		jsonErr(c.Ctx, http.StatusConflict, "user has borrow history; disable the account instead")
+		return
+	}
+	if _, err := GetServer().Sessions.DeleteByUser(id, 0); err != nil {
+		log.Printf("[admin-users] delete sessions id=%d: %v", id, err)
+	}
+	if _, err := srv.DB.Exec("DELETE FROM "+usersTable+" WHERE id=?", id); err != nil {
+		log.Printf("[admin-users] delete id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "delete error")
+		return
+	}
+	logActivity(currentUserID(c.Ctx), fmt.Sprintf("Deleted user #%d %s", id, u.Username))
+	jsonOK(c.Ctx, map[string]interface{}{"ok": true})
+}
+
+// PUT /api/admin/users/:id/role  { "role": "lab_manager" }
+func (c *AdminUserController) SetRole() {
+	id, ok := c.userID()
+	if !ok {
+		return
+	}
+	var in struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(c.Ctx.Request.Body).Decode(&in); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	in.Role = strings.TrimSpace(in.Role)
+	if !validRole(in.Role) {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid role")
+		return
+	}
+	u, ok := c.load(id)
+	if !ok {
+		return
+	}
+	if in.Role != RoleAdmin && u.Role == RoleAdmin && !c.guardSelf(id, "demote") {
+		return
+	}
+	if _, err := srv.DB.Exec("UPDATE "+usersTable+" SET role=? WHERE id=?", in.Role, id); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivity(currentUserID(c.Ctx), fmt.Sprintf("Changed role of user #%d %s: %s->%s", id, u.Username, u.Role, in.Role))
+	jsonOK(c.Ctx, map[string]interface{}{"ok": true, "role": in.Role})
+}
+
+// POST /api/admin/users/:id/disable
+// Disabling also ends every session of the user.
+func (c *AdminUserController) Disable() {
+	id, ok := c.userID()
+	if !ok || !c.guardSelf(id, "disable") {
+		return
+	}
+	u, ok := c.load(id)
+	if !ok {
+		return
+	}
+	if _, err := srv.DB.Exec("UPDATE "+usersTable+" SET disabled_at=IFNULL(disabled_at, NOW()) WHERE id=?", id); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	n, err := GetServer().Sessions.DeleteByUser(id, 0)
+	if err != nil {
+		log.Printf("[admin-users] disable sessions id=%d: %v", id, err)
+	}
+	logActivity(currentUserID(c.Ctx), fmt.Sprintf("Disabled user #%d %s (%d sessions revoked)", id, u.Username, n))
+	jsonOK(c.Ctx, map[string]interface{}{"ok": true})
+}
+
+// POST /api/admin/users/:id/enable
+func (c *AdminUserController) Enable() {
+	id, ok := c.userID()
+	if !ok {
+		return
+	}
+	u, ok := c.load(id)
+	if !ok {
+		return
+	}
+	if _, err := srv.DB.Exec("UPDATE "+usersTable+" SET disabled_at=NULL WHERE id=?", id); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivity(currentUserID(c.Ctx), fmt.Sprintf("Enabled user #%d %s", id, u.Username))
+	jsonOK(c.Ctx, map[string]interface{}{"ok": true})
+}
+
+// POST /api/admin/users/:id/reset-password  { "password": "..." } (optional)
+// Sets a new password, forces a change at next login and signs the user out everywhere.
+func (c *AdminUserController) ResetPassword() {
+	id, ok := c.userID()
+	if !ok {
+		return
+	}
+	var in struct {
+		Password string `json:"password"`
+	}
+	_ = json.NewDecoder(c.Ctx.Request.Body).Decode(&in) // body is optional
+	u, ok := c.load(id)
+	if !ok {
+		return
+	}
+	pw := in.Password
+	generated := pw == ""
+	if generated {
+		pw = newTempPassword()
+	} else if len(pw) < 8 {
+		jsonErr(c.Ctx, http.StatusBadRequest, "password must be at least 8 characters")
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if _, err := srv.DB.Exec("UPDATE "+usersTable+" SET password_hash=?, must_change_password=1 WHERE id=?", string(hash), id); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if _, err := GetServer().Sessions.DeleteByUser(id, 0); err != nil {
+		log.Printf("[admin-users] reset sessions id=%d: %v", id, err)
+	}
+	logActivity(currentUserID(c.Ctx), fmt.Sprintf("Forced password reset for user #%d %s", id, u.Username))
+
+	out := map[string]interface{}{"ok": true}
+	if generated {
+		out["temporary_password"] = pw
+	}
+	jsonOK(c.Ctx, out)
+}
+
+// newTempPassword returns a random 16-char password for admin-issued resets.
+func newTempPassword() string {
+	return newToken()[:16]
+}
+
+// ensureBootstrapAdmin creates the first admin from ADMIN_BOOTSTRAP_USERNAME /
+// ADMIN_BOOTSTRAP_EMAIL / ADMIN_BOOTSTRAP_PASSWORD when no admin exists yet.
+// After that, accounts are managed through /api/admin/users.
+func ensureBootstrapAdmin(db *sqlx.DB) error {
+	username := firstNonEmpty(getConf("ADMIN_BOOTSTRAP_USERNAME"), os.Getenv("ADMIN_BOOTSTRAP_USERNAME"))
+	password := firstNonEmpty(getConf("ADMIN_BOOTSTRAP_PASSWORD"), os.Getenv("ADMIN_BOOTSTRAP_PASSWORD"))
+	if username == "" || password == "" {
+		return nil
+	}
+	var n int
+	if err := db.Get(&n, "SELECT COUNT(1) FROM "+usersTable+" WHERE role=?", RoleAdmin); err != nil || n > 0 {
+		return err
+	}
+	email := firstNonEmpty(getConf("ADMIN_BOOTSTRAP_EMAIL"), os.Getenv("ADMIN_BOOTSTRAP_EMAIL"), username+"@local")
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("INSERT INTO "+usersTable+
+		" (username, full_name, email, password_hash, role, must_change_password, create_at) VALUES (?,?,?,?,?,1, NOW())",
+		username, "Administrator", email, string(hash), RoleAdmin); err != nil {
+		return fmt.Errorf("bootstrap admin: %w", err)
+	}
+	log.Printf("[server] bootstrap admin %q created; change its password after first login", username)
+	return nil
+}
@@ -0,0 +1,223 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+)
+
+// Personal API tokens for scripts and kiosks. They are sent like session
+// tokens (Authorization: Bearer / X-Auth-Token) and recognised by their
+// prefix; only the sha256 hash is stored.
+
+const (
+	apiTokensTable = "api_tokens"
+	apiTokenPrefix = "imx_pat_"
+)
+
+const apiTokensSchema = `
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id           BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id      BIGINT UNSIGNED NOT NULL,
+	name         VARCHAR(100)    NOT NULL,
+	token_hash   CHAR(64)        NOT NULL,
+	hint         VARCHAR(16)     NOT NULL,
+	scope        VARCHAR(16)     NOT NULL,
+	created_at   DATETIME        NOT NULL,
+	expires_at   DATETIME        NULL,
+	last_used_at DATETIME        NULL,
+	last_used_ip VARCHAR(64)     NULL,
+	revoked_at   DATETIME        NULL,
+	UNIQUE KEY uq_api_tokens_token_hash (token_hash),
+	KEY idx_api_tokens_user (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// Token scopes. A token never grants more than its owner's role allows.
+const (
+	ScopeRead   = "read"   // GET requests only
+	ScopeBorrow = "borrow" // read + borrow/return (kiosks)
+	ScopeAdmin  = "admin"  // everything the owner's role allows
+)
+
+// last_used_at is only written back when it is older than this
+const apiTokenTouchInterval = time.Minute
+
+// ScopeAllows reports whether a token with scope may call method+path, which
+// requires perm. Token and account management (/api/auth/*) always needs a
+// real session, so a leaked token cannot mint or revoke credentials.
+func ScopeAllows(scope, method, path string, perm Permission) bool {
+	if strings.HasPrefix(path, "/api/auth/") {
+		return false
+	}
+	switch scope {
+	case ScopeAdmin:
+		return true
+	case ScopeBorrow:
+		return method == http.MethodGet || perm == PermBorrowCreate || perm == PermBorrowReturn
+	case ScopeRead:
+		return method == http.MethodGet
+	}
+	return false
+}
+
+func validScope(s string) bool {
+	return s == ScopeRead || s == ScopeBorrow || s == ScopeAdmin
+}
+
+type apiToken struct {
+	ID         int64      `db:"id"           json:"id"`
+	UserID     int64      `db:"user_id"      json:"-"`
+	Name       string     `db:"name"         json:"name"`
+	Hint       string     `db:"hint"         json:"hint"`
+	Scope      string     `db:"scope"        json:"scope"`
+	CreatedAt  time.Time  `db:"created_at"   json:"created_at"`
+	ExpiresAt  *time.Time `db:"expires_at"   json:"expires_at"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at"`
+	LastUsedIP *string    `db:"last_used_ip" json:"last_used_ip"`
+	Role       string     `db:"role"         json:"-"`
+
+	MustChangePassword bool `db:"must_change_password" json:"-"`
+}
+
+// apiTokenGet resolves a presented token to its (live) row plus the owner's role.
+func apiTokenGet(token string, ip string) (apiToken, bool) {
+	var t apiToken
+	err := srv.DB.Get(&t, "SELECT t.id, t.user_id, t.name, t.hint, t.scope, t.created_at, t.expires_at, t.last_used_at, t.last_used_ip, u.role, u.must_change_password FROM "+
+		apiTokensTable+" t JOIN "+usersTable+" u ON u.id = t.user_id"+
+		" WHERE t.token_hash=? AND t.revoked_at IS NULL AND (t.expires_at IS NULL OR t.expires_at > UTC_TIMESTAMP()) AND u.disabled_at IS NULL LIMIT 1",
+		hashToken(token))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("[api-tokens] lookup: %v", err)
+		}
+		return t, false
+	}
+	now := time.Now().UTC()
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > apiTokenTouchInterval {
+		if _, err := srv.DB.Exec("UPDATE "+apiTokensTable+" SET last_used_at=?, last_used_ip=? WHERE id=?",
+			now, nullableStr(ip), t.ID); err != nil {
+			log.Printf("[api-tokens] touch id=%d: %v", t.ID, err)
+		}
+	}
+	return t, true
+}
+
+func currentTokenScope(ctx *beegoctx.Context) (string, bool) {
+	s, ok := ctx.Input.GetData("api_token_scope").(string)
+	return s, ok
+}
+
+func apiTokenMaxDays() int64 {
+	return int64FromConf("API_TOKEN_MAX_DAYS", 365)
+}
+
+// GET /api/auth/tokens
+func AuthTokensList(ctx *beegoctx.Context) {
+	rows := make([]apiToken, 0)
+	if err := srv.DB.Select(&rows, "SELECT id, user_id, name, hint, scope, created_at, expires_at, last_used_at, last_used_ip, '' AS role FROM "+
+		apiTokensTable+" WHERE user_id=? AND revoked_at IS NULL ORDER BY id DESC", currentUserID(ctx)); err != nil {
+		log.Printf("[api-tokens] list: %v", err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	jsonOK(ctx, rows)
+}
+
+// POST /api/auth/tokens  { "name": "kiosk B2.04", "scope": "borrow", "expires_in_days": 90 }
+// The token is returned once; only its hash is kept.
+func AuthTokenCreate(ctx *beegoctx.Context) {
+	var in struct {
+		Name          string `json:"name"`
+		Scope         string `json:"scope"`
+		ExpiresInDays *int64 `json:"expires_in_days"`
+	}
+	if err := readJSON(ctx, &in); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	in.Name = strings.TrimSpace(in.Name)
+	in.Scope = strings.ToLower(strings.TrimSpace(in.Scope))
+	if in.Scope == "read-only" {
+		in.Scope = ScopeRead
+	}
+	if in.Name == "" || len(in.Name) > 100 {
+		jsonErr(ctx, http.StatusBadRequest, "name is required (max 100 characters)")
+		return
+	}
+	if !validScope(in.Scope) {
+		jsonErr(ctx, http.StatusBadRequest, "scope must be one of: read, borrow, admin")
+		return
+	}
+	maxDays := apiTokenMaxDays()
+	days := int64(90)
+	if in.ExpiresInDays != nil {
+		days = *in.ExpiresInDays
+	}
+	if days < 0 || (maxDays > 0 && (days == 0 || days > maxDays)) {
+		jsonErr(ctx, http.StatusBadRequest, fmt.Sprintf("expires_in_days must be between 1 and %d", maxDays))
+		return
+	}
+	// a token acts with the MFA level of the session that created it
+	role := currentRole(ctx)
+	if mfa, _ := ctx.Input.GetData("session_mfa").(bool); roleRequiresMFA(role) && !mfa {
+		ctx.Output.SetStatus(http.StatusForbidden)
+		_ = ctx.Output.JSON(map[string]any{"ok": false, "error": "mfa_required"}, false, false)
+		return
+	}
+
+	uid := currentUserID(ctx)
+	token := apiTokenPrefix + newToken()
+	now := time.Now().UTC()
+	var exp *time.Time
+	if days > 0 {
+		e := now.AddDate(0, 0, int(days))
+		exp = &e
+	}
+	hint := token[:len(apiTokenPrefix)+4]
+	res, err := srv.DB.Exec("INSERT INTO "+apiTokensTable+" (user_id, name, token_hash, hint, scope, created_at, expires_at) VALUES (?,?,?,?,?,?,?)",
+		uid, in.Name, hashToken(token), hint, in.Scope, now, exp)
+	if err != nil {
+		log.Printf("[api-tokens] create: %v", err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	id, _ := res.LastInsertId()
+	logActivity(uid, fmt.Sprintf("Created API token #%d %q (%s)", id, in.Name, in.Scope))
+	jsonOK(ctx, map[string]interface{}{
+		"id":         id,
+		"name":       in.Name,
+		"scope":      in.Scope,
+		"hint":       hint,
+		"expires_at": exp,
+		"token":      token,
+	})
+}
+
+// DELETE /api/auth/tokens/:id
+func AuthTokenRevoke(ctx *beegoctx.Context) {
+	id, ok := pathID(ctx, ":id")
+	if !ok {
+		jsonErr(ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	uid := currentUserID(ctx)
+	res, err := srv.DB.Exec("UPDATE "+apiTokensTable+" SET revoked_at=? WHERE id=? AND user_id=? AND revoked_at IS NULL",
+		time.Now().UTC(), id, uid)
+	if err != nil {
+		log.Printf("[api-tokens] revoke id=%d: %v", id, err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		jsonErr(ctx, http.StatusNotFound, "token not found")
+		return
+	}
+	logActivity(uid, fmt.Sprintf("Revoked API token #%d", id))
+	jsonOK(ctx, map[string]interface{}{"ok": true})
+}
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"vlu_infrastructure_management/models"
+)
+
+// Authenticator checks an identifier (username or e-mail) and password and
+// returns the local user it belongs to. AuthLogin tries the configured
+// backends in order (AUTH_BACKENDS, default "local").
+type Authenticator interface {
+	Name() string
+	Authenticate(identifier, password string) (models.User, error)
+}
+
+// AuthFailure is a rejected login; Reason ends up in failed_logins.
+type AuthFailure struct {
+	Reason string
+	UserID int64 // local user, when known
+}
+
+func (e *AuthFailure) Error() string { return "authentication failed: " + e.Reason }
+
+// localAuthenticator is the bcrypt hash in users.password_hash.
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string { return "local" }
+
+func (localAuthenticator) Authenticate(identifier, password string) (models.User, error) {
+	var u models.User
+	q := `SELECT id, username, password_hash, email, full_name, role, disabled_at, must_change_password, totp_enabled FROM users WHERE email = ? OR username = ? LIMIT 1`
+	if err := srv.DB.Get(&u, q, identifier, identifier); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return u, &AuthFailure{Reason: "unknown_user"}
+		}
+		return u, err
+	}
+	if err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)); err != nil {
+		return u, &AuthFailure{Reason: "bad_password", UserID: int64(u.ID)}
+	}
+	return u, nil
+}
+
+// authChain tries each backend until one accepts the credentials.
+type authChain []Authenticator
+
+func (authChain) Name() string { return "chain" }
+
+// Authenticate returns the first success. When every backend rejects the
+// login, the failure that identified a local user wins so the limiter can
+// count it against the account. If a backend could not be reached the
+// outcome is unknown, so its error is returned instead of a rejection.
+func (c authChain) Authenticate(identifier, password string) (models.User, error) {
+	var failure *AuthFailure
+	var backendErr error
+	for _, a := range c {
+		u, err := a.Authenticate(identifier, password)
+		if err == nil {
+			return u, nil
+		}
+		var f *AuthFailure
+		switch {
+		case errors.As(err, &f):
+			if failure == nil || (failure.UserID == 0 && f.UserID > 0) {
+				failure = f
+			}
+		case errors.Is(err, errAccountDisabled):
+			return u, err
+		default:
+			log.Printf("[auth] %s backend error: %v", a.Name(), err)
+			backendErr = err
+		}
+	}
+	if backendErr != nil {
+		return models.User{}, backendErr
+	}
+	if failure == nil {
+		failure = &AuthFailure{Reason: "unknown_user"}
+	}
+	return models.User{}, failure
+}
+
+// newAuthenticatorFromConf builds the chain from AUTH_BACKENDS (e.g. "local,ldap").
+func newAuthenticatorFromConf() Authenticator {
+	var chain authChain
+	for _, name := range splitCSV(firstNonEmpty(getConf("AUTH_BACKENDS"), "local")) {
+		switch strings.ToLower(name) {
+		case "local":
+			chain = append(chain, localAuthenticator{})
+		case "ldap":
+			chain = append(chain, NewLDAPAuthenticator(ldapConfigFromConf()))
+		default:
+			log.Printf("[auth] unknown backend %q in AUTH_BACKENDS, ignored", name)
+		}
+	}
+	if len(chain) == 0 {
+		chain = append(chain, localAuthenticator{})
+	}
+	return chain
+}
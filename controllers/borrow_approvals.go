@@ -0,0 +1,402 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+)
+
+// Restricted equipment (laser cutter, robot arm, table saw) is not checked
+// out on the spot. An item needs approval when its own requires_approval
+// flag is set or its category's policy says so. Borrow then records a
+// pending request without touching stock; a lab manager approves it, which
+// lends the stock like a walk-up borrow, or rejects it with a reason.
+// Callers who may approve borrow restricted items directly.
+
+const categoryPoliciesSchema = `
+CREATE TABLE IF NOT EXISTS category_policies (
+	category          VARCHAR(100)    NOT NULL PRIMARY KEY,
+	requires_approval TINYINT(1)      NOT NULL DEFAULT 0,
+	updated_by        BIGINT UNSIGNED NULL,
+	updated_at        DATETIME        NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// borrowNeedsApproval reports whether borrowing an item with the given flag
+// and category waits for a lab manager.
+func borrowNeedsApproval(q sqlGetter, itemFlag bool, category string) (bool, error) {
+	if itemFlag {
+		return true, nil
+	}
+	if strings.TrimSpace(category) == "" {
+		return false, nil
+	}
+	var n int
+	err := q.Get(&n, `SELECT COUNT(1) FROM category_policies WHERE category=? AND requires_approval=1`, category)
+	return n > 0, err
+}
+
+type categoryPolicy struct {
+	Category                string     `db:"category"                  json:"category"`
+	RequiresApproval        bool       `db:"requires_approval"         json:"requires_approval"`
+	MaxRenewals             *int       `db:"max_renewals"              json:"max_renewals"`
+	MaxLoanDays             *int       `db:"max_loan_days"             json:"max_loan_days"`
+	RenewalRequiresApproval bool       `db:"renewal_requires_approval" json:"renewal_requires_approval"`
+	UpdatedBy               *int64     `db:"updated_by"                json:"updated_by"`
+	UpdatedAt               *time.Time `db:"updated_at"                json:"updated_at"`
+	Items                   int        `db:"items"                     json:"items"`
+}
+
+// GET /api/category-policies
+// Every category in use or with a policy, whether it requires approval and
+// its renewal limits (null: the BORROW_* defaults in conf/app.conf).
+func CategoryPolicies(ctx *beegoctx.Context) {
+	out := make([]categoryPolicy, 0)
+	if err := srv.DB.Select(&out, `
+		SELECT c.category, COALESCE(p.requires_approval, 0) AS requires_approval,
+		       p.max_renewals, p.max_loan_days, COALESCE(p.renewal_requires_approval, 0) AS renewal_requires_approval,
+		       p.updated_by, p.updated_at,
+		       (SELECT COUNT(1) FROM log_lab_equipment_master e WHERE e.category = c.category AND e.archived_at IS NULL) AS items
+		FROM (SELECT DISTINCT category FROM log_lab_equipment_master WHERE category <> ''
+		      UNION SELECT category FROM category_policies) c
+		LEFT JOIN category_policies p ON p.category = c.category
+		ORDER BY c.category`); err != nil {
+		log.Printf("[approvals] category policies: %v", err)
+		jsonErr(ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(ctx, out)
+}
+
+// PUT /api/category-policies
+//
+//	{"category": "Laser", "requires_approval": true, "max_renewals": 1,
+//	 "max_loan_days": 14, "renewal_requires_approval": true}
+//
+// Settings left out keep their value; a null limit falls back to the
+// default.
+func SetCategoryPolicy(ctx *beegoctx.Context) {
+	var in struct {
+		Category                string          `json:"category"`
+		RequiresApproval        *bool           `json:"requires_approval"`
+		MaxRenewals             json.RawMessage `json:"max_renewals"`
+		MaxLoanDays             json.RawMessage `json:"max_loan_days"`
+		RenewalRequiresApproval *bool           `json:"renewal_requires_approval"`
+	}
+	if err := readJSON(ctx, &in); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	in.Category = strings.TrimSpace(in.Category)
+	maxRenewals, setRenewals, err := policyLimit(in.MaxRenewals, 0)
+	if err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "max_renewals must be null or a number >= 0")
+		return
+	}
+	maxDays, setDays, err := policyLimit(in.MaxLoanDays, 1)
+	if err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "max_loan_days must be null or a number >= 1")
+		return
+	}
+	switch {
+	case in.Category == "":
+		jsonErr(ctx, http.StatusBadRequest, "category is required")
+		return
+	case in.RequiresApproval == nil && in.RenewalRequiresApproval == nil && !setRenewals && !setDays:
+		jsonErr(ctx, http.StatusBadRequest, "nothing to update")
+		return
+	case len(in.Category) > 100:
+		jsonErr(ctx, http.StatusBadRequest, "category is too long")
+		return
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var p categoryPolicy
+	err = tx.Get(&p, `SELECT category, requires_approval, max_renewals, max_loan_days, renewal_requires_approval
+		FROM category_policies WHERE category=? FOR UPDATE`, in.Category)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("[approvals] load policy %q: %v", in.Category, err)
+		jsonErr(ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	p.Category = in.Category
+	if in.RequiresApproval != nil {
+		p.RequiresApproval = *in.RequiresApproval
+	}
+	if in.RenewalRequiresApproval != nil {
+		p.RenewalRequiresApproval = *in.RenewalRequiresApproval
+	}
+	if setRenewals {
+		p.MaxRenewals = maxRenewals
+	}
+	if setDays {
+		p.MaxLoanDays = maxDays
+	}
+	uid := currentUserID(ctx)
+	if _, err := tx.Exec(`INSERT INTO category_policies (category, requires_approval, max_renewals, max_loan_days, renewal_requires_approval, updated_by, updated_at)
+		VALUES (?,?,?,?,?,?,?)
+		ON DUPLICATE KEY UPDATE requires_approval=VALUES(requires_approval), max_renewals=VALUES(max_renewals), max_loan_days=VALUES(max_loan_days),
+			renewal_requires_approval=VALUES(renewal_requires_approval), updated_by=VALUES(updated_by), updated_at=VALUES(updated_at)`,
+		p.Category, p.RequiresApproval, p.MaxRenewals, p.MaxLoanDays, p.RenewalRequiresApproval, uid, time.Now().UTC()); err != nil {
+		log.Printf("[approvals] set policy %q: %v", in.Category, err)
+		jsonErr(ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if in.RequiresApproval != nil {
+		verb := "no longer require"
+		if *in.RequiresApproval {
+			verb = "now require"
+		}
+		logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Borrows in category %s %s approval", in.Category, verb))
+	}
+	if in.RenewalRequiresApproval != nil || setRenewals || setDays {
+		logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Renewal policy for category %s: %s", in.Category, describeRenewalPolicy(p)))
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	jsonOK(ctx, map[string]interface{}{
+		"category":                  p.Category,
+		"requires_approval":         p.RequiresApproval,
+		"max_renewals":              p.MaxRenewals,
+		"max_loan_days":             p.MaxLoanDays,
+		"renewal_requires_approval": p.RenewalRequiresApproval,
+	})
+}
+
+// policyLimit reads an optional limit of at least least: set is false when
+// it was left out, and a null clears it.
+func policyLimit(raw json.RawMessage, least int) (v *int, set bool, err error) {
+	if len(raw) == 0 {
+		return nil, false, nil
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, true, err
+	}
+	if v != nil && *v < least {
+		return nil, true, fmt.Errorf("limit %d below %d", *v, least)
+	}
+	return v, true, nil
+}
+
+type borrowRequestRow struct {
+	ID           int64      `db:"id"            json:"id"`
+	ItemID       int64      `db:"item_id"       json:"item_id"`
+	SKU          string     `db:"sku"           json:"sku"`
+	ItemName     string     `db:"item_name"     json:"item_name"`
+	UserID       int64      `db:"user_id"       json:"user_id"`
+	UserName     *string    `db:"user_name"     json:"user_name"`
+	Quantity     int        `db:"quantity"      json:"quantity"`
+	BorrowDate   time.Time  `db:"borrow_date"   json:"borrow_date"`
+	ReturnDate   *time.Time `db:"return_date"   json:"return_date"`
+	Status       string     `db:"status"        json:"status"`
+	DecidedBy    *int64     `db:"decided_by"    json:"decided_by"`
+	DecidedAt    *time.Time `db:"decided_at"    json:"decided_at"`
+	DecisionNote *string    `db:"decision_note" json:"decision_note"`
+}
+
+const borrowRequestSelect = `SELECT br.id, br.item_id, e.sku, e.name AS item_name, br.user_id, u.full_name AS user_name,
+	br.quantity, br.borrow_date, br.return_date, br.status, br.decided_by, br.decided_at, br.decision_note
+	FROM log_lab_borrow_records br
+	JOIN log_lab_equipment_master e ON e.id = br.item_id
+	LEFT JOIN users u ON u.id = br.user_id`
+
+// BorrowApprovalController serves /api/borrows/pending and the approve and
+// reject actions.
+type BorrowApprovalController struct{ web.Controller }
+
+// GET /api/borrows/pending?item_id=
+// Requests waiting for a decision, oldest first. Without borrow.approve the
+// caller sees only their own.
+func (c *BorrowApprovalController) Pending() {
+	where := ` WHERE br.status=?`
+	args := []interface{}{BorrowPending}
+	if id, err := c.GetInt64("item_id"); err == nil && id > 0 {
+		where += ` AND br.item_id=?`
+		args = append(args, id)
+	}
+	if !RoleAllows(currentRole(c.Ctx), PermBorrowApprove) {
+		where += ` AND br.user_id=?`
+		args = append(args, currentUserID(c.Ctx))
+	}
+	out := make([]borrowRequestRow, 0)
+	if err := srv.DB.Select(&out, borrowRequestSelect+where+` ORDER BY br.id LIMIT 500`, args...); err != nil {
+		log.Printf("[approvals] pending: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, out)
+}
+
+func (c *BorrowApprovalController) loadRequest(q sqlGetter, id int64, lock bool) (borrowRequestRow, bool) {
+	var r borrowRequestRow
+	sqlStr := borrowRequestSelect + ` WHERE br.id=? LIMIT 1`
+	if lock {
+		sqlStr += ` FOR UPDATE`
+	}
+	if err := q.Get(&r, sqlStr, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "borrow not found")
+		} else {
+			log.Printf("[approvals] load id=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return r, false
+	}
+	return r, true
+}
+
+// POST /api/borrows/:id/approve  {"note": "induction done", "unit_ids": [4], "units": ["LC-01"]}
+// Lends the stock now, as a walk-up borrow would, and picks the units.
+func (c *BorrowApprovalController) Approve() {
+	id, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var in struct {
+		Note    string   `json:"note"`
+		UnitIDs []int64  `json:"unit_ids"`
+		Units   []string `json:"units"`
+	}
+	_ = readJSON(c.Ctx, &in) // the body is optional
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// item first, then the record, as Borrow and Return do
+	r, ok := c.loadRequest(tx, id, false)
+	if !ok {
+		return
+	}
+	var item itemRow
+	if err := tx.Get(&item, `SELECT `+itemSelectCols+` FROM log_lab_equipment_master WHERE id=? FOR UPDATE`, r.ItemID); err != nil {
+		log.Printf("[approvals] lock item=%d: %v", r.ItemID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if r, ok = c.loadRequest(tx, id, true); !ok {
+		return
+	}
+	var returnDate interface{}
+	if r.ReturnDate != nil {
+		returnDate = *r.ReturnDate
+	}
+	switch {
+	case r.Status != BorrowPending:
+		jsonErr(c.Ctx, http.StatusConflict, "borrow is "+r.Status+", not pending")
+		return
+	case item.ArchivedAt != nil:
+		jsonErr(c.Ctx, http.StatusConflict, "item is archived")
+		return
+	case item.ItemType == ItemConsumable:
+		jsonErr(c.Ctx, http.StatusConflict, "consumable items are issued, not borrowed; reject the request")
+		return
+	case item.AvailableQuantity < r.Quantity:
+		jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("only %d available now", item.AvailableQuantity))
+		return
+	}
+	msg, err := walkUpMsg(tx, r.ItemID, item.AvailableQuantity, r.Quantity, returnDate)
+	if err != nil {
+		log.Printf("[approvals] reservations item=%d: %v", r.ItemID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if msg != "" {
+		jsonErr(c.Ctx, http.StatusConflict, msg)
+		return
+	}
+	unitIDs, msg, err := lend(tx, r.ItemID, r.ID, r.UserID, r.Quantity, item.AvailableQuantity, in.UnitIDs, in.Units)
+	if err != nil {
+		log.Printf("[approvals] approve id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if msg != "" {
+		jsonErr(c.Ctx, http.StatusConflict, msg)
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	// the loan starts when it is approved
+	if _, err := tx.Exec(`UPDATE log_lab_borrow_records SET status=?, borrow_date=NOW(), decided_by=?, decided_at=?, decision_note=? WHERE id=?`,
+		BorrowBorrowed, uid, time.Now().UTC(), nullableStr(truncate(strings.TrimSpace(in.Note), 255)), id); err != nil {
+		log.Printf("[approvals] approve id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Approved borrow #%d: %s (%s) x%d", id, item.Name, item.SKU, r.Quantity))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	if r, ok := c.loadRequest(srv.DB, id, false); ok {
+		jsonOK(c.Ctx, map[string]interface{}{"borrow": r, "unit_ids": unitIDs})
+	}
+}
+
+// POST /api/borrows/:id/reject  {"reason": "book the safety induction first"}
+func (c *BorrowApprovalController) Reject() {
+	id, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var in struct {
+		Reason string `json:"reason"`
+	}
+	_ = readJSON(c.Ctx, &in)
+	reason := strings.TrimSpace(in.Reason)
+	if reason == "" {
+		jsonErr(c.Ctx, http.StatusBadRequest, "reason is required")
+		return
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	r, ok := c.loadRequest(tx, id, true)
+	if !ok {
+		return
+	}
+	if r.Status != BorrowPending {
+		jsonErr(c.Ctx, http.StatusConflict, "borrow is "+r.Status+", not pending")
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	if _, err := tx.Exec(`UPDATE log_lab_borrow_records SET status=?, decided_by=?, decided_at=?, decision_note=? WHERE id=?`,
+		BorrowRejected, uid, time.Now().UTC(), truncate(reason, 255), id); err != nil {
+		log.Printf("[approvals] reject id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Rejected borrow #%d of %s (%s): %s", id, r.ItemName, r.SKU, reason))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	if r, ok := c.loadRequest(srv.DB, id, false); ok {
+		jsonOK(c.Ctx, r)
+	}
+}
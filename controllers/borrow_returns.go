@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+)
+
+// A borrow of several pieces may come back a few at a time. Each return is
+// a line in borrow_returns and adds to the record's quantity_returned; the
+// record keeps status borrowed until the last piece is back, when Return
+// closes it as before.
+
+const borrowReturnsSchema = `
+CREATE TABLE IF NOT EXISTS borrow_returns (
+	id                  BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	borrow_id           BIGINT UNSIGNED NOT NULL,
+	quantity            INT             NOT NULL,
+	held                INT             NOT NULL DEFAULT 0,
+	condition_on_return VARCHAR(255)    NULL,
+	returned_at         DATETIME        NOT NULL,
+	recorded_by         BIGINT UNSIGNED NULL,
+	created_at          DATETIME        NOT NULL,
+	KEY idx_borrow_returns_borrow (borrow_id, returned_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+type borrowReturnRow struct {
+	ID         int64     `db:"id"                  json:"id"`
+	Quantity   int       `db:"quantity"            json:"quantity"`
+	Held       int       `db:"held"                json:"held_for_maintenance"`
+	Condition  *string   `db:"condition_on_return" json:"condition_on_return"`
+	ReturnedAt time.Time `db:"returned_at"         json:"returned_at"`
+	RecordedBy *int64    `db:"recorded_by"         json:"recorded_by"`
+}
+
+// GET /api/borrows/:id/returns
+// The returns made against a borrow so far and how many are still out.
+// Borrowers see their own; approvers see any.
+func BorrowReturns(ctx *beegoctx.Context) {
+	id, ok := pathID(ctx, ":id")
+	if !ok {
+		jsonErr(ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var b struct {
+		UserID   int64 `db:"user_id"`
+		Quantity int   `db:"quantity"`
+		Returned int   `db:"quantity_returned"`
+	}
+	if err := srv.DB.Get(&b, `SELECT user_id, quantity, quantity_returned FROM log_lab_borrow_records WHERE id=?`, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(ctx, http.StatusNotFound, "borrow not found")
+		} else {
+			log.Printf("[borrow-returns] borrow=%d: %v", id, err)
+			jsonErr(ctx, http.StatusInternalServerError, "query error")
+		}
+		return
+	}
+	if b.UserID != currentUserID(ctx) && !RoleAllows(currentRole(ctx), PermBorrowApprove) {
+		jsonErr(ctx, http.StatusNotFound, "borrow not found")
+		return
+	}
+	rows := make([]borrowReturnRow, 0)
+	if err := srv.DB.Select(&rows, `SELECT id, quantity, held, condition_on_return, returned_at, recorded_by
+		FROM borrow_returns WHERE borrow_id=? ORDER BY returned_at, id`, id); err != nil {
+		log.Printf("[borrow-returns] list borrow=%d: %v", id, err)
+		jsonErr(ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(ctx, map[string]interface{}{
+		"borrow_id":         id,
+		"quantity":          b.Quantity,
+		"quantity_returned": b.Returned,
+		"outstanding":       b.Quantity - b.Returned,
+		"returns":           rows,
+	})
+}
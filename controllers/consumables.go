@@ -0,0 +1,277 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Consumables (item_type = consumable) are issued instead of borrowed: an
+// issue takes the stock off the books for good and records who took it and
+// for which course or project. They cannot be borrowed, returned or tracked
+// as units.
+
+const stockIssuesSchema = `
+CREATE TABLE IF NOT EXISTS stock_issues (
+	id         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	item_id    BIGINT UNSIGNED NOT NULL,
+	user_id    BIGINT UNSIGNED NOT NULL,
+	issued_by  BIGINT UNSIGNED NULL,
+	quantity   INT             NOT NULL,
+	unit_cost  DECIMAL(15,2)   NULL,
+	location   VARCHAR(255)    NULL,
+	course     VARCHAR(100)    NULL,
+	project    VARCHAR(100)    NULL,
+	note       VARCHAR(255)    NULL,
+	issued_at  DATETIME        NOT NULL,
+	KEY idx_stock_issues_item (item_id, issued_at),
+	KEY idx_stock_issues_user (user_id, issued_at),
+	KEY idx_stock_issues_course (course)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// itemTypeChangeMsg is the client error for making itemID a consumable
+// while it is on loan or tracked as units, or "".
+func itemTypeChangeMsg(q sqlGetter, itemID int64, to string) (string, error) {
+	if to != ItemConsumable {
+		return "", nil
+	}
+	var c struct {
+		Borrows int `db:"borrows"`
+		Units   int `db:"units"`
+	}
+	err := q.Get(&c, `SELECT
+		(SELECT COUNT(1) FROM log_lab_borrow_records WHERE item_id=? AND actual_return_date IS NULL AND status NOT IN ('pending', 'rejected', 'returned')) AS borrows,
+		(SELECT COUNT(1) FROM equipment_units WHERE item_id=? AND status <> 'retired') AS units`, itemID, itemID)
+	switch {
+	case err != nil:
+		return "", err
+	case c.Borrows > 0:
+		return fmt.Sprintf("item has %d open borrow(s); they must be returned before it becomes a consumable", c.Borrows), nil
+	case c.Units > 0:
+		return fmt.Sprintf("item tracks %d unit(s); retire them before it becomes a consumable", c.Units), nil
+	}
+	return "", nil
+}
+
+type issueRow struct {
+	ID       int64     `db:"id"         json:"id"`
+	ItemID   int64     `db:"item_id"    json:"item_id"`
+	SKU      string    `db:"sku"        json:"sku"`
+	ItemName string    `db:"item_name"  json:"item_name"`
+	UserID   int64     `db:"user_id"    json:"user_id"`
+	UserName *string   `db:"user_name"  json:"user_name"`
+	IssuedBy *int64    `db:"issued_by"  json:"issued_by"`
+	Quantity int       `db:"quantity"   json:"quantity"`
+	UnitCost *float64  `db:"unit_cost"  json:"unit_cost"`
+	Location *string   `db:"location"   json:"location"`
+	Course   *string   `db:"course"     json:"course"`
+	Project  *string   `db:"project"    json:"project"`
+	Note     *string   `db:"note"       json:"note"`
+	IssuedAt time.Time `db:"issued_at"  json:"issued_at"`
+}
+
+const issueSelect = `SELECT i.id, i.item_id, e.sku, e.name AS item_name, i.user_id, u.full_name AS user_name,
+	i.issued_by, i.quantity, i.unit_cost, i.location, i.course, i.project, i.note, i.issued_at
+	FROM stock_issues i
+	JOIN log_lab_equipment_master e ON e.id = i.item_id
+	LEFT JOIN users u ON u.id = i.user_id`
+
+// POST /api/items/issue
+//
+//	{"item_id": 12, "quantity": 2, "user_id": 57, "course": "ME3012",
+//	 "project": "Capstone drone frame", "location": "Store room", "note": "..."}
+//
+// sku may stand in for item_id; user_id (the person taking the stock)
+// defaults to the caller; course or project is required. location picks the
+// shelf the stock comes from when the item is kept in several places.
+func (c *ItemController) Issue() {
+	var in struct {
+		ItemID   int64  `json:"item_id"`
+		SKU      string `json:"sku"`
+		Quantity int    `json:"quantity"`
+		UserID   int64  `json:"user_id"`
+		Course   string `json:"course"`
+		Project  string `json:"project"`
+		Location string `json:"location"`
+		Note     string `json:"note"`
+	}
+	if err := readJSON(c.Ctx, &in); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	in.SKU, in.Course, in.Project, in.Note = strings.TrimSpace(in.SKU), strings.TrimSpace(in.Course), strings.TrimSpace(in.Project), strings.TrimSpace(in.Note)
+	location := normalizeLocation(in.Location)
+	switch {
+	case in.ItemID <= 0 && in.SKU == "":
+		jsonErr(c.Ctx, http.StatusBadRequest, "provide item_id or sku")
+		return
+	case in.Quantity <= 0:
+		jsonErr(c.Ctx, http.StatusBadRequest, "quantity must be > 0")
+		return
+	case in.Course == "" && in.Project == "":
+		jsonErr(c.Ctx, http.StatusBadRequest, "course or project is required")
+		return
+	case len(in.Course) > 100 || len(in.Project) > 100:
+		jsonErr(c.Ctx, http.StatusBadRequest, "course and project must be at most 100 characters")
+		return
+	case isInTransit(location):
+		jsonErr(c.Ctx, http.StatusBadRequest, "stock in transit cannot be issued")
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	recipient := in.UserID
+	if recipient <= 0 {
+		recipient = uid
+	}
+	if in.ItemID <= 0 {
+		if err := srv.DB.Get(&in.ItemID, `SELECT id FROM log_lab_equipment_master WHERE sku=? LIMIT 1`, in.SKU); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				jsonErr(c.Ctx, http.StatusNotFound, "item not found by sku")
+			} else {
+				log.Printf("[issue] sku %q: %v", in.SKU, err)
+				jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+			}
+			return
+		}
+	}
+	var name string
+	if err := srv.DB.Get(&name, `SELECT full_name FROM `+usersTable+` WHERE id=? AND disabled_at IS NULL`, recipient); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusBadRequest, "user_id is not an active user")
+		} else {
+			log.Printf("[issue] user=%d: %v", recipient, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	item, ok := c.loadItem(tx, in.ItemID, true)
+	if !ok {
+		return
+	}
+	switch {
+	case item.ArchivedAt != nil:
+		jsonErr(c.Ctx, http.StatusConflict, "item is archived")
+		return
+	case item.ItemType != ItemConsumable:
+		jsonErr(c.Ctx, http.StatusConflict, "only consumable items are issued; durable items are borrowed")
+		return
+	case item.AvailableQuantity < in.Quantity:
+		jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("only %d in stock", item.AvailableQuantity))
+		return
+	}
+	if _, err := tx.Exec(`UPDATE log_lab_equipment_master SET quantity=quantity-?, available_quantity=available_quantity-? WHERE id=?`,
+		in.Quantity, in.Quantity, item.ID); err != nil {
+		log.Printf("[issue] stock item=%d: %v", item.ID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	res, err := tx.Exec(`INSERT INTO stock_issues (item_id, user_id, issued_by, quantity, unit_cost, location, course, project, note, issued_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?)`, item.ID, recipient, uid, in.Quantity, item.UnitCost,
+		nullableStr(firstNonEmpty(location, item.Location)), nullableStr(in.Course), nullableStr(in.Project),
+		nullableStr(truncate(in.Note, 255)), time.Now().UTC())
+	if err != nil {
+		log.Printf("[issue] insert item=%d: %v", item.ID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "insert error")
+		return
+	}
+	issueID, _ := res.LastInsertId()
+	msg, err := shiftStock(tx, in.ItemID, -in.Quantity, location, nil,
+		stockMove{Reason: "issue", RefType: "issue", RefID: issueID, UserID: uid, Note: firstNonEmpty(in.Course, in.Project)})
+	if err != nil {
+		log.Printf("[issue] locations item=%d: %v", item.ID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if msg != "" {
+		jsonErr(c.Ctx, http.StatusConflict, msg)
+		return
+	}
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Issued %d x %s (%s) to %s for %s", in.Quantity, item.Name, item.SKU, name,
+		strings.Join(nonEmpty(in.Course, in.Project), " / ")))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+
+	var out issueRow
+	if err := srv.DB.Get(&out, issueSelect+` WHERE i.id=?`, issueID); err != nil {
+		jsonOK(c.Ctx, map[string]interface{}{"id": issueID})
+		return
+	}
+	c.Ctx.Output.SetStatus(http.StatusCreated)
+	jsonOK(c.Ctx, out)
+}
+
+func nonEmpty(vals ...string) []string {
+	var out []string
+	for _, v := range vals {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// GET /api/stock-issues?item_id=&user_id=&course=&project=&from=2024-09-01&to=2024-12-31
+// Issues newest first, with the quantity and cost totals of the selection.
+func (c *ItemController) Issues() {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	for _, f := range []string{"item_id", "user_id"} {
+		if id, err := c.GetInt64(f); err == nil && id > 0 {
+			where += ` AND i.` + f + `=?`
+			args = append(args, id)
+		}
+	}
+	for _, f := range []string{"course", "project"} {
+		if v := strings.TrimSpace(c.GetString(f)); v != "" {
+			where += ` AND i.` + f + `=?`
+			args = append(args, v)
+		}
+	}
+	for _, f := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		v := strings.TrimSpace(c.GetString(f.param))
+		if v == "" {
+			continue
+		}
+		d, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			jsonErr(c.Ctx, http.StatusBadRequest, f.param+" must be YYYY-MM-DD")
+			return
+		}
+		if f.param == "to" {
+			d = d.AddDate(0, 0, 1) // inclusive
+		}
+		where += ` AND i.issued_at ` + f.op + ` ?`
+		args = append(args, d)
+	}
+	rows := make([]issueRow, 0)
+	if err := srv.DB.Select(&rows, issueSelect+where+` ORDER BY i.id DESC LIMIT 1000`, args...); err != nil {
+		log.Printf("[issue] list: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	var totals struct {
+		Quantity int     `db:"quantity" json:"quantity"`
+		Cost     float64 `db:"cost"     json:"cost"`
+	}
+	if err := srv.DB.Get(&totals, `SELECT COALESCE(SUM(i.quantity),0) AS quantity, COALESCE(SUM(i.quantity*i.unit_cost),0) AS cost
+		FROM stock_issues i`+where, args...); err != nil {
+		log.Printf("[issue] totals: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, map[string]interface{}{"issues": rows, "totals": totals})
+}
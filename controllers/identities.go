@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"vlu_infrastructure_management/models"
+)
+
+const userIdentitiesTable = "user_identities"
+
+// user_identities links local users to accounts at an external identity
+// provider (university SSO, LDAP) by issuer + subject.
+const userIdentitiesSchema = `
+CREATE TABLE IF NOT EXISTS user_identities (
+	id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id       BIGINT UNSIGNED NOT NULL,
+	provider      VARCHAR(32)     NOT NULL,
+	issuer        VARCHAR(255)    NOT NULL,
+	subject       VARCHAR(255)    NOT NULL,
+	email         VARCHAR(255)    NULL,
+	created_at    DATETIME        NOT NULL,
+	last_login_at DATETIME        NULL,
+	UNIQUE KEY uq_user_identities_subject (provider, issuer, subject),
+	KEY idx_user_identities_user (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// externalIdentity is what an external provider tells us about a user.
+type externalIdentity struct {
+	Provider      string // "oidc" | "ldap"
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string // preferred username, may be empty
+	FullName      string
+	Role          string // when set, the local role follows it on every login
+}
+
+var errAccountDisabled = errors.New("account disabled")
+
+const externalUserCols = "u.id, u.username, u.email, u.full_name, u.role, u.disabled_at, u.must_change_password, u.totp_enabled"
+
+// resolveExternalUser finds the local user for ext, linking by verified e-mail
+// or creating one with defaultRole when autoProvision is on.
+func resolveExternalUser(ext externalIdentity, defaultRole string, autoProvision bool) (models.User, error) {
+	var u models.User
+	now := time.Now().UTC()
+
+	// 1) already linked
+	err := srv.DB.Get(&u, "SELECT "+externalUserCols+" FROM "+userIdentitiesTable+" i JOIN "+usersTable+
+		" u ON u.id = i.user_id WHERE i.provider=? AND i.issuer=? AND i.subject=? LIMIT 1",
+		ext.Provider, ext.Issuer, ext.Subject)
+	switch {
+	case err == nil:
+		_, _ = srv.DB.Exec("UPDATE "+userIdentitiesTable+" SET last_login_at=?, email=? WHERE provider=? AND issuer=? AND subject=?",
+			now, nullableStr(ext.Email), ext.Provider, ext.Issuer, ext.Subject)
+		return syncExternalRole(u, ext)
+	case !errors.Is(err, sql.ErrNoRows):
+		return u, err
+	}
+
+	// 2) existing local account with the same (provider-verified) e-mail
+	if ext.Email != "" && ext.EmailVerified {
+		err = srv.DB.Get(&u, "SELECT "+externalUserCols+" FROM "+usersTable+" u WHERE u.email=? LIMIT 1", ext.Email)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return u, err
+		}
+	}
+
+	// 3) auto-provision
+	if u.ID == 0 {
+		if !autoProvision {
+			return u, &AuthFailure{Reason: "no_local_account"}
+		}
+		role := defaultRole
+		if ext.Role != "" {
+			role = ext.Role
+		}
+		if u, err = createExternalUser(ext, role); err != nil {
+			return u, err
+		}
+		logActivity(int64(u.ID), fmt.Sprintf("Account provisioned via %s (%s)", ext.Provider, u.Username))
+	}
+
+	if _, err := srv.DB.Exec("INSERT INTO "+userIdentitiesTable+
+		" (user_id, provider, issuer, subject, email, created_at, last_login_at) VALUES (?,?,?,?,?,?,?)",
+		u.ID, ext.Provider, ext.Issuer, ext.Subject, nullableStr(ext.Email), now, now); err != nil {
+		return u, err
+	}
+	return syncExternalRole(u, ext)
+}
+
+func syncExternalRole(u models.User, ext externalIdentity) (models.User, error) {
+	if u.DisabledAt != nil {
+		return u, errAccountDisabled
+	}
+	if ext.Role == "" || ext.Role == u.Role {
+		return u, nil
+	}
+	if _, err := srv.DB.Exec("UPDATE "+usersTable+" SET role=? WHERE id=?", ext.Role, u.ID); err != nil {
+		return u, err
+	}
+	logActivity(int64(u.ID), fmt.Sprintf("Role synced from %s: %s->%s", ext.Provider, u.Role, ext.Role))
+	u.Role = ext.Role
+	return u, nil
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+func createExternalUser(ext externalIdentity, role string) (models.User, error) {
+	base := ext.Username
+	if base == "" && ext.Email != "" {
+		base = strings.SplitN(ext.Email, "@", 2)[0]
+	}
+	base = usernameUnsafe.ReplaceAllString(strings.ToLower(base), "")
+	if len(base) < 3 {
+		base = "user" + base
+	}
+	username := base
+	for i := 2; ; i++ {
+		exists, err := userExistsByUsername(username)
+		if err != nil {
+			return models.User{}, err
+		}
+		if !exists {
+			break
+		}
+		username = fmt.Sprintf("%s%d", base, i)
+	}
+	name := ext.FullName
+	if name == "" {
+		name = username
+	}
+
+	// Random, never disclosed password: these accounts sign in through the
+	// provider (or set a password via the reset flow).
+	hash, err := bcrypt.GenerateFromPassword([]byte(newToken()), bcrypt.DefaultCost)
+	if err != nil {
+		return models.User{}, err
+	}
+	res, err := srv.DB.Exec("INSERT INTO "+usersTable+" (username, password_hash, full_name, email, role, create_at) VALUES (?,?,?,?,?, NOW())",
+		username, string(hash), name, ext.Email, role)
+	if err != nil {
+		return models.User{}, err
+	}
+	id, _ := res.LastInsertId()
+	return models.User{ID: uint64(id), Username: username, FullName: name, Email: ext.Email, Role: role}, nil
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/beego/beego/v2/server/web"
 	beegoctx "github.com/beego/beego/v2/server/web/context"
 	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
 )
 
 // ItemController serves equipment endpoints.
@@ -49,6 +50,124 @@ type itemRow struct {
 	DatePurchased     *time.Time `db:"date_purchased"      json:"date_purchased,omitempty"`
 	Status            string     `db:"status"              json:"status"`
 	CreateAt          time.Time  `db:"create_at"           json:"create_at"`
+	ArchivedAt        *time.Time `db:"archived_at"         json:"archived_at,omitempty"`
+	ArchivedReason    *string    `db:"archived_reason"     json:"archived_reason,omitempty"`
+	ItemType          string     `db:"item_type"           json:"item_type"`
+	ReorderPoint      int        `db:"reorder_point"       json:"reorder_point"`
+	ReorderQty        int        `db:"reorder_qty"         json:"reorder_qty"`
+	RequiresApproval  bool       `db:"requires_approval"   json:"requires_approval"`
+}
+
+// itemSelectCols matches itemRow.
+const itemSelectCols = `id, sku, name, description, image_url, category, location,
+		       quantity, available_quantity, unit_cost, supplier,
+		       date_purchased, status, create_at, archived_at, archived_reason, item_type,
+		       reorder_point, reorder_qty, requires_approval`
+
+// itemFields is the writable part of an item, shared by Add (POST) and
+// Update (PATCH). Pointers tell "not sent" apart from "set to empty".
+type itemFields struct {
+	SKU               *string  `json:"sku"`
+	Name              *string  `json:"name"`
+	Description       *string  `json:"description"`
+	Category          *string  `json:"category"`
+	Location          *string  `json:"location"`
+	Quantity          *int     `json:"quantity"`
+	AvailableQuantity *int     `json:"available_quantity"`
+	UnitCost          *float64 `json:"unit_cost"`
+	Supplier          *string  `json:"supplier"`
+	DatePurchased     *string  `json:"date_purchased"` // "YYYY-MM-DD" or ""
+	Status            *string  `json:"status"`
+	ImageURL          *string  `json:"image_url"`
+	ItemType          *string  `json:"item_type"`     // durable (default) | consumable
+	ReorderPoint      *int     `json:"reorder_point"` // low stock at or below this; 0 = no threshold
+	ReorderQty        *int     `json:"reorder_qty"`   // order in multiples of this
+	RequiresApproval  *bool    `json:"requires_approval"`
+}
+
+// Item types. Durable items are borrowed and returned; consumables
+// (filament, wire, sheet stock, bits) are issued and used up.
+const (
+	ItemDurable    = "durable"
+	ItemConsumable = "consumable"
+)
+
+// NormalizeItemType maps the accepted spellings, English or Vietnamese, to
+// an item type; ok is false for anything else.
+func NormalizeItemType(s string) (string, bool) {
+	switch strings.ToLower(strings.Join(strings.Fields(s), " ")) {
+	case "", ItemDurable, "thiết bị", "thiet bi", "lâu bền", "lau ben":
+		return ItemDurable, true
+	case ItemConsumable, "tiêu hao", "tieu hao", "vật tư tiêu hao", "vat tu tieu hao":
+		return ItemConsumable, true
+	}
+	return "", false
+}
+
+type fieldError struct {
+	Field string `json:"field"`
+	Msg   string `json:"error"`
+}
+
+// validate trims the string fields in place and checks them. With partial
+// (PATCH) only the fields present are checked.
+func (f *itemFields) validate(partial bool) []fieldError {
+	for _, p := range []*string{f.SKU, f.Name, f.Description, f.Category, f.Location, f.Supplier, f.DatePurchased, f.Status, f.ImageURL, f.ItemType} {
+		if p != nil {
+			*p = strings.TrimSpace(*p)
+		}
+	}
+	var errs []fieldError
+	if (f.Name == nil && !partial) || (f.Name != nil && *f.Name == "") {
+		errs = append(errs, fieldError{"name", "name is required"})
+	}
+	if f.Quantity != nil && *f.Quantity < 0 {
+		errs = append(errs, fieldError{"quantity", "quantity must be >= 0"})
+	}
+	if f.AvailableQuantity != nil && *f.AvailableQuantity < 0 {
+		errs = append(errs, fieldError{"available_quantity", "available_quantity must be >= 0"})
+	}
+	if f.ReorderPoint != nil && *f.ReorderPoint < 0 {
+		errs = append(errs, fieldError{"reorder_point", "reorder_point must be >= 0"})
+	}
+	if f.ReorderQty != nil && *f.ReorderQty < 0 {
+		errs = append(errs, fieldError{"reorder_qty", "reorder_qty must be >= 0"})
+	}
+	if f.UnitCost != nil && *f.UnitCost < 0 {
+		errs = append(errs, fieldError{"unit_cost", "unit_cost must be >= 0"})
+	}
+	if f.DatePurchased != nil {
+		if _, err := parseItemDate(*f.DatePurchased); err != nil {
+			errs = append(errs, fieldError{"date_purchased", "date_purchased must be YYYY-MM-DD"})
+		}
+	}
+	if f.ItemType != nil {
+		if t, ok := NormalizeItemType(*f.ItemType); ok {
+			*f.ItemType = t
+		} else {
+			errs = append(errs, fieldError{"item_type", "item_type must be durable or consumable"})
+		}
+	}
+	return errs
+}
+
+// parseItemDate turns "YYYY-MM-DD" into a UTC date; "" is NULL.
+func parseItemDate(s string) (interface{}, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return nil, err
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+func strVal(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
 }
 
 type borrowReq struct {
@@ -89,53 +208,66 @@ func (c *ItemController) Add() {
 	}
 
 	// ---- payload ----
-	type addItemReq struct {
-		SKU               string   `json:"sku"`
-		Name              string   `json:"name"`
-		Description       string   `json:"description"`
-		Category          string   `json:"category"`
-		Location          string   `json:"location"`
-		Quantity          *int     `json:"quantity"`
-		AvailableQuantity *int     `json:"available_quantity"`
-		UnitCost          *float64 `json:"unit_cost"`
-		Supplier          string   `json:"supplier"`
-		DatePurchased     string   `json:"date_purchased"` // "YYYY-MM-DD" or ""
-		Status            string   `json:"status"`
-		ImageURL          *string  `json:"image_url"` // optional
-	}
-
-	var in addItemReq
+	var in itemFields
 	if err := json.NewDecoder(c.Ctx.Request.Body).Decode(&in); err != nil {
 		errf(400, "invalid json")
 		return
 	}
 
-	// ---- sanitize / defaults ----
-	in.SKU = strings.TrimSpace(in.SKU)
-	in.Name = strings.TrimSpace(in.Name)
-	in.Description = strings.TrimSpace(in.Description)
-	in.Category = strings.TrimSpace(in.Category)
-	in.Location = strings.TrimSpace(in.Location)
-	in.Supplier = strings.TrimSpace(in.Supplier)
-	in.Status = strings.TrimSpace(in.Status)
-	if in.Status == "" {
-		in.Status = "active"
+	// ---- sanitize / validate (shared with PATCH, see itemFields) ----
+	if errs := in.validate(false); len(errs) > 0 {
+		errf(400, errs[0].Msg)
+		return
 	}
-	if in.Name == "" {
-		errf(400, "name is required")
+	newID, err := insertItem(srv.DB, in)
+	if err != nil {
+		var me *mysql.MySQLError
+		if errors.As(err, &me) && me.Number == 1062 {
+			errf(400, "duplicate key (likely sku)")
+			return
+		}
+		errf(500, "insert error: "+err.Error())
 		return
 	}
 
+	// ---- return created row ----
+	row := map[string]interface{}{}
+	const getSQL = `
+		SELECT id, sku, name, description, image_url, category, location,
+		       quantity, available_quantity, unit_cost, supplier,
+		       date_purchased, status, item_type, reorder_point, reorder_qty, requires_approval, create_at
+		FROM log_lab_equipment_master
+		WHERE id = ? LIMIT 1
+	`
+	r := srv.DB.QueryRowx(getSQL, newID)
+	if r != nil {
+		if err := r.MapScan(row); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			ok(200, map[string]interface{}{"ok": true, "id": newID})
+			return
+		}
+	}
+	if len(row) == 0 {
+		ok(200, map[string]interface{}{"ok": true, "id": newID})
+		return
+	}
+	ok(200, map[string]interface{}{"ok": true, "data": row})
+}
+
+// insertItem writes a validated new item (see itemFields.validate).
+// Status defaults to "active" and available_quantity to quantity.
+func insertItem(ex sqlx.Execer, in itemFields) (int64, error) {
+	status := strVal(in.Status)
+	if status == "" {
+		status = "active"
+	}
+
 	qty := 0
-	if in.Quantity != nil && *in.Quantity > 0 {
+	if in.Quantity != nil {
 		qty = *in.Quantity
 	}
 	avail := qty
 	if in.AvailableQuantity != nil {
 		avail = *in.AvailableQuantity
-		if avail < 0 {
-			avail = 0
-		}
 	}
 
 	var unit interface{} = nil
@@ -144,78 +276,111 @@ func (c *ItemController) Add() {
 	}
 
 	var image interface{} = nil
-	if in.ImageURL != nil {
-		if trimmed := strings.TrimSpace(*in.ImageURL); trimmed != "" {
-			image = trimmed
-		}
+	if v := strVal(in.ImageURL); v != "" {
+		image = v
 	}
 
-	var dateVal interface{} = nil // NULL if empty
-	if d := strings.TrimSpace(in.DatePurchased); d != "" {
-		t, err := time.Parse("2006-01-02", d)
-		if err != nil {
-			errf(400, "date_purchased must be YYYY-MM-DD")
-			return
-		}
-		dateVal = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	dateVal, _ := parseItemDate(strVal(in.DatePurchased)) // NULL if empty
+	itemType := firstNonEmpty(strVal(in.ItemType), ItemDurable)
+	reorderPoint, reorderQty := 0, 0
+	if in.ReorderPoint != nil {
+		reorderPoint = *in.ReorderPoint
+	}
+	if in.ReorderQty != nil {
+		reorderQty = *in.ReorderQty
 	}
+	requiresApproval := in.RequiresApproval != nil && *in.RequiresApproval
 
 	// ---- INSERT (column order must match placeholders) ----
 	const insertSQL = `
 		INSERT INTO log_lab_equipment_master
 		  (name, description, category, image_url, location,
 		   quantity, available_quantity, unit_cost, supplier,
-		   date_purchased, sku, status, create_at)
-		VALUES (?,?,?,?,?,?,?,?,?,?,?, ?, NOW())
+		   date_purchased, sku, status, item_type, reorder_point, reorder_qty, requires_approval, create_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?, ?, ?, ?, ?, ?, NOW())
 	`
 
-	res, err := srv.DB.Exec(insertSQL,
-		in.Name,        // name
-		in.Description, // description
-		in.Category,    // category
-		image,          // image_url
-		in.Location,    // location
-		qty,            // quantity
-		avail,          // available_quantity
-		unit,           // unit_cost
-		in.Supplier,    // supplier
-		dateVal,        // date_purchased
-		in.SKU,         // sku
-		in.Status,      // status
+	res, err := ex.Exec(insertSQL,
+		strVal(in.Name),        // name
+		strVal(in.Description), // description
+		strVal(in.Category),    // category
+		image,                  // image_url
+		strVal(in.Location),    // location
+		qty,                    // quantity
+		avail,                  // available_quantity
+		unit,                   // unit_cost
+		strVal(in.Supplier),    // supplier
+		dateVal,                // date_purchased
+		strVal(in.SKU),         // sku
+		status,                 // status
+		itemType,               // item_type
+		reorderPoint,           // reorder_point
+		reorderQty,             // reorder_qty
+		requiresApproval,       // requires_approval
 	)
 	if err != nil {
-		var me *mysql.MySQLError
-		if errors.As(err, &me) && me.Number == 1062 {
-			errf(400, "duplicate key (likely sku)")
-			return
-		}
-		errf(500, "insert error: "+err.Error())
-		return
+		return 0, err
 	}
+	return res.LastInsertId()
+}
 
-	newID, _ := res.LastInsertId()
+// Borrow record statuses. Pending and rejected records never held stock;
+// the overdue job moves open loans past their due date to overdue.
+const (
+	BorrowPending  = "pending"
+	BorrowBorrowed = "borrowed"
+	BorrowOverdue  = "overdue"
+	BorrowRejected = "rejected"
+	BorrowReturned = "returned"
+)
 
-	// ---- return created row ----
-	row := map[string]interface{}{}
-	const getSQL = `
-		SELECT id, sku, name, description, image_url, category, location,
-		       quantity, available_quantity, unit_cost, supplier,
-		       date_purchased, status, create_at
-		FROM log_lab_equipment_master
-		WHERE id = ? LIMIT 1
-	`
-	r := srv.DB.QueryRowx(getSQL, newID)
-	if r != nil {
-		if err := r.MapScan(row); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			ok(200, map[string]interface{}{"ok": true, "id": newID})
-			return
-		}
+// insertBorrow writes a borrow record dated now.
+func insertBorrow(tx *sqlx.Tx, itemID, userID int64, qty int, returnDate interface{}, status string) (int64, error) {
+	// Insert borrow row (matches your columns)
+	res, err := tx.Exec(`
+		INSERT INTO log_lab_borrow_records
+		  (user_id, item_id, quantity, borrow_date, return_date, actual_return_date, condition_on_return, status)
+		VALUES
+		  (      ?,       ?,        ?,        NOW(),         ?,               NULL,                NULL,      ?)
+	`, userID, itemID, qty, returnDate, status)
+	if err != nil {
+		return 0, fmt.Errorf("insert borrow: %w", err)
 	}
-	if len(row) == 0 {
-		ok(200, map[string]interface{}{"ok": true, "id": newID})
-		return
+	return res.LastInsertId()
+}
+
+// checkout lends qty of itemID to userID: it records the borrow, hands out
+// tracked units and takes the stock off the shelf. The item row must be
+// locked with avail on the shelf. msg is a client error.
+func checkout(tx *sqlx.Tx, itemID, userID int64, qty, avail int, returnDate interface{}, unitIDs []int64, units []string) (int64, []int64, string, error) {
+	borrowID, err := insertBorrow(tx, itemID, userID, qty, returnDate, BorrowBorrowed)
+	if err != nil {
+		return 0, nil, "", err
 	}
-	ok(200, map[string]interface{}{"ok": true, "data": row})
+	picked, msg, err := lend(tx, itemID, borrowID, userID, qty, avail, unitIDs, units)
+	if err != nil || msg != "" {
+		return 0, nil, msg, err
+	}
+	return borrowID, picked, "", nil
+}
+
+// lend hands out the tracked units of borrowID and takes qty off the shelf.
+func lend(tx *sqlx.Tx, itemID, borrowID, userID int64, qty, avail int, unitIDs []int64, units []string) ([]int64, string, error) {
+	// Tracked units (see units.go)
+	picked, msg, err := takeUnits(tx, itemID, borrowID, userID, qty, avail, unitIDs, units)
+	if err != nil {
+		return nil, "", fmt.Errorf("assign units: %w", err)
+	}
+	if msg != "" {
+		return nil, msg, nil
+	}
+
+	// Update stock
+	if _, err = tx.Exec(`UPDATE log_lab_equipment_master SET available_quantity = available_quantity - ? WHERE id=?`,
+		qty, itemID); err != nil {
+		return nil, "", fmt.Errorf("update stock: %w", err)
+	}
+	return picked, "", nil
 }
 
 // Optional stub to avoid missing-method panics if routed:
@@ -241,18 +406,11 @@ func (c *ItemController) GetAll() {
 		}
 	}
 
-	args := []interface{}{}
+	where, args := itemListFilter(q, c.GetString("archived"))
 	sqlStr := `
-		SELECT id, sku, name, description, category, image_url, location,
-		       quantity, available_quantity, unit_cost, supplier,
-		       date_purchased, status, create_at
+		SELECT ` + itemSelectCols + `
 		FROM log_lab_equipment_master
-		WHERE 1=1`
-	if q != "" {
-		sqlStr += ` AND (name LIKE ? OR sku LIKE ? OR category LIKE ? OR location LIKE ?)`
-		p := "%" + q + "%"
-		args = append(args, p, p, p, p)
-	}
+		WHERE 1=1` + where
 	sqlStr += ` ORDER BY id DESC LIMIT ? OFFSET ?`
 	args = append(args, limit, offset)
 
@@ -266,6 +424,26 @@ func (c *ItemController) GetAll() {
 	_ = c.Ctx.Output.JSON(rows, false, false)
 }
 
+// itemListFilter is the WHERE tail shared by GetAll and Export. Archived
+// items are hidden unless asked for: archived=1 (only) or archived=all.
+func itemListFilter(q, archived string) (string, []interface{}) {
+	where := ""
+	args := []interface{}{}
+	switch archived {
+	case "all":
+	case "1", "true":
+		where += ` AND archived_at IS NOT NULL`
+	default:
+		where += ` AND archived_at IS NULL`
+	}
+	if q != "" {
+		where += ` AND (name LIKE ? OR sku LIKE ? OR category LIKE ? OR location LIKE ?)`
+		p := "%" + q + "%"
+		args = append(args, p, p, p, p)
+	}
+	return where, args
+}
+
 // uses return_date (or due_date) and updates stock.
 func (c *ItemController) Borrow() {
 	// local JSON helpers
@@ -280,12 +458,15 @@ func (c *ItemController) Borrow() {
 
 	// payload
 	type borrowReq struct {
-		UserID   *int64 `json:"user_id"`     // optional; fallback to context
+		UserID   *int64 `json:"user_id"`     // optional; staff only, see actingUserID
 		ItemID   *int64 `json:"item_id"`     // optional if sku provided
 		SKU      string `json:"sku"`         // optional if item_id provided
 		Quantity int    `json:"quantity"`    // required (>0)
 		Return   string `json:"return_date"` // "YYYY-MM-DD" (optional)
 		Due      string `json:"due_date"`    // alias to return_date
+		// optional: specific tracked units, by id or by serial number / asset tag
+		UnitIDs []int64  `json:"unit_ids"`
+		Units   []string `json:"units"`
 	}
 
 	var in borrowReq
@@ -293,35 +474,17 @@ func (c *ItemController) Borrow() {
 		errf(400, "invalid json")
 		return
 	}
+	if in.Quantity == 0 {
+		in.Quantity = len(in.UnitIDs) + len(in.Units)
+	}
 	if in.Quantity <= 0 {
 		errf(400, "quantity must be > 0")
 		return
 	}
 
-	// Resolve user_id: prefer body, else context
-	resolveUserID := func() (int64, bool) {
-		if in.UserID != nil && *in.UserID > 0 {
-			return *in.UserID, true
-		}
-		if v := c.Ctx.Input.GetData("user_id"); v != nil {
-			switch t := v.(type) {
-			case int64:
-				return t, true
-			case int:
-				return int64(t), true
-			case float64:
-				return int64(t), true
-			case string:
-				if id, e := strconv.ParseInt(t, 10, 64); e == nil {
-					return id, true
-				}
-			}
-		}
-		return 0, false
-	}
-	userID, okUID := resolveUserID()
-	if !okUID || userID <= 0 {
-		errf(401, "user id missing")
+	// the session user, or someone else's for staff who may approve borrows
+	userID, okUID := actingUserID(c.Ctx, in.UserID)
+	if !okUID {
 		return
 	}
 
@@ -369,8 +532,15 @@ func (c *ItemController) Borrow() {
 	defer func() { _ = tx.Rollback() }()
 
 	// Lock & check stock
-	var avail int
-	if err = tx.Get(&avail, `SELECT available_quantity FROM log_lab_equipment_master WHERE id=? FOR UPDATE`, itemID); err != nil {
+	var stock struct {
+		Avail            int        `db:"available_quantity"`
+		Archived         *time.Time `db:"archived_at"`
+		ItemType         string     `db:"item_type"`
+		Category         string     `db:"category"`
+		RequiresApproval bool       `db:"requires_approval"`
+	}
+	if err = tx.Get(&stock, `SELECT available_quantity, archived_at, item_type, category, requires_approval
+		FROM log_lab_equipment_master WHERE id=? FOR UPDATE`, itemID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			errf(404, "item not found")
 			return
@@ -378,33 +548,68 @@ func (c *ItemController) Borrow() {
 		errf(500, "query item: "+err.Error())
 		return
 	}
-	if avail < in.Quantity {
+	if stock.Archived != nil {
+		errf(409, "item is archived")
+		return
+	}
+	if stock.ItemType == ItemConsumable {
+		errf(409, "consumable items are issued, not borrowed; use POST /api/items/issue")
+		return
+	}
+	if stock.Avail < in.Quantity {
 		errf(400, "not enough stock")
 		return
 	}
 
-	// Insert borrow row (matches your columns)
-	res, err := tx.Exec(`
-		INSERT INTO log_lab_borrow_records
-		  (user_id, item_id, quantity, borrow_date, return_date, actual_return_date, condition_on_return, status)
-		VALUES
-		  (      ?,       ?,        ?,        NOW(),         ?,               NULL,                NULL, 'borrowed')
-	`, userID, itemID, in.Quantity, returnDate)
+	// Stock reserved over the loan period is not lent out (see reservations.go)
+	if msg, err := walkUpMsg(tx, itemID, stock.Avail, in.Quantity, returnDate); err != nil {
+		errf(500, "check reservations: "+err.Error())
+		return
+	} else if msg != "" {
+		errf(409, msg)
+		return
+	}
+
+	// Restricted items wait for a lab manager (see borrow_approvals.go);
+	// units are picked and stock taken when the request is approved.
+	needsApproval, err := borrowNeedsApproval(tx, stock.RequiresApproval, stock.Category)
+	if err != nil {
+		errf(500, "check approval: "+err.Error())
+		return
+	}
+	if needsApproval && !RoleAllows(currentRole(c.Ctx), PermBorrowApprove) {
+		borrowID, err := insertBorrow(tx, itemID, userID, in.Quantity, returnDate, BorrowPending)
+		if err != nil {
+			errf(500, err.Error())
+			return
+		}
+		logActivityTX(tx.Tx, int(currentUserID(c.Ctx)), fmt.Sprintf("Requested approval to borrow item #%d x%d (borrow #%d)", itemID, in.Quantity, borrowID))
+		if err = tx.Commit(); err != nil {
+			errf(500, "commit: "+err.Error())
+			return
+		}
+		ok(202, map[string]any{
+			"ok":       true,
+			"id":       borrowID,
+			"item_id":  itemID,
+			"quantity": in.Quantity,
+			"status":   BorrowPending,
+		})
+		return
+	}
+
+	borrowID, unitIDs, msg, err := checkout(tx, itemID, userID, in.Quantity, stock.Avail, returnDate, in.UnitIDs, in.Units)
 	if err != nil {
 		var me *mysql.MySQLError
 		if errors.As(err, &me) && me.Number == 1452 {
 			errf(400, "invalid user_id or item_id")
 			return
 		}
-		errf(500, "insert borrow: "+err.Error())
+		errf(500, err.Error())
 		return
 	}
-	borrowID, _ := res.LastInsertId()
-
-	// Update stock
-	if _, err = tx.Exec(`UPDATE log_lab_equipment_master SET available_quantity = available_quantity - ? WHERE id=?`,
-		in.Quantity, itemID); err != nil {
-		errf(500, "update stock: "+err.Error())
+	if msg != "" {
+		errf(409, msg)
 		return
 	}
 
@@ -418,6 +623,7 @@ func (c *ItemController) Borrow() {
 		"id":       borrowID, // matches your UI message
 		"item_id":  itemID,
 		"quantity": in.Quantity,
+		"unit_ids": unitIDs,
 	})
 }
 
@@ -438,13 +644,15 @@ func (c *ItemController) Return() {
 
 	// ---- payload ----
 	type returnReq struct {
-		UserID            *int64 `json:"user_id,omitempty"`   // optional; fallback to context
+		UserID            *int64 `json:"user_id,omitempty"`   // optional; staff only, see actingUserID
 		BorrowID          *int   `json:"borrow_id,omitempty"` // preferred
 		SKU               string `json:"sku,omitempty"`       // or identify by sku...
 		ItemID            *int   `json:"item_id,omitempty"`   // ...or item id
-		Quantity          *int   `json:"quantity,omitempty"`  // full only (for now)
+		Quantity          *int   `json:"quantity,omitempty"`  // default: everything still out
 		ConditionOnReturn string `json:"condition_on_return,omitempty"`
 		ReturnedAt        string `json:"returned_at,omitempty"` // YYYY-MM-DD (optional)
+		// per-unit condition for tracked units; damaged/broken go to maintenance
+		Units []unitReturn `json:"units,omitempty"`
 	}
 	var in returnReq
 	if err := json.NewDecoder(c.Ctx.Request.Body).Decode(&in); err != nil {
@@ -453,30 +661,9 @@ func (c *ItemController) Return() {
 	}
 	in.SKU = strings.TrimSpace(in.SKU)
 
-	// ---- resolve user_id (body > context) ----
-	resolveUID := func() (int64, bool) {
-		if in.UserID != nil && *in.UserID > 0 {
-			return *in.UserID, true
-		}
-		if v := c.Ctx.Input.GetData("user_id"); v != nil {
-			switch t := v.(type) {
-			case int64:
-				return t, true
-			case int:
-				return int64(t), true
-			case float64:
-				return int64(t), true
-			case string:
-				if id, e := strconv.ParseInt(t, 10, 64); e == nil {
-					return id, true
-				}
-			}
-		}
-		return 0, false
-	}
-	uid64, ok := resolveUID()
-	if !ok || uid64 <= 0 {
-		unauthorized(c)
+	// ---- user: the session's, or the body's for borrow.approve ----
+	uid64, ok := actingUserID(c.Ctx, in.UserID)
+	if !ok {
 		return
 	}
 	uid := int(uid64)
@@ -490,27 +677,29 @@ func (c *ItemController) Return() {
 
 	// ---- locate open borrow record ----
 	type rec struct {
-		ID     int
-		ItemID int
-		Qty    int
-		Name   string
-		SKU    string
+		ID          int
+		ItemID      int
+		Qty         int
+		QtyReturned int
+		Name        string
+		SKU         string
+		ItemType    string
 	}
 	var r rec
 
 	if in.BorrowID != nil {
 		row := tx.QueryRowx(`
-			SELECT br.id, br.item_id, br.quantity, em.name, em.sku
+			SELECT br.id, br.item_id, br.quantity, br.quantity_returned, em.name, em.sku, em.item_type
 			FROM log_lab_borrow_records br
 			JOIN log_lab_equipment_master em ON em.id = br.item_id
-			WHERE br.id=? AND br.user_id=? AND br.actual_return_date IS NULL AND br.status <> 'returned'
+			WHERE br.id=? AND br.user_id=? AND br.actual_return_date IS NULL AND br.status NOT IN ('pending', 'rejected', 'returned')
 			LIMIT 1`, *in.BorrowID, uid)
-		if err := row.Scan(&r.ID, &r.ItemID, &r.Qty, &r.Name, &r.SKU); err != nil {
+		if err := row.Scan(&r.ID, &r.ItemID, &r.Qty, &r.QtyReturned, &r.Name, &r.SKU, &r.ItemType); err != nil {
 			bad("open borrow not found for this id")
 			return
 		}
 	} else {
-		cond := `br.user_id=? AND br.actual_return_date IS NULL AND br.status <> 'returned'`
+		cond := `br.user_id=? AND br.actual_return_date IS NULL AND br.status NOT IN ('pending', 'rejected', 'returned')`
 		args := []interface{}{uid}
 		if in.ItemID != nil {
 			cond += ` AND br.item_id=?`
@@ -524,7 +713,7 @@ func (c *ItemController) Return() {
 		}
 
 		rows, err := tx.Queryx(`
-			SELECT br.id, br.item_id, br.quantity, em.name, em.sku
+			SELECT br.id, br.item_id, br.quantity, br.quantity_returned, em.name, em.sku, em.item_type
 			FROM log_lab_borrow_records br
 			JOIN log_lab_equipment_master em ON em.id = br.item_id
 			WHERE `+cond, args...)
@@ -535,7 +724,7 @@ func (c *ItemController) Return() {
 		defer rows.Close()
 		found := 0
 		for rows.Next() {
-			if err := rows.Scan(&r.ID, &r.ItemID, &r.Qty, &r.Name, &r.SKU); err != nil {
+			if err := rows.Scan(&r.ID, &r.ItemID, &r.Qty, &r.QtyReturned, &r.Name, &r.SKU, &r.ItemType); err != nil {
 				serr("scan error")
 				return
 			}
@@ -551,13 +740,25 @@ func (c *ItemController) Return() {
 		}
 	}
 
-	// ---- quantity: full only (for now) ----
-	qty := r.Qty
-	if in.Quantity != nil && *in.Quantity != r.Qty {
-		bad("partial returns not supported yet (send full quantity)")
+	// consumables are used up; stock only comes back through a new delivery
+	if r.ItemType == ItemConsumable {
+		c.Ctx.Output.SetStatus(http.StatusConflict)
+		_ = c.Ctx.Output.JSON(map[string]string{"error": "consumable items cannot be returned"}, false, false)
 		return
 	}
 
+	// ---- quantity: all or part of what is still out ----
+	outstanding := r.Qty - r.QtyReturned
+	qty := outstanding
+	if in.Quantity != nil {
+		if *in.Quantity <= 0 || *in.Quantity > outstanding {
+			bad(fmt.Sprintf("quantity must be between 1 and %d (still out on this borrow)", outstanding))
+			return
+		}
+		qty = *in.Quantity
+	}
+	closing := qty == outstanding
+
 	// ---- returned_at ----
 	var retAt *time.Time
 	if s := strings.TrimSpace(in.ReturnedAt); s != "" {
@@ -571,33 +772,73 @@ func (c *ItemController) Return() {
 	}
 
 	// ---- update borrow (use your table: log_lab_borrow) ----
-	if _, err := tx.Exec(`
-		UPDATE log_lab_borrow_records
-		SET actual_return_date = IFNULL(?, NOW()),
-		    condition_on_return = NULLIF(?, ''),
-		    status = 'returned'
-		WHERE id=? AND actual_return_date IS NULL
-	`, retAt, in.ConditionOnReturn, r.ID); err != nil {
+	// it closes only when everything is back
+	if closing {
+		_, err = tx.Exec(`
+			UPDATE log_lab_borrow_records
+			SET quantity_returned = quantity,
+			    actual_return_date = IFNULL(?, NOW()),
+			    condition_on_return = NULLIF(?, ''),
+			    status = 'returned'
+			WHERE id=? AND actual_return_date IS NULL
+		`, retAt, in.ConditionOnReturn, r.ID)
+	} else {
+		_, err = tx.Exec(`UPDATE log_lab_borrow_records SET quantity_returned = quantity_returned + ? WHERE id=?`, qty, r.ID)
+	}
+	if err != nil {
 		serr("update borrow error")
 		return
 	}
 
-	// ---- restore stock ----
+	// ---- tracked units ----
+	at := time.Now().UTC()
+	if retAt != nil {
+		at = *retAt
+	}
+	held, msg, err := releaseUnits(tx, int64(r.ID), in.Units, qty, outstanding, at)
+	if err != nil {
+		serr("release units error")
+		return
+	}
+	if msg != "" {
+		bad(msg)
+		return
+	}
+
+	// ---- restore stock (units held for maintenance stay unavailable) ----
 	if _, err := tx.Exec(`UPDATE log_lab_equipment_master SET available_quantity = available_quantity + ? WHERE id=?`,
-		qty, r.ItemID); err != nil {
+		qty-held, r.ItemID); err != nil {
 		serr("restore stock error")
 		return
 	}
 
+	// ---- return line (see borrow_returns.go) ----
+	if _, err := tx.Exec(`INSERT INTO borrow_returns (borrow_id, quantity, held, condition_on_return, returned_at, recorded_by, created_at)
+		VALUES (?,?,?,?,?,?,?)`, r.ID, qty, held, nullableStr(strings.TrimSpace(in.ConditionOnReturn)), at, currentUserID(c.Ctx), time.Now().UTC()); err != nil {
+		serr("record return error")
+		return
+	}
+
 	// activity log
-	logActivityTX(tx.Tx, uid, fmt.Sprintf("Returned %s (%s) x%d", r.Name, r.SKU, qty))
+	remaining := outstanding - qty
+	if closing {
+		logActivityTX(tx.Tx, uid, fmt.Sprintf("Returned %s (%s) x%d", r.Name, r.SKU, qty))
+	} else {
+		logActivityTX(tx.Tx, uid, fmt.Sprintf("Returned %s (%s) x%d, %d still out", r.Name, r.SKU, qty, remaining))
+	}
 
 	if err := tx.Commit(); err != nil {
 		serr("commit error")
 		return
 	}
 
-	_ = c.Ctx.Output.JSON(map[string]string{"status": "ok"}, false, false)
+	_ = c.Ctx.Output.JSON(map[string]interface{}{
+		"status":      "ok",
+		"borrow_id":   r.ID,
+		"returned":    qty,
+		"outstanding": remaining,
+		"closed":      closing,
+	}, false, false)
 }
 
 func (c *ItemController) UpdateImageURL() {
@@ -679,9 +920,7 @@ func (c *ItemController) GetOne() {
 
 	var row itemRow
 	err = srv.DB.Get(&row, `
-		SELECT id, sku, name, description, image_url, category, location,
-		       quantity, available_quantity, unit_cost, supplier,
-		       date_purchased, status, create_at
+		SELECT `+itemSelectCols+`
 		FROM log_lab_equipment_master
 		WHERE id=? LIMIT 1`, id)
 	if err != nil {
@@ -716,6 +955,14 @@ func logActivityTX(tx *sql.Tx, userID int, action string) {
 		userID, action)
 }
 
+// logActivity is logActivityTX outside a transaction; failures are only logged.
+func logActivity(userID int64, action string) {
+	if _, err := srv.DB.Exec(`INSERT INTO log_lab_activity_logs (user_id, action, timestamp) VALUES (?,?, NOW())`,
+		userID, action); err != nil {
+		log.Printf("[activity] write error: %v", err)
+	}
+}
+
 // GET /api/items/open-borrows?item_id=6 OR ?sku=23000120
 func (c *ItemController) GetOpenBorrows() {
 	if !isAuthed(c.Ctx) {
@@ -757,6 +1004,8 @@ func (c *ItemController) GetOpenBorrows() {
 		ItemID     int64      `db:"item_id"    json:"item_id"`
 		UserID     int64      `db:"user_id"    json:"user_id"`
 		Quantity   int        `db:"quantity"   json:"quantity"`
+		Returned   int        `db:"quantity_returned" json:"quantity_returned"`
+		Renewals   int        `db:"renewals"   json:"renewals"`
 		BorrowDate time.Time  `db:"borrow_date" json:"borrow_date"`
 		ReturnDate *time.Time `db:"return_date" json:"return_date,omitempty"`
 		Status     string     `db:"status"     json:"status"`
@@ -771,6 +1020,8 @@ func (c *ItemController) GetOpenBorrows() {
 			br.item_id,
 			br.user_id,
 			IFNULL(br.quantity, 1) AS quantity,
+			br.quantity_returned,
+			br.renewals,
 			br.borrow_date,
 			br.return_date,
 			IFNULL(br.status, '') AS status,
@@ -780,7 +1031,7 @@ func (c *ItemController) GetOpenBorrows() {
 		JOIN log_lab_equipment_master em ON em.id = br.item_id
 		WHERE br.item_id = ?
 		  AND br.actual_return_date IS NULL
-		  AND (br.status IS NULL OR LOWER(br.status) <> 'returned')
+		  AND (br.status IS NULL OR LOWER(br.status) NOT IN ('pending', 'rejected', 'returned'))
 		ORDER BY br.borrow_date DESC
 	`, itemID)
 
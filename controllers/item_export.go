@@ -0,0 +1,331 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Inventory export for finance and the faculty office. Rows are written to
+// the response as they are read from the database; every format ends with
+// totals of quantity and quantity * unit_cost.
+
+type exportColumn struct {
+	key string // English header and JSON key; matches the import field names
+	vi  string // header with lang=vi; read back by the import aliases
+}
+
+var itemExportColumns = []exportColumn{
+	{"id", "ID"},
+	{"sku", "Mã thiết bị"},
+	{"name", "Tên thiết bị"},
+	{"description", "Mô tả"},
+	{"category", "Danh mục"},
+	{"location", "Vị trí"},
+	{"quantity", "Số lượng"},
+	{"available_quantity", "Số lượng sẵn có"},
+	{"unit_cost", "Đơn giá"},
+	{"total_value", "Thành tiền"},
+	{"supplier", "Nhà cung cấp"},
+	{"date_purchased", "Ngày mua"},
+	{"status", "Trạng thái"},
+	{"archived_at", "Ngày lưu trữ"},
+	{"item_type", "Loại vật tư"},
+	{"reorder_point", "Tồn tối thiểu"},
+	{"reorder_qty", "Số lượng đặt lại"},
+	{"requires_approval", "Cần duyệt"},
+}
+
+type itemExportTotals struct {
+	Items     int     `json:"items"`
+	Quantity  int     `json:"quantity"`
+	Available int     `json:"available_quantity"`
+	Value     float64 `json:"total_value"`
+}
+
+func (t *itemExportTotals) add(r itemRow) {
+	t.Items++
+	t.Quantity += r.Quantity
+	t.Available += r.AvailableQuantity
+	t.Value += itemValue(r)
+}
+
+// row is the totals line: label in the first column and each total under
+// the column with its JSON key; the other cells are nil.
+func (t itemExportTotals) row(label string) []interface{} {
+	vals := make([]interface{}, len(itemExportColumns))
+	vals[0] = label
+	for i, c := range itemExportColumns {
+		switch c.key {
+		case "quantity":
+			vals[i] = t.Quantity
+		case "available_quantity":
+			vals[i] = t.Available
+		case "total_value":
+			vals[i] = t.Value
+		}
+	}
+	return vals
+}
+
+func itemValue(r itemRow) float64 { return float64(r.Quantity) * r.UnitCost }
+
+// itemExportValues follows itemExportColumns; requires_approval is yes/no,
+// or có/không with vi, as the import reads them back.
+func itemExportValues(r itemRow, vi bool) []interface{} {
+	date, archived, approval := "", "", "no"
+	if r.DatePurchased != nil {
+		date = r.DatePurchased.Format("2006-01-02")
+	}
+	if r.ArchivedAt != nil {
+		archived = r.ArchivedAt.Format("2006-01-02")
+	}
+	switch {
+	case vi && r.RequiresApproval:
+		approval = "có"
+	case vi:
+		approval = "không"
+	case r.RequiresApproval:
+		approval = "yes"
+	}
+	return []interface{}{r.ID, r.SKU, r.Name, r.Description, r.Category, r.Location,
+		r.Quantity, r.AvailableQuantity, r.UnitCost, itemValue(r), r.Supplier, date, r.Status, archived, r.ItemType,
+		r.ReorderPoint, r.ReorderQty, approval}
+}
+
+// itemExportWriter is one output format. flush pushes buffered rows to the
+// client; it is a no-op where the format cannot be sent in pieces (xlsx).
+type itemExportWriter interface {
+	item(r itemRow) error
+	flush()
+	finish(t itemExportTotals) error
+}
+
+type csvItemExport struct {
+	w      *csv.Writer
+	vi     bool
+	label  string
+	totals bool
+}
+
+func newCSVItemExport(w io.Writer, headers []string, vi bool, label string, totals bool) (*csvItemExport, error) {
+	// BOM so Excel opens the file as UTF-8 (Vietnamese names)
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return nil, err
+	}
+	e := &csvItemExport{w: csv.NewWriter(w), vi: vi, label: label, totals: totals}
+	return e, e.w.Write(headers)
+}
+
+func (e *csvItemExport) item(r itemRow) error { return e.w.Write(csvRecord(itemExportValues(r, e.vi))) }
+
+func csvRecord(vals []interface{}) []string {
+	rec := make([]string, len(vals))
+	for i, v := range vals {
+		switch v := v.(type) {
+		case nil:
+		case float64:
+			rec[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			rec[i] = fmt.Sprint(v)
+		}
+	}
+	return rec
+}
+
+func (e *csvItemExport) flush() { e.w.Flush() }
+
+func (e *csvItemExport) finish(t itemExportTotals) error {
+	if e.totals {
+		if err := e.w.Write(csvRecord(t.row(e.label))); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// xlsxItemExport uses excelize's stream writer, which spills rows to a
+// temporary file instead of holding the whole sheet in memory. The caller
+// owns f and closes it, which removes that file.
+type xlsxItemExport struct {
+	out    io.Writer
+	f      *excelize.File
+	sw     *excelize.StreamWriter
+	row    int
+	bold   int
+	vi     bool
+	label  string
+	totals bool
+}
+
+func newXLSXItemExport(w io.Writer, f *excelize.File, headers []string, vi bool, label string, totals bool) (*xlsxItemExport, error) {
+	sheet := f.GetSheetName(0)
+	sw, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return nil, err
+	}
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return nil, err
+	}
+	_ = sw.SetColWidth(2, 3, 24)
+	e := &xlsxItemExport{out: w, f: f, sw: sw, bold: bold, vi: vi, label: label, totals: totals}
+	cells := make([]interface{}, len(headers))
+	for i, h := range headers {
+		cells[i] = excelize.Cell{StyleID: bold, Value: h}
+	}
+	return e, e.next(cells)
+}
+
+func (e *xlsxItemExport) next(vals []interface{}) error {
+	e.row++
+	cell, _ := excelize.CoordinatesToCellName(1, e.row)
+	return e.sw.SetRow(cell, vals)
+}
+
+func (e *xlsxItemExport) item(r itemRow) error { return e.next(itemExportValues(r, e.vi)) }
+
+func (e *xlsxItemExport) flush() {}
+
+func (e *xlsxItemExport) finish(t itemExportTotals) error {
+	if e.totals {
+		vals := t.row(e.label)
+		for i, v := range vals {
+			if v != nil {
+				vals[i] = excelize.Cell{StyleID: e.bold, Value: v}
+			}
+		}
+		if err := e.next(vals); err != nil {
+			return err
+		}
+	}
+	if err := e.sw.Flush(); err != nil {
+		return err
+	}
+	_, err := e.f.WriteTo(e.out)
+	return err
+}
+
+// jsonlItemExport writes one JSON object per item and a final {"totals": ...}
+// line. Keys and values are the same whatever lang asks for.
+type jsonlItemExport struct {
+	enc    *json.Encoder
+	totals bool
+}
+
+func (e *jsonlItemExport) item(r itemRow) error {
+	vals := itemExportValues(r, false)
+	obj := make(map[string]interface{}, len(vals))
+	for i, c := range itemExportColumns {
+		obj[c.key] = vals[i]
+	}
+	obj["requires_approval"] = r.RequiresApproval
+	return e.enc.Encode(obj)
+}
+
+func (e *jsonlItemExport) flush() {}
+
+func (e *jsonlItemExport) finish(t itemExportTotals) error {
+	if !e.totals {
+		return nil
+	}
+	return e.enc.Encode(map[string]interface{}{"totals": t})
+}
+
+// GET /api/items/export?format=csv|xlsx|jsonl&q=&archived=&lang=vi&totals=0
+// q and archived filter like GET /api/items; lang=vi localises the
+// spreadsheet headers (JSON keys stay English). totals=0 leaves out the
+// totals row, e.g. for a file meant to go back through /api/items/import.
+func (c *ItemController) Export() {
+	format := strings.ToLower(firstNonEmpty(strings.TrimSpace(c.GetString("format")), "csv"))
+	vi := strings.ToLower(c.GetString("lang")) == "vi"
+	totals := c.GetString("totals") != "0" && c.GetString("totals") != "false"
+	headers := make([]string, len(itemExportColumns))
+	for i, col := range itemExportColumns {
+		headers[i] = col.key
+		if vi {
+			headers[i] = col.vi
+		}
+	}
+	label := "TOTAL"
+	if vi {
+		label = "TỔNG CỘNG"
+	}
+
+	var contentType string
+	switch format {
+	case "csv":
+		contentType = "text/csv; charset=utf-8"
+	case "xlsx":
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case "jsonl":
+		contentType = "application/x-ndjson"
+	default:
+		jsonErr(c.Ctx, http.StatusBadRequest, "format must be csv, xlsx or jsonl")
+		return
+	}
+
+	where, args := itemListFilter(strings.TrimSpace(c.GetString("q")), c.GetString("archived"))
+	rows, err := srv.DB.Queryx(`SELECT `+itemSelectCols+` FROM log_lab_equipment_master WHERE 1=1`+where+` ORDER BY id`, args...)
+	if err != nil {
+		log.Printf("[items] export query: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	defer rows.Close()
+
+	w := c.Ctx.ResponseWriter
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="items-%s.%s"`, time.Now().Format("20060102"), format))
+	w.WriteHeader(http.StatusOK)
+
+	var out itemExportWriter
+	switch format {
+	case "csv":
+		out, err = newCSVItemExport(w, headers, vi, label, totals)
+	case "xlsx":
+		f := excelize.NewFile()
+		defer f.Close()
+		out, err = newXLSXItemExport(w, f, headers, vi, label, totals)
+	case "jsonl":
+		out = &jsonlItemExport{enc: json.NewEncoder(w), totals: totals}
+	}
+	// from here on the status is sent: failures can only cut the file short
+	if err != nil {
+		log.Printf("[items] export %s: %v", format, err)
+		return
+	}
+	var t itemExportTotals
+	for rows.Next() {
+		var r itemRow
+		if err := rows.StructScan(&r); err != nil {
+			log.Printf("[items] export scan: %v", err)
+			return
+		}
+		if err := out.item(r); err != nil {
+			log.Printf("[items] export write: %v", err)
+			return
+		}
+		t.add(r)
+		if t.Items%500 == 0 {
+			out.flush()
+			w.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[items] export rows: %v", err)
+		return
+	}
+	if err := out.finish(t); err != nil {
+		log.Printf("[items] export finish: %v", err)
+	}
+}
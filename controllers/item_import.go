@@ -0,0 +1,605 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/xuri/excelize/v2"
+)
+
+// Bulk import of equipment from CSV or XLSX. Rows are matched to existing
+// items by SKU: unknown SKUs are inserted, known ones updated with the
+// non-empty cells of the row (an empty cell never clears a field). A dry run
+// reports what a commit would do; a commit applies every row in one
+// transaction or nothing at all.
+
+const itemImportMaxBytes = 10 << 20
+
+// importFieldAliases maps normalised header names (see normalizeHeader) to
+// itemFields. available_quantity is not importable: it follows quantity.
+var importFieldAliases = map[string]string{
+	"sku": "sku", "ma": "sku", "mã": "sku", "ma_thiet_bi": "sku", "mã_thiết_bị": "sku", "code": "sku", "item_code": "sku",
+	"name": "name", "ten": "name", "tên": "name", "ten_thiet_bi": "name", "tên_thiết_bị": "name", "item_name": "name",
+	"description": "description", "mo_ta": "description", "mô_tả": "description",
+	"category": "category", "loai": "category", "loại": "category", "danh_muc": "category", "danh_mục": "category",
+	"location": "location", "vi_tri": "location", "vị_trí": "location",
+	"quantity": "quantity", "qty": "quantity", "so_luong": "quantity", "số_lượng": "quantity",
+	"unit_cost": "unit_cost", "cost": "unit_cost", "price": "unit_cost", "don_gia": "unit_cost", "đơn_giá": "unit_cost",
+	"supplier": "supplier", "vendor": "supplier", "nha_cung_cap": "supplier", "nhà_cung_cấp": "supplier",
+	"date_purchased": "date_purchased", "purchase_date": "date_purchased", "ngay_mua": "date_purchased", "ngày_mua": "date_purchased",
+	"status": "status", "trang_thai": "status", "trạng_thái": "status",
+	"image_url": "image_url", "image": "image_url", "hinh_anh": "image_url", "hình_ảnh": "image_url",
+	"item_type": "item_type", "type": "item_type", "loai_vat_tu": "item_type", "loại_vật_tư": "item_type",
+	"reorder_point": "reorder_point", "min_stock": "reorder_point", "ton_toi_thieu": "reorder_point", "tồn_tối_thiểu": "reorder_point",
+	"reorder_qty": "reorder_qty", "reorder_quantity": "reorder_qty", "so_luong_dat_lai": "reorder_qty", "số_lượng_đặt_lại": "reorder_qty",
+	"requires_approval": "requires_approval", "approval": "requires_approval", "can_duyet": "requires_approval", "cần_duyệt": "requires_approval",
+}
+
+func normalizeHeader(h string) string {
+	h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+	return strings.Join(strings.FieldsFunc(h, func(r rune) bool { return r == ' ' || r == '-' || r == '_' || r == '.' }), "_")
+}
+
+// ItemImport is a parsed import file.
+type ItemImport struct {
+	Columns map[string]string `json:"columns"`                   // header -> field
+	Ignored []string          `json:"ignored_columns,omitempty"` // headers mapped to nothing
+	Rows    []ItemImportRow   `json:"rows"`
+}
+
+// ItemImportRow is one data row. Line is the row number in the file
+// (the header is line 1).
+type ItemImportRow struct {
+	Line    int          `json:"line"`
+	SKU     string       `json:"sku"`
+	Action  string       `json:"action"` // insert | update | unchanged | skip | error
+	ItemID  int          `json:"item_id,omitempty"`
+	Changes []string     `json:"changes,omitempty"`
+	Errors  []fieldError `json:"errors,omitempty"`
+
+	fields  itemFields
+	update  itemUpdate
+	current itemRow
+}
+
+func (r *ItemImportRow) fail(field, msg string) {
+	r.Errors = append(r.Errors, fieldError{field, msg})
+	r.Action = "error"
+}
+
+// ParseItemImport reads a .csv or .xlsx file (by filename extension) and
+// validates each row on its own; SKUs are not looked up here. mapping
+// overrides the header detection: header -> field, "" to ignore a column.
+// sheet picks the XLSX worksheet (default: the first one).
+func ParseItemImport(filename string, data []byte, sheet string, mapping map[string]string, maxRows int) (*ItemImport, error) {
+	var records [][]string
+	var lines []int // file line of each record
+	var err error
+	xlsx := false
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv", ".txt":
+		records, lines, err = readImportCSV(data)
+	case ".xlsx", ".xlsm":
+		xlsx = true
+		records, err = readImportXLSX(data, sheet)
+		for i := range records {
+			lines = append(lines, i+1)
+		}
+	default:
+		return nil, errors.New("unsupported file type (use .csv or .xlsx)")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("file is empty")
+	}
+
+	imp := &ItemImport{Columns: map[string]string{}}
+	overrides := map[string]string{}
+	for h, f := range mapping {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f != "" && importFieldAliases[f] != f {
+			return nil, fmt.Errorf("mapping: unknown field %q for column %q", f, h)
+		}
+		overrides[normalizeHeader(h)] = f
+	}
+	header := records[0]
+	cols := make([]string, len(header)) // column index -> field
+	seen := map[string]string{}
+	for i, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		key := normalizeHeader(h)
+		field, ok := overrides[key]
+		if !ok {
+			field = importFieldAliases[key]
+		}
+		if field == "" {
+			if h != "" {
+				imp.Ignored = append(imp.Ignored, h)
+			}
+			continue
+		}
+		if prev, dup := seen[field]; dup {
+			return nil, fmt.Errorf("columns %q and %q both map to %s", prev, h, field)
+		}
+		seen[field] = h
+		cols[i] = field
+		imp.Columns[h] = field
+	}
+	if _, ok := seen["sku"]; !ok {
+		return nil, errors.New("no sku column found (map one with the mapping parameter)")
+	}
+
+	bySKU := map[string]int{} // lower-case sku -> line
+	for n, rec := range records {
+		if n == 0 {
+			continue
+		}
+		if isBlankRecord(rec) {
+			continue
+		}
+		if maxRows > 0 && len(imp.Rows) >= maxRows {
+			return nil, fmt.Errorf("too many rows (max %d)", maxRows)
+		}
+		row := ItemImportRow{Line: lines[n]}
+		for i, field := range cols {
+			if field == "" || i >= len(rec) {
+				continue
+			}
+			row.setCell(field, strings.TrimSpace(rec[i]), xlsx)
+		}
+		row.SKU = strVal(row.fields.SKU)
+		for _, e := range row.fields.validate(true) {
+			row.fail(e.Field, e.Msg)
+		}
+		if row.SKU == "" {
+			row.fail("sku", "sku is required")
+		} else if first, dup := bySKU[strings.ToLower(row.SKU)]; dup {
+			row.fail("sku", fmt.Sprintf("duplicate sku (also on line %d)", first))
+		} else {
+			bySKU[strings.ToLower(row.SKU)] = row.Line
+		}
+		imp.Rows = append(imp.Rows, row)
+	}
+	return imp, nil
+}
+
+// setCell parses one cell into the row; empty cells leave the field unset.
+func (r *ItemImportRow) setCell(field, v string, xlsx bool) {
+	if v == "" {
+		return
+	}
+	f := &r.fields
+	switch field {
+	case "sku":
+		f.SKU = &v
+	case "name":
+		f.Name = &v
+	case "description":
+		f.Description = &v
+	case "category":
+		f.Category = &v
+	case "location":
+		f.Location = &v
+	case "supplier":
+		f.Supplier = &v
+	case "status":
+		f.Status = &v
+	case "image_url":
+		f.ImageURL = &v
+	case "item_type":
+		f.ItemType = &v
+	case "quantity", "reorder_point", "reorder_qty":
+		n, err := parseImportNumber(v)
+		if err != nil || n != math.Trunc(n) || math.Abs(n) > math.MaxInt32 {
+			r.fail(field, field+" must be a whole number")
+			return
+		}
+		q := int(n)
+		switch field {
+		case "quantity":
+			f.Quantity = &q
+		case "reorder_point":
+			f.ReorderPoint = &q
+		default:
+			f.ReorderQty = &q
+		}
+	case "requires_approval":
+		b, ok := parseImportBool(v)
+		if !ok {
+			r.fail(field, "requires_approval must be yes or no")
+			return
+		}
+		f.RequiresApproval = &b
+	case "unit_cost":
+		n, err := parseImportNumber(v)
+		if err != nil {
+			r.fail("unit_cost", "unit_cost must be a number")
+			return
+		}
+		f.UnitCost = &n
+	case "date_purchased":
+		d, ok := parseImportDate(v, xlsx)
+		if !ok {
+			r.fail("date_purchased", "date_purchased must be YYYY-MM-DD or DD/MM/YYYY")
+			return
+		}
+		f.DatePurchased = &d
+	}
+}
+
+// parseImportBool accepts 1/0, true/false, yes/no, x and có/không.
+func parseImportBool(s string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes", "y", "x", "có", "co":
+		return true, true
+	case "0", "false", "no", "n", "không", "khong":
+		return false, true
+	}
+	return false, false
+}
+
+var thousandsRe = regexp.MustCompile(`^-?\d{1,3}([.,]\d{3})+$`)
+
+// parseImportNumber accepts "1200000", "1,200,000", "1.200.000" (vi-VN),
+// "1.200.000,50" and "1,200,000.50".
+func parseImportNumber(s string) (float64, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), " ", "")
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "đ"), "₫")
+	dot, comma := strings.LastIndex(s, "."), strings.LastIndex(s, ",")
+	switch {
+	case dot >= 0 && comma >= 0:
+		if comma > dot { // 1.200,50
+			s = strings.ReplaceAll(s, ".", "")
+			s = strings.Replace(s, ",", ".", 1)
+		} else { // 1,200.50
+			s = strings.ReplaceAll(s, ",", "")
+		}
+	case thousandsRe.MatchString(s) && (comma >= 0 || strings.Count(s, ".") > 1):
+		s = strings.NewReplacer(",", "", ".", "").Replace(s)
+	case comma >= 0: // 12,5
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// parseImportDate returns YYYY-MM-DD. XLSX date cells arrive as serial numbers.
+func parseImportDate(s string, xlsx bool) (string, bool) {
+	for _, layout := range []string{"2006-01-02", "02/01/2006", "2/1/2006", "2006/01/02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format("2006-01-02"), true
+		}
+	}
+	if xlsx {
+		if serial, err := strconv.ParseFloat(s, 64); err == nil && serial >= 1 {
+			if t, err := excelize.ExcelDateToTime(serial, false); err == nil {
+				return t.Format("2006-01-02"), true
+			}
+		}
+	}
+	return "", false
+}
+
+func isBlankRecord(rec []string) bool {
+	for _, v := range rec {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// readImportCSV handles the Excel "CSV UTF-8" flavour (BOM) and the
+// semicolon-separated files Excel writes under vi-VN regional settings.
+func readImportCSV(data []byte) ([][]string, []int, error) {
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	first := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		first = data[:i]
+	}
+	r := csv.NewReader(bytes.NewReader(data))
+	if bytes.Count(first, []byte(";")) > bytes.Count(first, []byte(",")) {
+		r.Comma = ';'
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	var out [][]string
+	var lines []int
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return out, lines, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid csv: %w", err)
+		}
+		line, _ := r.FieldPos(0)
+		out = append(out, rec)
+		lines = append(lines, line)
+	}
+}
+
+func readImportXLSX(data []byte, sheet string) ([][]string, error) {
+	f, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid xlsx: %w", err)
+	}
+	defer f.Close()
+	if sheet == "" {
+		sheet = f.GetSheetName(0)
+	}
+	// raw values: numbers without locale formatting, dates as serials
+	rows, err := f.GetRows(sheet, excelize.Options{RawCellValue: true})
+	if err != nil {
+		return nil, fmt.Errorf("sheet %q: %w", sheet, err)
+	}
+	return rows, nil
+}
+
+// sqlQuerier is *sqlx.DB or *sqlx.Tx.
+type sqlQuerier interface {
+	sqlGetter
+	Select(dest interface{}, query string, args ...interface{}) error
+}
+
+// planItemImport matches the valid rows against the database by SKU and
+// decides what each row does. onConflict is update, skip or error.
+func planItemImport(q sqlQuerier, imp *ItemImport, onConflict string, lock bool) error {
+	var skus []string
+	for _, r := range imp.Rows {
+		if r.Action != "error" {
+			skus = append(skus, r.SKU)
+		}
+	}
+	existing := map[string][]itemRow{}
+	for len(skus) > 0 {
+		chunk := skus
+		if len(chunk) > 500 {
+			chunk = chunk[:500]
+		}
+		skus = skus[len(chunk):]
+		sqlStr, args, err := sqlx.In(`SELECT `+itemSelectCols+` FROM log_lab_equipment_master WHERE sku IN (?)`, chunk)
+		if err != nil {
+			return err
+		}
+		if lock {
+			sqlStr += ` FOR UPDATE`
+		}
+		var rows []itemRow
+		if err := q.Select(&rows, sqlStr, args...); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			k := strings.ToLower(r.SKU)
+			existing[k] = append(existing[k], r)
+		}
+	}
+
+	for i := range imp.Rows {
+		r := &imp.Rows[i]
+		if r.Action == "error" {
+			continue
+		}
+		matches := existing[strings.ToLower(r.SKU)]
+		switch {
+		case len(matches) > 1:
+			r.fail("sku", fmt.Sprintf("sku matches %d existing items", len(matches)))
+		case len(matches) == 1:
+			cur := matches[0]
+			r.ItemID = cur.ID
+			switch onConflict {
+			case "skip":
+				r.Action = "skip"
+				continue
+			case "error":
+				r.fail("sku", fmt.Sprintf("sku already exists (item #%d)", cur.ID))
+				continue
+			}
+			r.fields.SKU = nil // keep the stored spelling
+			u, err := diffItem(cur, r.fields)
+			if err != nil {
+				r.fail("quantity", err.Error())
+				continue
+			}
+			if n := r.fields.Quantity; n != nil && *n != cur.Quantity {
+				msg, err := checkUnitsFit(q, int64(cur.ID), *n, *n-(cur.Quantity-cur.AvailableQuantity))
+				if err != nil {
+					return err
+				}
+				if msg != "" {
+					r.fail("quantity", msg)
+					continue
+				}
+			}
+			if u.has("item_type") {
+				msg, err := itemTypeChangeMsg(q, int64(cur.ID), *r.fields.ItemType)
+				if err != nil {
+					return err
+				}
+				if msg != "" {
+					r.fail("item_type", msg)
+					continue
+				}
+			}
+			if u.has("location") {
+				msg, err := relocateMsg(q, int64(cur.ID))
+				if err != nil {
+					return err
+				}
+				if msg != "" {
+					r.fail("location", msg)
+					continue
+				}
+			}
+			r.update = u
+			r.current = cur
+			r.Changes = u.changed
+			r.Action = "update"
+			if len(u.changed) == 0 {
+				r.Action = "unchanged"
+			}
+		default:
+			if r.fields.Name == nil {
+				r.fail("name", "name is required for new items")
+				continue
+			}
+			r.Action = "insert"
+		}
+	}
+	return nil
+}
+
+func (imp *ItemImport) summary() map[string]int {
+	s := map[string]int{"rows": len(imp.Rows), "insert": 0, "update": 0, "unchanged": 0, "skip": 0, "error": 0}
+	for _, r := range imp.Rows {
+		s[r.Action]++
+	}
+	return s
+}
+
+func itemImportMaxRows() int {
+	return int(int64FromConf("ITEM_IMPORT_MAX_ROWS", 5000))
+}
+
+// POST /api/items/import  (multipart/form-data)
+//
+//	file         .csv or .xlsx, header row first
+//	mode         dry_run (default) | commit
+//	on_conflict  update (default) | skip | error — for SKUs that already exist
+//	mapping      optional JSON {"<column header>": "<field>"}, "" ignores a column
+//	sheet        optional XLSX worksheet name
+func (c *ItemController) Import() {
+	mode := firstNonEmpty(strings.TrimSpace(c.GetString("mode")), "dry_run")
+	if mode != "dry_run" && mode != "commit" {
+		jsonErr(c.Ctx, http.StatusBadRequest, "mode must be dry_run or commit")
+		return
+	}
+	onConflict := firstNonEmpty(strings.TrimSpace(c.GetString("on_conflict")), "update")
+	if onConflict != "update" && onConflict != "skip" && onConflict != "error" {
+		jsonErr(c.Ctx, http.StatusBadRequest, "on_conflict must be update, skip or error")
+		return
+	}
+	var mapping map[string]string
+	if m := strings.TrimSpace(c.GetString("mapping")); m != "" {
+		if err := json.Unmarshal([]byte(m), &mapping); err != nil {
+			jsonErr(c.Ctx, http.StatusBadRequest, "mapping must be a JSON object of column -> field")
+			return
+		}
+	}
+
+	file, hdr, err := c.GetFile("file")
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "file is required")
+		return
+	}
+	defer file.Close()
+	if hdr.Size > itemImportMaxBytes {
+		jsonErr(c.Ctx, http.StatusRequestEntityTooLarge, "file is too large (max 10 MB)")
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, itemImportMaxBytes+1))
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "could not read file")
+		return
+	}
+
+	imp, err := ParseItemImport(hdr.Filename, data, strings.TrimSpace(c.GetString("sheet")), mapping, itemImportMaxRows())
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	report := func(committed bool) map[string]interface{} {
+		return map[string]interface{}{
+			"mode":            mode,
+			"committed":       committed,
+			"summary":         imp.summary(),
+			"columns":         imp.Columns,
+			"ignored_columns": imp.Ignored,
+			"rows":            imp.Rows,
+		}
+	}
+
+	if mode == "dry_run" {
+		if err := planItemImport(srv.DB, imp, onConflict, false); err != nil {
+			log.Printf("[items] import plan: %v", err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+			return
+		}
+		jsonOK(c.Ctx, report(false))
+		return
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := planItemImport(tx, imp, onConflict, true); err != nil {
+		log.Printf("[items] import plan: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	sum := imp.summary()
+	if sum["error"] > 0 {
+		out := report(false)
+		out["error"] = fmt.Sprintf("%d row(s) have errors; nothing was imported", sum["error"])
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		_ = c.Ctx.Output.JSON(out, false, false)
+		return
+	}
+	mv := stockMove{Reason: "import", UserID: currentUserID(c.Ctx), Note: filepath.Base(hdr.Filename)}
+	for i := range imp.Rows {
+		r := &imp.Rows[i]
+		switch r.Action {
+		case "insert":
+			var id int64
+			if id, err = insertItem(tx, r.fields); err == nil {
+				r.ItemID = int(id)
+			}
+		case "update": // planned against the rows locked above
+			if err = r.update.apply(tx, int64(r.ItemID)); err == nil {
+				delta, relocated := r.update.stockChange(r.current, r.fields)
+				var msg string
+				if msg, err = syncStock(tx, int64(r.ItemID), delta, relocated, mv); err == nil && msg != "" {
+					err = errors.New(msg)
+				}
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			var me *mysql.MySQLError
+			if errors.As(err, &me) && me.Number == 1062 {
+				jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("line %d: duplicate key (likely sku); nothing was imported", r.Line))
+				return
+			}
+			log.Printf("[items] import line %d: %v", r.Line, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, fmt.Sprintf("line %d: write error; nothing was imported", r.Line))
+			return
+		}
+	}
+	logActivityTX(tx.Tx, int(currentUserID(c.Ctx)), fmt.Sprintf("Imported items from %s: %d new, %d updated",
+		filepath.Base(hdr.Filename), sum["insert"], sum["update"]))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	jsonOK(c.Ctx, report(true))
+}
@@ -0,0 +1,392 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// Item lifecycle: edit (PATCH), archive/restore (soft delete) and hard delete.
+// Archived items keep their history but are hidden from GET /api/items and
+// cannot be borrowed.
+
+func (c *ItemController) itemID() (int64, bool) {
+	id, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+	}
+	return id, ok
+}
+
+// loadItem reads one item; it writes the 404/500 itself when ok is false.
+func (c *ItemController) loadItem(q sqlGetter, id int64, lock bool) (itemRow, bool) {
+	var row itemRow
+	sqlStr := `SELECT ` + itemSelectCols + ` FROM log_lab_equipment_master WHERE id=? LIMIT 1`
+	if lock {
+		sqlStr += ` FOR UPDATE`
+	}
+	if err := q.Get(&row, sqlStr, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "not found")
+		} else {
+			log.Printf("[items] load id=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return row, false
+	}
+	return row, true
+}
+
+type sqlGetter interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+}
+
+// PATCH /api/items/:id  { any subset of the fields accepted by POST /api/items }
+// available_quantity follows quantity: the units currently out on loan stay
+// out, so quantity cannot drop below them.
+func (c *ItemController) Update() {
+	id, ok := c.itemID()
+	if !ok {
+		return
+	}
+	var in itemFields
+	if err := readJSON(c.Ctx, &in); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	errs := in.validate(true)
+	if in.AvailableQuantity != nil {
+		errs = append(errs, fieldError{"available_quantity", "available_quantity is derived from quantity and open borrows"})
+	}
+	if len(errs) > 0 {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		_ = c.Ctx.Output.JSON(map[string]interface{}{"error": errs[0].Msg, "fields": errs}, false, false)
+		return
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	cur, ok := c.loadItem(tx, id, true)
+	if !ok {
+		return
+	}
+
+	u, err := diffItem(cur, in)
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusConflict, err.Error())
+		return
+	}
+	if in.Quantity != nil && *in.Quantity != cur.Quantity {
+		msg, err := checkUnitsFit(tx, id, *in.Quantity, *in.Quantity-(cur.Quantity-cur.AvailableQuantity))
+		if err != nil {
+			log.Printf("[items] units id=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+			return
+		}
+		if msg != "" {
+			jsonErr(c.Ctx, http.StatusConflict, msg)
+			return
+		}
+	}
+	if u.has("item_type") {
+		msg, err := itemTypeChangeMsg(tx, id, *in.ItemType)
+		if err != nil {
+			log.Printf("[items] type id=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+			return
+		}
+		if msg != "" {
+			jsonErr(c.Ctx, http.StatusConflict, msg)
+			return
+		}
+	}
+	if len(u.changed) == 0 {
+		jsonOK(c.Ctx, cur)
+		return
+	}
+
+	if err := u.apply(tx, id); err != nil {
+		var me *mysql.MySQLError
+		if errors.As(err, &me) && me.Number == 1062 {
+			jsonErr(c.Ctx, http.StatusBadRequest, "duplicate key (likely sku)")
+			return
+		}
+		log.Printf("[items] update id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	delta, relocated := u.stockChange(cur, in)
+	if msg, err := syncStock(tx, id, delta, relocated, stockMove{Reason: "adjust", UserID: currentUserID(c.Ctx)}); err != nil || msg != "" {
+		if err != nil {
+			log.Printf("[items] stock id=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		} else {
+			jsonErr(c.Ctx, http.StatusConflict, msg)
+		}
+		return
+	}
+	logActivityTX(tx.Tx, int(currentUserID(c.Ctx)), fmt.Sprintf("Updated item #%d %s (%s): %s", id, cur.Name, cur.SKU, strings.Join(u.changed, ", ")))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	if row, ok := c.loadItem(srv.DB, id, false); ok {
+		jsonOK(c.Ctx, row)
+	}
+}
+
+// itemUpdate is the SET list for one item; changed names the columns that
+// actually differ from the stored row.
+type itemUpdate struct {
+	sets    []string
+	args    []interface{}
+	changed []string
+}
+
+func (u *itemUpdate) set(col string, v interface{}) {
+	u.sets = append(u.sets, col+"=?")
+	u.args = append(u.args, v)
+	u.changed = append(u.changed, col)
+}
+
+func (u itemUpdate) has(col string) bool {
+	for _, c := range u.changed {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
+// stockChange is what syncStock needs to know about the update: the change
+// of quantity and, when the location changed, the new one.
+func (u itemUpdate) stockChange(cur itemRow, in itemFields) (qtyDelta int, relocated *string) {
+	if u.has("quantity") {
+		qtyDelta = *in.Quantity - cur.Quantity
+	}
+	if u.has("location") {
+		relocated = in.Location
+	}
+	return qtyDelta, relocated
+}
+
+func (u itemUpdate) apply(ex sqlx.Execer, id int64) error {
+	_, err := ex.Exec("UPDATE log_lab_equipment_master SET "+strings.Join(u.sets, ", ")+" WHERE id=?", append(u.args, id)...)
+	return err
+}
+
+// diffItem compares validated fields against cur. Shared by PATCH and the
+// import upsert; it fails when quantity would drop below the units on loan.
+func diffItem(cur itemRow, in itemFields) (itemUpdate, error) {
+	var u itemUpdate
+	str := func(col string, p *string, old string) {
+		if p != nil && *p != old {
+			u.set(col, *p)
+		}
+	}
+	str("sku", in.SKU, cur.SKU)
+	str("name", in.Name, cur.Name)
+	str("description", in.Description, cur.Description)
+	str("category", in.Category, cur.Category)
+	str("location", in.Location, cur.Location)
+	str("supplier", in.Supplier, cur.Supplier)
+	str("status", in.Status, cur.Status)
+	str("item_type", in.ItemType, cur.ItemType)
+	if in.ImageURL != nil && *in.ImageURL != strVal(cur.ImageURL) {
+		u.set("image_url", nullableStr(*in.ImageURL))
+	}
+	if in.ReorderPoint != nil && *in.ReorderPoint != cur.ReorderPoint {
+		u.set("reorder_point", *in.ReorderPoint)
+	}
+	if in.ReorderQty != nil && *in.ReorderQty != cur.ReorderQty {
+		u.set("reorder_qty", *in.ReorderQty)
+	}
+	if in.RequiresApproval != nil && *in.RequiresApproval != cur.RequiresApproval {
+		u.set("requires_approval", *in.RequiresApproval)
+	}
+	if in.UnitCost != nil && *in.UnitCost != cur.UnitCost {
+		u.set("unit_cost", *in.UnitCost)
+	}
+	if in.DatePurchased != nil {
+		old := ""
+		if cur.DatePurchased != nil {
+			old = cur.DatePurchased.Format("2006-01-02")
+		}
+		if *in.DatePurchased != old {
+			d, _ := parseItemDate(*in.DatePurchased)
+			u.set("date_purchased", d)
+		}
+	}
+	if in.Quantity != nil && *in.Quantity != cur.Quantity {
+		out := cur.Quantity - cur.AvailableQuantity
+		if *in.Quantity < out {
+			return u, fmt.Errorf("quantity cannot be less than the %d unit(s) currently borrowed", out)
+		}
+		u.set("quantity", *in.Quantity)
+		u.sets = append(u.sets, "available_quantity=?")
+		u.args = append(u.args, *in.Quantity-out)
+	}
+	return u, nil
+}
+
+// POST /api/items/:id/archive  { "reason": "screen broken, not repairable" }
+func (c *ItemController) Archive() {
+	id, ok := c.itemID()
+	if !ok {
+		return
+	}
+	var in struct {
+		Reason string `json:"reason"`
+	}
+	_ = readJSON(c.Ctx, &in)
+	in.Reason = strings.TrimSpace(in.Reason)
+	if in.Reason == "" {
+		jsonErr(c.Ctx, http.StatusBadRequest, "reason is required")
+		return
+	}
+	if len(in.Reason) > 255 {
+		jsonErr(c.Ctx, http.StatusBadRequest, "reason is too long (max 255)")
+		return
+	}
+	c.setArchived(id, &in.Reason)
+}
+
+// POST /api/items/:id/restore
+func (c *ItemController) Restore() {
+	id, ok := c.itemID()
+	if !ok {
+		return
+	}
+	c.setArchived(id, nil)
+}
+
+// setArchived archives the item with reason, or restores it when reason is nil.
+func (c *ItemController) setArchived(id int64, reason *string) {
+	row, ok := c.loadItem(srv.DB, id, false)
+	if !ok {
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	var res sql.Result
+	var err error
+	var action string
+	if reason != nil {
+		if row.ArchivedAt != nil {
+			jsonErr(c.Ctx, http.StatusConflict, "item is already archived")
+			return
+		}
+		res, err = srv.DB.Exec(`UPDATE log_lab_equipment_master SET archived_at=?, archived_reason=?, archived_by=? WHERE id=? AND archived_at IS NULL`,
+			time.Now().UTC(), *reason, uid, id)
+		action = fmt.Sprintf("Archived item #%d %s (%s): %s", id, row.Name, row.SKU, *reason)
+	} else {
+		if row.ArchivedAt == nil {
+			jsonErr(c.Ctx, http.StatusConflict, "item is not archived")
+			return
+		}
+		res, err = srv.DB.Exec(`UPDATE log_lab_equipment_master SET archived_at=NULL, archived_reason=NULL, archived_by=NULL WHERE id=? AND archived_at IS NOT NULL`, id)
+		action = fmt.Sprintf("Restored item #%d %s (%s)", id, row.Name, row.SKU)
+	}
+	if err != nil {
+		log.Printf("[items] archive id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		jsonErr(c.Ctx, http.StatusConflict, "item changed concurrently; reload and retry")
+		return
+	}
+	logActivity(uid, action)
+	if row, ok := c.loadItem(srv.DB, id, false); ok {
+		jsonOK(c.Ctx, row)
+	}
+}
+
+// itemHistory lists the records that keep an item from being hard-deleted:
+// its loans and its stock ledger are the audit trail, so an item with any of
+// them can only be archived.
+var itemHistory = []struct {
+	query string
+	args  func() []interface{} // after the item id
+	msg   string
+}{
+	{`SELECT COUNT(1) FROM log_lab_borrow_records WHERE item_id=?`, nil, "item has borrow history; archive it instead"},
+	{`SELECT COUNT(1) FROM stock_movements WHERE item_id=?`, nil, "item has stock movements; archive it instead"},
+	{`SELECT COUNT(1) FROM stock_issues WHERE item_id=?`, nil, "item has consumable issues; archive it instead"},
+	{`SELECT COUNT(1) FROM stock_transfers WHERE item_id=?`, nil, "item has transfer history; archive it instead"},
+	{`SELECT COUNT(1) FROM reservations WHERE item_id=? AND status=? AND end_at > ?`,
+		func() []interface{} { return []interface{}{ReservationBooked, time.Now().UTC()} },
+		"item has upcoming reservations; cancel them first"},
+	{`SELECT COUNT(1) FROM purchase_request_lines WHERE item_id=?`, nil, "item is on a purchase request; archive it instead"},
+}
+
+// DELETE /api/items/:id  (admins only)
+// Only items without loans or stock history can be deleted; everything else is archived.
+func (c *ItemController) Delete() {
+	id, ok := c.itemID()
+	if !ok {
+		return
+	}
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	row, ok := c.loadItem(tx, id, true)
+	if !ok {
+		return
+	}
+	for _, h := range itemHistory {
+		args := []interface{}{id}
+		if h.args != nil {
+			args = append(args, h.args()...)
+		}
+		var n int
+		if err := tx.Get(&n, h.query, args...); err != nil {
+			log.Printf("[items] delete id=%d check: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+			return
+		}
+		if n > 0 {
+			jsonErr(c.Ctx, http.StatusConflict, h.msg)
+			return
+		}
+	}
+	// item-owned content goes with it; the stock ledger never does (see itemHistory)
+	for _, t := range []string{equipNotesTable, equipInstructionsTable, "log_lab_storage", "reservations", equipmentUnitsTable} {
+		if _, err := tx.Exec("DELETE FROM "+t+" WHERE item_id=?", id); err != nil {
+			log.Printf("[items] delete id=%d from %s: %v", id, t, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "delete error")
+			return
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM log_lab_equipment_master WHERE id=?`, id); err != nil {
+		var me *mysql.MySQLError
+		if errors.As(err, &me) && me.Number == 1451 {
+			jsonErr(c.Ctx, http.StatusConflict, "item is still referenced by other records; archive it instead")
+			return
+		}
+		log.Printf("[items] delete id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "delete error")
+		return
+	}
+	logActivityTX(tx.Tx, int(currentUserID(c.Ctx)), fmt.Sprintf("Deleted item #%d %s (%s)", id, row.Name, row.SKU))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	jsonOK(c.Ctx, map[string]interface{}{"ok": true})
+}
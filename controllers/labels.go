@@ -0,0 +1,519 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	"github.com/go-pdf/fpdf"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Asset labels: a QR code per item, as a PNG for one item or a PDF sheet of
+// sticker labels. The QR holds the SKU on its first line (what the borrow
+// page scanner reads) followed by the name and location for humans with a
+// generic scanner app.
+
+const labelMaxPerSheet = 1000
+
+// Label is what gets printed for one item.
+type Label struct {
+	SKU      string `db:"sku"`
+	Name     string `db:"name"`
+	Location string `db:"location"`
+}
+
+// Payload is the text encoded in the QR code.
+func (l Label) Payload() string {
+	return strings.TrimRight(strings.Join([]string{l.SKU, l.Name, l.Location}, "\n"), "\n")
+}
+
+// LabelLayout is a sheet of equally sized labels; all sizes are in mm.
+type LabelLayout struct {
+	PageW  float64 `json:"page_width_mm"`
+	PageH  float64 `json:"page_height_mm"`
+	Cols   int     `json:"cols"`
+	Rows   int     `json:"rows"`
+	LabelW float64 `json:"label_width_mm"`
+	LabelH float64 `json:"label_height_mm"`
+	Left   float64 `json:"margin_left_mm"` // omitted margins centre the grid
+	Top    float64 `json:"margin_top_mm"`
+	GapX   float64 `json:"gap_x_mm"`
+	GapY   float64 `json:"gap_y_mm"`
+}
+
+// LabelLayouts are the common A4 sticker sheets.
+var LabelLayouts = map[string]LabelLayout{
+	"a4-2x7":  {PageW: 210, PageH: 297, Cols: 2, Rows: 7, LabelW: 99.1, LabelH: 38.1, Left: 4.65, Top: 15.15, GapX: 2.5},
+	"a4-3x8":  {PageW: 210, PageH: 297, Cols: 3, Rows: 8, LabelW: 70, LabelH: 37, Left: 0, Top: 0.5},
+	"a4-4x10": {PageW: 210, PageH: 297, Cols: 4, Rows: 10, LabelW: 48.5, LabelH: 25.4, Left: 8, Top: 21.5},
+	"a4-5x13": {PageW: 210, PageH: 297, Cols: 5, Rows: 13, LabelW: 38.1, LabelH: 21.2, Left: 4.75, Top: 10.7, GapX: 2.5},
+}
+
+// normalize fills in an A4 page and centred margins, then checks the grid fits.
+func (l *LabelLayout) normalize() error {
+	if l.PageW == 0 && l.PageH == 0 {
+		l.PageW, l.PageH = 210, 297
+	}
+	if l.Cols < 1 || l.Rows < 1 || l.Cols*l.Rows > 200 {
+		return errors.New("layout needs 1..200 labels per page")
+	}
+	if l.LabelW < 15 || l.LabelH < 10 {
+		return errors.New("labels must be at least 15 x 10 mm")
+	}
+	if l.GapX < 0 || l.GapY < 0 || l.Left < 0 || l.Top < 0 {
+		return errors.New("margins and gaps cannot be negative")
+	}
+	gridW := float64(l.Cols)*l.LabelW + float64(l.Cols-1)*l.GapX
+	gridH := float64(l.Rows)*l.LabelH + float64(l.Rows-1)*l.GapY
+	if l.Left == 0 && l.Top == 0 {
+		l.Left, l.Top = (l.PageW-gridW)/2, (l.PageH-gridH)/2
+	}
+	if l.Left+gridW > l.PageW+0.01 || l.Top+gridH > l.PageH+0.01 || l.Left < 0 || l.Top < 0 {
+		return errors.New("labels do not fit on the page")
+	}
+	return nil
+}
+
+// LabelSheetOptions controls RenderLabelSheet.
+type LabelSheetOptions struct {
+	Layout   LabelLayout
+	Skip     int    // positions already used on the first sheet
+	Outline  bool   // draw cut lines (plain paper)
+	FontPath string // TTF with Vietnamese glyphs; without it text is folded to ASCII
+}
+
+// RenderLabelSheet writes a PDF with one label per entry and returns the page count.
+func RenderLabelSheet(w io.Writer, labels []Label, opt LabelSheetOptions) (int, error) {
+	lay := opt.Layout
+	if err := lay.normalize(); err != nil {
+		return 0, err
+	}
+	perPage := lay.Cols * lay.Rows
+	if opt.Skip < 0 || opt.Skip >= perPage {
+		return 0, fmt.Errorf("skip must be between 0 and %d", perPage-1)
+	}
+	pdf := fpdf.NewCustom(&fpdf.InitType{UnitStr: "mm", Size: fpdf.SizeType{Wd: lay.PageW, Ht: lay.PageH}})
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetCreator("VLU Lab Inventory", true)
+
+	family, text := "Helvetica", foldToASCII
+	if opt.FontPath != "" {
+		ttf, err := os.ReadFile(opt.FontPath)
+		if err != nil {
+			return 0, fmt.Errorf("label font: %w", err)
+		}
+		family, text = "label", func(s string) string { return s }
+		pdf.AddUTF8FontFromBytes(family, "", ttf)
+		pdf.AddUTF8FontFromBytes(family, "B", ttf)
+		if err := pdf.Error(); err != nil {
+			return 0, fmt.Errorf("label font: %w", err)
+		}
+	}
+
+	for i, l := range labels {
+		pos := i + opt.Skip
+		if pos%perPage == 0 || i == 0 {
+			pdf.AddPage()
+		}
+		pos %= perPage
+		x := lay.Left + float64(pos%lay.Cols)*(lay.LabelW+lay.GapX)
+		y := lay.Top + float64(pos/lay.Cols)*(lay.LabelH+lay.GapY)
+		if err := drawLabel(pdf, l, x, y, lay.LabelW, lay.LabelH, family, text); err != nil {
+			return 0, fmt.Errorf("label %q: %w", l.SKU, err)
+		}
+		if opt.Outline {
+			pdf.SetDrawColor(180, 180, 180)
+			pdf.SetLineWidth(0.1)
+			pdf.Rect(x, y, lay.LabelW, lay.LabelH, "D")
+		}
+	}
+	if len(labels) == 0 {
+		pdf.AddPage()
+	}
+	pages := pdf.PageCount()
+	return pages, pdf.Output(w)
+}
+
+// drawLabel puts the QR on the left and SKU / name / location beside it; on
+// narrow labels the text goes under a smaller QR.
+func drawLabel(pdf *fpdf.Fpdf, l Label, x, y, w, h float64, family string, text func(string) string) error {
+	code, err := qr.Encode(l.Payload(), qr.M, qr.Auto)
+	if err != nil {
+		return err
+	}
+	pad := h * 0.06
+	if pad < 1.5 {
+		pad = 1.5
+	}
+	scale := h / 37 // font sizes are tuned for 37 mm labels
+	side := h - 2*pad
+	tx, ty, tw := x+pad+side+pad, y+pad, w-side-3*pad
+	if w < 1.5*h {
+		side = h - 2*pad - 9*scale*0.3528*1.3 // leave room for the SKU line
+		tx, ty, tw = x+pad, y+pad+side, w-2*pad
+	}
+	drawQR(pdf, code, x+pad, y+pad, side)
+
+	pdf.SetTextColor(0, 0, 0)
+	line := func(style string, pt float64, s string, maxLines int) {
+		if s == "" || maxLines == 0 {
+			return
+		}
+		pdf.SetFont(family, style, pt)
+		lh := pt * 0.3528 * 1.25
+		lines := pdf.SplitText(text(s), tw)
+		if len(lines) > maxLines {
+			lines = lines[:maxLines]
+			r := []rune(lines[maxLines-1])
+			for len(r) > 0 && pdf.GetStringWidth(string(r)+"...") > tw {
+				r = r[:len(r)-1]
+			}
+			lines[maxLines-1] = string(r) + "..."
+		}
+		for _, ln := range lines {
+			if ty+lh > y+h-pad+0.01 {
+				return
+			}
+			pdf.SetXY(tx, ty)
+			pdf.CellFormat(tw, lh, ln, "", 0, "L", false, 0, "")
+			ty += lh
+		}
+	}
+	if w < 1.5*h {
+		line("B", 9*scale, l.SKU, 1)
+		return pdf.Error()
+	}
+	line("B", 10*scale, l.SKU, 1)
+	ty += 0.8 * scale
+	line("", 8*scale, l.Name, 3)
+	line("", 7*scale, l.Location, 1)
+	return pdf.Error()
+}
+
+// drawQR draws the modules as filled rectangles (sharp at any print size),
+// merging horizontal runs, inside a two-module quiet zone.
+func drawQR(pdf *fpdf.Fpdf, code barcode.Barcode, x, y, side float64) {
+	n := code.Bounds().Dx()
+	m := side / float64(n+4)
+	x, y = x+2*m, y+2*m
+	pdf.SetFillColor(0, 0, 0)
+	for row := 0; row < n; row++ {
+		for col := 0; col < n; {
+			if !isDark(code.At(col, row)) {
+				col++
+				continue
+			}
+			start := col
+			for col < n && isDark(code.At(col, row)) {
+				col++
+			}
+			// a hair of overlap hides seams between rows in some viewers
+			pdf.Rect(x+float64(start)*m, y+float64(row)*m, float64(col-start)*m, m+0.01, "F")
+		}
+	}
+}
+
+func isDark(c color.Color) bool {
+	r, _, _, _ := c.RGBA()
+	return r < 0x8000
+}
+
+// foldToASCII drops diacritics ("Máy hiện sóng" -> "May hien song") for the
+// built-in PDF fonts, which have no Vietnamese glyphs.
+func foldToASCII(s string) string {
+	s = strings.NewReplacer("đ", "d", "Đ", "D").Replace(s)
+	out, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), s)
+	if err != nil {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return '?'
+		}
+		return r
+	}, out)
+}
+
+// LabelPNG renders the QR with a quiet zone, size pixels wide, and the SKU
+// printed underneath when caption is set.
+func LabelPNG(l Label, size int, caption bool) ([]byte, error) {
+	code, err := qr.Encode(l.Payload(), qr.M, qr.Auto)
+	if err != nil {
+		return nil, err
+	}
+	n := code.Bounds().Dx()
+	m := size / (n + 8)
+	if m < 1 {
+		m = 1
+	}
+	side := m * (n + 8)
+	capH := 0
+	if caption {
+		capH = side / 6
+	}
+	img := image.NewGray(image.Rect(0, 0, side, side+capH))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	for row := 0; row < n; row++ {
+		for col := 0; col < n; col++ {
+			if isDark(code.At(col, row)) {
+				r := image.Rect((col+4)*m, (row+4)*m, (col+5)*m, (row+5)*m)
+				draw.Draw(img, r, image.Black, image.Point{}, draw.Src)
+			}
+		}
+	}
+	if caption {
+		if err := drawCaption(img, foldToASCII(l.SKU), side, capH); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func drawCaption(img draw.Image, s string, width, height int) error {
+	f, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return err
+	}
+	pt := float64(height) * 0.6
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: pt, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return err
+	}
+	d := &font.Drawer{Dst: img, Src: image.Black, Face: face}
+	if adv := d.MeasureString(s).Round(); adv > width*9/10 && adv > 0 {
+		face.Close()
+		pt = pt * float64(width*9/10) / float64(adv)
+		if face, err = opentype.NewFace(f, &opentype.FaceOptions{Size: pt, DPI: 72, Hinting: font.HintingFull}); err != nil {
+			return err
+		}
+		d.Face = face
+	}
+	defer face.Close()
+	adv := d.MeasureString(s).Round()
+	// the QR's bottom quiet zone already leaves a gap above the caption
+	d.Dot = fixed.P((width-adv)/2, width+int(float64(height)*0.55))
+	d.DrawString(s)
+	return nil
+}
+
+func labelFontPath() string {
+	return firstNonEmpty(getConf("LABEL_FONT_PATH"), os.Getenv("LABEL_FONT_PATH"))
+}
+
+// GET /api/items/:id/label.png?size=300&caption=0
+func (c *ItemController) LabelPNG() {
+	id, ok := c.itemID()
+	if !ok {
+		return
+	}
+	size := 300
+	if v, err := strconv.Atoi(c.GetString("size")); err == nil {
+		size = v
+	}
+	if size < 64 || size > 2000 {
+		jsonErr(c.Ctx, http.StatusBadRequest, "size must be between 64 and 2000")
+		return
+	}
+	var l Label
+	if err := srv.DB.Get(&l, `SELECT sku, name, location FROM log_lab_equipment_master WHERE id=? LIMIT 1`, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "not found")
+			return
+		}
+		log.Printf("[labels] load id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if strings.TrimSpace(l.SKU) == "" {
+		jsonErr(c.Ctx, http.StatusConflict, "item has no sku")
+		return
+	}
+	b, err := LabelPNG(l, size, c.GetString("caption") != "0")
+	if err != nil {
+		log.Printf("[labels] png id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "render error")
+		return
+	}
+	c.Ctx.Output.Header("Content-Type", "image/png")
+	c.Ctx.Output.Header("Cache-Control", "private, max-age=300")
+	_ = c.Ctx.Output.Body(b)
+}
+
+// POST /api/labels
+//
+//	{ "item_ids": [12, 13], "skus": ["OSC-01"], "copies": 1,
+//	  "layout": "a4-3x8" | { "cols": 3, "rows": 8, "label_width_mm": 70, ... },
+//	  "skip": 0, "outline": false }
+//
+// Labels come out in the order given (ids first, then skus).
+func LabelsPDF(ctx *beegoctx.Context) {
+	var in struct {
+		ItemIDs []int64         `json:"item_ids"`
+		SKUs    []string        `json:"skus"`
+		Copies  int             `json:"copies"`
+		Layout  json.RawMessage `json:"layout"`
+		Skip    int             `json:"skip"`
+		Outline bool            `json:"outline"`
+	}
+	if err := readJSON(ctx, &in); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if in.Copies == 0 {
+		in.Copies = 1
+	}
+	if in.Copies < 1 || in.Copies > 50 {
+		jsonErr(ctx, http.StatusBadRequest, "copies must be between 1 and 50")
+		return
+	}
+	if len(in.ItemIDs)+len(in.SKUs) == 0 {
+		jsonErr(ctx, http.StatusBadRequest, "provide item_ids or skus")
+		return
+	}
+
+	var layout LabelLayout
+	name := firstNonEmpty(getConf("LABEL_DEFAULT_LAYOUT"), "a4-3x8")
+	if len(in.Layout) > 0 && in.Layout[0] == '{' {
+		if err := json.Unmarshal(in.Layout, &layout); err != nil {
+			jsonErr(ctx, http.StatusBadRequest, "invalid layout")
+			return
+		}
+	} else {
+		if len(in.Layout) > 0 {
+			if err := json.Unmarshal(in.Layout, &name); err != nil {
+				jsonErr(ctx, http.StatusBadRequest, "invalid layout")
+				return
+			}
+		}
+		var ok bool
+		if layout, ok = LabelLayouts[strings.ToLower(name)]; !ok {
+			jsonErr(ctx, http.StatusBadRequest, "unknown layout "+strconv.Quote(name))
+			return
+		}
+	}
+
+	if err := layout.normalize(); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if in.Skip < 0 || in.Skip >= layout.Cols*layout.Rows {
+		jsonErr(ctx, http.StatusBadRequest, fmt.Sprintf("skip must be between 0 and %d", layout.Cols*layout.Rows-1))
+		return
+	}
+
+	items, msg := loadLabels(in.ItemIDs, in.SKUs)
+	if msg != "" {
+		jsonErr(ctx, http.StatusBadRequest, msg)
+		return
+	}
+	if items == nil {
+		jsonErr(ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	var labels []Label
+	for _, l := range items {
+		for i := 0; i < in.Copies; i++ {
+			labels = append(labels, l)
+		}
+	}
+	if len(labels) > labelMaxPerSheet {
+		jsonErr(ctx, http.StatusBadRequest, fmt.Sprintf("too many labels (max %d)", labelMaxPerSheet))
+		return
+	}
+
+	var buf bytes.Buffer
+	if _, err := RenderLabelSheet(&buf, labels, LabelSheetOptions{Layout: layout, Skip: in.Skip, Outline: in.Outline, FontPath: labelFontPath()}); err != nil {
+		log.Printf("[labels] render: %v", err)
+		jsonErr(ctx, http.StatusInternalServerError, "render error")
+		return
+	}
+	ctx.Output.Header("Content-Type", "application/pdf")
+	ctx.Output.Header("Content-Disposition", `inline; filename="labels.pdf"`)
+	_ = ctx.Output.Body(buf.Bytes())
+}
+
+// loadLabels resolves ids and skus in request order. A non-empty message is a
+// client error; a nil slice with no message is a database error (logged).
+func loadLabels(ids []int64, skus []string) ([]Label, string) {
+	type labelRow struct {
+		ID int64 `db:"id"`
+		Label
+	}
+	var rows []labelRow
+	if len(ids) > 0 {
+		q, args, err := sqlx.In(`SELECT id, sku, name, location FROM log_lab_equipment_master WHERE id IN (?)`, ids)
+		if err == nil {
+			err = srv.DB.Select(&rows, q, args...)
+		}
+		if err != nil {
+			log.Printf("[labels] load ids: %v", err)
+			return nil, ""
+		}
+	}
+	if len(skus) > 0 {
+		var more []labelRow
+		q, args, err := sqlx.In(`SELECT id, sku, name, location FROM log_lab_equipment_master WHERE sku IN (?)`, skus)
+		if err == nil {
+			err = srv.DB.Select(&more, q, args...)
+		}
+		if err != nil {
+			log.Printf("[labels] load skus: %v", err)
+			return nil, ""
+		}
+		rows = append(rows, more...)
+	}
+	byID := map[int64]Label{}
+	bySKU := map[string]Label{}
+	for _, r := range rows {
+		byID[r.ID] = r.Label
+		bySKU[strings.ToLower(r.SKU)] = r.Label
+	}
+	out := make([]Label, 0, len(ids)+len(skus))
+	for _, id := range ids {
+		l, ok := byID[id]
+		if !ok {
+			return nil, fmt.Sprintf("item #%d not found", id)
+		}
+		if strings.TrimSpace(l.SKU) == "" {
+			return nil, fmt.Sprintf("item #%d has no sku", id)
+		}
+		out = append(out, l)
+	}
+	for _, s := range skus {
+		l, ok := bySKU[strings.ToLower(strings.TrimSpace(s))]
+		if !ok {
+			return nil, fmt.Sprintf("sku %q not found", s)
+		}
+		out = append(out, l)
+	}
+	return out, ""
+}
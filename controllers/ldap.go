@@ -0,0 +1,293 @@
+package controllers
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"vlu_infrastructure_management/models"
+)
+
+// LDAPConfig points the LDAP backend at the campus directory (OpenLDAP or
+// Active Directory). Filters use {username} and {dn} placeholders, which are
+// filter-escaped before substitution.
+type LDAPConfig struct {
+	URL                string // ldap://host:389 or ldaps://host:636
+	StartTLS           bool
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+
+	BindDN       string // service account used to look users up; empty = anonymous
+	BindPassword string
+
+	BaseDN       string
+	UserFilter   string
+	AttrUsername string
+	AttrEmail    string
+	AttrName     string
+
+	GroupBaseDN  string // optional: also search groups whose GroupFilter matches the user
+	GroupFilter  string
+	GroupRoleMap map[string]string // group DN or CN (lower-case) -> role
+	DefaultRole  string
+
+	AutoProvision bool
+}
+
+// LDAPUser is the directory entry a successful bind resolved to.
+type LDAPUser struct {
+	DN       string
+	Username string
+	Email    string
+	Name     string
+	Groups   []string // group DNs
+	Role     string   // from GroupRoleMap; empty when the map is not configured
+}
+
+type LDAPAuthenticator struct {
+	cfg LDAPConfig
+}
+
+func NewLDAPAuthenticator(cfg LDAPConfig) *LDAPAuthenticator {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(&(objectClass=person)(|(uid={username})(mail={username})))"
+	}
+	if cfg.GroupFilter == "" {
+		cfg.GroupFilter = "(|(member={dn})(uniqueMember={dn}))"
+	}
+	if cfg.AttrUsername == "" {
+		cfg.AttrUsername = "uid"
+	}
+	if cfg.AttrEmail == "" {
+		cfg.AttrEmail = "mail"
+	}
+	if cfg.AttrName == "" {
+		cfg.AttrName = "displayName"
+	}
+	if cfg.DefaultRole == "" {
+		cfg.DefaultRole = RoleStudent
+	}
+	return &LDAPAuthenticator{cfg: cfg}
+}
+
+func ldapConfigFromConf() LDAPConfig {
+	conf := func(k string) string { return firstNonEmpty(getConf(k), os.Getenv(k)) }
+	roles := map[string]string{}
+	// LDAP_GROUP_ROLE_MAP = lab-admins:admin, cn=lab-managers,ou=groups,dc=vlu,dc=edu,dc=vn:lab_manager
+	for _, pair := range splitCSVKeepDN(conf("LDAP_GROUP_ROLE_MAP")) {
+		if i := strings.LastIndex(pair, ":"); i > 0 {
+			roles[strings.ToLower(strings.TrimSpace(pair[:i]))] = NormalizeRole(pair[i+1:])
+		}
+	}
+	return LDAPConfig{
+		URL:                conf("LDAP_URL"),
+		StartTLS:           conf("LDAP_START_TLS") == "true",
+		InsecureSkipVerify: conf("LDAP_INSECURE_SKIP_VERIFY") == "true",
+		Timeout:            time.Duration(int64FromConf("LDAP_TIMEOUT_SECONDS", 10)) * time.Second,
+		BindDN:             conf("LDAP_BIND_DN"),
+		BindPassword:       conf("LDAP_BIND_PASSWORD"),
+		BaseDN:             conf("LDAP_BASE_DN"),
+		UserFilter:         conf("LDAP_USER_FILTER"),
+		AttrUsername:       conf("LDAP_ATTR_USERNAME"),
+		AttrEmail:          conf("LDAP_ATTR_EMAIL"),
+		AttrName:           conf("LDAP_ATTR_NAME"),
+		GroupBaseDN:        conf("LDAP_GROUP_BASE_DN"),
+		GroupFilter:        conf("LDAP_GROUP_FILTER"),
+		GroupRoleMap:       roles,
+		DefaultRole:        NormalizeRole(firstNonEmpty(conf("LDAP_DEFAULT_ROLE"), RoleStudent)),
+		AutoProvision:      conf("LDAP_AUTO_PROVISION") != "false",
+	}
+}
+
+// splitCSVKeepDN splits "a:x, cn=b,ou=g,dc=y:z" into entries, keeping the
+// commas that belong to a DN (a new entry starts only after a ":role" part).
+func splitCSVKeepDN(s string) []string {
+	var out []string
+	cur := ""
+	for _, part := range strings.Split(s, ",") {
+		if cur != "" {
+			cur += ","
+		}
+		cur += part
+		if strings.Contains(part, ":") {
+			if v := strings.TrimSpace(cur); v != "" {
+				out = append(out, v)
+			}
+			cur = ""
+		}
+	}
+	return out
+}
+
+func (a *LDAPAuthenticator) Name() string { return "ldap" }
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(a.cfg.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("ldap: invalid LDAP_URL %q", a.cfg.URL)
+	}
+	tlsCfg := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: a.cfg.InsecureSkipVerify}
+	conn, err := ldap.DialURL(a.cfg.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.cfg.Timeout}),
+		ldap.DialWithTLSConfig(tlsCfg))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.cfg.Timeout)
+	if a.cfg.StartTLS && u.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsCfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) serviceBind(conn *ldap.Conn) error {
+	if a.cfg.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(a.cfg.BindDN, a.cfg.BindPassword)
+}
+
+func (a *LDAPAuthenticator) search(conn *ldap.Conn, base, filter string, attrs []string, limit int) ([]*ldap.Entry, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		limit, int(a.cfg.Timeout.Seconds()), false, filter, attrs, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+// Bind looks the user up with the service account, then binds as that user
+// with password. Rejections come back as *AuthFailure; anything else is a
+// directory/connection problem.
+func (a *LDAPAuthenticator) Bind(identifier, password string) (LDAPUser, error) {
+	identifier = strings.TrimSpace(identifier)
+	if identifier == "" || password == "" { // an empty password would be an anonymous bind
+		return LDAPUser{}, &AuthFailure{Reason: "ldap_bad_password"}
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return LDAPUser{}, err
+	}
+	defer conn.Close()
+
+	if err := a.serviceBind(conn); err != nil {
+		return LDAPUser{}, fmt.Errorf("ldap service bind: %w", err)
+	}
+	filter := strings.ReplaceAll(a.cfg.UserFilter, "{username}", ldap.EscapeFilter(identifier))
+	attrs := []string{a.cfg.AttrUsername, a.cfg.AttrEmail, a.cfg.AttrName, "memberOf"}
+	entries, err := a.search(conn, a.cfg.BaseDN, filter, attrs, 2)
+	if err != nil {
+		return LDAPUser{}, fmt.Errorf("ldap user search: %w", err)
+	}
+	if len(entries) != 1 {
+		return LDAPUser{}, &AuthFailure{Reason: "ldap_unknown_user"}
+	}
+	e := entries[0]
+
+	if err := conn.Bind(e.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return LDAPUser{DN: e.DN}, &AuthFailure{Reason: "ldap_bad_password"}
+		}
+		return LDAPUser{}, fmt.Errorf("ldap user bind: %w", err)
+	}
+
+	u := LDAPUser{
+		DN:       e.DN,
+		Username: e.GetAttributeValue(a.cfg.AttrUsername),
+		Email:    strings.ToLower(e.GetAttributeValue(a.cfg.AttrEmail)),
+		Name:     e.GetAttributeValue(a.cfg.AttrName),
+		Groups:   e.GetAttributeValues("memberOf"),
+	}
+	if u.Username == "" {
+		u.Username = strings.SplitN(identifier, "@", 2)[0]
+	}
+	if a.cfg.GroupBaseDN != "" {
+		if err := a.serviceBind(conn); err != nil {
+			return LDAPUser{}, fmt.Errorf("ldap service bind: %w", err)
+		}
+		gf := strings.ReplaceAll(a.cfg.GroupFilter, "{dn}", ldap.EscapeFilter(e.DN))
+		gf = strings.ReplaceAll(gf, "{username}", ldap.EscapeFilter(u.Username))
+		groups, err := a.search(conn, a.cfg.GroupBaseDN, gf, []string{"cn"}, 0)
+		if err != nil {
+			return LDAPUser{}, fmt.Errorf("ldap group search: %w", err)
+		}
+		for _, g := range groups {
+			u.Groups = append(u.Groups, g.DN)
+		}
+	}
+	u.Role = a.roleFor(u.Groups)
+	return u, nil
+}
+
+// roleFor maps group memberships onto the most privileged configured role.
+// Without a GroupRoleMap roles are managed locally and "" is returned.
+func (a *LDAPAuthenticator) roleFor(groups []string) string {
+	if len(a.cfg.GroupRoleMap) == 0 {
+		return ""
+	}
+	matched := map[string]bool{}
+	for _, dn := range groups {
+		keys := []string{strings.ToLower(dn)}
+		if parsed, err := ldap.ParseDN(dn); err == nil && len(parsed.RDNs) > 0 && len(parsed.RDNs[0].Attributes) > 0 {
+			keys = append(keys, strings.ToLower(parsed.RDNs[0].Attributes[0].Value))
+		}
+		for _, k := range keys {
+			if r, ok := a.cfg.GroupRoleMap[k]; ok {
+				matched[r] = true
+			}
+		}
+	}
+	for _, r := range roleOrder {
+		if matched[r] {
+			return r
+		}
+	}
+	return a.cfg.DefaultRole
+}
+
+// Authenticate binds against the directory and maps the entry onto a local
+// user (linked by DN, provisioned on first login).
+func (a *LDAPAuthenticator) Authenticate(identifier, password string) (models.User, error) {
+	lu, err := a.Bind(identifier, password)
+	var f *AuthFailure
+	if errors.As(err, &f) && lu.DN != "" {
+		// count the failure against the linked account, if any
+		var uid int64
+		if e := srv.DB.Get(&uid, "SELECT user_id FROM "+userIdentitiesTable+
+			" WHERE provider='ldap' AND issuer=? AND subject=? LIMIT 1", strings.ToLower(a.cfg.BaseDN), strings.ToLower(lu.DN)); e == nil {
+			f.UserID = uid
+		} else if !errors.Is(e, sql.ErrNoRows) {
+			return models.User{}, e
+		}
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	return resolveExternalUser(externalIdentity{
+		Provider:      "ldap",
+		Issuer:        strings.ToLower(a.cfg.BaseDN),
+		Subject:       strings.ToLower(lu.DN),
+		Email:         lu.Email,
+		EmailVerified: lu.Email != "", // the directory is authoritative for campus mail
+		Username:      lu.Username,
+		FullName:      lu.Name,
+		Role:          lu.Role,
+	}, a.cfg.DefaultRole, a.cfg.AutoProvision)
+}
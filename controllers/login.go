@@ -2,9 +2,9 @@ package controllers
 
 import (
 	cryptoRand "crypto/rand"
-	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -14,18 +14,25 @@ import (
 
 	beego "github.com/beego/beego/v2/server/web"
 	beegoctx "github.com/beego/beego/v2/server/web/context"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type Session struct {
-	Token  string
-	UserID int64
-	Email  string
-	Role   string
-	Exp    time.Time
+	ID        int64
+	Token     string
+	UserID    int64
+	Email     string
+	Role      string
+	Exp       time.Time
+	CreatedAt time.Time
+	LastSeen  time.Time
+	UserAgent string
+	IP        string
+	MFA       bool // second factor verified for this session
+
+	MustChangePassword bool // only the password change is served until it is done
 }
 
-// ---- simple in-memory session store via patrickmn/go-cache (wired in server.go) ----
+// ---- sessions: DB-backed SessionStore with go-cache read-through (wired in server.go) ----
 func sessionTTL() time.Duration {
 	h, _ := beego.AppConfig.Int64("SESSION_TTL_HOURS")
 	if h <= 0 {
@@ -40,18 +47,46 @@ func newToken() string {
 	return hex.EncodeToString(b)
 }
 
-// Backed by server.go’s cache instance:
-func sessionPut(s Session) {
+// last_seen_at is only written back when it is older than this
+const sessionTouchInterval = 5 * time.Minute
+
+// Backed by server.go’s SessionStore:
+func sessionPut(s Session) (Session, error) {
 	srv := GetServer() // see server.go; returns the singleton
-	srv.Cache.Set(s.Token, s, sessionTTL())
+	return srv.Sessions.Put(s)
 }
-func sessionGet(token string) (interface{}, bool) {
+func sessionGet(token string) (Session, bool) {
 	srv := GetServer()
-	return srv.Cache.Get(token)
+	s, ok, err := srv.Sessions.Get(token)
+	if err != nil {
+		log.Printf("[session] get error: %v", err)
+		return Session{}, false
+	}
+	if ok && time.Since(s.LastSeen) > sessionTouchInterval {
+		if err := srv.Sessions.Touch(token, time.Now()); err != nil {
+			log.Printf("[session] touch error: %v", err)
+		}
+	}
+	return s, ok
 }
 func sessionDel(token string) {
 	srv := GetServer()
-	srv.Cache.Delete(token)
+	if err := srv.Sessions.Delete(token); err != nil {
+		log.Printf("[session] delete error: %v", err)
+	}
+}
+
+// newSession builds a session for uid with request metadata (device, IP).
+func newSession(ctx *beegoctx.Context, uid int64, email, role string) Session {
+	return Session{
+		Token:     newToken(),
+		UserID:    uid,
+		Email:     email,
+		Role:      role,
+		Exp:       time.Now().Add(sessionTTL()).UTC(),
+		UserAgent: ctx.Input.UserAgent(),
+		IP:        ctx.Input.IP(),
+	}
 }
 
 type loginInput struct {
@@ -78,61 +113,97 @@ func AuthLogin(ctx *beegoctx.Context) {
 		return
 	}
 
-	// Look up user (either by email or username)
+	// Brute-force protection: lockout / per-IP window (see login_limiter.go)
 	srv := GetServer()
-	var u models.User
-	q := `SELECT id, username, password_hash, email, role FROM users WHERE email = ? OR username = ? LIMIT 1`
-	if err := srv.DB.Get(&u, q, id, id); err != nil {
-		if err == sql.ErrNoRows {
-			jsonErr(ctx, http.StatusUnauthorized, "invalid credentials")
-		} else {
-			log.Println("login query error:", err)
-			jsonErr(ctx, http.StatusInternalServerError, "server error")
-		}
+	ip, ua := ctx.Input.IP(), ctx.Input.UserAgent()
+	wait, failures, err := srv.Limiter.Check(id, ip)
+	if err != nil {
+		log.Println("login limiter error:", err) // fail open; bcrypt still applies
+	}
+	if wait > 0 {
+		tooManyAttempts(ctx, wait)
 		return
 	}
-
-	if err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(pw)); err != nil {
+	reject := func(uid int64, reason string) {
+		srv.Limiter.RecordFailure(id, uid, ip, ua, reason)
+		time.Sleep(srv.Limiter.Delay(failures + 1))
 		jsonErr(ctx, http.StatusUnauthorized, "invalid credentials")
+	}
+
+	// Verify credentials against the configured backends (local bcrypt, LDAP; see authenticator.go)
+	u, err := srv.Auth.Authenticate(id, pw)
+	var failure *AuthFailure
+	switch {
+	case errors.As(err, &failure):
+		reject(failure.UserID, failure.Reason)
+		return
+	case errors.Is(err, errAccountDisabled):
+		jsonErr(ctx, http.StatusForbidden, "account disabled")
 		return
+	case err != nil:
+		log.Println("login error:", err)
+		jsonErr(ctx, http.StatusServiceUnavailable, "authentication service unavailable")
+		return
+	}
+	if u.DisabledAt != nil {
+		jsonErr(ctx, http.StatusForbidden, "account disabled")
+		return
+	}
+
+	if err := srv.Limiter.Clear(int64(u.ID), id); err != nil {
+		log.Println("login limiter clear error:", err)
 	}
 
-	// Build a session & token
-	token := newToken()
-	exp := time.Now().Add(sessionTTL())
-	sessionPut(Session{
-		Token:  token,
-		UserID: int64(u.ID),
-		Email:  u.Email,
-		Role:   u.Role,
-		Exp:    exp,
+	// Second factor: hand out a short-lived challenge instead of a session
+	if u.TOTPEnabled {
+		startMFAChallenge(ctx, u)
+		return
+	}
+	completeLogin(ctx, u, false)
+}
+
+// completeLogin issues the session + cookie and writes the login response.
+// mfa records whether the user passed a second factor.
+func completeLogin(ctx *beegoctx.Context, u models.User, mfa bool) {
+	sess := newSession(ctx, int64(u.ID), u.Email, u.Role)
+	sess.MFA = mfa
+	sess, err := sessionPut(sess)
+	if err != nil {
+		log.Println("login session error:", err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	setAuthCookie(ctx, sess)
+
+	// Reply JSON for the React client (which reads `data.token`)
+	jsonOK(ctx, map[string]interface{}{
+		"token": sess.Token,
+		"exp":   sess.Exp.Unix(),
+		"user": map[string]interface{}{
+			"id":       u.ID,
+			"username": u.Username,
+			"email":    u.Email,
+			"role":     u.Role,
+		},
+		"must_change_password": u.MustChangePassword,
+		"mfa_setup_required":   !mfa && roleRequiresMFA(u.Role),
 	})
+}
 
+func setAuthCookie(ctx *beegoctx.Context, sess Session) {
 	// Optionally also set a cookie so non-Redux clients can work
 	// If you host frontend and backend on different origins, use SameSite=None; Secure
 	cookie := &http.Cookie{
 		Name:     "imx_token",
-		Value:    token,
+		Value:    sess.Token,
 		Path:     "/",
 		HttpOnly: true,
 		// Comment the next 2 lines if same-origin; keep if cross-origin over HTTPS
 		SameSite: http.SameSiteNoneMode,
 		Secure:   true,
-		Expires:  exp,
+		Expires:  sess.Exp,
 	}
 	http.SetCookie(ctx.ResponseWriter, cookie)
-
-	// Reply JSON for the React client (which reads `data.token`)
-	jsonOK(ctx, map[string]interface{}{
-		"token": token,
-		"exp":   exp.Unix(),
-		"user": map[string]interface{}{
-			"id":       u.ID,
-			"username": u.Username,
-			"email":    u.Email,
-			"role":     u.Role,
-		},
-	})
 }
 
 func AuthLogout(ctx *beegoctx.Context) {
@@ -141,15 +212,31 @@ func AuthLogout(ctx *beegoctx.Context) {
 		sessionDel(t)
 	}
 	// Clear cookie
-	http.SetCookie(ctx.ResponseWriter, &http.Cookie{
-		Name:     "imx_token",
-		Value:    "",
-		Path:     "/",
-		Expires:  time.Unix(0, 0),
-		MaxAge:   -1,
-		HttpOnly: true,
-		SameSite: http.SameSiteNoneMode,
-		Secure:   true,
-	})
+	clearAuthCookie(ctx)
 	jsonOK(ctx, map[string]interface{}{"ok": true})
 }
+
+// GET /api/auth/me
+// The signed-in user, as in the login response. It is served while a
+// password change is pending, so the client can ask for the new password.
+func AuthMe(ctx *beegoctx.Context) {
+	var u models.User
+	if err := srv.DB.Get(&u, "SELECT id, username, full_name, email, role, must_change_password FROM "+usersTable+
+		" WHERE id=? LIMIT 1", currentUserID(ctx)); err != nil {
+		log.Printf("[auth] me user_id=%d: %v", currentUserID(ctx), err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	mfa, _ := ctx.Input.GetData("session_mfa").(bool)
+	jsonOK(ctx, map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":        u.ID,
+			"username":  u.Username,
+			"full_name": u.FullName,
+			"email":     u.Email,
+			"role":      u.Role,
+		},
+		"mfa":                  mfa,
+		"must_change_password": u.MustChangePassword,
+	})
+}
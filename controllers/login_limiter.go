@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+	"github.com/jmoiron/sqlx"
+)
+
+const failedLoginsTable = "failed_logins"
+
+// failed_logins doubles as the audit trail and as the sliding window the
+// limiter counts over, so every instance sees the same numbers.
+const failedLoginsSchema = `
+CREATE TABLE IF NOT EXISTS failed_logins (
+	id         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	identifier VARCHAR(255)    NOT NULL,
+	user_id    BIGINT UNSIGNED NULL,
+	ip         VARCHAR(64)     NOT NULL,
+	user_agent VARCHAR(255)    NULL,
+	reason     VARCHAR(32)     NOT NULL,
+	created_at DATETIME        NOT NULL,
+	cleared_at DATETIME        NULL,
+	KEY idx_failed_logins_identifier (identifier, created_at),
+	KEY idx_failed_logins_ip (ip, created_at),
+	KEY idx_failed_logins_user (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+type loginLimiter struct {
+	db         *sqlx.DB
+	window     time.Duration // sliding window failures are counted over
+	maxPerID   int           // failures per identifier before lockout
+	maxPerIP   int           // failures per client IP before 429
+	lockout    time.Duration // account lockout once maxPerID is reached
+	delayAfter int           // failures before responses start slowing down
+}
+
+func newLoginLimiterFromConf(db *sqlx.DB) *loginLimiter {
+	return &loginLimiter{
+		db:         db,
+		window:     time.Duration(int64FromConf("LOGIN_WINDOW_MINUTES", 15)) * time.Minute,
+		maxPerID:   int(int64FromConf("LOGIN_MAX_FAILURES_PER_ID", 5)),
+		maxPerIP:   int(int64FromConf("LOGIN_MAX_FAILURES_PER_IP", 20)),
+		lockout:    time.Duration(int64FromConf("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute,
+		delayAfter: 2,
+	}
+}
+
+func normalizeIdentifier(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+// windowCount returns the number of uncleared failures matching col=val in
+// the window and when the oldest of them leaves it.
+func (l *loginLimiter) windowCount(col, val string, now time.Time) (int, time.Time, error) {
+	var r struct {
+		N      int          `db:"n"`
+		Oldest sql.NullTime `db:"oldest"`
+	}
+	err := l.db.Get(&r, "SELECT COUNT(1) AS n, MIN(created_at) AS oldest FROM "+failedLoginsTable+
+		" WHERE "+col+"=? AND cleared_at IS NULL AND created_at > ?", val, now.Add(-l.window))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return r.N, r.Oldest.Time.Add(l.window), nil
+}
+
+// Check decides whether a login attempt may proceed. It returns how long the
+// caller must wait (0 = allowed) and the identifier's recent failure count,
+// which drives the progressive delay.
+func (l *loginLimiter) Check(identifier, ip string) (time.Duration, int, error) {
+	now := time.Now().UTC()
+	id := normalizeIdentifier(identifier)
+
+	var lockedUntil sql.NullTime
+	err := l.db.Get(&lockedUntil, "SELECT locked_until FROM "+usersTable+" WHERE email=? OR username=? LIMIT 1", id, id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, err
+	}
+	if lockedUntil.Valid && lockedUntil.Time.After(now) {
+		return lockedUntil.Time.Sub(now), 0, nil
+	}
+
+	nIP, ipFree, err := l.windowCount("ip", ip, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if nIP >= l.maxPerIP {
+		return ipFree.Sub(now), nIP, nil
+	}
+	nID, idFree, err := l.windowCount("identifier", id, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if nID >= l.maxPerID {
+		return idFree.Sub(now), nID, nil
+	}
+	return 0, nID, nil
+}
+
+// Delay grows exponentially once an identifier has delayAfter failures: 1s, 2s, 4s, capped at 8s.
+func (l *loginLimiter) Delay(failures int) time.Duration {
+	if failures < l.delayAfter {
+		return 0
+	}
+	d := time.Duration(math.Pow(2, float64(failures-l.delayAfter))) * time.Second
+	if d > 8*time.Second {
+		d = 8 * time.Second
+	}
+	return d
+}
+
+// RecordFailure writes the audit row and locks the account once the
+// identifier reaches maxPerID failures in the window.
+func (l *loginLimiter) RecordFailure(identifier string, userID int64, ip, userAgent, reason string) {
+	now := time.Now().UTC()
+	id := normalizeIdentifier(identifier)
+	var uid interface{}
+	if userID > 0 {
+		uid = userID
+	}
+	if _, err := l.db.Exec("INSERT INTO "+failedLoginsTable+
+		" (identifier, user_id, ip, user_agent, reason, created_at) VALUES (?,?,?,?,?,?)",
+		truncate(id, 255), uid, ip, nullableStr(truncate(userAgent, 255)), reason, now); err != nil {
+		log.Printf("[login-limiter] record failure: %v", err)
+		return
+	}
+	if userID <= 0 {
+		return
+	}
+	n, _, err := l.windowCount("identifier", id, now)
+	if err != nil || n < l.maxPerID {
+		return
+	}
+	if _, err := l.db.Exec("UPDATE "+usersTable+" SET locked_until=? WHERE id=?", now.Add(l.lockout), userID); err != nil {
+		log.Printf("[login-limiter] lock user_id=%d: %v", userID, err)
+		return
+	}
+	log.Printf("[login-limiter] locked user_id=%d after %d failures", userID, n)
+}
+
+// Clear forgets the failures counted against a user (successful login or admin unlock).
+// Rows stay in the table for auditing.
+func (l *loginLimiter) Clear(userID int64, identifiers ...string) error {
+	args := []interface{}{time.Now().UTC(), userID}
+	cond := "user_id=?"
+	for _, id := range identifiers {
+		if id = normalizeIdentifier(id); id != "" {
+			cond += " OR identifier=?"
+			args = append(args, id)
+		}
+	}
+	if _, err := l.db.Exec("UPDATE "+failedLoginsTable+" SET cleared_at=? WHERE cleared_at IS NULL AND ("+cond+")", args...); err != nil {
+		return err
+	}
+	_, err := l.db.Exec("UPDATE "+usersTable+" SET locked_until=NULL WHERE id=?", userID)
+	return err
+}
+
+func tooManyAttempts(ctx *beegoctx.Context, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	ctx.Output.Header("Retry-After", strconv.Itoa(secs))
+	ctx.Output.SetStatus(http.StatusTooManyRequests)
+	_ = ctx.Output.JSON(map[string]interface{}{"error": "too many login attempts", "retry_after": secs}, false, false)
+}
+
+// ---- admin: audit trail & unlock ----
+
+type FailedLoginController struct{ web.Controller }
+
+type failedLoginRow struct {
+	ID         int64      `db:"id"         json:"id"`
+	Identifier string     `db:"identifier" json:"identifier"`
+	UserID     *int64     `db:"user_id"    json:"user_id,omitempty"`
+	IP         string     `db:"ip"         json:"ip"`
+	UserAgent  *string    `db:"user_agent" json:"user_agent,omitempty"`
+	Reason     string     `db:"reason"     json:"reason"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	ClearedAt  *time.Time `db:"cleared_at" json:"cleared_at,omitempty"`
+}
+
+// GET /api/admin/failed-logins?user_id=&identifier=&ip=&limit=100&offset=0
+func (c *FailedLoginController) List() {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	if v, err := c.GetInt64("user_id"); err == nil && v > 0 {
+		where += " AND user_id=?"
+		args = append(args, v)
+	}
+	if v := normalizeIdentifier(c.GetString("identifier")); v != "" {
+		where += " AND identifier=?"
+		args = append(args, v)
+	}
+	if v := strings.TrimSpace(c.GetString("ip")); v != "" {
+		where += " AND ip=?"
+		args = append(args, v)
+	}
+	limit := 100
+	if v, err := c.GetInt("limit"); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+	offset := 0
+	if v, err := c.GetInt("offset"); err == nil && v >= 0 {
+		offset = v
+	}
+	rows := make([]failedLoginRow, 0)
+	if err := srv.DB.Select(&rows, "SELECT id, identifier, user_id, ip, user_agent, reason, created_at, cleared_at FROM "+
+		failedLoginsTable+where+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...); err != nil {
+		log.Printf("[failed-logins] list: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, rows)
+}
+
+// POST /api/admin/users/:id/unlock
+func (c *AdminUserController) Unlock() {
+	id, ok := c.userID()
+	if !ok {
+		return
+	}
+	u, ok := c.load(id)
+	if !ok {
+		return
+	}
+	if err := GetServer().Limiter.Clear(id, u.Username, u.Email); err != nil {
+		log.Printf("[admin-users] unlock id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivity(currentUserID(c.Ctx), fmt.Sprintf("Unlocked user #%d %s", id, u.Username))
+	jsonOK(c.Ctx, map[string]interface{}{"ok": true})
+}
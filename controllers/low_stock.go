@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+	"github.com/jmoiron/sqlx"
+)
+
+// Low stock: an item with a reorder_point is low while its shelf stock
+// (available_quantity, which for consumables is all of it) is at or below
+// that point. A background check stamps low_stock_since when an item
+// crosses the threshold, writes an activity entry and mails a digest, and
+// clears the stamp once stock is back above it. Stock on order (open
+// purchase requests) is shown with each item and taken off the suggestion.
+
+// SuggestReorder is how many to order for an item with stock on the shelf,
+// 0 when it is not low. Orders come in multiples of qty and lift the stock
+// above point; without a reorder quantity they top it up to twice the point.
+func SuggestReorder(stock, point, qty int) int {
+	if point <= 0 || stock > point {
+		return 0
+	}
+	if stock < 0 {
+		stock = 0
+	}
+	if qty <= 0 {
+		return 2*point - stock
+	}
+	need := point - stock + 1
+	return (need + qty - 1) / qty * qty
+}
+
+type lowStockRow struct {
+	ID           int        `db:"id"                 json:"id"`
+	SKU          string     `db:"sku"                json:"sku"`
+	Name         string     `db:"name"               json:"name"`
+	Category     string     `db:"category"           json:"category"`
+	ItemType     string     `db:"item_type"          json:"item_type"`
+	Location     string     `db:"location"           json:"location"`
+	Quantity     int        `db:"quantity"           json:"quantity"`
+	Available    int        `db:"available_quantity" json:"available_quantity"`
+	ReorderPoint int        `db:"reorder_point"      json:"reorder_point"`
+	ReorderQty   int        `db:"reorder_qty"        json:"reorder_qty"`
+	LowSince     *time.Time `db:"low_stock_since"    json:"low_stock_since"`
+	OnOrder      int        `db:"on_order"           json:"on_order"`
+	Shortfall    int        `db:"-"                  json:"shortfall"`
+	Suggested    int        `db:"-"                  json:"suggested_order_qty"`
+}
+
+const lowStockSelect = `SELECT id, sku, name, category, item_type, location, quantity, available_quantity,
+	reorder_point, reorder_qty, low_stock_since,
+	(SELECT COALESCE(SUM(l.quantity - l.received_qty),0) FROM purchase_request_lines l
+	   JOIN purchase_requests p ON p.id = l.request_id
+	  WHERE l.item_id = log_lab_equipment_master.id AND p.status IN ('` + PurchaseApproved + `','` + PurchaseOrdered + `','` + PurchasePartial + `')) AS on_order
+	FROM log_lab_equipment_master
+	WHERE archived_at IS NULL AND reorder_point > 0 AND available_quantity <= reorder_point`
+
+func (r *lowStockRow) suggest() {
+	r.Shortfall = r.ReorderPoint - r.Available
+	r.Suggested = SuggestReorder(r.Available+r.OnOrder, r.ReorderPoint, r.ReorderQty)
+}
+
+// GET /api/inventory/low-stock?q=&category=&item_type=consumable
+// Items at or below their reorder point, emptiest first, with a suggested
+// order quantity.
+func LowStock(ctx *beegoctx.Context) {
+	where := ""
+	var args []interface{}
+	if q := strings.TrimSpace(ctx.Input.Query("q")); q != "" {
+		where += ` AND (name LIKE ? OR sku LIKE ?)`
+		args = append(args, "%"+q+"%", "%"+q+"%")
+	}
+	if v := strings.TrimSpace(ctx.Input.Query("category")); v != "" {
+		where += ` AND category=?`
+		args = append(args, v)
+	}
+	if v := strings.TrimSpace(ctx.Input.Query("item_type")); v != "" {
+		t, ok := NormalizeItemType(v)
+		if !ok {
+			jsonErr(ctx, http.StatusBadRequest, "item_type must be durable or consumable")
+			return
+		}
+		where += ` AND item_type=?`
+		args = append(args, t)
+	}
+	rows := make([]lowStockRow, 0)
+	if err := srv.DB.Select(&rows, lowStockSelect+where+` ORDER BY available_quantity - reorder_point, name`, args...); err != nil {
+		log.Printf("[low-stock] list: %v", err)
+		jsonErr(ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	for i := range rows {
+		rows[i].suggest()
+	}
+	jsonOK(ctx, rows)
+}
+
+// watchLowStock runs checkLowStock every interval; see
+// LOW_STOCK_CHECK_MINUTES in conf/app.conf.
+func watchLowStock(s *Server, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		if err := checkLowStock(s.DB, s.Mailer); err != nil {
+			log.Printf("[low-stock] check: %v", err)
+		}
+	}
+}
+
+// checkLowStock raises items that went low since the last run and resets
+// those that recovered. Stamping low_stock_since with a conditional UPDATE
+// keeps several app instances from reporting the same item twice.
+func checkLowStock(db *sqlx.DB, mailer Mailer) error {
+	if _, err := db.Exec(`UPDATE log_lab_equipment_master SET low_stock_since=NULL
+		WHERE low_stock_since IS NOT NULL
+		  AND (archived_at IS NOT NULL OR reorder_point <= 0 OR available_quantity > reorder_point)`); err != nil {
+		return err
+	}
+	var rows []lowStockRow
+	if err := db.Select(&rows, lowStockSelect+` AND low_stock_since IS NULL ORDER BY id`); err != nil {
+		return err
+	}
+	var raised []lowStockRow
+	now := time.Now().UTC()
+	for _, r := range rows {
+		res, err := db.Exec(`UPDATE log_lab_equipment_master SET low_stock_since=? WHERE id=? AND low_stock_since IS NULL`, now, r.ID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		r.suggest()
+		raised = append(raised, r)
+		logActivity(0, fmt.Sprintf("Low stock: %s (%s) has %d available, reorder point %d; suggest ordering %d",
+			r.Name, r.SKU, r.Available, r.ReorderPoint, r.Suggested))
+	}
+	if len(raised) == 0 || mailer == nil {
+		return nil
+	}
+	to, err := lowStockRecipients(db)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("The following items have reached their reorder point:\n\n")
+	for _, r := range raised {
+		fmt.Fprintf(&b, "- %s (%s): %d available, reorder point %d, suggested order %d\n",
+			r.Name, r.SKU, r.Available, r.ReorderPoint, r.Suggested)
+	}
+	b.WriteString("\nThe full list is at /api/inventory/low-stock.\n")
+	subject := fmt.Sprintf("Low stock: %d item(s) to reorder", len(raised))
+	for _, addr := range to {
+		if err := mailer.Send(addr, subject, b.String()); err != nil {
+			log.Printf("[low-stock] mail %s: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// lowStockRecipients is LOW_STOCK_NOTIFY, or every active admin and lab
+// manager with an e-mail address.
+func lowStockRecipients(db *sqlx.DB) ([]string, error) {
+	if v := firstNonEmpty(getConf("LOW_STOCK_NOTIFY"), os.Getenv("LOW_STOCK_NOTIFY")); v != "" {
+		return splitCSV(v), nil
+	}
+	var to []string
+	err := db.Select(&to, `SELECT email FROM `+usersTable+`
+		WHERE role IN (?, ?) AND disabled_at IS NULL AND email <> ''`, RoleAdmin, RoleLabManager)
+	return to, err
+}
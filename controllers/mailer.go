@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends plain-text e-mail (password resets, notifications).
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// newMailerFromConf picks the implementation from MAILER (smtp|log, default log).
+func newMailerFromConf() Mailer {
+	from := firstNonEmpty(getConf("MAIL_FROM"), os.Getenv("MAIL_FROM"), "no-reply@vlu.local")
+	kind := strings.ToLower(firstNonEmpty(getConf("MAILER"), os.Getenv("MAILER"), "log"))
+	if kind == "smtp" {
+		return &SMTPMailer{
+			Host:     firstNonEmpty(getConf("SMTP_HOST"), os.Getenv("SMTP_HOST")),
+			Port:     firstNonEmpty(getConf("SMTP_PORT"), os.Getenv("SMTP_PORT"), "587"),
+			Username: firstNonEmpty(getConf("SMTP_USERNAME"), os.Getenv("SMTP_USERNAME")),
+			Password: firstNonEmpty(getConf("SMTP_PASSWORD"), os.Getenv("SMTP_PASSWORD")),
+			From:     from,
+		}
+	}
+	verbose, _ := strconv.ParseBool(firstNonEmpty(os.Getenv("MAIL_LOG_BODY"), getConf("MAIL_LOG_BODY")))
+	return &LogMailer{From: from, Dir: firstNonEmpty(getConf("MAIL_DIR"), os.Getenv("MAIL_DIR")), Verbose: verbose}
+}
+
+// buildMessage renders an RFC 5322 message with a UTF-8 body (Vietnamese text safe).
+func buildMessage(from, to, subject, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// ---- SMTP ----
+
+// SMTPMailer delivers through an SMTP relay. Port 465 uses implicit TLS;
+// other ports use STARTTLS when the server offers it.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if m.Host == "" {
+		return fmt.Errorf("smtp: SMTP_HOST not set")
+	}
+	addr := net.JoinHostPort(m.Host, m.Port)
+	msg := buildMessage(m.From, to, subject, body)
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	if m.Port != "465" {
+		return smtp.SendMail(addr, auth, m.From, []string{to}, msg)
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: m.Host})
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// ---- log / file (dev & tests) ----
+
+// LogMailer logs who each message is for and, when Dir is set, writes it to
+// Dir as an .eml file. The body may hold a live reset link, so it is only
+// logged with Verbose (MAIL_LOG_BODY, for development). With Keep the
+// messages are also collected in Sent, for tests.
+type LogMailer struct {
+	From    string
+	Dir     string
+	Verbose bool
+	Keep    bool
+
+	mu   sync.Mutex
+	n    int
+	Sent []SentMail
+}
+
+type SentMail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	m.n++
+	n := m.n
+	if m.Keep {
+		m.Sent = append(m.Sent, SentMail{To: to, Subject: subject, Body: body})
+	}
+	m.mu.Unlock()
+
+	if m.Verbose {
+		log.Printf("[mail] to=%s subject=%q\n%s", to, subject, body)
+	} else {
+		log.Printf("[mail] to=%s subject=%q (%d bytes)", to, subject, len(body))
+	}
+	if m.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%03d.eml", time.Now().Format("20060102-150405"), n)
+	return os.WriteFile(filepath.Join(m.Dir, name), buildMessage(m.From, to, subject, body), 0o644)
+}
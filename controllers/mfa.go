@@ -0,0 +1,396 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+	"golang.org/x/crypto/bcrypt"
+
+	"vlu_infrastructure_management/models"
+)
+
+const mfaChallengesTable = "mfa_challenges"
+
+// mfa_challenges holds the "mfa pending" tokens handed out by AuthLogin
+// between the password and the TOTP step.
+const mfaChallengesSchema = `
+CREATE TABLE IF NOT EXISTS mfa_challenges (
+	id         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	token_hash CHAR(64)        NOT NULL,
+	user_id    BIGINT UNSIGNED NOT NULL,
+	created_at DATETIME        NOT NULL,
+	expires_at DATETIME        NOT NULL,
+	attempts   INT             NOT NULL DEFAULT 0,
+	UNIQUE KEY uq_mfa_challenges_token_hash (token_hash),
+	KEY idx_mfa_challenges_expires (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+const (
+	mfaChallengeTTL         = 5 * time.Minute
+	mfaChallengeMaxAttempts = 5
+	mfaRecoveryCodeCount    = 10
+)
+
+func mfaIssuer() string {
+	return firstNonEmpty(getConf("MFA_ISSUER"), os.Getenv("MFA_ISSUER"), "VLU Lab Inventory")
+}
+
+// roleRequiresMFA reports whether MFA_REQUIRED_ROLES (comma-separated) lists role.
+func roleRequiresMFA(role string) bool {
+	r := NormalizeRole(role)
+	for _, v := range splitCSV(firstNonEmpty(getConf("MFA_REQUIRED_ROLES"), os.Getenv("MFA_REQUIRED_ROLES"))) {
+		if NormalizeRole(v) == r {
+			return true
+		}
+	}
+	return false
+}
+
+type mfaUser struct {
+	ID            int64          `db:"id"`
+	Username      string         `db:"username"`
+	Email         string         `db:"email"`
+	Role          string         `db:"role"`
+	PasswordHash  []byte         `db:"password_hash"`
+	Secret        sql.NullString `db:"totp_secret"`
+	Enabled       bool           `db:"totp_enabled"`
+	RecoveryCodes sql.NullString `db:"totp_recovery_codes"`
+}
+
+func loadMFAUser(uid int64) (*mfaUser, error) {
+	var u mfaUser
+	err := srv.DB.Get(&u, "SELECT id, username, email, role, password_hash, totp_secret, totp_enabled, totp_recovery_codes FROM "+
+		usersTable+" WHERE id=? LIMIT 1", uid)
+	return &u, err
+}
+
+// checkSecondFactor accepts either a TOTP code (replay-protected via
+// totp_last_step) or an unused recovery code, which is consumed.
+func checkSecondFactor(u *mfaUser, code, recovery string) bool {
+	if code != "" && u.Secret.Valid {
+		step, ok := VerifyTOTP(u.Secret.String, code, time.Now())
+		if !ok {
+			return false
+		}
+		res, err := srv.DB.Exec("UPDATE "+usersTable+
+			" SET totp_last_step=? WHERE id=? AND (totp_last_step IS NULL OR totp_last_step < ?)", step, u.ID, step)
+		if err != nil {
+			log.Printf("[mfa] store last step user_id=%d: %v", u.ID, err)
+			return false
+		}
+		n, _ := res.RowsAffected()
+		return n == 1 // 0 rows: code already used
+	}
+	if recovery != "" {
+		return consumeRecoveryCode(u, recovery)
+	}
+	return false
+}
+
+func normalizeRecoveryCode(c string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(c), " ", ""))
+}
+
+func consumeRecoveryCode(u *mfaUser, code string) bool {
+	var hashes []string
+	if u.RecoveryCodes.Valid {
+		_ = json.Unmarshal([]byte(u.RecoveryCodes.String), &hashes)
+	}
+	h := hashToken(normalizeRecoveryCode(code))
+	for i, have := range hashes {
+		if have != h {
+			continue
+		}
+		rest := append(hashes[:i:i], hashes[i+1:]...)
+		b, _ := json.Marshal(rest)
+		// compare-and-swap so a code cannot be spent twice concurrently
+		res, err := srv.DB.Exec("UPDATE "+usersTable+" SET totp_recovery_codes=? WHERE id=? AND totp_recovery_codes=?",
+			string(b), u.ID, u.RecoveryCodes.String)
+		if err != nil {
+			log.Printf("[mfa] consume recovery code user_id=%d: %v", u.ID, err)
+			return false
+		}
+		n, _ := res.RowsAffected()
+		if n == 1 {
+			logActivity(u.ID, fmt.Sprintf("Used an MFA recovery code (%d left)", len(rest)))
+		}
+		return n == 1
+	}
+	return false
+}
+
+// newRecoveryCodes returns fresh codes (shown once) and their hashes (stored).
+func newRecoveryCodes() ([]string, string) {
+	codes := make([]string, 0, mfaRecoveryCodeCount)
+	hashes := make([]string, 0, mfaRecoveryCodeCount)
+	for i := 0; i < mfaRecoveryCodeCount; i++ {
+		raw := strings.ToLower(NewTOTPSecret()[:10])
+		code := raw[:5] + "-" + raw[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	b, _ := json.Marshal(hashes)
+	return codes, string(b)
+}
+
+// ---- login step 2 ----
+
+// newMFAChallenge stores a challenge for uid and returns its token and expiry.
+func newMFAChallenge(uid uint64) (string, time.Time, error) {
+	token := newToken()
+	now := time.Now().UTC()
+	_, err := srv.DB.Exec("INSERT INTO "+mfaChallengesTable+" (token_hash, user_id, created_at, expires_at) VALUES (?,?,?,?)",
+		hashToken(token), uid, now, now.Add(mfaChallengeTTL))
+	return token, now.Add(mfaChallengeTTL), err
+}
+
+// startMFAChallenge is called by AuthLogin once the password checked out.
+func startMFAChallenge(ctx *beegoctx.Context, u models.User) {
+	token, exp, err := newMFAChallenge(u.ID)
+	if err != nil {
+		log.Println("mfa challenge insert error:", err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	jsonOK(ctx, map[string]interface{}{
+		"mfa_required": true,
+		"mfa_token":    token,
+		"exp":          exp.Unix(),
+	})
+}
+
+// POST /api/auth/mfa/verify  { "mfa_token": "...", "code": "123456" } or { "mfa_token", "recovery_code" }
+func AuthMFAVerify(ctx *beegoctx.Context) {
+	var in struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := readJSON(ctx, &in); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if in.MFAToken == "" || (in.Code == "" && in.RecoveryCode == "") {
+		jsonErr(ctx, http.StatusBadRequest, "missing mfa_token or code")
+		return
+	}
+
+	var ch struct {
+		ID       int64 `db:"id"`
+		UserID   int64 `db:"user_id"`
+		Attempts int   `db:"attempts"`
+	}
+	err := srv.DB.Get(&ch, "SELECT id, user_id, attempts FROM "+mfaChallengesTable+
+		" WHERE token_hash=? AND expires_at > UTC_TIMESTAMP() LIMIT 1", hashToken(in.MFAToken))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && ch.Attempts >= mfaChallengeMaxAttempts) {
+		jsonErr(ctx, http.StatusUnauthorized, "mfa challenge expired; log in again")
+		return
+	}
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	mu, err := loadMFAUser(ch.UserID)
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if !checkSecondFactor(mu, in.Code, in.RecoveryCode) {
+		_, _ = srv.DB.Exec("UPDATE "+mfaChallengesTable+" SET attempts=attempts+1 WHERE id=?", ch.ID)
+		GetServer().Limiter.RecordFailure(mu.Username, mu.ID, ctx.Input.IP(), ctx.Input.UserAgent(), "bad_mfa_code")
+		jsonErr(ctx, http.StatusUnauthorized, "invalid code")
+		return
+	}
+	_, _ = srv.DB.Exec("DELETE FROM "+mfaChallengesTable+" WHERE id=? OR expires_at <= UTC_TIMESTAMP()", ch.ID)
+
+	var u models.User
+	if err := srv.DB.Get(&u, "SELECT id, username, email, role, disabled_at, must_change_password FROM "+usersTable+
+		" WHERE id=? LIMIT 1", ch.UserID); err != nil || u.DisabledAt != nil {
+		jsonErr(ctx, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	completeLogin(ctx, u, true)
+}
+
+// ---- enrollment (authenticated) ----
+
+// POST /api/auth/mfa/enroll -> { secret, otpauth_uri }
+// Stores a pending secret; MFA is only switched on by /confirm.
+func AuthMFAEnroll(ctx *beegoctx.Context) {
+	u, err := loadMFAUser(currentUserID(ctx))
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if u.Enabled {
+		jsonErr(ctx, http.StatusConflict, "mfa already enabled")
+		return
+	}
+	secret := NewTOTPSecret()
+	if _, err := srv.DB.Exec("UPDATE "+usersTable+" SET totp_secret=?, totp_last_step=NULL WHERE id=?", secret, u.ID); err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	account := u.Email
+	if account == "" {
+		account = u.Username
+	}
+	jsonOK(ctx, map[string]interface{}{
+		"secret":      secret,
+		"otpauth_uri": TOTPURI(mfaIssuer(), account, secret),
+	})
+}
+
+// POST /api/auth/mfa/confirm { "code": "123456" } -> { recovery_codes, token }
+// Enables MFA and rotates the caller's session into an MFA-verified one.
+func AuthMFAConfirm(ctx *beegoctx.Context) {
+	var in struct {
+		Code string `json:"code"`
+	}
+	if err := readJSON(ctx, &in); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	u, err := loadMFAUser(currentUserID(ctx))
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if u.Enabled {
+		jsonErr(ctx, http.StatusConflict, "mfa already enabled")
+		return
+	}
+	if !u.Secret.Valid {
+		jsonErr(ctx, http.StatusBadRequest, "call /api/auth/mfa/enroll first")
+		return
+	}
+	if !checkSecondFactor(u, in.Code, "") {
+		jsonErr(ctx, http.StatusBadRequest, "invalid code")
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	if _, err := srv.DB.Exec("UPDATE "+usersTable+" SET totp_enabled=1, totp_recovery_codes=? WHERE id=?", hashes, u.ID); err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	logActivity(u.ID, "Enabled two-factor authentication")
+
+	sess := newSession(ctx, u.ID, u.Email, u.Role)
+	sess.MFA = true
+	sess, err = sessionPut(sess)
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	sessionDel(getToken(ctx))
+	setAuthCookie(ctx, sess)
+	jsonOK(ctx, map[string]interface{}{
+		"ok":             true,
+		"recovery_codes": codes,
+		"token":          sess.Token,
+		"exp":            sess.Exp.Unix(),
+	})
+}
+
+// POST /api/auth/mfa/recovery-codes { "code": "123456" } -> new codes, old ones stop working
+func AuthMFARecoveryCodes(ctx *beegoctx.Context) {
+	var in struct {
+		Code string `json:"code"`
+	}
+	if err := readJSON(ctx, &in); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	u, err := loadMFAUser(currentUserID(ctx))
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if !u.Enabled {
+		jsonErr(ctx, http.StatusBadRequest, "mfa not enabled")
+		return
+	}
+	if !checkSecondFactor(u, in.Code, "") {
+		jsonErr(ctx, http.StatusBadRequest, "invalid code")
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	if _, err := srv.DB.Exec("UPDATE "+usersTable+" SET totp_recovery_codes=? WHERE id=?", hashes, u.ID); err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	logActivity(u.ID, "Regenerated MFA recovery codes")
+	jsonOK(ctx, map[string]interface{}{"ok": true, "recovery_codes": codes})
+}
+
+// POST /api/auth/mfa/disable { "password": "...", "code": "123456" }
+func AuthMFADisable(ctx *beegoctx.Context) {
+	var in struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := readJSON(ctx, &in); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	u, err := loadMFAUser(currentUserID(ctx))
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if !u.Enabled {
+		jsonErr(ctx, http.StatusBadRequest, "mfa not enabled")
+		return
+	}
+	if roleRequiresMFA(u.Role) {
+		jsonErr(ctx, http.StatusConflict, "mfa is required for your role")
+		return
+	}
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(in.Password)) != nil || !checkSecondFactor(u, in.Code, "") {
+		jsonErr(ctx, http.StatusUnauthorized, "invalid password or code")
+		return
+	}
+	if err := clearMFA(u.ID); err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	logActivity(u.ID, "Disabled two-factor authentication")
+	jsonOK(ctx, map[string]interface{}{"ok": true})
+}
+
+func clearMFA(uid int64) error {
+	_, err := srv.DB.Exec("UPDATE "+usersTable+
+		" SET totp_enabled=0, totp_secret=NULL, totp_recovery_codes=NULL, totp_last_step=NULL WHERE id=?", uid)
+	return err
+}
+
+// POST /api/admin/users/:id/mfa/reset
+// For a lost phone: turns MFA off so the user can enroll again.
+func (c *AdminUserController) ResetMFA() {
+	id, ok := c.userID()
+	if !ok {
+		return
+	}
+	u, ok := c.load(id)
+	if !ok {
+		return
+	}
+	if err := clearMFA(id); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if _, err := GetServer().Sessions.DeleteByUser(id, 0); err != nil {
+		log.Printf("[mfa] reset revoke sessions user_id=%d: %v", id, err)
+	}
+	logActivity(currentUserID(c.Ctx), fmt.Sprintf("Reset two-factor authentication of user #%d %s", id, u.Username))
+	jsonOK(c.Ctx, map[string]interface{}{"ok": true})
+}
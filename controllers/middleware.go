@@ -3,6 +3,7 @@ package controllers
 import (
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	//"time"/
 
@@ -35,18 +36,42 @@ func getToken(ctx *beegoctx.Context) string {
 	return ""
 }
 
-// small helper to expose user id to handlers that read different keys
-func attachUser(ctx *beegoctx.Context, uid int64) {
+// small helper to expose user id/role to handlers that read different keys
+func attachUser(ctx *beegoctx.Context, uid int64, role string) {
 	ctx.Input.SetData("user_id", uid)
 	ctx.Input.SetData("userID", uid)
+	ctx.Input.SetData("user_role", NormalizeRole(role))
 }
 
-// Public (no auth): HTML/static, /api/healthz, /api/auth/*,
+// publicAPIPaths never require a session. Other /api/auth/* routes
+// (e.g. /api/auth/sessions) are self-service and need one.
+var publicAPIPaths = map[string]bool{
+	"/api/healthz":       true,
+	"/api/auth/login":    true,
+	"/api/auth/logout":   true,
+	"/api/auth/register": true,
+
+	"/api/auth/password/forgot": true,
+	"/api/auth/password/reset":  true,
+	"/api/auth/mfa/verify":      true,
+	"/api/auth/oidc/login":      true,
+	"/api/auth/oidc/callback":   true,
+}
+
+// passwordChangePaths are all a user whose password must be changed (an
+// admin reset it, or the bootstrap admin) may call; logout is public.
+var passwordChangePaths = map[string]bool{
+	"/api/auth/password/change": true,
+	"/api/auth/me":              true,
+}
+
+// Public (no auth): HTML/static, publicAPIPaths,
 //
-//	GET /api/items(/:id), /api/equipment-notes,
+//	GET /api/items(/:id), /api/items/:id/label.png, /api/equipment-notes,
 //	/api/instructions, /api/dashboard-stat
 //
-// Protected: everything else (POST/PUT/DELETE e.g. borrow/return/add item)
+// Protected: everything else (POST/PUT/DELETE e.g. borrow/return/add item),
+// then checked against the role policy table (see rbac.go / routers/router.go)
 func SessionAuthFilter(ctx *beegoctx.Context) {
 	path := ctx.Input.URL()
 	method := strings.ToUpper(ctx.Input.Method())
@@ -66,15 +91,15 @@ func SessionAuthFilter(ctx *beegoctx.Context) {
 	if !strings.HasPrefix(path, "/api/") {
 		return
 	}
-	// Auth endpoints & health: always public
-	if strings.HasPrefix(path, "/api/auth/") || path == "/api/healthz" {
+	// Login/register/logout & health: always public
+	if publicAPIPaths[path] {
 		return
 	}
 	// Read-only public GETs (dashboard works for guests)
 	if method == http.MethodGet {
 		switch {
 		case path == "/api/items",
-			strings.HasPrefix(path, "/api/items/"),
+			publicItemPath(path),
 			path == "/api/equipment-notes",
 			path == "/api/instructions",
 			path == "/api/dashboard-stat":
@@ -89,11 +114,36 @@ func SessionAuthFilter(ctx *beegoctx.Context) {
 		_ = ctx.Output.JSON(map[string]any{"ok": false, "error": "unauthorized"}, false, false)
 		return
 	}
+	if must, _ := ctx.Input.GetData("must_change_password").(bool); must && !passwordChangePaths[path] {
+		ctx.Output.SetStatus(http.StatusForbidden)
+		_ = ctx.Output.JSON(map[string]any{"ok": false, "error": "password_change_required"}, false, false)
+		return
+	}
+	authorize(ctx, method, path)
 }
 
-// Resolve user from token. Order:
-//  1. in-memory session (sessionGet)
-//  2. users table fallback: token/api_token/auth_token
+// publicItemPath reports whether a GET under /api/items/ is open to guests:
+// an item, its label and open-borrows (which checks the session itself).
+// Everything else there (export, units, stock, availability) needs a session
+// and a route policy.
+func publicItemPath(path string) bool {
+	rest, ok := strings.CutPrefix(path, "/api/items/")
+	if !ok {
+		return false
+	}
+	if rest == "open-borrows" {
+		return true
+	}
+	id, sub, _ := strings.Cut(rest, "/")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return false
+	}
+	return sub == "" || sub == "label.png"
+}
+
+// Resolve user from token: personal API tokens (imx_pat_...) from api_tokens,
+// anything else via the session store (sessionGet), which is DB-backed and
+// therefore survives server restarts.
 func validateAndAttachUser(ctx *beegoctx.Context) (int64, bool) {
 	tok := getToken(ctx)
 	if tok == "" {
@@ -101,43 +151,34 @@ func validateAndAttachUser(ctx *beegoctx.Context) (int64, bool) {
 		return 0, false
 	}
 
-	// 1) in-memory session
-	sess, ok := sessionGet(tok) // defined in login.go; returns your Session or nil
-	if ok && sess != nil {
-		switch s := sess.(type) {
-		case Session:
-			attachUser(ctx, s.UserID)
-			log.Printf("[AUTH] ok via session user_id=%d path=%s", s.UserID, ctx.Input.URL())
-			return s.UserID, true
-		case map[string]interface{}:
-			if v, ok := s["user_id"].(int64); ok && v > 0 {
-				attachUser(ctx, v)
-				log.Printf("[AUTH] ok via session(map) user_id=%d path=%s", v, ctx.Input.URL())
-				return v, true
-			}
-		}
+	if srv := GetServer(); srv == nil || srv.Sessions == nil {
+		log.Printf("[AUTH] 401 %s %s -> server/session store nil", ctx.Input.Method(), ctx.Input.URL())
+		return 0, false
 	}
 
-	// 2) DB fallback (works after server restarts)
-	srv := GetServer()
-	if srv == nil || srv.DB == nil {
-		log.Printf("[AUTH] 401 %s %s -> server/db nil", ctx.Input.Method(), ctx.Input.URL())
+	if strings.HasPrefix(tok, apiTokenPrefix) {
+		if t, ok := apiTokenGet(tok, ctx.Input.IP()); ok {
+			attachUser(ctx, t.UserID, t.Role)
+			ctx.Input.SetData("api_token_id", t.ID)
+			ctx.Input.SetData("api_token_scope", t.Scope)
+			ctx.Input.SetData("session_mfa", true) // creating a token required an MFA session
+			ctx.Input.SetData("must_change_password", t.MustChangePassword)
+			log.Printf("[AUTH] ok via api token id=%d user_id=%d path=%s", t.ID, t.UserID, ctx.Input.URL())
+			return t.UserID, true
+		}
+		log.Printf("[AUTH] 401 %s %s -> api token not found, revoked or expired", ctx.Input.Method(), ctx.Input.URL())
 		return 0, false
 	}
 
-	// If you only have one column (e.g. token), keep the first predicate and drop the ORs.
-	var uid int64
-	err := srv.DB.Get(&uid, `
-		SELECT id FROM `+usersTable+`
-		WHERE token = ? OR api_token = ? OR auth_token = ?
-		LIMIT 1
-	`, tok, tok, tok)
-	if err == nil && uid > 0 {
-		attachUser(ctx, uid)
-		log.Printf("[AUTH] ok via users table user_id=%d path=%s", uid, ctx.Input.URL())
-		return uid, true
+	if s, ok := sessionGet(tok); ok && s.UserID > 0 {
+		attachUser(ctx, s.UserID, s.Role)
+		ctx.Input.SetData("session_id", s.ID)
+		ctx.Input.SetData("session_mfa", s.MFA)
+		ctx.Input.SetData("must_change_password", s.MustChangePassword)
+		log.Printf("[AUTH] ok via session user_id=%d path=%s", s.UserID, ctx.Input.URL())
+		return s.UserID, true
 	}
 
-	log.Printf("[AUTH] 401 %s %s -> token not found in session/users", ctx.Input.Method(), ctx.Input.URL())
+	log.Printf("[AUTH] 401 %s %s -> session not found or expired", ctx.Input.Method(), ctx.Input.URL())
 	return 0, false
 }
@@ -0,0 +1,372 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Single sign-on with the university identity provider: OpenID Connect
+// authorization code flow with PKCE. A successful callback issues the same
+// imx_token session as a password login.
+
+const oidcLoginStatesTable = "oidc_login_states"
+
+// oidc_login_states holds the per-login secrets between the redirect to the
+// provider and its callback; rows are single-use.
+const oidcLoginStatesSchema = `
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+	id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	state_hash    CHAR(64)        NOT NULL,
+	nonce         VARCHAR(64)     NOT NULL,
+	code_verifier VARCHAR(128)    NOT NULL,
+	return_to     VARCHAR(512)    NULL,
+	created_at    DATETIME        NOT NULL,
+	expires_at    DATETIME        NOT NULL,
+	UNIQUE KEY uq_oidc_login_states_state_hash (state_hash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+const (
+	oidcStateTTL    = 10 * time.Minute
+	oidcStateCookie = "imx_oidc_state"
+)
+
+// OIDCConfig describes the relying party registration at the provider.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string // "openid" is always requested
+}
+
+// OIDCProvider wraps discovery, the code exchange and ID token verification.
+type OIDCProvider struct {
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCProvider runs discovery against cfg.Issuer.
+func NewOIDCProvider(ctx context.Context, cfg OIDCConfig) (*OIDCProvider, error) {
+	p, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	scopes := []string{oidc.ScopeOpenID}
+	for _, s := range cfg.Scopes {
+		if s != oidc.ScopeOpenID {
+			scopes = append(scopes, s)
+		}
+	}
+	return &OIDCProvider{
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     p.Endpoint(),
+			Scopes:       scopes,
+		},
+		verifier: p.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+// OIDCAuthRequest is the secret state of one login attempt.
+type OIDCAuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string // PKCE code_verifier
+}
+
+func NewOIDCAuthRequest() OIDCAuthRequest {
+	return OIDCAuthRequest{State: newToken(), Nonce: newToken(), Verifier: oauth2.GenerateVerifier()}
+}
+
+// AuthCodeURL is where the browser is sent to sign in.
+func (p *OIDCProvider) AuthCodeURL(r OIDCAuthRequest) string {
+	return p.oauth.AuthCodeURL(r.State, oidc.Nonce(r.Nonce), oauth2.S256ChallengeOption(r.Verifier))
+}
+
+// OIDCClaims are the ID token claims mapped onto local users.
+type OIDCClaims struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+	AMR               []string // authentication methods, e.g. ["pwd","mfa"]
+}
+
+// Exchange redeems code with the PKCE verifier and verifies the returned ID
+// token (signature, issuer, audience, expiry, nonce).
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, r OIDCAuthRequest) (OIDCClaims, error) {
+	tok, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(r.Verifier))
+	if err != nil {
+		return OIDCClaims{}, fmt.Errorf("oidc exchange: %w", err)
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return OIDCClaims{}, errors.New("oidc: token response has no id_token")
+	}
+	idt, err := p.verifier.Verify(ctx, raw)
+	if err != nil {
+		return OIDCClaims{}, fmt.Errorf("oidc verify: %w", err)
+	}
+	if idt.Nonce != r.Nonce {
+		return OIDCClaims{}, errors.New("oidc: nonce mismatch")
+	}
+	var c struct {
+		Email             string      `json:"email"`
+		EmailVerified     interface{} `json:"email_verified"` // some providers send "true"
+		Name              string      `json:"name"`
+		PreferredUsername string      `json:"preferred_username"`
+		UPN               string      `json:"upn"`
+		AMR               []string    `json:"amr"`
+	}
+	if err := idt.Claims(&c); err != nil {
+		return OIDCClaims{}, fmt.Errorf("oidc claims: %w", err)
+	}
+	email := strings.ToLower(strings.TrimSpace(firstNonEmpty(c.Email, c.UPN)))
+	return OIDCClaims{
+		Issuer:            idt.Issuer,
+		Subject:           idt.Subject,
+		Email:             email,
+		EmailVerified:     c.EmailVerified == true || c.EmailVerified == "true",
+		Name:              c.Name,
+		PreferredUsername: c.PreferredUsername,
+		AMR:               c.AMR,
+	}, nil
+}
+
+// ---- configuration ----
+
+func oidcConf(key string) string {
+	return firstNonEmpty(getConf(key), os.Getenv(key))
+}
+
+func oidcConfigFromConf() OIDCConfig {
+	return OIDCConfig{
+		Issuer:       oidcConf("OIDC_ISSUER"),
+		ClientID:     oidcConf("OIDC_CLIENT_ID"),
+		ClientSecret: oidcConf("OIDC_CLIENT_SECRET"),
+		RedirectURL:  firstNonEmpty(oidcConf("OIDC_REDIRECT_URL"), appBaseURL()+"/api/auth/oidc/callback"),
+		Scopes:       splitCSV(firstNonEmpty(oidcConf("OIDC_SCOPES"), "openid,email,profile")),
+	}
+}
+
+var oidcState struct {
+	sync.Mutex
+	p *OIDCProvider
+}
+
+var errOIDCDisabled = errors.New("oidc not configured")
+
+// oidcProvider discovers the provider on first use, so the API still starts
+// when the identity provider is unreachable.
+func oidcProvider() (*OIDCProvider, error) {
+	oidcState.Lock()
+	defer oidcState.Unlock()
+	if oidcState.p != nil {
+		return oidcState.p, nil
+	}
+	cfg := oidcConfigFromConf()
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errOIDCDisabled
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p, err := NewOIDCProvider(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	oidcState.p = p
+	return p, nil
+}
+
+// oidcEmailAllowed checks OIDC_ALLOWED_DOMAINS (comma-separated, empty = any).
+func oidcEmailAllowed(email string) bool {
+	domains := splitCSV(oidcConf("OIDC_ALLOWED_DOMAINS"))
+	if len(domains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	for _, d := range domains {
+		if strings.EqualFold(email[at+1:], strings.TrimPrefix(d, "@")) {
+			return true
+		}
+	}
+	return false
+}
+
+// safeReturnTo only allows same-origin paths, so the flow can't be used as an open redirect.
+func safeReturnTo(s string) string {
+	if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || strings.HasPrefix(s, "/\\") {
+		return "/dashboard"
+	}
+	return s
+}
+
+// ---- handlers ----
+
+// GET /api/auth/oidc/login?return_to=/dashboard
+func AuthOIDCLogin(ctx *beegoctx.Context) {
+	p, err := oidcProvider()
+	if errors.Is(err, errOIDCDisabled) {
+		jsonErr(ctx, http.StatusNotFound, "single sign-on is not enabled")
+		return
+	}
+	if err != nil {
+		log.Println("oidc provider error:", err)
+		jsonErr(ctx, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+
+	r := NewOIDCAuthRequest()
+	now := time.Now().UTC()
+	_, _ = srv.DB.Exec("DELETE FROM "+oidcLoginStatesTable+" WHERE expires_at < ?", now)
+	if _, err := srv.DB.Exec("INSERT INTO "+oidcLoginStatesTable+
+		" (state_hash, nonce, code_verifier, return_to, created_at, expires_at) VALUES (?,?,?,?,?,?)",
+		hashToken(r.State), r.Nonce, r.Verifier, safeReturnTo(ctx.Input.Query("return_to")), now, now.Add(oidcStateTTL)); err != nil {
+		log.Println("oidc state insert error:", err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	// Binds the callback to this browser (login CSRF). Lax, because the
+	// callback is a top-level navigation coming back from the provider.
+	http.SetCookie(ctx.ResponseWriter, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    r.State,
+		Path:     "/api/auth/oidc",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  now.Add(oidcStateTTL),
+	})
+	ctx.Redirect(http.StatusFound, p.AuthCodeURL(r))
+}
+
+// GET /api/auth/oidc/callback?code=...&state=...
+// Always ends in a redirect back to the SPA: the return_to path on success,
+// /login?sso_error=... otherwise.
+func AuthOIDCCallback(ctx *beegoctx.Context) {
+	fail := func(code string) {
+		ctx.Redirect(http.StatusFound, "/login?sso_error="+url.QueryEscape(code))
+	}
+	http.SetCookie(ctx.ResponseWriter, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/api/auth/oidc", MaxAge: -1, HttpOnly: true, Secure: true})
+
+	if e := ctx.Input.Query("error"); e != "" {
+		log.Printf("oidc provider returned error=%s: %s", e, ctx.Input.Query("error_description"))
+		fail("provider_error")
+		return
+	}
+	state, code := ctx.Input.Query("state"), ctx.Input.Query("code")
+	c, _ := ctx.Request.Cookie(oidcStateCookie)
+	if state == "" || code == "" || c == nil || c.Value != state {
+		fail("invalid_state")
+		return
+	}
+
+	var st struct {
+		ID       int64          `db:"id"`
+		Nonce    string         `db:"nonce"`
+		Verifier string         `db:"code_verifier"`
+		ReturnTo sql.NullString `db:"return_to"`
+	}
+	err := srv.DB.Get(&st, "SELECT id, nonce, code_verifier, return_to FROM "+oidcLoginStatesTable+
+		" WHERE state_hash=? AND expires_at > UTC_TIMESTAMP() LIMIT 1", hashToken(state))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("oidc state lookup error:", err)
+		}
+		fail("invalid_state")
+		return
+	}
+	if res, err := srv.DB.Exec("DELETE FROM "+oidcLoginStatesTable+" WHERE id=?", st.ID); err != nil {
+		fail("server_error")
+		return
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		fail("invalid_state") // consumed by a concurrent callback
+		return
+	}
+
+	p, err := oidcProvider()
+	if err != nil {
+		log.Println("oidc provider error:", err)
+		fail("provider_unavailable")
+		return
+	}
+	claims, err := p.Exchange(ctx.Request.Context(), code, OIDCAuthRequest{State: state, Nonce: st.Nonce, Verifier: st.Verifier})
+	if err != nil {
+		log.Println("oidc callback:", err)
+		fail("invalid_token")
+		return
+	}
+	if claims.Email == "" || !oidcEmailAllowed(claims.Email) {
+		fail("domain_not_allowed")
+		return
+	}
+
+	u, err := resolveExternalUser(externalIdentity{
+		Provider:      "oidc",
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified || oidcConf("OIDC_TRUST_EMAIL") == "true",
+		Username:      firstNonEmpty(claims.PreferredUsername, claims.Email),
+		FullName:      claims.Name,
+	}, NormalizeRole(firstNonEmpty(oidcConf("OIDC_DEFAULT_ROLE"), RoleStudent)), oidcConf("OIDC_AUTO_PROVISION") != "false")
+	if errors.Is(err, errAccountDisabled) {
+		fail("account_disabled")
+		return
+	}
+	if err != nil {
+		log.Println("oidc resolve user:", err)
+		fail("no_account")
+		return
+	}
+
+	// The provider's own MFA counts as our second factor.
+	mfa := false
+	for _, m := range claims.AMR {
+		if m == "mfa" || m == "otp" {
+			mfa = true
+		}
+	}
+	if u.TOTPEnabled && !mfa {
+		token, _, err := newMFAChallenge(u.ID)
+		if err != nil {
+			fail("server_error")
+			return
+		}
+		// fragment, so the challenge token stays out of access logs
+		ctx.Redirect(http.StatusFound, "/login#mfa_token="+token)
+		return
+	}
+
+	sess := newSession(ctx, int64(u.ID), u.Email, u.Role)
+	sess.MFA = mfa
+	sess, err = sessionPut(sess)
+	if err != nil {
+		log.Println("oidc session error:", err)
+		fail("server_error")
+		return
+	}
+	setAuthCookie(ctx, sess)
+	logActivity(int64(u.ID), "Signed in via single sign-on")
+	ctx.Redirect(http.StatusFound, safeReturnTo(st.ReturnTo.String))
+}
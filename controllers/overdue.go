@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+	"github.com/jmoiron/sqlx"
+)
+
+// Overdue loans: a loan is overdue from the day after its return_date until
+// it is back. A background job marks open loans past their due date as
+// overdue and writes an activity entry for each, and puts loans whose due
+// date moved into the future back to borrowed. Several app instances may
+// run it; a lease row in job_leases lets only one of them do the work at a
+// time, and takes over from an instance that stopped renewing it.
+
+const jobLeasesSchema = `
+CREATE TABLE IF NOT EXISTS job_leases (
+	name       VARCHAR(64)  NOT NULL PRIMARY KEY,
+	holder     VARCHAR(128) NOT NULL,
+	expires_at DATETIME     NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// leaseHolder names this process in job_leases.
+var leaseHolder = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), newToken()[:8])
+}()
+
+// acquireLease takes the lease on job for ttl, or renews it if this process
+// holds it already. It is false while another live instance holds it.
+func acquireLease(db *sqlx.DB, job string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	if _, err := db.Exec(`INSERT IGNORE INTO job_leases (name, holder, expires_at) VALUES (?,?,?)`, job, "", now); err != nil {
+		return false, err
+	}
+	if _, err := db.Exec(`UPDATE job_leases SET holder=?, expires_at=? WHERE name=? AND (holder=? OR expires_at <= ?)`,
+		leaseHolder, now.Add(ttl), job, leaseHolder, now); err != nil {
+		return false, err
+	}
+	var holder string
+	if err := db.Get(&holder, `SELECT holder FROM job_leases WHERE name=?`, job); err != nil {
+		return false, err
+	}
+	return holder == leaseHolder, nil
+}
+
+// DaysOverdue is how many days past due a loan due on due is at now; 0
+// until the due date is over.
+func DaysOverdue(due, now time.Time) int {
+	d := time.Date(due.Year(), due.Month(), due.Day(), 0, 0, 0, 0, time.UTC)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !today.After(d) {
+		return 0
+	}
+	return int(today.Sub(d).Hours() / 24)
+}
+
+type overdueRow struct {
+	ID          int64     `db:"id"          json:"id"`
+	ItemID      int64     `db:"item_id"     json:"item_id"`
+	SKU         string    `db:"sku"         json:"sku"`
+	ItemName    string    `db:"item_name"   json:"item_name"`
+	Category    string    `db:"category"    json:"category"`
+	UserID      int64     `db:"user_id"     json:"user_id"`
+	UserName    *string   `db:"user_name"   json:"user_name"`
+	Email       *string   `db:"email"       json:"email"`
+	Quantity    int       `db:"quantity"    json:"quantity"` // still out
+	BorrowDate  time.Time `db:"borrow_date" json:"borrow_date"`
+	ReturnDate  time.Time `db:"return_date" json:"return_date"`
+	Status      string    `db:"status"      json:"status"`
+	Renewals    int       `db:"renewals"    json:"renewals"`
+	DaysOverdue int       `db:"-"           json:"days_overdue"`
+}
+
+// overdueSelect picks open loans due before the date given as its argument,
+// whether or not the job has marked them yet.
+const overdueSelect = `SELECT br.id, br.item_id, e.sku, e.name AS item_name, e.category, br.user_id,
+	u.full_name AS user_name, u.email, br.quantity - br.quantity_returned AS quantity,
+	br.borrow_date, br.return_date, br.status, br.renewals
+	FROM log_lab_borrow_records br
+	JOIN log_lab_equipment_master e ON e.id = br.item_id
+	LEFT JOIN users u ON u.id = br.user_id
+	WHERE br.actual_return_date IS NULL AND br.status IN ('` + BorrowBorrowed + `','` + BorrowOverdue + `')
+	  AND br.return_date IS NOT NULL AND br.return_date < ?`
+
+// GET /api/borrows/overdue?user_id=&item_id=&category=
+// Open loans past their due date, longest overdue first. Without
+// borrow.approve the caller sees only their own.
+func OverdueBorrows(ctx *beegoctx.Context) {
+	now := time.Now().UTC()
+	where := ""
+	args := []interface{}{now.Truncate(24 * time.Hour)}
+	for _, f := range []string{"user_id", "item_id"} {
+		if v := strings.TrimSpace(ctx.Input.Query(f)); v != "" {
+			id, err := parseInt64(v)
+			if err != nil || id <= 0 {
+				jsonErr(ctx, http.StatusBadRequest, "invalid "+f)
+				return
+			}
+			where += ` AND br.` + f + `=?`
+			args = append(args, id)
+		}
+	}
+	if v := strings.TrimSpace(ctx.Input.Query("category")); v != "" {
+		where += ` AND e.category=?`
+		args = append(args, v)
+	}
+	if !RoleAllows(currentRole(ctx), PermBorrowApprove) {
+		where += ` AND br.user_id=?`
+		args = append(args, currentUserID(ctx))
+	}
+	rows := make([]overdueRow, 0)
+	if err := srv.DB.Select(&rows, overdueSelect+where+` ORDER BY br.return_date, br.id LIMIT 1000`, args...); err != nil {
+		log.Printf("[overdue] list: %v", err)
+		jsonErr(ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	for i := range rows {
+		rows[i].DaysOverdue = DaysOverdue(rows[i].ReturnDate, now)
+	}
+	jsonOK(ctx, rows)
+}
+
+// watchOverdue runs checkOverdue every interval; see OVERDUE_CHECK_MINUTES
+// in conf/app.conf. The lease outlives two runs, so another instance takes
+// over within two intervals of this one stopping.
+func watchOverdue(s *Server, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		ok, err := acquireLease(s.DB, "overdue", 2*every)
+		if err != nil {
+			log.Printf("[overdue] lease: %v", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := checkOverdue(s.DB); err != nil {
+			log.Printf("[overdue] check: %v", err)
+		}
+	}
+}
+
+// checkOverdue moves loans between borrowed and overdue. Each change is a
+// conditional UPDATE, so a run that overlaps another (a lease that expired
+// mid-run) neither reports a loan twice nor undoes a return.
+func checkOverdue(db *sqlx.DB) error {
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	if _, err := db.Exec(`UPDATE log_lab_borrow_records SET status=?
+		WHERE status=? AND actual_return_date IS NULL AND (return_date IS NULL OR return_date >= ?)`,
+		BorrowBorrowed, BorrowOverdue, today); err != nil {
+		return err
+	}
+	var rows []overdueRow
+	if err := db.Select(&rows, overdueSelect+` AND br.status=? ORDER BY br.id`, today, BorrowBorrowed); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		res, err := db.Exec(`UPDATE log_lab_borrow_records SET status=? WHERE id=? AND status=? AND actual_return_date IS NULL`,
+			BorrowOverdue, r.ID, BorrowBorrowed)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		logActivity(0, fmt.Sprintf("Overdue: borrow #%d of %s (%s) x%d by %s was due %s",
+			r.ID, r.ItemName, r.SKU, r.Quantity, firstNonEmpty(strVal(r.UserName), fmt.Sprintf("user #%d", r.UserID)),
+			r.ReturnDate.Format("2006-01-02")))
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetsTable = "password_resets"
+
+const passwordResetsSchema = `
+CREATE TABLE IF NOT EXISTS password_resets (
+	id         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id    BIGINT UNSIGNED NOT NULL,
+	token_hash CHAR(64)        NOT NULL,
+	created_at DATETIME        NOT NULL,
+	expires_at DATETIME        NOT NULL,
+	used_at    DATETIME        NULL,
+	ip         VARCHAR(64)     NULL,
+	UNIQUE KEY uq_password_resets_token_hash (token_hash),
+	KEY idx_password_resets_user (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// a new reset mail is not sent again for the same user within this window
+const passwordResetResendAfter = time.Minute
+
+func passwordResetTTL() time.Duration {
+	return time.Duration(int64FromConf("PASSWORD_RESET_TTL_MINUTES", 60)) * time.Minute
+}
+
+func appBaseURL() string {
+	return strings.TrimRight(firstNonEmpty(getConf("APP_BASE_URL"), os.Getenv("APP_BASE_URL"), "http://localhost:8020"), "/")
+}
+
+func validatePassword(pw string) string {
+	if len(pw) < 8 {
+		return "password must be at least 8 characters"
+	}
+	return ""
+}
+
+// POST /api/auth/password/forgot  { "identifier": "email or username" }
+// Always answers 200 so the endpoint cannot be used to discover accounts.
+func AuthPasswordForgot(ctx *beegoctx.Context) {
+	var in struct {
+		Identifier string `json:"identifier"`
+		Email      string `json:"email"`
+	}
+	if err := readJSON(ctx, &in); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	id := strings.TrimSpace(firstNonEmpty(in.Identifier, in.Email))
+	if id == "" {
+		jsonErr(ctx, http.StatusBadRequest, "missing identifier")
+		return
+	}
+	done := func() {
+		jsonOK(ctx, map[string]interface{}{"ok": true, "message": "if the account exists, a reset link has been sent"})
+	}
+
+	var u struct {
+		ID       int64  `db:"id"`
+		Email    string `db:"email"`
+		FullName string `db:"full_name"`
+	}
+	err := srv.DB.Get(&u, "SELECT id, email, full_name FROM "+usersTable+
+		" WHERE (email = ? OR username = ?) AND disabled_at IS NULL LIMIT 1", id, id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("[password] forgot lookup: %v", err)
+		}
+		done()
+		return
+	}
+
+	var recent int
+	if err := srv.DB.Get(&recent, "SELECT COUNT(1) FROM "+passwordResetsTable+
+		" WHERE user_id=? AND used_at IS NULL AND created_at > ?", u.ID, time.Now().UTC().Add(-passwordResetResendAfter)); err == nil && recent > 0 {
+		done()
+		return
+	}
+
+	token := newToken()
+	now := time.Now().UTC()
+	ttl := passwordResetTTL()
+	if _, err := srv.DB.Exec("INSERT INTO "+passwordResetsTable+
+		" (user_id, token_hash, created_at, expires_at, ip) VALUES (?,?,?,?,?)",
+		u.ID, hashToken(token), now, now.Add(ttl), nullableStr(ctx.Input.IP())); err != nil {
+		log.Printf("[password] forgot insert: %v", err)
+		done()
+		return
+	}
+
+	link := appBaseURL() + "/reset-password?token=" + token
+	body := fmt.Sprintf("Xin chào %s,\n\n"+
+		"Chúng tôi nhận được yêu cầu đặt lại mật khẩu cho tài khoản của bạn.\n"+
+		"We received a request to reset your password.\n\n"+
+		"%s\n\n"+
+		"Liên kết hết hạn sau %d phút và chỉ dùng được một lần. / The link expires in %d minutes and works once.\n"+
+		"Nếu bạn không yêu cầu, hãy bỏ qua email này. / If this wasn't you, ignore this e-mail.\n",
+		u.FullName, link, int(ttl.Minutes()), int(ttl.Minutes()))
+	if err := GetServer().Mailer.Send(u.Email, "Đặt lại mật khẩu / Password reset", body); err != nil {
+		log.Printf("[password] send reset mail user_id=%d: %v", u.ID, err)
+	}
+	done()
+}
+
+// POST /api/auth/password/reset  { "token": "...", "password": "..." }
+// Tokens are single-use; a successful reset signs the user out everywhere.
+func AuthPasswordReset(ctx *beegoctx.Context) {
+	var in struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := readJSON(ctx, &in); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	in.Token = strings.TrimSpace(in.Token)
+	if in.Token == "" {
+		jsonErr(ctx, http.StatusBadRequest, "missing token")
+		return
+	}
+	if msg := validatePassword(in.Password); msg != "" {
+		jsonErr(ctx, http.StatusBadRequest, msg)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(in.Password), bcrypt.DefaultCost)
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var r struct {
+		ID     int64 `db:"id"`
+		UserID int64 `db:"user_id"`
+	}
+	err = tx.Get(&r, "SELECT id, user_id FROM "+passwordResetsTable+
+		" WHERE token_hash=? AND used_at IS NULL AND expires_at > UTC_TIMESTAMP() FOR UPDATE", hashToken(in.Token))
+	if errors.Is(err, sql.ErrNoRows) {
+		jsonErr(ctx, http.StatusBadRequest, "invalid or expired token")
+		return
+	}
+	if err != nil {
+		log.Printf("[password] reset lookup: %v", err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if _, err := tx.Exec("UPDATE "+usersTable+" SET password_hash=?, must_change_password=0 WHERE id=?", string(hash), r.UserID); err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	// burn this token and any other outstanding ones for the user
+	if _, err := tx.Exec("UPDATE "+passwordResetsTable+" SET used_at=UTC_TIMESTAMP() WHERE user_id=? AND used_at IS NULL", r.UserID); err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if _, err := GetServer().Sessions.DeleteByUser(r.UserID, 0); err != nil {
+		log.Printf("[password] reset revoke sessions user_id=%d: %v", r.UserID, err)
+	}
+	logActivity(r.UserID, "Password reset via e-mail link")
+	jsonOK(ctx, map[string]interface{}{"ok": true})
+}
+
+// POST /api/auth/password/change  { "current_password": "...", "new_password": "..." }
+// Other sessions are signed out; the calling session stays valid.
+func AuthPasswordChange(ctx *beegoctx.Context) {
+	var in struct {
+		Current string `json:"current_password"`
+		New     string `json:"new_password"`
+	}
+	if err := readJSON(ctx, &in); err != nil {
+		jsonErr(ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if msg := validatePassword(in.New); msg != "" {
+		jsonErr(ctx, http.StatusBadRequest, msg)
+		return
+	}
+	if in.New == in.Current {
+		jsonErr(ctx, http.StatusBadRequest, "new password must differ from the current one")
+		return
+	}
+
+	uid := currentUserID(ctx)
+	var current []byte
+	if err := srv.DB.Get(&current, "SELECT password_hash FROM "+usersTable+" WHERE id=? LIMIT 1", uid); err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword(current, []byte(in.Current)); err != nil {
+		jsonErr(ctx, http.StatusUnauthorized, "current password is incorrect")
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(in.New), bcrypt.DefaultCost)
+	if err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if _, err := srv.DB.Exec("UPDATE "+usersTable+" SET password_hash=?, must_change_password=0 WHERE id=?", string(hash), uid); err != nil {
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if _, err := GetServer().Sessions.DeleteByUser(uid, currentSessionID(ctx)); err != nil {
+		log.Printf("[password] change revoke sessions user_id=%d: %v", uid, err)
+	}
+	logActivity(uid, "Changed password")
+	jsonOK(ctx, map[string]interface{}{"ok": true})
+}
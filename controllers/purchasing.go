@@ -0,0 +1,744 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+
+	"vlu_infrastructure_management/models"
+)
+
+// Purchasing replaces the paper requests filed when stock runs low:
+//
+//	requested -> approved -> ordered -> partially_received -> received
+//	    |            \           \              \
+//	    |             \-----------\--------------\--> cancelled
+//	    \--> rejected
+//
+// A request lists lines for existing items or for items the lab does not
+// stock yet. A manager other than the requester approves it. Goods
+// receipts add the delivered quantity to the item, through the
+// stock_movements ledger, and create the items that did not exist, with
+// date_purchased set to the day of delivery.
+
+const purchaseRequestsSchema = `
+CREATE TABLE IF NOT EXISTS purchase_requests (
+	id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	status        VARCHAR(20)     NOT NULL DEFAULT 'requested',
+	supplier      VARCHAR(255)    NOT NULL DEFAULT '',
+	order_ref     VARCHAR(100)    NULL,
+	note          VARCHAR(255)    NULL,
+	requested_by  BIGINT UNSIGNED NULL,
+	requested_at  DATETIME        NOT NULL,
+	decided_by    BIGINT UNSIGNED NULL,
+	decided_at    DATETIME        NULL,
+	decision_note VARCHAR(255)    NULL,
+	ordered_by    BIGINT UNSIGNED NULL,
+	ordered_at    DATETIME        NULL,
+	received_at   DATETIME        NULL,
+	cancelled_by  BIGINT UNSIGNED NULL,
+	cancelled_at  DATETIME        NULL,
+	cancel_reason VARCHAR(255)    NULL,
+	KEY idx_purchase_requests_status (status, requested_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// purchase_request_lines: item_id is NULL until a line for a new item is
+// first received.
+const purchaseRequestLinesSchema = `
+CREATE TABLE IF NOT EXISTS purchase_request_lines (
+	id           BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	request_id   BIGINT UNSIGNED NOT NULL,
+	item_id      BIGINT UNSIGNED NULL,
+	sku          VARCHAR(100)    NOT NULL DEFAULT '',
+	name         VARCHAR(255)    NOT NULL,
+	category     VARCHAR(100)    NOT NULL DEFAULT '',
+	item_type    VARCHAR(16)     NOT NULL DEFAULT 'durable',
+	location     VARCHAR(255)    NULL,
+	quantity     INT             NOT NULL,
+	unit_cost    DECIMAL(15,2)   NULL,
+	received_qty INT             NOT NULL DEFAULT 0,
+	KEY idx_purchase_request_lines_request (request_id),
+	KEY idx_purchase_request_lines_item (item_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// purchase_receipts has one row per line per delivery.
+const purchaseReceiptsSchema = `
+CREATE TABLE IF NOT EXISTS purchase_receipts (
+	id          BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	request_id  BIGINT UNSIGNED NOT NULL,
+	line_id     BIGINT UNSIGNED NOT NULL,
+	item_id     BIGINT UNSIGNED NOT NULL,
+	quantity    INT             NOT NULL,
+	unit_cost   DECIMAL(15,2)   NULL,
+	location    VARCHAR(255)    NULL,
+	note        VARCHAR(255)    NULL,
+	received_by BIGINT UNSIGNED NULL,
+	received_on DATE            NOT NULL,
+	created_at  DATETIME        NOT NULL,
+	KEY idx_purchase_receipts_request (request_id),
+	KEY idx_purchase_receipts_item (item_id, received_on)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// Purchase request statuses.
+const (
+	PurchaseRequested = "requested"
+	PurchaseApproved  = "approved"
+	PurchaseRejected  = "rejected"
+	PurchaseOrdered   = "ordered"
+	PurchasePartial   = "partially_received"
+	PurchaseReceived  = "received"
+	PurchaseCancelled = "cancelled"
+)
+
+// PurchaseNext reports whether a purchase request in status from may move
+// to status to. Cancelling a partly received order closes what is left.
+func PurchaseNext(from, to string) bool {
+	switch to {
+	case PurchaseApproved, PurchaseRejected:
+		return from == PurchaseRequested
+	case PurchaseOrdered:
+		return from == PurchaseApproved
+	case PurchasePartial, PurchaseReceived:
+		return from == PurchaseOrdered || from == PurchasePartial
+	case PurchaseCancelled:
+		return from == PurchaseRequested || from == PurchaseApproved || from == PurchaseOrdered || from == PurchasePartial
+	}
+	return false
+}
+
+type purchaseRow struct {
+	ID             int64      `db:"id"              json:"id"`
+	Status         string     `db:"status"          json:"status"`
+	Supplier       string     `db:"supplier"        json:"supplier"`
+	OrderRef       *string    `db:"order_ref"       json:"order_ref"`
+	Note           *string    `db:"note"            json:"note"`
+	RequestedBy    *int64     `db:"requested_by"    json:"requested_by"`
+	RequestedAt    time.Time  `db:"requested_at"    json:"requested_at"`
+	DecidedBy      *int64     `db:"decided_by"      json:"decided_by"`
+	DecidedAt      *time.Time `db:"decided_at"      json:"decided_at"`
+	DecisionNote   *string    `db:"decision_note"   json:"decision_note"`
+	OrderedBy      *int64     `db:"ordered_by"      json:"ordered_by"`
+	OrderedAt      *time.Time `db:"ordered_at"      json:"ordered_at"`
+	ReceivedAt     *time.Time `db:"received_at"     json:"received_at"`
+	CancelledBy    *int64     `db:"cancelled_by"    json:"cancelled_by"`
+	CancelledAt    *time.Time `db:"cancelled_at"    json:"cancelled_at"`
+	CancelReason   *string    `db:"cancel_reason"   json:"cancel_reason"`
+	EstimatedTotal float64    `db:"estimated_total" json:"estimated_total"`
+}
+
+const purchaseSelect = `SELECT p.id, p.status, p.supplier, p.order_ref, p.note, p.requested_by, p.requested_at,
+	p.decided_by, p.decided_at, p.decision_note, p.ordered_by, p.ordered_at, p.received_at,
+	p.cancelled_by, p.cancelled_at, p.cancel_reason,
+	(SELECT COALESCE(SUM(l.quantity*l.unit_cost),0) FROM purchase_request_lines l WHERE l.request_id = p.id) AS estimated_total
+	FROM purchase_requests p`
+
+type purchaseLine struct {
+	ID          int64    `db:"id"           json:"id"`
+	RequestID   int64    `db:"request_id"   json:"request_id"`
+	ItemID      *int64   `db:"item_id"      json:"item_id"`
+	SKU         string   `db:"sku"          json:"sku"`
+	Name        string   `db:"name"         json:"name"`
+	Category    string   `db:"category"     json:"category"`
+	ItemType    string   `db:"item_type"    json:"item_type"`
+	Location    *string  `db:"location"     json:"location"`
+	Quantity    int      `db:"quantity"     json:"quantity"`
+	UnitCost    *float64 `db:"unit_cost"    json:"unit_cost"`
+	ReceivedQty int      `db:"received_qty" json:"received_qty"`
+}
+
+const purchaseLineSelect = `SELECT id, request_id, item_id, sku, name, category, item_type, location,
+	quantity, unit_cost, received_qty FROM purchase_request_lines`
+
+type purchaseReceipt struct {
+	ID         int64     `db:"id"          json:"id"`
+	LineID     int64     `db:"line_id"     json:"line_id"`
+	ItemID     int64     `db:"item_id"     json:"item_id"`
+	Quantity   int       `db:"quantity"    json:"quantity"`
+	UnitCost   *float64  `db:"unit_cost"   json:"unit_cost"`
+	Location   *string   `db:"location"    json:"location"`
+	Note       *string   `db:"note"        json:"note"`
+	ReceivedBy *int64    `db:"received_by" json:"received_by"`
+	ReceivedOn time.Time `db:"received_on" json:"received_on"`
+	CreatedAt  time.Time `db:"created_at"  json:"created_at"`
+}
+
+// PurchaseController serves /api/purchase-requests.
+type PurchaseController struct{ web.Controller }
+
+func (c *PurchaseController) requestID() (int64, bool) {
+	id, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+	}
+	return id, ok
+}
+
+func (c *PurchaseController) loadRequest(q sqlGetter, id int64, lock bool) (purchaseRow, bool) {
+	var p purchaseRow
+	sqlStr := purchaseSelect + ` WHERE p.id=? LIMIT 1`
+	if lock {
+		sqlStr += ` FOR UPDATE`
+	}
+	if err := q.Get(&p, sqlStr, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "purchase request not found")
+		} else {
+			log.Printf("[purchasing] load id=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return p, false
+	}
+	return p, true
+}
+
+// GET /api/purchase-requests?status=ordered&item_id=&supplier=
+func (c *PurchaseController) List() {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	if s := strings.TrimSpace(c.GetString("status")); s != "" {
+		where += ` AND p.status=?`
+		args = append(args, s)
+	}
+	if s := strings.TrimSpace(c.GetString("supplier")); s != "" {
+		where += ` AND p.supplier LIKE ?`
+		args = append(args, "%"+s+"%")
+	}
+	if id, err := c.GetInt64("item_id"); err == nil && id > 0 {
+		where += ` AND EXISTS (SELECT 1 FROM purchase_request_lines l WHERE l.request_id = p.id AND l.item_id=?)`
+		args = append(args, id)
+	}
+	out := make([]purchaseRow, 0)
+	if err := srv.DB.Select(&out, purchaseSelect+where+` ORDER BY p.id DESC LIMIT 500`, args...); err != nil {
+		log.Printf("[purchasing] list: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, out)
+}
+
+// GET /api/purchase-requests/:id
+// The request with its lines and receipts.
+func (c *PurchaseController) Get() {
+	id, ok := c.requestID()
+	if !ok {
+		return
+	}
+	c.respond(id)
+}
+
+func (c *PurchaseController) respond(id int64) {
+	p, ok := c.loadRequest(srv.DB, id, false)
+	if !ok {
+		return
+	}
+	lines := make([]purchaseLine, 0)
+	receipts := make([]purchaseReceipt, 0)
+	err := srv.DB.Select(&lines, purchaseLineSelect+` WHERE request_id=? ORDER BY id`, id)
+	if err == nil {
+		err = srv.DB.Select(&receipts, `SELECT id, line_id, item_id, quantity, unit_cost, location, note, received_by, received_on, created_at
+			FROM purchase_receipts WHERE request_id=? ORDER BY id`, id)
+	}
+	if err != nil {
+		log.Printf("[purchasing] get id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, map[string]interface{}{"request": p, "lines": lines, "receipts": receipts})
+}
+
+type purchaseLineIn struct {
+	ItemID   int64    `json:"item_id"`
+	SKU      string   `json:"sku"`
+	Name     string   `json:"name"`
+	Category string   `json:"category"`
+	ItemType string   `json:"item_type"`
+	Location string   `json:"location"`
+	Quantity int      `json:"quantity"`
+	UnitCost *float64 `json:"unit_cost"`
+}
+
+// POST /api/purchase-requests
+//
+//	{"supplier": "Hshop", "note": "filament for the capstone term",
+//	 "lines": [{"item_id": 12, "quantity": 20, "unit_cost": 350000},
+//	           {"sku": "ESP32-S3", "name": "ESP32-S3 DevKit", "category": "Electronics",
+//	            "item_type": "durable", "location": "Store room", "quantity": 10, "unit_cost": 180000}]}
+//
+// A line names an existing item by item_id (or its sku), or describes a new
+// one by name. unit_cost is the estimate; it defaults to the item's.
+func (c *PurchaseController) Create() {
+	var in struct {
+		Supplier string           `json:"supplier"`
+		Note     string           `json:"note"`
+		Lines    []purchaseLineIn `json:"lines"`
+	}
+	if err := readJSON(c.Ctx, &in); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	in.Supplier, in.Note = strings.TrimSpace(in.Supplier), strings.TrimSpace(in.Note)
+	switch {
+	case len(in.Lines) == 0:
+		jsonErr(c.Ctx, http.StatusBadRequest, "at least one line is required")
+		return
+	case len(in.Lines) > 200:
+		jsonErr(c.Ctx, http.StatusBadRequest, "at most 200 lines per request")
+		return
+	case len(in.Supplier) > 255:
+		jsonErr(c.Ctx, http.StatusBadRequest, "supplier is too long")
+		return
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	lines := make([]purchaseLine, 0, len(in.Lines))
+	for i, l := range in.Lines {
+		line, msg, err := purchaseLineFrom(tx, l)
+		if err != nil {
+			log.Printf("[purchasing] line %d: %v", i+1, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+			return
+		}
+		if msg != "" {
+			jsonErr(c.Ctx, http.StatusBadRequest, fmt.Sprintf("line %d: %s", i+1, msg))
+			return
+		}
+		lines = append(lines, line)
+	}
+	uid := currentUserID(c.Ctx)
+	res, err := tx.Exec(`INSERT INTO purchase_requests (status, supplier, note, requested_by, requested_at) VALUES (?,?,?,?,?)`,
+		PurchaseRequested, in.Supplier, nullableStr(truncate(in.Note, 255)), uid, time.Now().UTC())
+	if err != nil {
+		log.Printf("[purchasing] create: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "insert error")
+		return
+	}
+	id, _ := res.LastInsertId()
+	for _, l := range lines {
+		if _, err := tx.Exec(`INSERT INTO purchase_request_lines (request_id, item_id, sku, name, category, item_type, location, quantity, unit_cost)
+			VALUES (?,?,?,?,?,?,?,?,?)`, id, l.ItemID, l.SKU, l.Name, l.Category, l.ItemType, l.Location, l.Quantity, l.UnitCost); err != nil {
+			log.Printf("[purchasing] create line: %v", err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "insert error")
+			return
+		}
+	}
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Requested purchase #%d: %d line(s) from %s", id, len(lines), firstNonEmpty(in.Supplier, "unspecified supplier")))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	c.Ctx.Output.SetStatus(http.StatusCreated)
+	c.respond(id)
+}
+
+// purchaseLineFrom checks one requested line and fills it in from the item
+// it names; msg is the client error.
+func purchaseLineFrom(q sqlGetter, in purchaseLineIn) (line purchaseLine, msg string, err error) {
+	in.SKU, in.Name, in.Category = strings.TrimSpace(in.SKU), strings.TrimSpace(in.Name), strings.TrimSpace(in.Category)
+	switch {
+	case in.Quantity <= 0:
+		return line, "quantity must be > 0", nil
+	case in.UnitCost != nil && *in.UnitCost < 0:
+		return line, "unit_cost must be >= 0", nil
+	case len(in.SKU) > 100 || len(in.Name) > 255 || len(in.Category) > 100:
+		return line, "sku, name or category is too long", nil
+	}
+	line.Quantity, line.UnitCost = in.Quantity, in.UnitCost
+	if loc := normalizeLocation(in.Location); loc != "" {
+		if isInTransit(loc) {
+			return line, fmt.Sprintf("%q is not a location goods can be received at", inTransitLocation), nil
+		}
+		line.Location = &loc
+	}
+
+	var item itemRow
+	switch {
+	case in.ItemID > 0:
+		err = q.Get(&item, `SELECT `+itemSelectCols+` FROM log_lab_equipment_master WHERE id=?`, in.ItemID)
+	case in.SKU != "":
+		err = q.Get(&item, `SELECT `+itemSelectCols+` FROM log_lab_equipment_master WHERE sku=? LIMIT 1`, in.SKU)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil // a new item with its sku chosen up front
+		}
+	}
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return line, fmt.Sprintf("item %d not found", in.ItemID), nil
+	case err != nil:
+		return line, "", err
+	case item.ID > 0 && item.ArchivedAt != nil:
+		return line, fmt.Sprintf("item %s (%s) is archived", item.Name, item.SKU), nil
+	case item.ID > 0:
+		id := int64(item.ID)
+		line.ItemID, line.SKU, line.Name, line.Category, line.ItemType = &id, item.SKU, item.Name, item.Category, item.ItemType
+		if line.UnitCost == nil && item.UnitCost > 0 {
+			cost := item.UnitCost
+			line.UnitCost = &cost
+		}
+		return line, "", nil
+	}
+
+	if in.Name == "" {
+		return line, "name is required for a new item (or give item_id)", nil
+	}
+	t, ok := NormalizeItemType(in.ItemType)
+	if !ok {
+		return line, "item_type must be durable or consumable", nil
+	}
+	line.SKU, line.Name, line.Category, line.ItemType = in.SKU, in.Name, in.Category, t
+	return line, "", nil
+}
+
+// POST /api/purchase-requests/:id/approve  {"note": "within the term budget"}
+// The requester cannot approve their own request unless they are an admin.
+func (c *PurchaseController) Approve() {
+	var in struct {
+		Note string `json:"note"`
+	}
+	_ = readJSON(c.Ctx, &in)
+	c.advance(PurchaseApproved, func(tx *sqlx.Tx, p purchaseRow, uid int64) (string, error) {
+		if p.RequestedBy != nil && *p.RequestedBy == uid && currentRole(c.Ctx) != RoleAdmin {
+			return "a purchase request must be approved by someone other than the requester", nil
+		}
+		_, err := tx.Exec(`UPDATE purchase_requests SET status=?, decided_by=?, decided_at=?, decision_note=? WHERE id=?`,
+			PurchaseApproved, uid, time.Now().UTC(), nullableStr(truncate(strings.TrimSpace(in.Note), 255)), p.ID)
+		return "", err
+	})
+}
+
+// POST /api/purchase-requests/:id/reject  {"reason": "use the stock in Lab 2"}
+func (c *PurchaseController) Reject() {
+	var in struct {
+		Reason string `json:"reason"`
+	}
+	_ = readJSON(c.Ctx, &in)
+	reason := strings.TrimSpace(in.Reason)
+	if reason == "" {
+		jsonErr(c.Ctx, http.StatusBadRequest, "reason is required")
+		return
+	}
+	c.advance(PurchaseRejected, func(tx *sqlx.Tx, p purchaseRow, uid int64) (string, error) {
+		_, err := tx.Exec(`UPDATE purchase_requests SET status=?, decided_by=?, decided_at=?, decision_note=? WHERE id=?`,
+			PurchaseRejected, uid, time.Now().UTC(), truncate(reason, 255), p.ID)
+		return "", err
+	})
+}
+
+// POST /api/purchase-requests/:id/order  {"order_ref": "PO-2024-118", "supplier": "Hshop"}
+// Records that the order was placed; supplier may be filled in or changed.
+func (c *PurchaseController) Order() {
+	var in struct {
+		OrderRef string `json:"order_ref"`
+		Supplier string `json:"supplier"`
+	}
+	_ = readJSON(c.Ctx, &in)
+	in.OrderRef, in.Supplier = strings.TrimSpace(in.OrderRef), strings.TrimSpace(in.Supplier)
+	if len(in.OrderRef) > 100 || len(in.Supplier) > 255 {
+		jsonErr(c.Ctx, http.StatusBadRequest, "order_ref or supplier is too long")
+		return
+	}
+	c.advance(PurchaseOrdered, func(tx *sqlx.Tx, p purchaseRow, uid int64) (string, error) {
+		_, err := tx.Exec(`UPDATE purchase_requests SET status=?, ordered_by=?, ordered_at=?, order_ref=?, supplier=? WHERE id=?`,
+			PurchaseOrdered, uid, time.Now().UTC(), nullableStr(in.OrderRef), firstNonEmpty(in.Supplier, p.Supplier), p.ID)
+		return "", err
+	})
+}
+
+// POST /api/purchase-requests/:id/cancel  {"reason": "supplier out of stock"}
+// Goods already received stay received.
+func (c *PurchaseController) Cancel() {
+	var in struct {
+		Reason string `json:"reason"`
+	}
+	_ = readJSON(c.Ctx, &in)
+	c.advance(PurchaseCancelled, func(tx *sqlx.Tx, p purchaseRow, uid int64) (string, error) {
+		_, err := tx.Exec(`UPDATE purchase_requests SET status=?, cancelled_by=?, cancelled_at=?, cancel_reason=? WHERE id=?`,
+			PurchaseCancelled, uid, time.Now().UTC(), nullableStr(truncate(strings.TrimSpace(in.Reason), 255)), p.ID)
+		return "", err
+	})
+}
+
+// advance runs one status change in a transaction and answers with the
+// updated request. apply returns a client message to refuse the change.
+func (c *PurchaseController) advance(to string, apply func(tx *sqlx.Tx, p purchaseRow, uid int64) (string, error)) {
+	id, ok := c.requestID()
+	if !ok {
+		return
+	}
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	p, ok := c.loadRequest(tx, id, true)
+	if !ok {
+		return
+	}
+	if !PurchaseNext(p.Status, to) {
+		jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("purchase request is %s and cannot become %s", p.Status, to))
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	msg, err := apply(tx, p, uid)
+	if err != nil {
+		log.Printf("[purchasing] %s id=%d: %v", to, id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if msg != "" {
+		jsonErr(c.Ctx, http.StatusConflict, msg)
+		return
+	}
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Purchase request #%d %s", id, to))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	c.respond(id)
+}
+
+// POST /api/purchase-requests/:id/receive
+//
+//	{"received_on": "2024-10-03", "note": "delivery note 4411",
+//	 "lines": [{"line_id": 31, "quantity": 12, "location": "Store room", "unit_cost": 345000}]}
+//
+// Books a delivery against an ordered request. Without lines everything
+// still outstanding is received, at each line's location. Lines for new
+// items create the item on first receipt.
+func (c *PurchaseController) Receive() {
+	id, ok := c.requestID()
+	if !ok {
+		return
+	}
+	var in struct {
+		ReceivedOn string `json:"received_on"`
+		Note       string `json:"note"`
+		Lines      []struct {
+			LineID   int64    `json:"line_id"`
+			Quantity int      `json:"quantity"`
+			Location string   `json:"location"`
+			UnitCost *float64 `json:"unit_cost"`
+		} `json:"lines"`
+	}
+	_ = readJSON(c.Ctx, &in) // the body is optional
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	if s := strings.TrimSpace(in.ReceivedOn); s != "" {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			jsonErr(c.Ctx, http.StatusBadRequest, "received_on must be YYYY-MM-DD")
+			return
+		}
+		day = d
+	}
+	note := truncate(strings.TrimSpace(in.Note), 255)
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	p, ok := c.loadRequest(tx, id, true)
+	if !ok {
+		return
+	}
+	if !PurchaseNext(p.Status, PurchaseReceived) {
+		jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("purchase request is %s; only ordered requests can be received", p.Status))
+		return
+	}
+	var lines []purchaseLine
+	if err := tx.Select(&lines, purchaseLineSelect+` WHERE request_id=? ORDER BY id FOR UPDATE`, id); err != nil {
+		log.Printf("[purchasing] receive id=%d lines: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	byID := map[int64]*purchaseLine{}
+	for i := range lines {
+		byID[lines[i].ID] = &lines[i]
+	}
+
+	type delivery struct {
+		line     *purchaseLine
+		qty      int
+		location string
+		unitCost *float64
+	}
+	var deliveries []delivery
+	if len(in.Lines) == 0 {
+		for i := range lines {
+			if n := lines[i].Quantity - lines[i].ReceivedQty; n > 0 {
+				deliveries = append(deliveries, delivery{&lines[i], n, "", lines[i].UnitCost})
+			}
+		}
+	}
+	pending := map[int64]int{}
+	for _, d := range in.Lines {
+		l := byID[d.LineID]
+		switch {
+		case l == nil:
+			jsonErr(c.Ctx, http.StatusBadRequest, fmt.Sprintf("line %d is not on this request", d.LineID))
+			return
+		case d.Quantity <= 0:
+			jsonErr(c.Ctx, http.StatusBadRequest, fmt.Sprintf("line %d: quantity must be > 0", d.LineID))
+			return
+		case d.UnitCost != nil && *d.UnitCost < 0:
+			jsonErr(c.Ctx, http.StatusBadRequest, fmt.Sprintf("line %d: unit_cost must be >= 0", d.LineID))
+			return
+		case isInTransit(normalizeLocation(d.Location)):
+			jsonErr(c.Ctx, http.StatusBadRequest, fmt.Sprintf("%q is not a location goods can be received at", inTransitLocation))
+			return
+		}
+		pending[l.ID] += d.Quantity
+		if left := l.Quantity - l.ReceivedQty; pending[l.ID] > left {
+			jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("line %d (%s): only %d outstanding", l.ID, l.Name, left))
+			return
+		}
+		deliveries = append(deliveries, delivery{l, d.Quantity, normalizeLocation(d.Location), firstCost(d.UnitCost, l.UnitCost)})
+	}
+	if len(deliveries) == 0 {
+		jsonErr(c.Ctx, http.StatusConflict, "nothing is outstanding on this request")
+		return
+	}
+
+	uid := currentUserID(c.Ctx)
+	now := time.Now().UTC()
+	for _, d := range deliveries {
+		l := d.line
+		location := firstNonEmpty(d.location, strVal(l.Location))
+		if l.ItemID == nil {
+			itemID, msg, err := createPurchasedItem(tx, *l, p.Supplier, location, d.unitCost, day)
+			if err != nil {
+				log.Printf("[purchasing] receive id=%d new item: %v", id, err)
+				jsonErr(c.Ctx, http.StatusInternalServerError, "insert error")
+				return
+			}
+			if msg != "" {
+				jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("line %d (%s): %s", l.ID, l.Name, msg))
+				return
+			}
+			l.ItemID = &itemID
+			if _, err := tx.Exec(`UPDATE purchase_request_lines SET item_id=? WHERE id=?`, itemID, l.ID); err != nil {
+				log.Printf("[purchasing] receive id=%d line=%d: %v", id, l.ID, err)
+				jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+				return
+			}
+		}
+		var item itemRow
+		if err := tx.Get(&item, `SELECT `+itemSelectCols+` FROM log_lab_equipment_master WHERE id=? FOR UPDATE`, *l.ItemID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("line %d (%s): item no longer exists", l.ID, l.Name))
+			} else {
+				log.Printf("[purchasing] receive id=%d item=%d: %v", id, *l.ItemID, err)
+				jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+			}
+			return
+		}
+		if item.ArchivedAt != nil {
+			jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("line %d: item %s (%s) is archived", l.ID, item.Name, item.SKU))
+			return
+		}
+		msg, err := receiveStock(tx, item, d.qty, location,
+			stockMove{Reason: "receipt", RefType: "purchase", RefID: id, UserID: uid, Note: firstNonEmpty(strVal(p.OrderRef), p.Supplier)})
+		if err == nil && msg == "" {
+			_, err = tx.Exec(`INSERT INTO purchase_receipts (request_id, line_id, item_id, quantity, unit_cost, location, note, received_by, received_on, created_at)
+				VALUES (?,?,?,?,?,?,?,?,?,?)`, id, l.ID, item.ID, d.qty, d.unitCost, nullableStr(location), nullableStr(note), uid, day, now)
+		}
+		if err == nil && msg == "" {
+			_, err = tx.Exec(`UPDATE purchase_request_lines SET received_qty=received_qty+? WHERE id=?`, d.qty, l.ID)
+		}
+		if err != nil {
+			log.Printf("[purchasing] receive id=%d line=%d: %v", id, l.ID, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+			return
+		}
+		if msg != "" {
+			jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("line %d (%s): %s", l.ID, l.Name, msg))
+			return
+		}
+		l.ReceivedQty += d.qty
+		logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Received %d x %s (%s) on purchase #%d", d.qty, item.Name, item.SKU, id))
+	}
+
+	status := PurchaseReceived
+	for _, l := range lines {
+		if l.ReceivedQty < l.Quantity {
+			status = PurchasePartial
+			break
+		}
+	}
+	var receivedAt interface{}
+	if status == PurchaseReceived {
+		receivedAt = now
+	}
+	if _, err := tx.Exec(`UPDATE purchase_requests SET status=?, received_at=? WHERE id=?`, status, receivedAt, id); err != nil {
+		log.Printf("[purchasing] receive id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	c.respond(id)
+}
+
+func firstCost(vals ...*float64) *float64 {
+	for _, v := range vals {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// createPurchasedItem adds the item a line asked for, empty: receiveStock
+// then books the delivery. msg is the client error for a taken sku.
+func createPurchasedItem(tx *sqlx.Tx, l purchaseLine, supplier, location string, unitCost *float64, day time.Time) (int64, string, error) {
+	qty, date := 0, day.Format("2006-01-02")
+	f := itemFields{
+		SKU: &l.SKU, Name: &l.Name, Category: &l.Category, Location: &location,
+		Quantity: &qty, UnitCost: unitCost, Supplier: &supplier, DatePurchased: &date, ItemType: &l.ItemType,
+	}
+	id, err := insertItem(tx, f)
+	var me *mysql.MySQLError
+	if errors.As(err, &me) && me.Number == 1062 {
+		return 0, fmt.Sprintf("sku %s is already in use; put the existing item on the line instead", l.SKU), nil
+	}
+	return id, "", err
+}
+
+// receiveStock books n delivered of item: quantity and available_quantity
+// go up and the stock lands at location (the primary location when empty).
+// The master row must be locked.
+func receiveStock(tx *sqlx.Tx, item itemRow, n int, location string, mv stockMove) (string, error) {
+	levels, err := seedStock(tx, item, mv.UserID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE log_lab_equipment_master SET quantity=quantity+?, available_quantity=available_quantity+? WHERE id=?`,
+		n, n, item.ID); err != nil {
+		return "", err
+	}
+	if len(levels) == 0 {
+		// nothing on hand yet: the delivery is the item's first stock
+		loc := firstNonEmpty(location, normalizeLocation(item.Location), unassignedLocation)
+		return "", writeStockLevels(tx, int64(item.ID), nil, []models.Storage{{Location: &loc, Quantity: n}}, mv)
+	}
+	return shiftStock(tx, int64(item.ID), n, location, nil, mv)
+}
@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+)
+
+// ---- roles (values stored in users.role) ----
+const (
+	RoleAdmin      = "admin"
+	RoleLabManager = "lab_manager"
+	RoleTechnician = "technician"
+	RoleStudent    = "student"
+)
+
+// Permission is an action a role may perform, e.g. "item.create".
+type Permission string
+
+const (
+	// PermAuthenticated is held by every signed-in user (self-service routes).
+	PermAuthenticated Permission = "authenticated"
+
+	PermItemCreate      Permission = "item.create"
+	PermItemUpdate      Permission = "item.update"
+	PermItemArchive     Permission = "item.archive"
+	PermItemDelete      Permission = "item.delete" // hard delete: admins only
+	PermBorrowCreate    Permission = "borrow.create"
+	PermBorrowReturn    Permission = "borrow.return"
+	PermBorrowApprove   Permission = "borrow.approve"
+	PermStockTransfer   Permission = "stock.transfer"
+	PermStockIssue      Permission = "stock.issue" // hand out consumables
+	PermPurchaseRequest Permission = "purchase.request"
+	PermPurchaseApprove Permission = "purchase.approve" // approve, reject and place orders
+	PermPurchaseReceive Permission = "purchase.receive"
+	PermInstructionEdit Permission = "instruction.edit"
+	PermNoteCreate      Permission = "note.create"
+	PermSessionManage   Permission = "session.manage" // revoke other users' sessions
+	PermUserManage      Permission = "user.manage"
+)
+
+// rolePermissions is the single source of truth for who may do what.
+// Admins are allowed everything and are not listed here.
+var rolePermissions = map[string][]Permission{
+	RoleLabManager: {
+		PermItemCreate, PermItemUpdate, PermItemArchive, PermStockTransfer, PermStockIssue,
+		PermPurchaseRequest, PermPurchaseApprove, PermPurchaseReceive,
+		PermBorrowCreate, PermBorrowReturn, PermBorrowApprove,
+		PermInstructionEdit, PermNoteCreate,
+	},
+	RoleTechnician: {
+		PermItemUpdate, PermStockTransfer, PermStockIssue,
+		PermPurchaseRequest, PermPurchaseReceive,
+		PermBorrowCreate, PermBorrowReturn,
+		PermInstructionEdit, PermNoteCreate,
+	},
+	RoleStudent: {
+		PermBorrowCreate, PermBorrowReturn,
+		PermNoteCreate,
+	},
+}
+
+// roleOrder lists the roles from most to least privileged.
+var roleOrder = []string{RoleAdmin, RoleLabManager, RoleTechnician, RoleStudent}
+
+// NormalizeRole maps stored role strings onto the known roles.
+// Accounts created before roles existed carry "user" and are treated as students.
+func NormalizeRole(role string) string {
+	r := strings.ToLower(strings.TrimSpace(role))
+	switch r {
+	case RoleAdmin, RoleLabManager, RoleTechnician, RoleStudent:
+		return r
+	default:
+		return RoleStudent
+	}
+}
+
+// RoleAllows reports whether role has permission p.
+func RoleAllows(role string, p Permission) bool {
+	r := NormalizeRole(role)
+	if r == RoleAdmin || p == PermAuthenticated {
+		return true
+	}
+	for _, have := range rolePermissions[r] {
+		if have == p {
+			return true
+		}
+	}
+	return false
+}
+
+// ---- per-route policy table (filled from routers/router.go) ----
+
+type routePolicy struct {
+	method  string
+	pattern []string // path segments; ":x" matches one segment, "*" matches the rest
+	perm    Permission
+}
+
+var routePolicies []routePolicy
+
+// Policy declares that method+pattern requires perm. Patterns use the same
+// ":param" syntax as the router, without regex suffixes, e.g. "/api/items/:id/image".
+func Policy(method, pattern string, perm Permission) {
+	routePolicies = append(routePolicies, routePolicy{
+		method:  strings.ToUpper(method),
+		pattern: splitPath(pattern),
+		perm:    perm,
+	})
+}
+
+// lookupPolicy returns the permission required for method+path.
+func lookupPolicy(method, path string) (Permission, bool) {
+	segs := splitPath(path)
+	for _, p := range routePolicies {
+		if p.method == method && matchSegments(p.pattern, segs) {
+			return p.perm, true
+		}
+	}
+	return "", false
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+func matchSegments(pattern, segs []string) bool {
+	for i, p := range pattern {
+		if p == "*" {
+			return true
+		}
+		if i >= len(segs) {
+			return false
+		}
+		if !strings.HasPrefix(p, ":") && p != segs[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(segs)
+}
+
+// authorize checks the route policy for an authenticated request and writes
+// a 403 when the caller's role lacks the permission. Routes without a
+// declared policy, reads included, are denied for everyone but admins, so
+// new routes must be added to the table before they become usable.
+//
+// Requests made with an API token are further limited by the token's scope.
+// Roles listed in MFA_REQUIRED_ROLES additionally need an MFA-verified
+// session for anything beyond self-service (PermAuthenticated) routes.
+func authorize(ctx *beegoctx.Context, method, path string) bool {
+	role := currentRole(ctx)
+	perm, ok := lookupPolicy(method, path)
+	if scope, isToken := currentTokenScope(ctx); isToken && !ScopeAllows(scope, method, path, perm) {
+		log.Printf("[RBAC] 403 %s %s -> api token scope=%s", method, path, scope)
+		forbidden(ctx, perm)
+		return false
+	}
+	if !ok {
+		if role != RoleAdmin {
+			log.Printf("[RBAC] 403 %s %s -> no policy declared (role=%s)", method, path, role)
+			forbidden(ctx, "")
+			return false
+		}
+	}
+	if perm != PermAuthenticated && roleRequiresMFA(role) {
+		if mfa, _ := ctx.Input.GetData("session_mfa").(bool); !mfa {
+			log.Printf("[RBAC] 403 %s %s -> role=%s requires mfa", method, path, role)
+			ctx.Output.SetStatus(http.StatusForbidden)
+			_ = ctx.Output.JSON(map[string]any{"ok": false, "error": "mfa_required"}, false, false)
+			return false
+		}
+	}
+	if ok && !RoleAllows(role, perm) {
+		log.Printf("[RBAC] 403 %s %s -> role=%s lacks %s", method, path, role, perm)
+		forbidden(ctx, perm)
+		return false
+	}
+	return true
+}
+
+func forbidden(ctx *beegoctx.Context, perm Permission) {
+	body := map[string]any{"ok": false, "error": "forbidden"}
+	if perm != "" {
+		body["permission"] = string(perm)
+	}
+	ctx.Output.SetStatus(http.StatusForbidden)
+	_ = ctx.Output.JSON(body, false, false)
+}
+
+// currentRole returns the normalized role attached by SessionAuthFilter.
+func currentRole(ctx *beegoctx.Context) string {
+	r, _ := ctx.Input.GetData("user_role").(string)
+	return NormalizeRole(r)
+}
+
+// currentUserID returns the user id attached by SessionAuthFilter (0 if none).
+func currentUserID(ctx *beegoctx.Context) int64 {
+	uid, _ := ctx.Input.GetData("user_id").(int64)
+	return uid
+}
+
+// actingUserID is the user a borrow or return is recorded for: the session
+// user, or the body's user_id when the caller may act for others
+// (borrow.approve). ok is false once it has answered 401 or 403.
+func actingUserID(ctx *beegoctx.Context, bodyID *int64) (int64, bool) {
+	uid := currentUserID(ctx)
+	if uid <= 0 {
+		jsonErr(ctx, http.StatusUnauthorized, "missing or invalid auth")
+		return 0, false
+	}
+	if bodyID == nil || *bodyID <= 0 || *bodyID == uid {
+		return uid, true
+	}
+	if !RoleAllows(currentRole(ctx), PermBorrowApprove) {
+		forbidden(ctx, PermBorrowApprove)
+		return 0, false
+	}
+	return *bodyID, true
+}
@@ -6,7 +6,6 @@ import (
 	"log"
 	"net/http"
 	"strings"
-	"time"
 
 	beegoctx "github.com/beego/beego/v2/server/web/context"
 	"golang.org/x/crypto/bcrypt"
@@ -73,7 +72,7 @@ func AuthRegister(ctx *beegoctx.Context) {
 
 	// Insert user (use the same table name other controllers use)
 	const q = "INSERT INTO " + usersTable + " (username, password_hash, full_name, email, role, create_at) VALUES (?,?,?,?,?, NOW())"
-	res, err := srv.DB.Exec(q, in.Username, string(hash), in.FullName, in.Email, "user")
+	res, err := srv.DB.Exec(q, in.Username, string(hash), in.FullName, in.Email, RoleStudent)
 	if err != nil {
 		// In case of a race, surface duplicate-key as 409
 		lo := strings.ToLower(err.Error())
@@ -92,15 +91,14 @@ func AuthRegister(ctx *beegoctx.Context) {
 	}
 
 	// Auto-login: issue a session token using the SAME machinery as login.go
-	token := newToken()
-	exp := time.Now().Add(sessionTTL()).UTC()
-	sessionPut(Session{
-		Token:  token,
-		UserID: newID, // LastInsertId() is int64
-		Email:  in.Email,
-		Role:   "user",
-		Exp:    exp, // matches Session struct in login.go
-	})
+	sess, err := sessionPut(newSession(ctx, newID, in.Email, RoleStudent)) // LastInsertId() is int64
+	if err != nil {
+		// account exists; the client can still log in normally
+		log.Printf("register session error: %v", err)
+		jsonOK(ctx, map[string]interface{}{"status": "ok"})
+		return
+	}
+	token, exp := sess.Token, sess.Exp
 
 	// Set auth cookie (SameSite=None; Secure for cross-origin over HTTPS)
 	http.SetCookie(ctx.ResponseWriter, &http.Cookie{
@@ -122,7 +120,7 @@ func AuthRegister(ctx *beegoctx.Context) {
 			"username":  in.Username,
 			"full_name": in.FullName,
 			"email":     in.Email,
-			"role":      "user",
+			"role":      RoleStudent,
 		},
 	})
 }
@@ -0,0 +1,540 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/jmoiron/sqlx"
+)
+
+// A borrower may push the due date (return_date) of an open loan back a
+// limited number of times, and never past a maximum loan length counted
+// from the day it was lent. Both limits come from the item's category
+// policy, falling back to BORROW_MAX_RENEWALS and BORROW_MAX_LOAN_DAYS.
+// A renewal is refused outright when a reservation needs the stock before
+// the new due date, and waits for staff when the category says so; callers
+// with borrow.approve renew directly.
+
+const borrowRenewalsSchema = `
+CREATE TABLE IF NOT EXISTS borrow_renewals (
+	id              BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	borrow_id       BIGINT UNSIGNED NOT NULL,
+	old_return_date DATE            NOT NULL,
+	new_return_date DATE            NOT NULL,
+	status          VARCHAR(16)     NOT NULL,
+	note            VARCHAR(255)    NULL,
+	requested_by    BIGINT UNSIGNED NULL,
+	requested_at    DATETIME        NOT NULL,
+	decided_by      BIGINT UNSIGNED NULL,
+	decided_at      DATETIME        NULL,
+	decision_note   VARCHAR(255)    NULL,
+	KEY idx_borrow_renewals_borrow (borrow_id, status),
+	KEY idx_borrow_renewals_status (status, requested_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+const (
+	RenewalPending  = "pending"
+	RenewalApproved = "approved"
+	RenewalRejected = "rejected"
+)
+
+// RenewalPolicy limits renewals of loans in a category. MaxLoanDays 0 is
+// no limit.
+type RenewalPolicy struct {
+	MaxRenewals   int  `json:"max_renewals"`
+	MaxLoanDays   int  `json:"max_loan_days"`
+	NeedsApproval bool `json:"requires_approval"`
+}
+
+// RenewalMsg is the client error for moving the due date of a loan lent on
+// borrowed and renewed renewals times to due, or "".
+func RenewalMsg(p RenewalPolicy, renewals int, borrowed, due time.Time) string {
+	lent := time.Date(borrowed.Year(), borrowed.Month(), borrowed.Day(), 0, 0, 0, 0, time.UTC)
+	switch {
+	case p.MaxRenewals <= 0:
+		return "loans in this category cannot be renewed"
+	case renewals >= p.MaxRenewals:
+		return fmt.Sprintf("this loan has already been renewed %d time(s), the most allowed for its category", renewals)
+	case p.MaxLoanDays > 0 && due.After(lent.AddDate(0, 0, p.MaxLoanDays)):
+		return fmt.Sprintf("loans in this category last at most %d days; the latest due date is %s",
+			p.MaxLoanDays, lent.AddDate(0, 0, p.MaxLoanDays).Format("2006-01-02"))
+	}
+	return ""
+}
+
+// renewalPolicy is the policy for category: its overrides on top of the
+// defaults in conf/app.conf.
+func renewalPolicy(q sqlGetter, category string) (RenewalPolicy, error) {
+	p := RenewalPolicy{
+		MaxRenewals: int(int64FromConf("BORROW_MAX_RENEWALS", 2)),
+		MaxLoanDays: int(int64FromConf("BORROW_MAX_LOAN_DAYS", 60)),
+	}
+	var o categoryPolicy
+	err := q.Get(&o, `SELECT category, max_renewals, max_loan_days, renewal_requires_approval
+		FROM category_policies WHERE category=?`, strings.TrimSpace(category))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return p, nil
+	case err != nil:
+		return p, err
+	}
+	if o.MaxRenewals != nil {
+		p.MaxRenewals = *o.MaxRenewals
+	}
+	if o.MaxLoanDays != nil {
+		p.MaxLoanDays = *o.MaxLoanDays
+	}
+	p.NeedsApproval = o.RenewalRequiresApproval
+	return p, nil
+}
+
+func describeRenewalPolicy(p categoryPolicy) string {
+	limit := func(v *int, unit string) string {
+		if v == nil {
+			return "default " + unit
+		}
+		return fmt.Sprintf("%d %s", *v, unit)
+	}
+	s := limit(p.MaxRenewals, "renewals") + ", " + limit(p.MaxLoanDays, "days at most")
+	if p.RenewalRequiresApproval {
+		s += ", staff approval"
+	}
+	return s
+}
+
+type renewalRow struct {
+	ID            int64      `db:"id"              json:"id"`
+	BorrowID      int64      `db:"borrow_id"       json:"borrow_id"`
+	ItemID        int64      `db:"item_id"         json:"item_id"`
+	SKU           string     `db:"sku"             json:"sku"`
+	ItemName      string     `db:"item_name"       json:"item_name"`
+	UserID        int64      `db:"user_id"         json:"user_id"`
+	UserName      *string    `db:"user_name"       json:"user_name"`
+	OldReturnDate time.Time  `db:"old_return_date" json:"old_return_date"`
+	NewReturnDate time.Time  `db:"new_return_date" json:"new_return_date"`
+	Status        string     `db:"status"          json:"status"`
+	Note          *string    `db:"note"            json:"note"`
+	RequestedBy   *int64     `db:"requested_by"    json:"requested_by"`
+	RequestedAt   time.Time  `db:"requested_at"    json:"requested_at"`
+	DecidedBy     *int64     `db:"decided_by"      json:"decided_by"`
+	DecidedAt     *time.Time `db:"decided_at"      json:"decided_at"`
+	DecisionNote  *string    `db:"decision_note"   json:"decision_note"`
+}
+
+const renewalSelect = `SELECT n.id, n.borrow_id, br.item_id, e.sku, e.name AS item_name, br.user_id, u.full_name AS user_name,
+	n.old_return_date, n.new_return_date, n.status, n.note, n.requested_by, n.requested_at,
+	n.decided_by, n.decided_at, n.decision_note
+	FROM borrow_renewals n
+	JOIN log_lab_borrow_records br ON br.id = n.borrow_id
+	JOIN log_lab_equipment_master e ON e.id = br.item_id
+	LEFT JOIN users u ON u.id = br.user_id`
+
+// renewableBorrow is what a renewal needs to know about the loan.
+type renewableBorrow struct {
+	ID          int64      `db:"id"`
+	ItemID      int64      `db:"item_id"`
+	UserID      int64      `db:"user_id"`
+	Outstanding int        `db:"outstanding"`
+	BorrowDate  time.Time  `db:"borrow_date"`
+	ReturnDate  *time.Time `db:"return_date"`
+	Returned    *time.Time `db:"actual_return_date"`
+	Status      string     `db:"status"`
+	Renewals    int        `db:"renewals"`
+	SKU         string     `db:"sku"`
+	Name        string     `db:"name"`
+	Category    string     `db:"category"`
+}
+
+// RenewalController serves /api/borrows/:id/renew and the renewal requests
+// under /api/borrows/renewals.
+type RenewalController struct{ web.Controller }
+
+func (c *RenewalController) pathID() (int64, bool) {
+	id, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+	}
+	return id, ok
+}
+
+// lockBorrow locks the loan's item and then the loan, as Return does.
+func (c *RenewalController) lockBorrow(tx *sqlx.Tx, id int64) (renewableBorrow, itemRow, bool) {
+	var b renewableBorrow
+	var item itemRow
+	if err := tx.Get(&b.ItemID, `SELECT item_id FROM log_lab_borrow_records WHERE id=?`, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "borrow not found")
+		} else {
+			log.Printf("[renewals] borrow=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return b, item, false
+	}
+	if err := tx.Get(&item, `SELECT `+itemSelectCols+` FROM log_lab_equipment_master WHERE id=? FOR UPDATE`, b.ItemID); err != nil {
+		log.Printf("[renewals] lock item=%d: %v", b.ItemID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return b, item, false
+	}
+	if err := tx.Get(&b, `SELECT br.id, br.item_id, br.user_id, br.quantity - br.quantity_returned AS outstanding,
+			br.borrow_date, br.return_date, br.actual_return_date, IFNULL(br.status, '') AS status, br.renewals,
+			e.sku, e.name, e.category
+		FROM log_lab_borrow_records br
+		JOIN log_lab_equipment_master e ON e.id = br.item_id
+		WHERE br.id=? FOR UPDATE`, id); err != nil {
+		log.Printf("[renewals] lock borrow=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return b, item, false
+	}
+	return b, item, true
+}
+
+// renewMsg checks that b can be due on due instead: it is open and not
+// overdue, the category's limits allow it and no reservation needs the
+// stock in between. conflicts are the bookings in the way.
+func renewMsg(tx *sqlx.Tx, b renewableBorrow, avail int, p RenewalPolicy, due time.Time) (string, []bookingRow, error) {
+	now := time.Now().UTC()
+	switch {
+	case b.Returned != nil || (b.Status != BorrowBorrowed && b.Status != BorrowOverdue):
+		return "only open loans can be renewed", nil, nil
+	case b.ReturnDate == nil:
+		return "this loan has no due date to extend", nil, nil
+	}
+	old := time.Date(b.ReturnDate.Year(), b.ReturnDate.Month(), b.ReturnDate.Day(), 0, 0, 0, 0, time.UTC)
+	from := old.AddDate(0, 0, 1) // held through the old due date
+	switch {
+	case !from.After(now):
+		return "this loan is overdue; return it instead", nil, nil
+	case !due.After(old):
+		return "return_date must be after the current due date " + old.Format("2006-01-02"), nil, nil
+	}
+	if msg := RenewalMsg(p, b.Renewals, b.BorrowDate, due); msg != "" {
+		return msg, nil, nil
+	}
+	slots, rows, err := itemAvailability(tx, b.ItemID, avail, from, due.AddDate(0, 0, 1))
+	if err != nil {
+		return "", nil, err
+	}
+	s, ok := TightestSlot(slots)
+	if !ok || s.Available >= b.Outstanding {
+		return "", nil, nil
+	}
+	var conflicts []bookingRow
+	for _, r := range rows {
+		if r.Kind == "reservation" && r.Start.Before(s.To) && (r.End == nil || r.End.After(s.From)) {
+			conflicts = append(conflicts, r)
+		}
+	}
+	return fmt.Sprintf("reserved by someone else from %s; it can be kept until %s at the latest",
+		s.From.Format(time.RFC3339), old.Format("2006-01-02")), conflicts, nil
+}
+
+// POST /api/borrows/:id/renew  {"return_date": "2024-11-15", "note": "thesis runs late"}
+// days may stand in for return_date; by default the loan runs
+// BORROW_RENEWAL_DAYS longer. 200 with the renewal when it applies at once,
+// 202 when it waits for staff.
+func (c *RenewalController) Renew() {
+	id, ok := c.pathID()
+	if !ok {
+		return
+	}
+	var in struct {
+		ReturnDate string `json:"return_date"`
+		Days       int    `json:"days"`
+		Note       string `json:"note"`
+	}
+	_ = readJSON(c.Ctx, &in) // the body is optional
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	b, item, ok := c.lockBorrow(tx, id)
+	if !ok {
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	staff := RoleAllows(currentRole(c.Ctx), PermBorrowApprove)
+	if b.UserID != uid && !staff {
+		jsonErr(c.Ctx, http.StatusForbidden, "not your borrow")
+		return
+	}
+	if b.ReturnDate == nil {
+		jsonErr(c.Ctx, http.StatusConflict, "this loan has no due date to extend")
+		return
+	}
+	old := time.Date(b.ReturnDate.Year(), b.ReturnDate.Month(), b.ReturnDate.Day(), 0, 0, 0, 0, time.UTC)
+	var due time.Time
+	switch s := strings.TrimSpace(in.ReturnDate); {
+	case s != "":
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			jsonErr(c.Ctx, http.StatusBadRequest, "return_date must be YYYY-MM-DD")
+			return
+		}
+		due = d
+	case in.Days < 0:
+		jsonErr(c.Ctx, http.StatusBadRequest, "days must be > 0")
+		return
+	case in.Days > 0:
+		due = old.AddDate(0, 0, in.Days)
+	default:
+		due = old.AddDate(0, 0, int(int64FromConf("BORROW_RENEWAL_DAYS", 7)))
+	}
+
+	var pending int
+	if err := tx.Get(&pending, `SELECT COUNT(1) FROM borrow_renewals WHERE borrow_id=? AND status=?`, id, RenewalPending); err != nil {
+		log.Printf("[renewals] pending borrow=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if pending > 0 {
+		jsonErr(c.Ctx, http.StatusConflict, "a renewal of this loan is already waiting for approval")
+		return
+	}
+	p, err := renewalPolicy(tx, b.Category)
+	if err != nil {
+		log.Printf("[renewals] policy %q: %v", b.Category, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	msg, conflicts, err := renewMsg(tx, b, item.AvailableQuantity, p, due)
+	if err != nil {
+		log.Printf("[renewals] check borrow=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if msg != "" {
+		c.Ctx.Output.SetStatus(http.StatusConflict)
+		_ = c.Ctx.Output.JSON(map[string]interface{}{"error": msg, "conflicts": conflicts}, false, false)
+		return
+	}
+
+	status := RenewalApproved
+	if p.NeedsApproval && !staff {
+		status = RenewalPending
+	}
+	now := time.Now().UTC()
+	var decidedBy, decidedAt interface{}
+	if status == RenewalApproved {
+		decidedAt = now
+		if staff {
+			decidedBy = uid
+		}
+	}
+	res, err := tx.Exec(`INSERT INTO borrow_renewals (borrow_id, old_return_date, new_return_date, status, note, requested_by, requested_at, decided_by, decided_at)
+		VALUES (?,?,?,?,?,?,?,?,?)`, id, old, due, status, nullableStr(truncate(strings.TrimSpace(in.Note), 255)), uid, now, decidedBy, decidedAt)
+	if err != nil {
+		log.Printf("[renewals] insert borrow=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "insert error")
+		return
+	}
+	renewalID, _ := res.LastInsertId()
+	if status == RenewalApproved {
+		if err := extendLoan(tx, id, due); err != nil {
+			log.Printf("[renewals] extend borrow=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+			return
+		}
+		logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Renewed borrow #%d of %s (%s): due %s instead of %s",
+			id, b.Name, b.SKU, due.Format("2006-01-02"), old.Format("2006-01-02")))
+	} else {
+		logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Requested renewal of borrow #%d of %s (%s) until %s",
+			id, b.Name, b.SKU, due.Format("2006-01-02")))
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	if status == RenewalPending {
+		c.Ctx.Output.SetStatus(http.StatusAccepted)
+	}
+	c.respond(renewalID)
+}
+
+func extendLoan(tx *sqlx.Tx, borrowID int64, due time.Time) error {
+	_, err := tx.Exec(`UPDATE log_lab_borrow_records SET return_date=?, renewals=renewals+1 WHERE id=?`, due, borrowID)
+	return err
+}
+
+func (c *RenewalController) loadRenewal(q sqlGetter, id int64, lock bool) (renewalRow, bool) {
+	var r renewalRow
+	sqlStr := renewalSelect + ` WHERE n.id=? LIMIT 1`
+	if lock {
+		sqlStr += ` FOR UPDATE`
+	}
+	if err := q.Get(&r, sqlStr, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "renewal not found")
+		} else {
+			log.Printf("[renewals] load id=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return r, false
+	}
+	return r, true
+}
+
+func (c *RenewalController) respond(id int64) {
+	if r, ok := c.loadRenewal(srv.DB, id, false); ok {
+		jsonOK(c.Ctx, r)
+	}
+}
+
+// GET /api/borrows/renewals?status=pending&borrow_id=
+// Renewals newest first. Without borrow.approve the caller sees only those
+// of their own loans.
+func (c *RenewalController) List() {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	if v := strings.TrimSpace(c.GetString("status")); v != "" {
+		where += ` AND n.status=?`
+		args = append(args, v)
+	}
+	if id, err := c.GetInt64("borrow_id"); err == nil && id > 0 {
+		where += ` AND n.borrow_id=?`
+		args = append(args, id)
+	}
+	if !RoleAllows(currentRole(c.Ctx), PermBorrowApprove) {
+		where += ` AND br.user_id=?`
+		args = append(args, currentUserID(c.Ctx))
+	}
+	out := make([]renewalRow, 0)
+	if err := srv.DB.Select(&out, renewalSelect+where+` ORDER BY n.id DESC LIMIT 500`, args...); err != nil {
+		log.Printf("[renewals] list: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, out)
+}
+
+// POST /api/borrows/renewals/:id/approve  {"note": "ok until the exam"}
+// Runs the checks again, since the loan or the bookings may have changed
+// while the request waited.
+func (c *RenewalController) Approve() {
+	id, ok := c.pathID()
+	if !ok {
+		return
+	}
+	var in struct {
+		Note string `json:"note"`
+	}
+	_ = readJSON(c.Ctx, &in)
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	r, ok := c.loadRenewal(tx, id, false)
+	if !ok {
+		return
+	}
+	b, item, ok := c.lockBorrow(tx, r.BorrowID)
+	if !ok {
+		return
+	}
+	if r, ok = c.loadRenewal(tx, id, true); !ok {
+		return
+	}
+	if r.Status != RenewalPending {
+		jsonErr(c.Ctx, http.StatusConflict, "renewal is "+r.Status+", not pending")
+		return
+	}
+	if b.ReturnDate == nil || !b.ReturnDate.Equal(r.OldReturnDate) {
+		jsonErr(c.Ctx, http.StatusConflict, "the due date changed since this renewal was requested; reject it")
+		return
+	}
+	p, err := renewalPolicy(tx, b.Category)
+	if err != nil {
+		log.Printf("[renewals] policy %q: %v", b.Category, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	msg, conflicts, err := renewMsg(tx, b, item.AvailableQuantity, p, r.NewReturnDate)
+	if err != nil {
+		log.Printf("[renewals] check borrow=%d: %v", b.ID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if msg != "" {
+		c.Ctx.Output.SetStatus(http.StatusConflict)
+		_ = c.Ctx.Output.JSON(map[string]interface{}{"error": msg, "conflicts": conflicts}, false, false)
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	if _, err := tx.Exec(`UPDATE borrow_renewals SET status=?, decided_by=?, decided_at=?, decision_note=? WHERE id=?`,
+		RenewalApproved, uid, time.Now().UTC(), nullableStr(truncate(strings.TrimSpace(in.Note), 255)), id); err != nil {
+		log.Printf("[renewals] approve id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if err := extendLoan(tx, b.ID, r.NewReturnDate); err != nil {
+		log.Printf("[renewals] extend borrow=%d: %v", b.ID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Approved renewal of borrow #%d of %s (%s): due %s",
+		b.ID, b.Name, b.SKU, r.NewReturnDate.Format("2006-01-02")))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	c.respond(id)
+}
+
+// POST /api/borrows/renewals/:id/reject  {"reason": "needed for the lab exam"}
+func (c *RenewalController) Reject() {
+	id, ok := c.pathID()
+	if !ok {
+		return
+	}
+	var in struct {
+		Reason string `json:"reason"`
+	}
+	_ = readJSON(c.Ctx, &in)
+	reason := strings.TrimSpace(in.Reason)
+	if reason == "" {
+		jsonErr(c.Ctx, http.StatusBadRequest, "reason is required")
+		return
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	r, ok := c.loadRenewal(tx, id, true)
+	if !ok {
+		return
+	}
+	if r.Status != RenewalPending {
+		jsonErr(c.Ctx, http.StatusConflict, "renewal is "+r.Status+", not pending")
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	if _, err := tx.Exec(`UPDATE borrow_renewals SET status=?, decided_by=?, decided_at=?, decision_note=? WHERE id=?`,
+		RenewalRejected, uid, time.Now().UTC(), truncate(reason, 255), id); err != nil {
+		log.Printf("[renewals] reject id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Rejected renewal of borrow #%d of %s (%s): %s", r.BorrowID, r.ItemName, r.SKU, reason))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	c.respond(id)
+}
@@ -0,0 +1,745 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/jmoiron/sqlx"
+)
+
+// Reservations book N of an item over [start_at, end_at), e.g. 8 Arduino
+// kits for next Tuesday's lab session. An item's stock on the shelf or on
+// loan is its capacity; open borrows (until their return date, or for good
+// once overdue) and booked reservations hold part of it over time, and a
+// reservation is only accepted when what is left covers it throughout.
+// At pickup the reservation becomes an ordinary borrow.
+
+const reservationsSchema = `
+CREATE TABLE IF NOT EXISTS reservations (
+	id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	item_id       BIGINT UNSIGNED NOT NULL,
+	user_id       BIGINT UNSIGNED NOT NULL,
+	quantity      INT             NOT NULL,
+	start_at      DATETIME        NOT NULL,
+	end_at        DATETIME        NOT NULL,
+	purpose       VARCHAR(255)    NULL,
+	course        VARCHAR(100)    NULL,
+	status        VARCHAR(16)     NOT NULL DEFAULT 'booked',
+	borrow_id     BIGINT UNSIGNED NULL,
+	created_by    BIGINT UNSIGNED NULL,
+	created_at    DATETIME        NOT NULL,
+	picked_up_by  BIGINT UNSIGNED NULL,
+	picked_up_at  DATETIME        NULL,
+	cancelled_by  BIGINT UNSIGNED NULL,
+	cancelled_at  DATETIME        NULL,
+	cancel_reason VARCHAR(255)    NULL,
+	KEY idx_reservations_item (item_id, status, start_at),
+	KEY idx_reservations_user (user_id, start_at),
+	KEY idx_reservations_window (status, start_at, end_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// Reservation statuses. Expired is never stored: it is a booked
+// reservation whose end passed without a pickup.
+const (
+	ReservationBooked    = "booked"
+	ReservationPickedUp  = "picked_up"
+	ReservationCancelled = "cancelled"
+	ReservationExpired   = "expired"
+)
+
+const (
+	// reservationEarlyPickup is how long before its start a reservation may
+	// be picked up.
+	reservationEarlyPickup = time.Hour
+	reservationMaxLength   = 30 * 24 * time.Hour
+	availabilityMaxWindow  = 92 * 24 * time.Hour
+)
+
+// Booking is stock held over [Start, End); a zero End holds it until
+// further notice (an open borrow without a return date, or overdue).
+type Booking struct {
+	Start    time.Time
+	End      time.Time
+	Quantity int
+}
+
+// AvailabilitySlot is a stretch of time over which the booked quantity
+// does not change.
+type AvailabilitySlot struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Booked    int       `json:"booked"`
+	Available int       `json:"available"`
+}
+
+// Availability sweeps bookings over [from, to) against capacity. The slots
+// are in order and cover the whole window; Available is negative where the
+// stock is overbooked.
+func Availability(capacity int, bookings []Booking, from, to time.Time) []AvailabilitySlot {
+	type edge struct {
+		at    time.Time
+		delta int
+	}
+	var edges []edge
+	for _, b := range bookings {
+		if b.Quantity <= 0 || !b.Start.Before(to) || (!b.End.IsZero() && !b.End.After(from)) {
+			continue
+		}
+		start := b.Start
+		if start.Before(from) {
+			start = from
+		}
+		edges = append(edges, edge{start, b.Quantity})
+		if !b.End.IsZero() && b.End.Before(to) {
+			edges = append(edges, edge{b.End, -b.Quantity})
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].at.Before(edges[j].at) })
+
+	var slots []AvailabilitySlot
+	add := func(a, b time.Time, booked int) {
+		if n := len(slots); n > 0 && slots[n-1].Booked == booked {
+			slots[n-1].To = b
+			return
+		}
+		slots = append(slots, AvailabilitySlot{From: a, To: b, Booked: booked, Available: capacity - booked})
+	}
+	booked, at := 0, from
+	for i := 0; i < len(edges); {
+		t := edges[i].at
+		if t.After(at) {
+			add(at, t, booked)
+			at = t
+		}
+		for ; i < len(edges) && edges[i].at.Equal(t); i++ {
+			booked += edges[i].delta
+		}
+	}
+	if to.After(at) {
+		add(at, to, booked)
+	}
+	return slots
+}
+
+// TightestSlot is the slot with the least available, the earliest on ties.
+func TightestSlot(slots []AvailabilitySlot) (AvailabilitySlot, bool) {
+	if len(slots) == 0 {
+		return AvailabilitySlot{}, false
+	}
+	least := slots[0]
+	for _, s := range slots[1:] {
+		if s.Available < least.Available {
+			least = s
+		}
+	}
+	return least, true
+}
+
+// bookingRow is a borrow or reservation holding stock, as listed with an
+// item's availability and with a rejected reservation.
+type bookingRow struct {
+	Kind     string     `db:"kind"     json:"kind"` // borrow | reservation
+	ID       int64      `db:"id"       json:"id,omitempty"`
+	UserID   int64      `db:"user_id"  json:"user_id,omitempty"`
+	Quantity int        `db:"quantity" json:"quantity"`
+	Start    time.Time  `db:"start_at" json:"start"`
+	End      *time.Time `db:"end_at"   json:"end"` // null: until returned
+	Purpose  *string    `db:"purpose"  json:"purpose,omitempty"`
+	Course   *string    `db:"course"   json:"course,omitempty"`
+}
+
+// itemAvailability loads what holds itemID's stock over [from, to) and
+// sweeps it; avail is the item's available_quantity. Open borrows are held
+// until the end of their return date, or without end once that has passed.
+func itemAvailability(q sqlQuerier, itemID int64, avail int, from, to time.Time) ([]AvailabilitySlot, []bookingRow, error) {
+	now := time.Now().UTC()
+	var borrows []struct {
+		ID         int64      `db:"id"`
+		UserID     int64      `db:"user_id"`
+		Quantity   int        `db:"quantity"`
+		BorrowDate time.Time  `db:"borrow_date"`
+		ReturnDate *time.Time `db:"return_date"`
+	}
+	if err := q.Select(&borrows, `SELECT id, user_id, quantity - quantity_returned AS quantity, borrow_date, return_date FROM log_lab_borrow_records
+		WHERE item_id=? AND actual_return_date IS NULL AND status NOT IN ('pending', 'rejected', 'returned')`, itemID); err != nil {
+		return nil, nil, err
+	}
+	var held []bookingRow
+	if err := q.Select(&held, `SELECT 'reservation' AS kind, id, user_id, quantity, start_at, end_at, purpose, course
+		FROM reservations WHERE item_id=? AND status=? AND start_at < ? AND end_at > ? AND end_at > ?
+		ORDER BY start_at, id`, itemID, ReservationBooked, to, from, now); err != nil {
+		return nil, nil, err
+	}
+
+	capacity := avail
+	var bookings []Booking
+	var rows []bookingRow
+	for _, b := range borrows {
+		capacity += b.Quantity
+		r := bookingRow{Kind: "borrow", ID: b.ID, UserID: b.UserID, Quantity: b.Quantity, Start: b.BorrowDate}
+		if r.Start.After(now) {
+			r.Start = now // borrow_date comes from the database clock
+		}
+		if d := b.ReturnDate; d != nil {
+			end := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+			if end.After(now) {
+				r.End = &end
+			}
+		}
+		if r.End != nil && !r.End.After(from) {
+			continue
+		}
+		rows = append(rows, r)
+	}
+	rows = append(rows, held...)
+	for _, r := range rows {
+		b := Booking{Start: r.Start, Quantity: r.Quantity}
+		if r.End != nil {
+			b.End = *r.End
+		}
+		bookings = append(bookings, b)
+	}
+	return Availability(capacity, bookings, from, to), rows, nil
+}
+
+// walkUpMsg is the client error for lending qty of itemID now when part of
+// the stock on the shelf is reserved before the loan ends, or "". Without
+// a due date only reservations already under way count.
+func walkUpMsg(q sqlQuerier, itemID int64, avail, qty int, due interface{}) (string, error) {
+	from := time.Now().UTC()
+	to := from.Add(time.Minute)
+	if d, ok := due.(time.Time); ok && d.AddDate(0, 0, 1).After(to) {
+		to = d.AddDate(0, 0, 1)
+	}
+	slots, _, err := itemAvailability(q, itemID, avail, from, to)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := TightestSlot(slots); ok && s.Available < qty {
+		return fmt.Sprintf("only %d can be lent until %s; the rest is reserved", maxInt(s.Available, 0), s.To.Format(time.RFC3339)), nil
+	}
+	return "", nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// parseBookingTime accepts RFC 3339, "2006-01-02T15:04" or
+// "2006-01-02 15:04" in the server's time zone, or a bare date (midnight).
+func parseBookingTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time", s)
+}
+
+// GET /api/items/:id/availability?from=2024-10-01&to=2024-10-07
+// from defaults to now and to to a week later; a bare to date is
+// inclusive. Answers the free quantity over time and what holds the rest;
+// without borrow.approve other users' bookings only show when and how many.
+func (c *ItemController) Availability() {
+	id, ok := c.itemID()
+	if !ok {
+		return
+	}
+	from, to := time.Now().UTC(), time.Time{}
+	if v := strings.TrimSpace(c.GetString("from")); v != "" {
+		t, err := parseBookingTime(v)
+		if err != nil {
+			jsonErr(c.Ctx, http.StatusBadRequest, "from must be a date or time")
+			return
+		}
+		from = t
+	}
+	if v := strings.TrimSpace(c.GetString("to")); v != "" {
+		t, err := parseBookingTime(v)
+		if err != nil {
+			jsonErr(c.Ctx, http.StatusBadRequest, "to must be a date or time")
+			return
+		}
+		if len(v) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1)
+		}
+		to = t
+	} else {
+		to = from.AddDate(0, 0, 7)
+	}
+	switch {
+	case !to.After(from):
+		jsonErr(c.Ctx, http.StatusBadRequest, "to must be after from")
+		return
+	case to.Sub(from) > availabilityMaxWindow:
+		jsonErr(c.Ctx, http.StatusBadRequest, "the window may span at most 92 days")
+		return
+	}
+	item, ok := c.loadItem(srv.DB, id, false)
+	if !ok {
+		return
+	}
+	slots, held, err := itemAvailability(srv.DB, id, item.AvailableQuantity, from, to)
+	if err != nil {
+		log.Printf("[reservations] availability item=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if !RoleAllows(currentRole(c.Ctx), PermBorrowApprove) {
+		uid := currentUserID(c.Ctx)
+		for i := range held {
+			if held[i].UserID != uid {
+				held[i] = bookingRow{Kind: held[i].Kind, Quantity: held[i].Quantity, Start: held[i].Start, End: held[i].End}
+			}
+		}
+	}
+	least, _ := TightestSlot(slots)
+	jsonOK(c.Ctx, map[string]interface{}{
+		"item_id":       id,
+		"from":          from,
+		"to":            to,
+		"min_available": least.Available,
+		"slots":         slots,
+		"bookings":      held,
+	})
+}
+
+type reservationRow struct {
+	ID           int64      `db:"id"            json:"id"`
+	ItemID       int64      `db:"item_id"       json:"item_id"`
+	SKU          string     `db:"sku"           json:"sku"`
+	ItemName     string     `db:"item_name"     json:"item_name"`
+	UserID       int64      `db:"user_id"       json:"user_id"`
+	UserName     *string    `db:"user_name"     json:"user_name"`
+	Quantity     int        `db:"quantity"      json:"quantity"`
+	Start        time.Time  `db:"start_at"      json:"start"`
+	End          time.Time  `db:"end_at"        json:"end"`
+	Purpose      *string    `db:"purpose"       json:"purpose"`
+	Course       *string    `db:"course"        json:"course"`
+	Status       string     `db:"status"        json:"status"`
+	BorrowID     *int64     `db:"borrow_id"     json:"borrow_id"`
+	CreatedBy    *int64     `db:"created_by"    json:"created_by"`
+	CreatedAt    time.Time  `db:"created_at"    json:"created_at"`
+	PickedUpBy   *int64     `db:"picked_up_by"  json:"picked_up_by"`
+	PickedUpAt   *time.Time `db:"picked_up_at"  json:"picked_up_at"`
+	CancelledBy  *int64     `db:"cancelled_by"  json:"cancelled_by"`
+	CancelledAt  *time.Time `db:"cancelled_at"  json:"cancelled_at"`
+	CancelReason *string    `db:"cancel_reason" json:"cancel_reason"`
+}
+
+const reservationSelect = `SELECT r.id, r.item_id, e.sku, e.name AS item_name, r.user_id, u.full_name AS user_name,
+	r.quantity, r.start_at, r.end_at, r.purpose, r.course, r.status, r.borrow_id, r.created_by, r.created_at,
+	r.picked_up_by, r.picked_up_at, r.cancelled_by, r.cancelled_at, r.cancel_reason
+	FROM reservations r
+	JOIN log_lab_equipment_master e ON e.id = r.item_id
+	LEFT JOIN users u ON u.id = r.user_id`
+
+// settle shows a booked reservation whose end has passed as expired.
+func (r *reservationRow) settle(now time.Time) {
+	if r.Status == ReservationBooked && !r.End.After(now) {
+		r.Status = ReservationExpired
+	}
+}
+
+// ReservationController serves /api/reservations.
+type ReservationController struct{ web.Controller }
+
+func (c *ReservationController) reservationID() (int64, bool) {
+	id, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+	}
+	return id, ok
+}
+
+func (c *ReservationController) loadReservation(q sqlGetter, id int64, lock bool) (reservationRow, bool) {
+	var r reservationRow
+	sqlStr := reservationSelect + ` WHERE r.id=? LIMIT 1`
+	if lock {
+		sqlStr += ` FOR UPDATE`
+	}
+	if err := q.Get(&r, sqlStr, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "reservation not found")
+		} else {
+			log.Printf("[reservations] load id=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return r, false
+	}
+	return r, true
+}
+
+func (c *ReservationController) lockItem(tx *sqlx.Tx, id int64) (itemRow, bool) {
+	var item itemRow
+	if err := tx.Get(&item, `SELECT `+itemSelectCols+` FROM log_lab_equipment_master WHERE id=? FOR UPDATE`, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "item not found")
+		} else {
+			log.Printf("[reservations] lock item=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return item, false
+	}
+	return item, true
+}
+
+// GET /api/reservations?item_id=&user_id=&status=&course=&from=&to=
+// Reservations overlapping [from, to), in start order: the booking
+// calendar. mine=1 limits them to the caller's.
+func (c *ReservationController) List() {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	for _, f := range []string{"item_id", "user_id"} {
+		if id, err := c.GetInt64(f); err == nil && id > 0 {
+			where += ` AND r.` + f + `=?`
+			args = append(args, id)
+		}
+	}
+	if c.GetString("mine") == "1" {
+		where += ` AND r.user_id=?`
+		args = append(args, currentUserID(c.Ctx))
+	}
+	now := time.Now().UTC()
+	switch s := strings.TrimSpace(c.GetString("status")); s {
+	case "":
+	case ReservationExpired:
+		where += ` AND r.status=? AND r.end_at <= ?`
+		args = append(args, ReservationBooked, now)
+	case ReservationBooked:
+		where += ` AND r.status=? AND r.end_at > ?`
+		args = append(args, ReservationBooked, now)
+	default:
+		where += ` AND r.status=?`
+		args = append(args, s)
+	}
+	if v := strings.TrimSpace(c.GetString("course")); v != "" {
+		where += ` AND r.course=?`
+		args = append(args, v)
+	}
+	for _, f := range []struct{ param, cond string }{{"from", ` AND r.end_at > ?`}, {"to", ` AND r.start_at < ?`}} {
+		v := strings.TrimSpace(c.GetString(f.param))
+		if v == "" {
+			continue
+		}
+		t, err := parseBookingTime(v)
+		if err != nil {
+			jsonErr(c.Ctx, http.StatusBadRequest, f.param+" must be a date or time")
+			return
+		}
+		if f.param == "to" && len(v) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1) // inclusive
+		}
+		where += f.cond
+		args = append(args, t)
+	}
+	out := make([]reservationRow, 0)
+	if err := srv.DB.Select(&out, reservationSelect+where+` ORDER BY r.start_at, r.id LIMIT 1000`, args...); err != nil {
+		log.Printf("[reservations] list: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	for i := range out {
+		out[i].settle(now)
+	}
+	jsonOK(c.Ctx, out)
+}
+
+// GET /api/reservations/:id
+func (c *ReservationController) Get() {
+	id, ok := c.reservationID()
+	if !ok {
+		return
+	}
+	c.respond(id)
+}
+
+func (c *ReservationController) respond(id int64) {
+	r, ok := c.loadReservation(srv.DB, id, false)
+	if !ok {
+		return
+	}
+	r.settle(time.Now().UTC())
+	jsonOK(c.Ctx, r)
+}
+
+// POST /api/reservations
+//
+//	{"item_id": 7, "quantity": 8, "start": "2024-10-08T07:30", "end": "2024-10-08T11:30",
+//	 "purpose": "Embedded systems practical", "course": "CS3104", "user_id": 57}
+//
+// sku may stand in for item_id. user_id defaults to the caller; booking for
+// someone else takes borrow.approve. A reservation the stock cannot cover
+// throughout is refused with 409, the free quantity over the window and
+// the bookings in the way.
+func (c *ReservationController) Create() {
+	var in struct {
+		ItemID   int64  `json:"item_id"`
+		SKU      string `json:"sku"`
+		Quantity int    `json:"quantity"`
+		Start    string `json:"start"`
+		End      string `json:"end"`
+		Purpose  string `json:"purpose"`
+		Course   string `json:"course"`
+		UserID   int64  `json:"user_id"`
+	}
+	if err := readJSON(c.Ctx, &in); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	in.SKU, in.Purpose, in.Course = strings.TrimSpace(in.SKU), strings.TrimSpace(in.Purpose), strings.TrimSpace(in.Course)
+	start, errStart := parseBookingTime(in.Start)
+	end, errEnd := parseBookingTime(in.End)
+	now := time.Now().UTC()
+	switch {
+	case in.ItemID <= 0 && in.SKU == "":
+		jsonErr(c.Ctx, http.StatusBadRequest, "provide item_id or sku")
+		return
+	case in.Quantity <= 0:
+		jsonErr(c.Ctx, http.StatusBadRequest, "quantity must be > 0")
+		return
+	case errStart != nil || errEnd != nil:
+		jsonErr(c.Ctx, http.StatusBadRequest, "start and end are required, as YYYY-MM-DDTHH:MM or RFC 3339")
+		return
+	case !end.After(start):
+		jsonErr(c.Ctx, http.StatusBadRequest, "end must be after start")
+		return
+	case end.Sub(start) > reservationMaxLength:
+		jsonErr(c.Ctx, http.StatusBadRequest, "a reservation may last at most 30 days")
+		return
+	case start.Before(now.Add(-5 * time.Minute)):
+		jsonErr(c.Ctx, http.StatusBadRequest, "start must not be in the past")
+		return
+	case len(in.Purpose) > 255 || len(in.Course) > 100:
+		jsonErr(c.Ctx, http.StatusBadRequest, "purpose or course is too long")
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	holder := in.UserID
+	if holder <= 0 {
+		holder = uid
+	}
+	if holder != uid && !RoleAllows(currentRole(c.Ctx), PermBorrowApprove) {
+		jsonErr(c.Ctx, http.StatusForbidden, "you can only reserve for yourself")
+		return
+	}
+	if in.ItemID <= 0 {
+		if err := srv.DB.Get(&in.ItemID, `SELECT id FROM log_lab_equipment_master WHERE sku=? LIMIT 1`, in.SKU); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				jsonErr(c.Ctx, http.StatusNotFound, "item not found by sku")
+			} else {
+				log.Printf("[reservations] sku %q: %v", in.SKU, err)
+				jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+			}
+			return
+		}
+	}
+	var n int
+	if err := srv.DB.Get(&n, `SELECT COUNT(1) FROM `+usersTable+` WHERE id=? AND disabled_at IS NULL`, holder); err != nil || n == 0 {
+		jsonErr(c.Ctx, http.StatusBadRequest, "user_id is not an active user")
+		return
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// the item lock serialises bookings of the same item
+	item, ok := c.lockItem(tx, in.ItemID)
+	if !ok {
+		return
+	}
+	switch {
+	case item.ArchivedAt != nil:
+		jsonErr(c.Ctx, http.StatusConflict, "item is archived")
+		return
+	case item.ItemType == ItemConsumable:
+		jsonErr(c.Ctx, http.StatusConflict, "consumable items are issued, not reserved")
+		return
+	}
+	slots, held, err := itemAvailability(tx, in.ItemID, item.AvailableQuantity, start, end)
+	if err != nil {
+		log.Printf("[reservations] availability item=%d: %v", in.ItemID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if s, ok := TightestSlot(slots); ok && s.Available < in.Quantity {
+		c.Ctx.Output.SetStatus(http.StatusConflict)
+		jsonOK(c.Ctx, map[string]interface{}{
+			"error": fmt.Sprintf("only %d of %s can be reserved between %s and %s",
+				maxInt(s.Available, 0), item.Name, s.From.Format(time.RFC3339), s.To.Format(time.RFC3339)),
+			"slots":     slots,
+			"conflicts": held,
+		})
+		return
+	}
+	res, err := tx.Exec(`INSERT INTO reservations (item_id, user_id, quantity, start_at, end_at, purpose, course, status, created_by, created_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?)`, in.ItemID, holder, in.Quantity, start, end,
+		nullableStr(in.Purpose), nullableStr(in.Course), ReservationBooked, uid, now)
+	if err != nil {
+		log.Printf("[reservations] create: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "insert error")
+		return
+	}
+	id, _ := res.LastInsertId()
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Reserved %d x %s (%s) from %s to %s (reservation #%d)",
+		in.Quantity, item.Name, item.SKU, start.Format(time.RFC3339), end.Format(time.RFC3339), id))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	c.Ctx.Output.SetStatus(http.StatusCreated)
+	c.respond(id)
+}
+
+// step locks the reservation's item and then the reservation, and checks
+// that it is still booked and that the caller may act on it: its holder,
+// whoever booked it, or borrow.approve.
+func (c *ReservationController) step(tx *sqlx.Tx) (itemRow, reservationRow, bool) {
+	id, ok := c.reservationID()
+	if !ok {
+		return itemRow{}, reservationRow{}, false
+	}
+	r, ok := c.loadReservation(tx, id, false)
+	if !ok {
+		return itemRow{}, r, false
+	}
+	item, ok := c.lockItem(tx, r.ItemID)
+	if !ok {
+		return item, r, false
+	}
+	if r, ok = c.loadReservation(tx, id, true); !ok {
+		return item, r, false
+	}
+	uid := currentUserID(c.Ctx)
+	if r.UserID != uid && (r.CreatedBy == nil || *r.CreatedBy != uid) && !RoleAllows(currentRole(c.Ctx), PermBorrowApprove) {
+		jsonErr(c.Ctx, http.StatusForbidden, "not your reservation")
+		return item, r, false
+	}
+	r.settle(time.Now().UTC())
+	if r.Status != ReservationBooked {
+		jsonErr(c.Ctx, http.StatusConflict, "reservation is "+r.Status)
+		return item, r, false
+	}
+	return item, r, true
+}
+
+// POST /api/reservations/:id/cancel  {"reason": "session moved online"}
+func (c *ReservationController) Cancel() {
+	var in struct {
+		Reason string `json:"reason"`
+	}
+	_ = readJSON(c.Ctx, &in)
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	item, r, ok := c.step(tx)
+	if !ok {
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	if _, err := tx.Exec(`UPDATE reservations SET status=?, cancelled_by=?, cancelled_at=?, cancel_reason=? WHERE id=?`,
+		ReservationCancelled, uid, time.Now().UTC(), nullableStr(truncate(strings.TrimSpace(in.Reason), 255)), r.ID); err != nil {
+		log.Printf("[reservations] cancel id=%d: %v", r.ID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Cancelled reservation #%d of %s (%s)", r.ID, item.Name, item.SKU))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	c.respond(r.ID)
+}
+
+// POST /api/reservations/:id/pickup  {"unit_ids": [12], "units": ["SN-0042"]}
+// Turns the reservation into a borrow for its holder, due back on the day
+// it ends. Pickup opens an hour before the start.
+func (c *ReservationController) Pickup() {
+	var in struct {
+		UnitIDs []int64  `json:"unit_ids"`
+		Units   []string `json:"units"`
+	}
+	_ = readJSON(c.Ctx, &in) // the body is optional
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	item, r, ok := c.step(tx)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	switch {
+	case now.Before(r.Start.Add(-reservationEarlyPickup)):
+		jsonErr(c.Ctx, http.StatusConflict, "reservation starts at "+r.Start.Format(time.RFC3339)+"; pickup opens an hour before")
+		return
+	case item.ArchivedAt != nil:
+		jsonErr(c.Ctx, http.StatusConflict, "item is archived")
+		return
+	case item.AvailableQuantity < r.Quantity:
+		jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("only %d on the shelf; reserved stock has not come back yet", item.AvailableQuantity))
+		return
+	}
+	// restricted items are handed over by someone who may approve borrows
+	needsApproval, err := borrowNeedsApproval(tx, item.RequiresApproval, item.Category)
+	if err != nil {
+		log.Printf("[reservations] pickup id=%d: %v", r.ID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if needsApproval && !RoleAllows(currentRole(c.Ctx), PermBorrowApprove) {
+		jsonErr(c.Ctx, http.StatusForbidden, "this item requires approval; a lab manager must hand it over")
+		return
+	}
+	endLocal := r.End.In(time.Local)
+	due := time.Date(endLocal.Year(), endLocal.Month(), endLocal.Day(), 0, 0, 0, 0, time.UTC)
+	borrowID, _, msg, err := checkout(tx, r.ItemID, r.UserID, r.Quantity, item.AvailableQuantity, due, in.UnitIDs, in.Units)
+	if err != nil {
+		log.Printf("[reservations] pickup id=%d: %v", r.ID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if msg != "" {
+		jsonErr(c.Ctx, http.StatusConflict, msg)
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	if _, err := tx.Exec(`UPDATE reservations SET status=?, borrow_id=?, picked_up_by=?, picked_up_at=? WHERE id=?`,
+		ReservationPickedUp, borrowID, uid, now, r.ID); err != nil {
+		log.Printf("[reservations] pickup id=%d: %v", r.ID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Picked up reservation #%d: %d x %s (%s) as borrow #%d",
+		r.ID, r.Quantity, item.Name, item.SKU, borrowID))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	c.respond(r.ID)
+}
@@ -1,6 +1,9 @@
 package controllers
 
 import (
+	"encoding/json"
+	"io"
+
 	beegoctx "github.com/beego/beego/v2/server/web/context"
 )
 
@@ -13,3 +16,12 @@ func jsonErr(ctx *beegoctx.Context, code int, msg string) {
 	ctx.Output.SetStatus(code)
 	_ = ctx.Output.JSON(map[string]string{"error": msg}, false, false)
 }
+
+// readJSON decodes the request body into v (with Beego's copied-body fallback).
+func readJSON(ctx *beegoctx.Context, v interface{}) error {
+	body, _ := io.ReadAll(ctx.Request.Body)
+	if len(body) == 0 && len(ctx.Input.RequestBody) > 0 {
+		body = ctx.Input.RequestBody
+	}
+	return json.Unmarshal(body, v)
+}
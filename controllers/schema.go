@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// schemaStatements creates the tables this service owns on top of the
+// existing vlu schema (users, log_lab_*). Every statement must be idempotent;
+// they run once at startup from InitServer.
+var schemaStatements = []string{
+	sessionsSchema,
+	passwordResetsSchema,
+	failedLoginsSchema,
+	mfaChallengesSchema,
+	userIdentitiesSchema,
+	oidcLoginStatesSchema,
+	apiTokensSchema,
+	equipmentUnitsSchema,
+	borrowUnitsSchema,
+	stockMovementsSchema,
+	stockTransfersSchema,
+	stockTransferUnitsSchema,
+	stockIssuesSchema,
+	purchaseRequestsSchema,
+	purchaseRequestLinesSchema,
+	purchaseReceiptsSchema,
+	reservationsSchema,
+	categoryPoliciesSchema,
+	borrowReturnsSchema,
+	borrowRenewalsSchema,
+	jobLeasesSchema,
+}
+
+// schemaColumns are columns added to pre-existing tables.
+var schemaColumns = []struct{ table, column, definition string }{
+	{usersTable, "disabled_at", "DATETIME NULL"},
+	{usersTable, "must_change_password", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{usersTable, "locked_until", "DATETIME NULL"},
+	{usersTable, "totp_secret", "VARCHAR(64) NULL"},
+	{usersTable, "totp_enabled", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{usersTable, "totp_recovery_codes", "TEXT NULL"},
+	{usersTable, "totp_last_step", "BIGINT NULL"},
+	{sessionsTable, "mfa", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"log_lab_equipment_master", "archived_at", "DATETIME NULL"},
+	{"log_lab_equipment_master", "archived_reason", "VARCHAR(255) NULL"},
+	{"log_lab_equipment_master", "archived_by", "BIGINT UNSIGNED NULL"},
+	{"log_lab_equipment_master", "item_type", "VARCHAR(16) NOT NULL DEFAULT 'durable'"},
+	{"log_lab_equipment_master", "reorder_point", "INT NOT NULL DEFAULT 0"},
+	{"log_lab_equipment_master", "reorder_qty", "INT NOT NULL DEFAULT 0"},
+	{"log_lab_equipment_master", "low_stock_since", "DATETIME NULL"},
+	{"log_lab_equipment_master", "requires_approval", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"log_lab_borrow_records", "decided_by", "BIGINT UNSIGNED NULL"},
+	{"log_lab_borrow_records", "decided_at", "DATETIME NULL"},
+	{"log_lab_borrow_records", "decision_note", "VARCHAR(255) NULL"},
+	{"log_lab_borrow_records", "quantity_returned", "INT NOT NULL DEFAULT 0"},
+	{"log_lab_borrow_records", "renewals", "INT NOT NULL DEFAULT 0"},
+	{"category_policies", "max_renewals", "INT NULL"},
+	{"category_policies", "max_loan_days", "INT NULL"},
+	{"category_policies", "renewal_requires_approval", "TINYINT(1) NOT NULL DEFAULT 0"},
+}
+
+// ensureSchema applies schemaStatements in order, then schemaColumns.
+func ensureSchema(db *sqlx.DB) error {
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("ensure schema: %w", err)
+		}
+	}
+	for _, c := range schemaColumns {
+		if err := ensureColumn(db, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureColumn adds table.column with the given definition when it is missing.
+// MySQL has no ADD COLUMN IF NOT EXISTS, so we check information_schema first.
+func ensureColumn(db *sqlx.DB, table, column, definition string) error {
+	var n int
+	if err := db.Get(&n, `
+		SELECT COUNT(1) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, table, column); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", table, column, definition)); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
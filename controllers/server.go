@@ -17,8 +17,12 @@ import (
 )
 
 type Server struct {
-	DB    *sqlx.DB
-	Cache *cache.Cache
+	DB       *sqlx.DB
+	Cache    *cache.Cache
+	Sessions SessionStore
+	Mailer   Mailer
+	Limiter  *loginLimiter
+	Auth     Authenticator
 }
 
 var srv *Server
@@ -51,9 +55,6 @@ func InitServer() (*Server, error) {
 		log.Printf("[server] MYSQL_DSN not set; using default DSN: %s", mysqlDSN)
 	}
 
-	// Session TTL (hours)
-	sessTTL := int64FromConf("SESSION_TTL_HOURS", 168) // 7 days
-
 	// Allowed CORS origins (comma-separated)
 	originsCSV := firstNonEmpty(
 		getConf("cors_origins"),
@@ -78,9 +79,17 @@ func InitServer() (*Server, error) {
 		return nil, err
 	}
 
-	// ---- 3) In-memory cache for sessions (used by login.go helpers)
-	defaultExp := time.Duration(sessTTL) * time.Hour
-	srvCache := cache.New(defaultExp, 10*time.Minute)
+	// Create the tables this service owns (sessions, ...)
+	if err := ensureSchema(db); err != nil {
+		return nil, err
+	}
+	if err := ensureBootstrapAdmin(db); err != nil {
+		return nil, err
+	}
+
+	// ---- 3) Sessions, limiter, mailer and authenticator around the DB
+	srv = NewServer(db)
+	go purgeExpiredSessions(srv.Sessions, time.Hour)
 
 	// ---- 4) CORS (allow credentials, common headers & methods)
 	beego.InsertFilter("*", beego.BeforeRouter, cors.Allow(&cors.Options{
@@ -106,18 +115,54 @@ func InitServer() (*Server, error) {
 		}, false, false)
 	})
 
-	// ---- 6) Save singleton
-	srv = &Server{
-		DB:    db,
-		Cache: srvCache,
+	// Low-stock check (0 disables it)
+	if m := int64FromConf("LOW_STOCK_CHECK_MINUTES", 15); m > 0 {
+		go watchLowStock(srv, time.Duration(m)*time.Minute)
+	}
+	// Overdue loans (0 disables it)
+	if m := int64FromConf("OVERDUE_CHECK_MINUTES", 10); m > 0 {
+		go watchOverdue(srv, time.Duration(m)*time.Minute)
 	}
 
-	log.Printf("[server] Init OK | origins=%v | sessionTTL=%dh", allowOrigins, sessTTL)
+	log.Printf("[server] Init OK | origins=%v | sessionTTL=%dh", allowOrigins, int64FromConf("SESSION_TTL_HOURS", 168))
 	return srv, nil
 }
 
+// NewServer wires the session store, login limiter, mailer and
+// authenticator around an open database and makes the result the server
+// GetServer returns. InitServer calls it once the schema is in place; tests
+// hand it a mock database.
+func NewServer(db *sqlx.DB) *Server {
+	// Session TTL (hours)
+	sessTTL := int64FromConf("SESSION_TTL_HOURS", 168) // 7 days
+	// How long a session may be served from memory before re-reading the DB
+	sessCacheSecs := int64FromConf("SESSION_CACHE_SECONDS", 60)
+
+	// `sessions` table with the in-memory cache as a read-through layer
+	c := cache.New(time.Duration(sessTTL)*time.Hour, 10*time.Minute)
+	srv = &Server{
+		DB:       db,
+		Cache:    c,
+		Sessions: newCachedSessionStore(newSQLSessionStore(db), c, time.Duration(sessCacheSecs)*time.Second),
+		Mailer:   newMailerFromConf(),
+		Limiter:  newLoginLimiterFromConf(db),
+		Auth:     newAuthenticatorFromConf(),
+	}
+	return srv
+}
+
 // ---------- helpers ----------
 
+func purgeExpiredSessions(store SessionStore, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		if err := store.PurgeExpired(); err != nil {
+			log.Printf("[server] purge expired sessions: %v", err)
+		}
+	}
+}
+
 func getConf(key string) string {
 	// Reads from app.conf (if present). Returns empty string on error/missing.
 	v, err := beego.AppConfig.String(key)
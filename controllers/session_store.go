@@ -0,0 +1,289 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+)
+
+const sessionsTable = "sessions"
+
+const sessionsSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id           BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	token_hash   CHAR(64)        NOT NULL,
+	user_id      BIGINT UNSIGNED NOT NULL,
+	created_at   DATETIME        NOT NULL,
+	last_seen_at DATETIME        NOT NULL,
+	expires_at   DATETIME        NOT NULL,
+	user_agent   VARCHAR(255)    NULL,
+	ip           VARCHAR(64)     NULL,
+	mfa          TINYINT(1)      NOT NULL DEFAULT 0,
+	UNIQUE KEY uq_sessions_token_hash (token_hash),
+	KEY idx_sessions_user (user_id),
+	KEY idx_sessions_expires (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// SessionStore persists login sessions. Only the SHA-256 of a token is stored;
+// the plain token exists only in the client and in the Session returned by Put.
+type SessionStore interface {
+	Put(s Session) (Session, error)
+	Get(token string) (Session, bool, error)
+	Touch(token string, at time.Time) error
+	Delete(token string) error
+	PurgeExpired() error
+
+	// per-user management (sessions API)
+	ListByUser(userID int64) ([]Session, error)
+	DeleteByID(userID, id int64) (bool, error)
+	DeleteByUser(userID int64, exceptID int64) (int64, error)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ---- sessions table ----
+
+type sqlSessionStore struct {
+	db *sqlx.DB
+}
+
+func newSQLSessionStore(db *sqlx.DB) *sqlSessionStore {
+	return &sqlSessionStore{db: db}
+}
+
+type sessionRow struct {
+	ID        int64          `db:"id"`
+	UserID    int64          `db:"user_id"`
+	Email     string         `db:"email"`
+	Role      string         `db:"role"`
+	CreatedAt time.Time      `db:"created_at"`
+	LastSeen  time.Time      `db:"last_seen_at"`
+	ExpiresAt time.Time      `db:"expires_at"`
+	UserAgent sql.NullString `db:"user_agent"`
+	IP        sql.NullString `db:"ip"`
+	MFA       bool           `db:"mfa"`
+
+	MustChangePassword bool `db:"must_change_password"`
+}
+
+func (r sessionRow) session(token string) Session {
+	return Session{
+		ID:        r.ID,
+		Token:     token,
+		UserID:    r.UserID,
+		Email:     r.Email,
+		Role:      r.Role,
+		Exp:       r.ExpiresAt,
+		CreatedAt: r.CreatedAt,
+		LastSeen:  r.LastSeen,
+		UserAgent: r.UserAgent.String,
+		IP:        r.IP.String,
+		MFA:       r.MFA,
+
+		MustChangePassword: r.MustChangePassword,
+	}
+}
+
+func (st *sqlSessionStore) Put(s Session) (Session, error) {
+	now := time.Now().UTC()
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = now
+	}
+	s.LastSeen = now
+	res, err := st.db.Exec(`
+		INSERT INTO `+sessionsTable+` (token_hash, user_id, created_at, last_seen_at, expires_at, user_agent, ip, mfa)
+		VALUES (?,?,?,?,?,?,?,?)`,
+		hashToken(s.Token), s.UserID, s.CreatedAt, s.LastSeen, s.Exp.UTC(),
+		nullableStr(truncate(s.UserAgent, 255)), nullableStr(s.IP), s.MFA,
+	)
+	if err != nil {
+		return s, err
+	}
+	s.ID, _ = res.LastInsertId()
+	return s, nil
+}
+
+// Get joins users so that role/email changes, disabling and a forced
+// password change apply to existing sessions.
+func (st *sqlSessionStore) Get(token string) (Session, bool, error) {
+	var r sessionRow
+	err := st.db.Get(&r, `
+		SELECT s.id, s.user_id, u.email, u.role, s.created_at, s.last_seen_at, s.expires_at, s.user_agent, s.ip, s.mfa,
+		       u.must_change_password
+		FROM `+sessionsTable+` s
+		JOIN `+usersTable+` u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > UTC_TIMESTAMP() AND u.disabled_at IS NULL
+		LIMIT 1`, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, false, nil
+	}
+	if err != nil {
+		return Session{}, false, err
+	}
+	return r.session(token), true, nil
+}
+
+func (st *sqlSessionStore) Touch(token string, at time.Time) error {
+	_, err := st.db.Exec(`UPDATE `+sessionsTable+` SET last_seen_at=? WHERE token_hash=?`, at.UTC(), hashToken(token))
+	return err
+}
+
+func (st *sqlSessionStore) Delete(token string) error {
+	_, err := st.db.Exec(`DELETE FROM `+sessionsTable+` WHERE token_hash=?`, hashToken(token))
+	return err
+}
+
+func (st *sqlSessionStore) PurgeExpired() error {
+	_, err := st.db.Exec(`DELETE FROM ` + sessionsTable + ` WHERE expires_at <= UTC_TIMESTAMP()`)
+	return err
+}
+
+func (st *sqlSessionStore) ListByUser(userID int64) ([]Session, error) {
+	var rows []sessionRow
+	err := st.db.Select(&rows, `
+		SELECT s.id, s.user_id, u.email, u.role, s.created_at, s.last_seen_at, s.expires_at, s.user_agent, s.ip, s.mfa
+		FROM `+sessionsTable+` s
+		JOIN `+usersTable+` u ON u.id = s.user_id
+		WHERE s.user_id = ? AND s.expires_at > UTC_TIMESTAMP()
+		ORDER BY s.last_seen_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Session, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, r.session(""))
+	}
+	return out, nil
+}
+
+func (st *sqlSessionStore) DeleteByID(userID, id int64) (bool, error) {
+	res, err := st.db.Exec(`DELETE FROM `+sessionsTable+` WHERE id=? AND user_id=?`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// DeleteByUser removes every session of userID except exceptID (0 = none kept).
+func (st *sqlSessionStore) DeleteByUser(userID int64, exceptID int64) (int64, error) {
+	res, err := st.db.Exec(`DELETE FROM `+sessionsTable+` WHERE user_id=? AND id<>?`, userID, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ---- go-cache read-through layer ----
+
+// cachedSessionStore keeps recently used sessions in memory for a short TTL so
+// most requests skip the database. The TTL is kept short on purpose: a session
+// deleted on another instance stays valid here for at most that long.
+type cachedSessionStore struct {
+	next  SessionStore
+	cache *cache.Cache
+	ttl   time.Duration
+}
+
+func newCachedSessionStore(next SessionStore, c *cache.Cache, ttl time.Duration) *cachedSessionStore {
+	return &cachedSessionStore{next: next, cache: c, ttl: ttl}
+}
+
+func (cs *cachedSessionStore) key(token string) string { return "sess:" + hashToken(token) }
+
+func (cs *cachedSessionStore) remember(s Session) {
+	ttl := cs.ttl
+	if left := time.Until(s.Exp); left < ttl {
+		ttl = left
+	}
+	if ttl > 0 {
+		cs.cache.Set(cs.key(s.Token), s, ttl)
+	}
+}
+
+func (cs *cachedSessionStore) Put(s Session) (Session, error) {
+	s, err := cs.next.Put(s)
+	if err != nil {
+		return s, err
+	}
+	cs.remember(s)
+	return s, nil
+}
+
+func (cs *cachedSessionStore) Get(token string) (Session, bool, error) {
+	if v, ok := cs.cache.Get(cs.key(token)); ok {
+		if s, ok := v.(Session); ok && time.Now().Before(s.Exp) {
+			return s, true, nil
+		}
+	}
+	s, ok, err := cs.next.Get(token)
+	if err != nil || !ok {
+		return s, ok, err
+	}
+	cs.remember(s)
+	return s, true, nil
+}
+
+func (cs *cachedSessionStore) Touch(token string, at time.Time) error {
+	if v, ok := cs.cache.Get(cs.key(token)); ok {
+		if s, ok := v.(Session); ok {
+			s.LastSeen = at
+			cs.remember(s)
+		}
+	}
+	return cs.next.Touch(token, at)
+}
+
+func (cs *cachedSessionStore) Delete(token string) error {
+	cs.cache.Delete(cs.key(token))
+	return cs.next.Delete(token)
+}
+
+func (cs *cachedSessionStore) PurgeExpired() error {
+	return cs.next.PurgeExpired()
+}
+
+func (cs *cachedSessionStore) ListByUser(userID int64) ([]Session, error) {
+	return cs.next.ListByUser(userID)
+}
+
+func (cs *cachedSessionStore) DeleteByID(userID, id int64) (bool, error) {
+	cs.forget(func(s Session) bool { return s.UserID == userID && s.ID == id })
+	return cs.next.DeleteByID(userID, id)
+}
+
+// DeleteByUser also drops the kept session from the cache, so what changed
+// along with the revocation (a new password) shows on its next request.
+func (cs *cachedSessionStore) DeleteByUser(userID int64, exceptID int64) (int64, error) {
+	cs.forget(func(s Session) bool { return s.UserID == userID })
+	return cs.next.DeleteByUser(userID, exceptID)
+}
+
+// forget drops cached sessions matching fn. The cache only holds sessions used
+// within the last ttl, so scanning it is cheap.
+func (cs *cachedSessionStore) forget(fn func(Session) bool) {
+	for k, it := range cs.cache.Items() {
+		if !strings.HasPrefix(k, "sess:") {
+			continue
+		}
+		if s, ok := it.Object.(Session); ok && fn(s) {
+			cs.cache.Delete(k)
+		}
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+)
+
+type sessionView struct {
+	ID        int64     `json:"id"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Current   bool      `json:"current"`
+}
+
+func sessionViews(list []Session, currentID int64) []sessionView {
+	out := make([]sessionView, 0, len(list))
+	for _, s := range list {
+		out = append(out, sessionView{
+			ID:        s.ID,
+			Device:    describeDevice(s.UserAgent),
+			UserAgent: s.UserAgent,
+			IP:        s.IP,
+			CreatedAt: s.CreatedAt,
+			LastSeen:  s.LastSeen,
+			ExpiresAt: s.Exp,
+			Current:   currentID > 0 && s.ID == currentID,
+		})
+	}
+	return out
+}
+
+// describeDevice turns a User-Agent into a short label like "Chrome on Windows".
+func describeDevice(ua string) string {
+	if ua == "" {
+		return "Unknown device"
+	}
+	lo := strings.ToLower(ua)
+	browser := "Browser"
+	switch {
+	case strings.Contains(lo, "edg/"):
+		browser = "Edge"
+	case strings.Contains(lo, "opr/") || strings.Contains(lo, "opera"):
+		browser = "Opera"
+	case strings.Contains(lo, "coc_coc") || strings.Contains(lo, "coccoc"):
+		browser = "Cốc Cốc"
+	case strings.Contains(lo, "chrome/"):
+		browser = "Chrome"
+	case strings.Contains(lo, "firefox/"):
+		browser = "Firefox"
+	case strings.Contains(lo, "safari/"):
+		browser = "Safari"
+	case strings.Contains(lo, "curl/"), strings.Contains(lo, "python"), strings.Contains(lo, "go-http-client"):
+		browser = "Script"
+	}
+	platform := ""
+	switch {
+	case strings.Contains(lo, "android"):
+		platform = "Android"
+	case strings.Contains(lo, "iphone"), strings.Contains(lo, "ipad"):
+		platform = "iOS"
+	case strings.Contains(lo, "windows"):
+		platform = "Windows"
+	case strings.Contains(lo, "mac os"), strings.Contains(lo, "macintosh"):
+		platform = "macOS"
+	case strings.Contains(lo, "linux"):
+		platform = "Linux"
+	}
+	if platform == "" {
+		return browser
+	}
+	return browser + " on " + platform
+}
+
+func currentSessionID(ctx *beegoctx.Context) int64 {
+	id, _ := ctx.Input.GetData("session_id").(int64)
+	return id
+}
+
+func pathID(ctx *beegoctx.Context, key string) (int64, bool) {
+	id, err := strconv.ParseInt(ctx.Input.Param(key), 10, 64)
+	return id, err == nil && id > 0
+}
+
+func clearAuthCookie(ctx *beegoctx.Context) {
+	http.SetCookie(ctx.ResponseWriter, &http.Cookie{
+		Name:     "imx_token",
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+}
+
+// GET /api/auth/sessions
+func AuthSessionsList(ctx *beegoctx.Context) {
+	uid := currentUserID(ctx)
+	list, err := GetServer().Sessions.ListByUser(uid)
+	if err != nil {
+		log.Printf("[sessions] list user_id=%d: %v", uid, err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	jsonOK(ctx, sessionViews(list, currentSessionID(ctx)))
+}
+
+// DELETE /api/auth/sessions/:id
+func AuthSessionRevoke(ctx *beegoctx.Context) {
+	id, ok := pathID(ctx, ":id")
+	if !ok {
+		jsonErr(ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	uid := currentUserID(ctx)
+	found, err := GetServer().Sessions.DeleteByID(uid, id)
+	if err != nil {
+		log.Printf("[sessions] revoke id=%d user_id=%d: %v", id, uid, err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if !found {
+		jsonErr(ctx, http.StatusNotFound, "session not found")
+		return
+	}
+	if id == currentSessionID(ctx) {
+		clearAuthCookie(ctx)
+	}
+	jsonOK(ctx, map[string]interface{}{"ok": true})
+}
+
+// DELETE /api/auth/sessions?keep_current=1
+// "Log out everywhere"; keep_current leaves the calling session signed in.
+func AuthSessionsRevokeAll(ctx *beegoctx.Context) {
+	uid := currentUserID(ctx)
+	var keep int64
+	if v, _ := strconv.ParseBool(ctx.Input.Query("keep_current")); v {
+		keep = currentSessionID(ctx)
+	}
+	n, err := GetServer().Sessions.DeleteByUser(uid, keep)
+	if err != nil {
+		log.Printf("[sessions] revoke all user_id=%d: %v", uid, err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if keep == 0 {
+		clearAuthCookie(ctx)
+	}
+	jsonOK(ctx, map[string]interface{}{"ok": true, "revoked": n})
+}
+
+// GET /api/admin/users/:id/sessions
+func AdminUserSessionsList(ctx *beegoctx.Context) {
+	uid, ok := pathID(ctx, ":id")
+	if !ok {
+		jsonErr(ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	list, err := GetServer().Sessions.ListByUser(uid)
+	if err != nil {
+		log.Printf("[sessions] admin list user_id=%d: %v", uid, err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	jsonOK(ctx, sessionViews(list, 0))
+}
+
+// DELETE /api/admin/users/:id/sessions
+// Used when a student card is lost or an account is compromised.
+func AdminUserSessionsRevokeAll(ctx *beegoctx.Context) {
+	uid, ok := pathID(ctx, ":id")
+	if !ok {
+		jsonErr(ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	n, err := GetServer().Sessions.DeleteByUser(uid, 0)
+	if err != nil {
+		log.Printf("[sessions] admin revoke all user_id=%d: %v", uid, err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	logActivity(currentUserID(ctx), fmt.Sprintf("Revoked all sessions of user #%d (%d)", uid, n))
+	jsonOK(ctx, map[string]interface{}{"ok": true, "revoked": n})
+}
+
+// DELETE /api/admin/users/:id/sessions/:sid
+func AdminUserSessionRevoke(ctx *beegoctx.Context) {
+	uid, ok := pathID(ctx, ":id")
+	sid, ok2 := pathID(ctx, ":sid")
+	if !ok || !ok2 {
+		jsonErr(ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	found, err := GetServer().Sessions.DeleteByID(uid, sid)
+	if err != nil {
+		log.Printf("[sessions] admin revoke id=%d user_id=%d: %v", sid, uid, err)
+		jsonErr(ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	if !found {
+		jsonErr(ctx, http.StatusNotFound, "session not found")
+		return
+	}
+	logActivity(currentUserID(ctx), fmt.Sprintf("Revoked session #%d of user #%d", sid, uid))
+	jsonOK(ctx, map[string]interface{}{"ok": true})
+}
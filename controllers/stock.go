@@ -0,0 +1,563 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+	"github.com/jmoiron/sqlx"
+
+	"vlu_infrastructure_management/models"
+)
+
+// Stock per location, kept in log_lab_storage (one row per item and
+// location: lab 1/2/3, store room, a shelf bin...). An item without rows has
+// all of its quantity at the location on the master row. Once it has rows:
+//
+//	sum(log_lab_storage.quantity) = quantity
+//	location on the master row    = the row holding the most stock
+//
+// Borrowing does not move stock between locations; a unit on loan still
+// belongs where it came from. Stock sent on a transfer sits in the "In
+// transit" row until it is received. Every change to a row is written to
+// the stock_movements ledger, and every write locks the master row first.
+
+const (
+	unassignedLocation = "Unassigned"
+	inTransitLocation  = "In transit"
+)
+
+const stockMovementsSchema = `
+CREATE TABLE IF NOT EXISTS stock_movements (
+	id         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	item_id    BIGINT UNSIGNED NOT NULL,
+	location   VARCHAR(255)    NOT NULL,
+	delta      INT             NOT NULL,
+	balance    INT             NOT NULL,
+	reason     VARCHAR(32)     NOT NULL,
+	ref_type   VARCHAR(32)     NULL,
+	ref_id     BIGINT UNSIGNED NULL,
+	user_id    BIGINT UNSIGNED NULL,
+	note       VARCHAR(255)    NULL,
+	created_at DATETIME        NOT NULL,
+	KEY idx_stock_movements_item (item_id, id),
+	KEY idx_stock_movements_location (location, id),
+	KEY idx_stock_movements_ref (ref_type, ref_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// stockMove says why stock changed; it is stored with each ledger line.
+// Balance on a line is the location's quantity after it.
+type stockMove struct {
+	Reason  string
+	RefType string
+	RefID   int64
+	UserID  int64
+	Note    string
+}
+
+func (mv stockMove) record(tx *sqlx.Tx, itemID int64, location string, delta, balance int, at time.Time) error {
+	var ref interface{}
+	if mv.RefType != "" {
+		ref = mv.RefID
+	}
+	var user interface{}
+	if mv.UserID > 0 {
+		user = mv.UserID
+	}
+	_, err := tx.Exec(`INSERT INTO stock_movements (item_id, location, delta, balance, reason, ref_type, ref_id, user_id, note, created_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?)`,
+		itemID, location, delta, balance, mv.Reason, nullableStr(mv.RefType), ref, user, nullableStr(truncate(mv.Note, 255)), at)
+	return err
+}
+
+func isInTransit(location string) bool {
+	return strings.EqualFold(normalizeLocation(location), inTransitLocation)
+}
+
+// normalizeLocation trims and collapses inner whitespace so "Lab  1 " and
+// "Lab 1" are the same place. Comparisons are case-insensitive.
+func normalizeLocation(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func locationName(s *models.Storage) string {
+	if s.Location == nil || normalizeLocation(*s.Location) == "" {
+		return unassignedLocation
+	}
+	return normalizeLocation(*s.Location)
+}
+
+// PrimaryLocation is the location holding the most stock; ties go to the
+// older row.
+func PrimaryLocation(levels []models.Storage) string {
+	best := -1
+	for i := range levels {
+		if best < 0 || levels[i].Quantity > levels[best].Quantity {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return locationName(&levels[best])
+}
+
+// ApplyStockDelta spreads a change of quantity over the item's locations.
+// An increase goes to location, or the primary location when it is empty;
+// a decrease comes out of location, or out of the largest holdings first.
+// Rows that drop to zero are kept with Quantity 0 for the caller to delete;
+// new locations are appended with ID 0.
+func ApplyStockDelta(levels []models.Storage, delta int, location string) ([]models.Storage, error) {
+	out := append([]models.Storage(nil), levels...)
+	location = normalizeLocation(location)
+	find := func(name string) int {
+		for i := range out {
+			if strings.EqualFold(locationName(&out[i]), name) {
+				return i
+			}
+		}
+		return -1
+	}
+	switch {
+	case delta == 0:
+		return out, nil
+	case delta > 0:
+		target := firstNonEmpty(location, PrimaryLocation(out), unassignedLocation)
+		if i := find(target); i >= 0 {
+			out[i].Quantity += delta
+		} else {
+			out = append(out, models.Storage{Location: &target, Quantity: delta})
+		}
+		return out, nil
+	}
+
+	need := -delta
+	if location != "" {
+		have := 0
+		i := find(location)
+		if i >= 0 {
+			have = out[i].Quantity
+		}
+		if have < need {
+			return nil, fmt.Errorf("%s holds %d, cannot take %d", location, have, need)
+		}
+		out[i].Quantity -= need
+		return out, nil
+	}
+	order := make([]int, len(out))
+	total := 0
+	for i := range out {
+		order[i] = i
+		total += out[i].Quantity
+	}
+	if total < need {
+		return nil, fmt.Errorf("only %d in stock across all locations, cannot take %d", total, need)
+	}
+	sort.SliceStable(order, func(a, b int) bool { return out[order[a]].Quantity > out[order[b]].Quantity })
+	for _, i := range order {
+		take := minInt(need, out[i].Quantity)
+		out[i].Quantity -= take
+		need -= take
+		if need == 0 {
+			break
+		}
+	}
+	return out, nil
+}
+
+// stockLevels reads the item's rows, largest first.
+func stockLevels(q sqlQuerier, itemID int64, lock bool) ([]models.Storage, error) {
+	levels := make([]models.Storage, 0)
+	sqlStr := `SELECT id, item_id, location, quantity, updated_at FROM log_lab_storage
+		WHERE item_id=? ORDER BY quantity DESC, id`
+	if lock {
+		sqlStr += ` FOR UPDATE`
+	}
+	return levels, q.Select(&levels, sqlStr, itemID)
+}
+
+// writeStockLevels stores after, as returned by ApplyStockDelta from
+// before, writes the difference to the ledger and points the master row's
+// location at the primary one (never at "In transit").
+func writeStockLevels(tx *sqlx.Tx, itemID int64, before, after []models.Storage, mv stockMove) error {
+	at := time.Now().UTC()
+	prev := make(map[uint64]models.Storage, len(before))
+	for _, s := range before {
+		prev[s.ID] = s
+	}
+	for _, s := range after {
+		name := locationName(&s)
+		var err error
+		switch {
+		case s.ID == 0 && s.Quantity > 0:
+			_, err = tx.Exec(`INSERT INTO log_lab_storage (item_id, location, quantity, updated_at) VALUES (?,?,?,?)`,
+				itemID, name, s.Quantity, at)
+		case s.ID != 0 && s.Quantity <= 0:
+			_, err = tx.Exec(`DELETE FROM log_lab_storage WHERE id=?`, s.ID)
+		case s.ID != 0:
+			_, err = tx.Exec(`UPDATE log_lab_storage SET location=?, quantity=?, updated_at=? WHERE id=?`,
+				name, s.Quantity, at, s.ID)
+		}
+		if err != nil {
+			return err
+		}
+
+		qty := s.Quantity
+		if qty < 0 {
+			qty = 0
+		}
+		old, had := prev[s.ID]
+		switch {
+		case s.ID == 0 || !had:
+			if qty > 0 {
+				err = mv.record(tx, itemID, name, qty, qty, at)
+			}
+		case !strings.EqualFold(locationName(&old), name):
+			if err = mv.record(tx, itemID, locationName(&old), -old.Quantity, 0, at); err == nil && qty > 0 {
+				err = mv.record(tx, itemID, name, qty, qty, at)
+			}
+		case qty != old.Quantity:
+			err = mv.record(tx, itemID, name, qty-old.Quantity, qty, at)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var shelf []models.Storage
+	for _, s := range after {
+		if s.Quantity > 0 && !isInTransit(locationName(&s)) {
+			shelf = append(shelf, s)
+		}
+	}
+	if len(shelf) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`UPDATE log_lab_equipment_master SET location=? WHERE id=?`, PrimaryLocation(shelf), itemID)
+	return err
+}
+
+// relocateMsg is the client error for changing the master location of an
+// item that is spread over several locations, or "".
+func relocateMsg(q sqlQuerier, itemID int64) (string, error) {
+	var n int
+	if err := q.Get(&n, `SELECT COUNT(1) FROM log_lab_storage WHERE item_id=? AND location<>?`, itemID, inTransitLocation); err != nil {
+		return "", err
+	}
+	if n > 1 {
+		return fmt.Sprintf("item is stocked in %d locations; move stock with PUT /api/items/%d/stock", n, itemID), nil
+	}
+	return "", nil
+}
+
+// syncStock keeps log_lab_storage in line after the master row of itemID
+// changed by qtyDelta and, when relocated is not nil, moved to a new
+// location. Stock in transit is left alone. Items without rows need
+// nothing. The master row must already be locked by the caller.
+func syncStock(tx *sqlx.Tx, itemID int64, qtyDelta int, relocated *string, mv stockMove) (string, error) {
+	return shiftStock(tx, itemID, qtyDelta, "", relocated, mv)
+}
+
+// shiftStock is syncStock with the change going to or coming from location
+// (see ApplyStockDelta). For an item without rows, location must be its
+// master location.
+func shiftStock(tx *sqlx.Tx, itemID int64, qtyDelta int, location string, relocated *string, mv stockMove) (string, error) {
+	levels, err := stockLevels(tx, itemID, true)
+	if err != nil {
+		return "", err
+	}
+	if len(levels) == 0 {
+		if location == "" {
+			return "", nil
+		}
+		var master string
+		if err := tx.Get(&master, `SELECT location FROM log_lab_equipment_master WHERE id=?`, itemID); err != nil {
+			return "", err
+		}
+		if !strings.EqualFold(firstNonEmpty(normalizeLocation(master), unassignedLocation), location) {
+			return fmt.Sprintf("item is not kept at %s", location), nil
+		}
+		return "", nil
+	}
+	var shelf, transit []models.Storage
+	for _, s := range levels {
+		if isInTransit(locationName(&s)) {
+			transit = append(transit, s)
+		} else {
+			shelf = append(shelf, s)
+		}
+	}
+	if relocated != nil {
+		if len(shelf) > 1 {
+			return relocateMsg(tx, itemID)
+		}
+		if len(shelf) == 1 {
+			loc := normalizeLocation(*relocated)
+			shelf[0].Location = &loc
+		}
+	}
+	after, err := ApplyStockDelta(shelf, qtyDelta, location)
+	if err != nil {
+		return err.Error(), nil
+	}
+	return "", writeStockLevels(tx, itemID, levels, append(after, transit...), mv)
+}
+
+// seedStock gives an item without rows its opening balance: the whole
+// quantity at the master location. It returns the item's rows, locked.
+func seedStock(tx *sqlx.Tx, item itemRow, userID int64) ([]models.Storage, error) {
+	levels, err := stockLevels(tx, int64(item.ID), true)
+	if err != nil || len(levels) > 0 || item.Quantity <= 0 {
+		return levels, err
+	}
+	loc := firstNonEmpty(normalizeLocation(item.Location), unassignedLocation)
+	after := []models.Storage{{Location: &loc, Quantity: item.Quantity}}
+	if err := writeStockLevels(tx, int64(item.ID), nil, after, stockMove{Reason: "opening", UserID: userID}); err != nil {
+		return nil, err
+	}
+	return stockLevels(tx, int64(item.ID), true)
+}
+
+// moveStock moves n from one location of the item to another and returns
+// a client message when from does not hold n.
+func moveStock(tx *sqlx.Tx, item itemRow, from, to string, n int, mv stockMove) (string, error) {
+	levels, err := seedStock(tx, item, mv.UserID)
+	if err != nil {
+		return "", err
+	}
+	after, err := ApplyStockDelta(levels, -n, from)
+	if err != nil {
+		return err.Error(), nil
+	}
+	if after, err = ApplyStockDelta(after, n, to); err != nil {
+		return err.Error(), nil
+	}
+	return "", writeStockLevels(tx, int64(item.ID), levels, after, mv)
+}
+
+// itemStock is GET /api/items/:id/stock. Implicit means the item has no
+// rows yet and the single level shown is its master location.
+type itemStock struct {
+	ItemID            int              `json:"item_id"`
+	SKU               string           `json:"sku"`
+	Name              string           `json:"name"`
+	Quantity          int              `json:"quantity"`
+	AvailableQuantity int              `json:"available_quantity"`
+	Implicit          bool             `json:"implicit"`
+	Locations         []models.Storage `json:"locations"`
+}
+
+func stockOf(item itemRow, levels []models.Storage) itemStock {
+	out := itemStock{ItemID: item.ID, SKU: item.SKU, Name: item.Name, Quantity: item.Quantity,
+		AvailableQuantity: item.AvailableQuantity, Locations: levels}
+	if len(levels) == 0 {
+		loc := firstNonEmpty(normalizeLocation(item.Location), unassignedLocation)
+		out.Implicit = true
+		out.Locations = []models.Storage{{ItemID: uint64(item.ID), Location: &loc, Quantity: item.Quantity}}
+	}
+	return out
+}
+
+// GET /api/items/:id/stock  (stock.transfer, like the other stock reads)
+func (c *ItemController) Stock() {
+	id, ok := c.itemID()
+	if !ok {
+		return
+	}
+	item, ok := c.loadItem(srv.DB, id, false)
+	if !ok {
+		return
+	}
+	levels, err := StorageByItem(c.Ctx.Request.Context(), uint64(id))
+	if err != nil {
+		log.Printf("[stock] item=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	sort.SliceStable(levels, func(a, b int) bool { return levels[a].Quantity > levels[b].Quantity })
+	jsonOK(c.Ctx, stockOf(item, levels))
+}
+
+// PUT /api/items/:id/stock
+//
+//	{"locations": [{"location": "Lab 1", "quantity": 3}, {"location": "Store room", "quantity": 2}]}
+//
+// A stock count: replaces the item's distribution. Together with any stock
+// in transit the quantities must add up to the item's quantity (change that
+// with PATCH /api/items/:id). Omitted locations are emptied.
+func (c *ItemController) SetStock() {
+	id, ok := c.itemID()
+	if !ok {
+		return
+	}
+	var in struct {
+		Locations []struct {
+			Location string `json:"location"`
+			Quantity int    `json:"quantity"`
+		} `json:"locations"`
+	}
+	if err := readJSON(c.Ctx, &in); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	want := map[string]int{}
+	var names []string
+	total := 0
+	for _, l := range in.Locations {
+		name := normalizeLocation(l.Location)
+		switch {
+		case name == "":
+			jsonErr(c.Ctx, http.StatusBadRequest, "location is required")
+			return
+		case len(name) > 255:
+			jsonErr(c.Ctx, http.StatusBadRequest, "location is too long")
+			return
+		case isInTransit(name):
+			jsonErr(c.Ctx, http.StatusBadRequest, "stock in transit is moved by receiving or cancelling its transfer")
+			return
+		case l.Quantity < 0:
+			jsonErr(c.Ctx, http.StatusBadRequest, "quantity must be >= 0")
+			return
+		}
+		key := strings.ToLower(name)
+		if _, dup := want[key]; dup {
+			jsonErr(c.Ctx, http.StatusBadRequest, fmt.Sprintf("location %q is listed twice", name))
+			return
+		}
+		want[key] = l.Quantity
+		names = append(names, name)
+		total += l.Quantity
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	item, ok := c.loadItem(tx, id, true)
+	if !ok {
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	levels, err := seedStock(tx, item, uid)
+	if err != nil {
+		log.Printf("[stock] lock item=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	transit := 0
+	for _, l := range levels {
+		if isInTransit(locationName(&l)) {
+			transit += l.Quantity
+		}
+	}
+	if total+transit != item.Quantity {
+		msg := fmt.Sprintf("locations add up to %d but the item's quantity is %d", total, item.Quantity)
+		if transit > 0 {
+			msg = fmt.Sprintf("locations add up to %d and %d are in transit, but the item's quantity is %d", total, transit, item.Quantity)
+		}
+		jsonErr(c.Ctx, http.StatusConflict, msg)
+		return
+	}
+	after := append([]models.Storage(nil), levels...)
+	var changes []string
+	for i := range after {
+		name := locationName(&after[i])
+		if isInTransit(name) {
+			continue
+		}
+		q, listed := want[strings.ToLower(name)]
+		if listed {
+			delete(want, strings.ToLower(name))
+		}
+		if q != after[i].Quantity {
+			changes = append(changes, fmt.Sprintf("%s %d -> %d", name, after[i].Quantity, q))
+		}
+		after[i].Quantity = q
+	}
+	for _, name := range names {
+		if q, ok := want[strings.ToLower(name)]; ok && q > 0 {
+			name := name
+			after = append(after, models.Storage{Location: &name, Quantity: q})
+			changes = append(changes, fmt.Sprintf("%s 0 -> %d", name, q))
+		}
+	}
+	if err := writeStockLevels(tx, id, levels, after, stockMove{Reason: "count", UserID: uid}); err != nil {
+		log.Printf("[stock] write item=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	if len(changes) > 0 {
+		logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Set stock of item #%d %s (%s): %s", id, item.Name, item.SKU, strings.Join(changes, ", ")))
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	c.Stock()
+}
+
+// locationTotal is one row of GET /api/locations.
+type locationTotal struct {
+	Location string `db:"location" json:"location"`
+	Items    int    `db:"items"    json:"items"`
+	Quantity int    `db:"quantity" json:"quantity"`
+}
+
+// locationStockSelect lists (item, location, quantity) for active items:
+// stored rows, plus the master location of items without any.
+const locationStockSelect = `
+	SELECT s.item_id, COALESCE(NULLIF(TRIM(s.location), ''), '` + unassignedLocation + `') AS location, s.quantity
+	FROM log_lab_storage s JOIN log_lab_equipment_master e ON e.id = s.item_id
+	WHERE e.archived_at IS NULL AND s.quantity > 0
+	UNION ALL
+	SELECT e.id, COALESCE(NULLIF(TRIM(e.location), ''), '` + unassignedLocation + `'), e.quantity
+	FROM log_lab_equipment_master e
+	WHERE e.archived_at IS NULL AND e.quantity > 0
+	  AND NOT EXISTS (SELECT 1 FROM log_lab_storage s WHERE s.item_id = e.id)`
+
+// GET /api/locations
+// Every location in use with the number of items and units it holds.
+func Locations(ctx *beegoctx.Context) {
+	out := make([]locationTotal, 0)
+	if err := srv.DB.Select(&out, `SELECT location, COUNT(DISTINCT item_id) AS items, SUM(quantity) AS quantity
+		FROM (`+locationStockSelect+`) ls GROUP BY location ORDER BY location`); err != nil {
+		log.Printf("[stock] locations: %v", err)
+		jsonErr(ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(ctx, out)
+}
+
+// GET /api/locations/stock?location=Lab 1
+// The items held at one location and how many of each.
+func LocationStock(ctx *beegoctx.Context) {
+	loc := normalizeLocation(ctx.Input.Query("location"))
+	if loc == "" {
+		jsonErr(ctx, http.StatusBadRequest, "location is required")
+		return
+	}
+	type row struct {
+		ItemID   int    `db:"item_id"  json:"item_id"`
+		SKU      string `db:"sku"      json:"sku"`
+		Name     string `db:"name"     json:"name"`
+		Category string `db:"category" json:"category"`
+		Quantity int    `db:"quantity" json:"quantity"`
+		Total    int    `db:"total"    json:"item_quantity"`
+	}
+	out := make([]row, 0)
+	if err := srv.DB.Select(&out, `SELECT ls.item_id, e.sku, e.name, e.category, ls.quantity, e.quantity AS total
+		FROM (`+locationStockSelect+`) ls JOIN log_lab_equipment_master e ON e.id = ls.item_id
+		WHERE ls.location = ? ORDER BY e.name, e.id`, loc); err != nil {
+		log.Printf("[stock] location %q: %v", loc, err)
+		jsonErr(ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(ctx, map[string]interface{}{"location": loc, "items": out})
+}
@@ -0,0 +1,566 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/jmoiron/sqlx"
+
+	"vlu_infrastructure_management/models"
+)
+
+// Stock transfers move N of an item from one location to another:
+//
+//	requested -> in_transit -> received
+//	    \------------\--------> cancelled
+//
+// Sending takes the stock off the shelf (available_quantity) and parks it
+// in the "In transit" location; receiving puts it on the shelf at the
+// destination. Both steps go through the stock_movements ledger.
+
+const stockTransfersSchema = `
+CREATE TABLE IF NOT EXISTS stock_transfers (
+	id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	item_id       BIGINT UNSIGNED NOT NULL,
+	from_location VARCHAR(255)    NOT NULL,
+	to_location   VARCHAR(255)    NOT NULL,
+	quantity      INT             NOT NULL,
+	status        VARCHAR(16)     NOT NULL DEFAULT 'requested',
+	note          VARCHAR(255)    NULL,
+	requested_by  BIGINT UNSIGNED NULL,
+	requested_at  DATETIME        NOT NULL,
+	sent_by       BIGINT UNSIGNED NULL,
+	sent_at       DATETIME        NULL,
+	received_by   BIGINT UNSIGNED NULL,
+	received_at   DATETIME        NULL,
+	cancelled_by  BIGINT UNSIGNED NULL,
+	cancelled_at  DATETIME        NULL,
+	cancel_reason VARCHAR(255)    NULL,
+	KEY idx_stock_transfers_item (item_id, status),
+	KEY idx_stock_transfers_status (status, requested_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// stock_transfer_units records which tracked units travel with a transfer.
+const stockTransferUnitsSchema = `
+CREATE TABLE IF NOT EXISTS stock_transfer_units (
+	transfer_id BIGINT UNSIGNED NOT NULL,
+	unit_id     BIGINT UNSIGNED NOT NULL,
+	PRIMARY KEY (transfer_id, unit_id),
+	KEY idx_stock_transfer_units_unit (unit_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// Transfer statuses.
+const (
+	TransferRequested = "requested"
+	TransferInTransit = "in_transit"
+	TransferReceived  = "received"
+	TransferCancelled = "cancelled"
+)
+
+// TransferNext reports whether a transfer in status from may move to status to.
+func TransferNext(from, to string) bool {
+	switch from + ">" + to {
+	case TransferRequested + ">" + TransferInTransit,
+		TransferInTransit + ">" + TransferReceived,
+		TransferRequested + ">" + TransferCancelled,
+		TransferInTransit + ">" + TransferCancelled:
+		return true
+	}
+	return false
+}
+
+type transferRow struct {
+	ID           int64      `db:"id"            json:"id"`
+	ItemID       int64      `db:"item_id"       json:"item_id"`
+	SKU          string     `db:"sku"           json:"sku"`
+	ItemName     string     `db:"item_name"     json:"item_name"`
+	FromLocation string     `db:"from_location" json:"from_location"`
+	ToLocation   string     `db:"to_location"   json:"to_location"`
+	Quantity     int        `db:"quantity"      json:"quantity"`
+	Status       string     `db:"status"        json:"status"`
+	Note         *string    `db:"note"          json:"note"`
+	RequestedBy  *int64     `db:"requested_by"  json:"requested_by"`
+	RequestedAt  time.Time  `db:"requested_at"  json:"requested_at"`
+	SentBy       *int64     `db:"sent_by"       json:"sent_by"`
+	SentAt       *time.Time `db:"sent_at"       json:"sent_at"`
+	ReceivedBy   *int64     `db:"received_by"   json:"received_by"`
+	ReceivedAt   *time.Time `db:"received_at"   json:"received_at"`
+	CancelledBy  *int64     `db:"cancelled_by"  json:"cancelled_by"`
+	CancelledAt  *time.Time `db:"cancelled_at"  json:"cancelled_at"`
+	CancelReason *string    `db:"cancel_reason" json:"cancel_reason"`
+}
+
+const transferSelect = `SELECT t.id, t.item_id, e.sku, e.name AS item_name, t.from_location, t.to_location,
+	t.quantity, t.status, t.note, t.requested_by, t.requested_at, t.sent_by, t.sent_at,
+	t.received_by, t.received_at, t.cancelled_by, t.cancelled_at, t.cancel_reason
+	FROM stock_transfers t JOIN log_lab_equipment_master e ON e.id = t.item_id`
+
+// stockMovement is one line of the ledger.
+type stockMovement struct {
+	ID        int64     `db:"id"         json:"id"`
+	ItemID    int64     `db:"item_id"    json:"item_id"`
+	Location  string    `db:"location"   json:"location"`
+	Delta     int       `db:"delta"      json:"delta"`
+	Balance   int       `db:"balance"    json:"balance"`
+	Reason    string    `db:"reason"     json:"reason"`
+	RefType   *string   `db:"ref_type"   json:"ref_type"`
+	RefID     *int64    `db:"ref_id"     json:"ref_id"`
+	UserID    *int64    `db:"user_id"    json:"user_id"`
+	Note      *string   `db:"note"       json:"note"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// TransferController serves /api/transfers.
+type TransferController struct{ web.Controller }
+
+func (c *TransferController) transferID() (int64, bool) {
+	id, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+	}
+	return id, ok
+}
+
+func (c *TransferController) loadTransfer(q sqlGetter, id int64, lock bool) (transferRow, bool) {
+	var t transferRow
+	sqlStr := transferSelect + ` WHERE t.id=? LIMIT 1`
+	if lock {
+		sqlStr += ` FOR UPDATE`
+	}
+	if err := q.Get(&t, sqlStr, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "transfer not found")
+		} else {
+			log.Printf("[transfers] load id=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return t, false
+	}
+	return t, true
+}
+
+// lockItem locks the item a transfer moves; every transfer step takes it
+// before the transfer row.
+func (c *TransferController) lockItem(tx *sqlx.Tx, id int64) (itemRow, bool) {
+	var item itemRow
+	if err := tx.Get(&item, `SELECT `+itemSelectCols+` FROM log_lab_equipment_master WHERE id=? FOR UPDATE`, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "item not found")
+		} else {
+			log.Printf("[transfers] lock item=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return item, false
+	}
+	return item, true
+}
+
+// GET /api/transfers?status=in_transit&item_id=&location=
+// location matches either end of the transfer.
+func (c *TransferController) List() {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	if s := strings.TrimSpace(c.GetString("status")); s != "" {
+		where += ` AND t.status=?`
+		args = append(args, s)
+	}
+	if id, err := c.GetInt64("item_id"); err == nil && id > 0 {
+		where += ` AND t.item_id=?`
+		args = append(args, id)
+	}
+	if loc := normalizeLocation(c.GetString("location")); loc != "" {
+		where += ` AND (t.from_location=? OR t.to_location=?)`
+		args = append(args, loc, loc)
+	}
+	out := make([]transferRow, 0)
+	if err := srv.DB.Select(&out, transferSelect+where+` ORDER BY t.id DESC LIMIT 500`, args...); err != nil {
+		log.Printf("[transfers] list: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, out)
+}
+
+// GET /api/transfers/:id
+// The transfer with its units and ledger lines.
+func (c *TransferController) Get() {
+	id, ok := c.transferID()
+	if !ok {
+		return
+	}
+	t, ok := c.loadTransfer(srv.DB, id, false)
+	if !ok {
+		return
+	}
+	units := make([]unitRow, 0)
+	moves := make([]stockMovement, 0)
+	err := srv.DB.Select(&units, unitSelect+` JOIN stock_transfer_units tu ON tu.unit_id = u.id WHERE tu.transfer_id=? ORDER BY u.id`, id)
+	if err == nil {
+		err = srv.DB.Select(&moves, `SELECT id, item_id, location, delta, balance, reason, ref_type, ref_id, user_id, note, created_at
+			FROM stock_movements WHERE ref_type='transfer' AND ref_id=? ORDER BY id`, id)
+	}
+	if err != nil {
+		log.Printf("[transfers] get id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, map[string]interface{}{"transfer": t, "units": units, "movements": moves})
+}
+
+type transferSend struct {
+	UnitIDs []int64  `json:"unit_ids"`
+	Units   []string `json:"units"` // serial numbers or asset tags
+}
+
+// POST /api/transfers
+//
+//	{"item_id": 7, "from_location": "D.1.01", "to_location": "Lab 2", "quantity": 3,
+//	 "note": "for the Friday practical", "send": true, "unit_ids": [12, 13]}
+//
+// Creates a requested transfer; with "send": true it is sent straight away
+// (unit_ids / units pick the tracked units that go, as for /send).
+func (c *TransferController) Create() {
+	var in struct {
+		ItemID       int64   `json:"item_id"`
+		FromLocation string  `json:"from_location"`
+		ToLocation   string  `json:"to_location"`
+		Quantity     int     `json:"quantity"`
+		Note         *string `json:"note"`
+		Send         bool    `json:"send"`
+		transferSend
+	}
+	if err := readJSON(c.Ctx, &in); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	from, to := normalizeLocation(in.FromLocation), normalizeLocation(in.ToLocation)
+	switch {
+	case in.ItemID <= 0:
+		jsonErr(c.Ctx, http.StatusBadRequest, "item_id is required")
+		return
+	case from == "" || to == "":
+		jsonErr(c.Ctx, http.StatusBadRequest, "from_location and to_location are required")
+		return
+	case len(from) > 255 || len(to) > 255:
+		jsonErr(c.Ctx, http.StatusBadRequest, "location is too long")
+		return
+	case strings.EqualFold(from, to):
+		jsonErr(c.Ctx, http.StatusBadRequest, "from_location and to_location must differ")
+		return
+	case isInTransit(from) || isInTransit(to):
+		jsonErr(c.Ctx, http.StatusBadRequest, fmt.Sprintf("%q is not a location stock can be moved to or from", inTransitLocation))
+		return
+	case in.Quantity <= 0:
+		jsonErr(c.Ctx, http.StatusBadRequest, "quantity must be > 0")
+		return
+	case !in.Send && len(in.UnitIDs)+len(in.Units) > 0:
+		jsonErr(c.Ctx, http.StatusBadRequest, "units are picked when the transfer is sent")
+		return
+	}
+	var note interface{}
+	if in.Note != nil && strings.TrimSpace(*in.Note) != "" {
+		note = truncate(strings.TrimSpace(*in.Note), 255)
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	item, ok := c.lockItem(tx, in.ItemID)
+	if !ok {
+		return
+	}
+	if item.ArchivedAt != nil {
+		jsonErr(c.Ctx, http.StatusConflict, "item is archived")
+		return
+	}
+	levels, err := stockLevels(tx, in.ItemID, true)
+	if err != nil {
+		log.Printf("[transfers] stock item=%d: %v", in.ItemID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if have := stockAt(item, levels, from); have < in.Quantity {
+		jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("%s holds %d of this item, cannot move %d", from, have, in.Quantity))
+		return
+	}
+	uid := currentUserID(c.Ctx)
+	res, err := tx.Exec(`INSERT INTO stock_transfers (item_id, from_location, to_location, quantity, status, note, requested_by, requested_at)
+		VALUES (?,?,?,?,?,?,?,?)`, in.ItemID, from, to, in.Quantity, TransferRequested, note, uid, time.Now().UTC())
+	if err != nil {
+		log.Printf("[transfers] create: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "insert error")
+		return
+	}
+	id, _ := res.LastInsertId()
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Requested transfer #%d: %d x %s (%s) from %s to %s", id, in.Quantity, item.Name, item.SKU, from, to))
+	if in.Send {
+		t, ok := c.loadTransfer(tx, id, true)
+		if !ok || !c.send(tx, item, t, in.transferSend) {
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	c.Ctx.Output.SetStatus(http.StatusCreated)
+	if t, ok := c.loadTransfer(srv.DB, id, false); ok {
+		jsonOK(c.Ctx, t)
+	}
+}
+
+// stockAt is how much of item sits at location, treating an item without
+// rows as holding everything at its master location.
+func stockAt(item itemRow, levels []models.Storage, location string) int {
+	if len(levels) == 0 {
+		if strings.EqualFold(firstNonEmpty(normalizeLocation(item.Location), unassignedLocation), location) {
+			return item.Quantity
+		}
+		return 0
+	}
+	for i := range levels {
+		if strings.EqualFold(locationName(&levels[i]), location) {
+			return levels[i].Quantity
+		}
+	}
+	return 0
+}
+
+// step locks the transfer's item and then the transfer, and checks that it
+// may move to status to. The caller owns tx.
+func (c *TransferController) step(tx *sqlx.Tx, to string) (itemRow, transferRow, bool) {
+	id, ok := c.transferID()
+	if !ok {
+		return itemRow{}, transferRow{}, false
+	}
+	t, ok := c.loadTransfer(tx, id, false)
+	if !ok {
+		return itemRow{}, t, false
+	}
+	item, ok := c.lockItem(tx, t.ItemID)
+	if !ok {
+		return item, t, false
+	}
+	if t, ok = c.loadTransfer(tx, id, true); !ok {
+		return item, t, false
+	}
+	if !TransferNext(t.Status, to) {
+		jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("transfer is %s and cannot become %s", t.Status, to))
+		return item, t, false
+	}
+	return item, t, true
+}
+
+// send takes the stock off the shelf at the source; it writes the error
+// response itself when it returns false.
+func (c *TransferController) send(tx *sqlx.Tx, item itemRow, t transferRow, in transferSend) bool {
+	if item.ArchivedAt != nil {
+		jsonErr(c.Ctx, http.StatusConflict, "item is archived")
+		return false
+	}
+	if t.Quantity > item.AvailableQuantity {
+		jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("only %d of this item are on the shelf; the rest is borrowed, in maintenance or in transit", item.AvailableQuantity))
+		return false
+	}
+	avail, err := lockAvailableUnits(tx, t.ItemID)
+	if err != nil {
+		log.Printf("[transfers] units item=%d: %v", t.ItemID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return false
+	}
+	picked, msg := pickUnits(avail, t.Quantity, item.AvailableQuantity, in.UnitIDs, in.Units)
+	if msg != "" {
+		jsonErr(c.Ctx, http.StatusConflict, msg)
+		return false
+	}
+	uid := currentUserID(c.Ctx)
+	now := time.Now().UTC()
+	err = c.moveUnits(tx, t.ID, picked, UnitInTransit, now)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE log_lab_equipment_master SET available_quantity=available_quantity-? WHERE id=?`, t.Quantity, t.ItemID)
+	}
+	if err == nil {
+		msg, err = moveStock(tx, item, t.FromLocation, inTransitLocation, t.Quantity,
+			stockMove{Reason: "transfer_out", RefType: "transfer", RefID: t.ID, UserID: uid})
+	}
+	if err == nil && msg == "" {
+		_, err = tx.Exec(`UPDATE stock_transfers SET status=?, sent_by=?, sent_at=? WHERE id=?`, TransferInTransit, uid, now, t.ID)
+	}
+	if err != nil {
+		log.Printf("[transfers] send id=%d: %v", t.ID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return false
+	}
+	if msg != "" {
+		jsonErr(c.Ctx, http.StatusConflict, msg)
+		return false
+	}
+	logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Sent transfer #%d: %d x %s (%s) from %s to %s", t.ID, t.Quantity, item.Name, item.SKU, t.FromLocation, t.ToLocation))
+	return true
+}
+
+// moveUnits sets the status of units travelling with transfer id. Units
+// leaving the shelf are recorded on the transfer; units coming back are
+// read from it.
+func (c *TransferController) moveUnits(tx *sqlx.Tx, transferID int64, ids []int64, status string, at time.Time) error {
+	if status != UnitInTransit {
+		_, err := tx.Exec(`UPDATE equipment_units u JOIN stock_transfer_units tu ON tu.unit_id = u.id
+			SET u.status=?, u.updated_at=? WHERE tu.transfer_id=? AND u.status=?`, status, at, transferID, UnitInTransit)
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	q, args, err := sqlx.In(`UPDATE equipment_units SET status=?, updated_at=? WHERE id IN (?)`, status, at, ids)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(q, args...); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec(`INSERT INTO stock_transfer_units (transfer_id, unit_id) VALUES (?,?)`, transferID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish brings the stock of an in-transit transfer back onto the shelf at
+// location: the destination on receipt, the source on cancellation.
+func (c *TransferController) finish(tx *sqlx.Tx, item itemRow, t transferRow, location, reason string) error {
+	now := time.Now().UTC()
+	if err := c.moveUnits(tx, t.ID, nil, UnitAvailable, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE log_lab_equipment_master SET available_quantity=available_quantity+? WHERE id=?`, t.Quantity, t.ItemID); err != nil {
+		return err
+	}
+	msg, err := moveStock(tx, item, inTransitLocation, location, t.Quantity,
+		stockMove{Reason: reason, RefType: "transfer", RefID: t.ID, UserID: currentUserID(c.Ctx)})
+	if err == nil && msg != "" {
+		err = errors.New(msg) // the ledger no longer holds the stock we sent
+	}
+	return err
+}
+
+// POST /api/transfers/:id/send  {"unit_ids": [12], "units": ["SN-0042"]}
+func (c *TransferController) Send() {
+	var in transferSend
+	_ = readJSON(c.Ctx, &in) // the body is optional
+	c.advance(TransferInTransit, func(tx *sqlx.Tx, item itemRow, t transferRow) bool {
+		return c.send(tx, item, t, in)
+	})
+}
+
+// POST /api/transfers/:id/receive
+func (c *TransferController) Receive() {
+	c.advance(TransferReceived, func(tx *sqlx.Tx, item itemRow, t transferRow) bool {
+		if err := c.finish(tx, item, t, t.ToLocation, "transfer_in"); err != nil {
+			log.Printf("[transfers] receive id=%d: %v", t.ID, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+			return false
+		}
+		uid := currentUserID(c.Ctx)
+		if _, err := tx.Exec(`UPDATE stock_transfers SET status=?, received_by=?, received_at=? WHERE id=?`,
+			TransferReceived, uid, time.Now().UTC(), t.ID); err != nil {
+			log.Printf("[transfers] receive id=%d: %v", t.ID, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+			return false
+		}
+		logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Received transfer #%d: %d x %s (%s) at %s", t.ID, t.Quantity, item.Name, item.SKU, t.ToLocation))
+		return true
+	})
+}
+
+// POST /api/transfers/:id/cancel  {"reason": "lab closed"}
+// Stock already sent goes back to the source location.
+func (c *TransferController) Cancel() {
+	var in struct {
+		Reason string `json:"reason"`
+	}
+	_ = readJSON(c.Ctx, &in)
+	reason := strings.TrimSpace(in.Reason)
+	c.advance(TransferCancelled, func(tx *sqlx.Tx, item itemRow, t transferRow) bool {
+		if t.Status == TransferInTransit {
+			if err := c.finish(tx, item, t, t.FromLocation, "transfer_cancel"); err != nil {
+				log.Printf("[transfers] cancel id=%d: %v", t.ID, err)
+				jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+				return false
+			}
+		}
+		uid := currentUserID(c.Ctx)
+		if _, err := tx.Exec(`UPDATE stock_transfers SET status=?, cancelled_by=?, cancelled_at=?, cancel_reason=? WHERE id=?`,
+			TransferCancelled, uid, time.Now().UTC(), nullableStr(truncate(reason, 255)), t.ID); err != nil {
+			log.Printf("[transfers] cancel id=%d: %v", t.ID, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+			return false
+		}
+		logActivityTX(tx.Tx, int(uid), fmt.Sprintf("Cancelled transfer #%d of %s (%s)", t.ID, item.Name, item.SKU))
+		return true
+	})
+}
+
+// advance runs one status change in a transaction and answers with the
+// updated transfer.
+func (c *TransferController) advance(to string, apply func(tx *sqlx.Tx, item itemRow, t transferRow) bool) {
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	item, t, ok := c.step(tx, to)
+	if !ok || !apply(tx, item, t) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	if t, ok := c.loadTransfer(srv.DB, t.ID, false); ok {
+		jsonOK(c.Ctx, t)
+	}
+}
+
+// GET /api/stock-movements?item_id=&location=&reason=&limit=200
+// The ledger, newest first.
+func (c *TransferController) Movements() {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	if id, err := c.GetInt64("item_id"); err == nil && id > 0 {
+		where += ` AND item_id=?`
+		args = append(args, id)
+	}
+	if loc := normalizeLocation(c.GetString("location")); loc != "" {
+		where += ` AND location=?`
+		args = append(args, loc)
+	}
+	if r := strings.TrimSpace(c.GetString("reason")); r != "" {
+		where += ` AND reason=?`
+		args = append(args, r)
+	}
+	limit, _ := c.GetInt("limit", 200)
+	if limit <= 0 || limit > 1000 {
+		limit = 200
+	}
+	out := make([]stockMovement, 0)
+	if err := srv.DB.Select(&out, `SELECT id, item_id, location, delta, balance, reason, ref_type, ref_id, user_id, note, created_at
+		FROM stock_movements`+where+` ORDER BY id DESC LIMIT ?`, append(args, limit)...); err != nil {
+		log.Printf("[transfers] movements: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, out)
+}
@@ -0,0 +1,705 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// Individually tracked units (serial number / asset tag) of an item. An item
+// may track all, some or none of its stock as units; the counters on
+// log_lab_equipment_master stay authoritative:
+//
+//	quantity           = units not retired + untracked units
+//	available_quantity = units "available" + untracked units on the shelf
+//
+// so a unit in maintenance is in quantity but not available, and a retired
+// unit is in neither.
+
+const (
+	equipmentUnitsTable = "equipment_units"
+	borrowUnitsTable    = "borrow_record_units"
+)
+
+const equipmentUnitsSchema = `
+CREATE TABLE IF NOT EXISTS equipment_units (
+	id             BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	item_id        BIGINT UNSIGNED NOT NULL,
+	serial_number  VARCHAR(100)    NULL,
+	asset_tag      VARCHAR(64)     NULL,
+	unit_condition VARCHAR(16)     NOT NULL DEFAULT 'good',
+	status         VARCHAR(16)     NOT NULL DEFAULT 'available',
+	holder_user_id BIGINT UNSIGNED NULL,
+	borrow_id      BIGINT UNSIGNED NULL,
+	notes          VARCHAR(255)    NULL,
+	created_at     DATETIME        NOT NULL,
+	updated_at     DATETIME        NOT NULL,
+	UNIQUE KEY uq_equipment_units_serial (item_id, serial_number),
+	UNIQUE KEY uq_equipment_units_asset_tag (asset_tag),
+	KEY idx_equipment_units_item_status (item_id, status),
+	KEY idx_equipment_units_borrow (borrow_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// borrow_record_units records which units went out with a borrow.
+const borrowUnitsSchema = `
+CREATE TABLE IF NOT EXISTS borrow_record_units (
+	borrow_id           BIGINT UNSIGNED NOT NULL,
+	unit_id             BIGINT UNSIGNED NOT NULL,
+	returned_at         DATETIME        NULL,
+	condition_on_return VARCHAR(16)     NULL,
+	PRIMARY KEY (borrow_id, unit_id),
+	KEY idx_borrow_record_units_unit (unit_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+// Unit statuses. borrowed is only entered and left through Borrow / Return,
+// in_transit through sending and receiving a stock transfer.
+const (
+	UnitAvailable   = "available"
+	UnitBorrowed    = "borrowed"
+	UnitInTransit   = "in_transit"
+	UnitMaintenance = "maintenance"
+	UnitRetired     = "retired"
+)
+
+// Unit conditions, worst last.
+var unitConditions = []string{"good", "fair", "damaged", "broken"}
+
+func validUnitCondition(c string) bool {
+	for _, v := range unitConditions {
+		if c == v {
+			return true
+		}
+	}
+	return false
+}
+
+// UnitStatusChange returns how a manual status change moves the item's
+// available_quantity and quantity.
+func UnitStatusChange(from, to string) (availDelta, qtyDelta int, err error) {
+	if from == to {
+		return 0, 0, nil
+	}
+	switch {
+	case from == UnitBorrowed || to == UnitBorrowed:
+		return 0, 0, errors.New("borrowed is set by borrowing and returning the unit")
+	case from == UnitInTransit || to == UnitInTransit:
+		return 0, 0, errors.New("in_transit is set by sending and receiving a transfer")
+	case from == UnitRetired:
+		return 0, 0, errors.New("retired units cannot be put back into service")
+	}
+	switch from + ">" + to {
+	case UnitAvailable + ">" + UnitMaintenance:
+		return -1, 0, nil
+	case UnitMaintenance + ">" + UnitAvailable:
+		return 1, 0, nil
+	case UnitAvailable + ">" + UnitRetired:
+		return -1, -1, nil
+	case UnitMaintenance + ">" + UnitRetired:
+		return 0, -1, nil
+	}
+	return 0, 0, fmt.Errorf("status must be one of: %s, %s, %s", UnitAvailable, UnitMaintenance, UnitRetired)
+}
+
+// ReturnedUnitStatus is where a unit goes when it comes back in condition.
+func ReturnedUnitStatus(condition string) string {
+	if condition == "damaged" || condition == "broken" {
+		return UnitMaintenance
+	}
+	return UnitAvailable
+}
+
+type unitRow struct {
+	ID           int64     `db:"id"             json:"id"`
+	ItemID       int64     `db:"item_id"        json:"item_id"`
+	SKU          string    `db:"sku"            json:"sku"`
+	ItemName     string    `db:"item_name"      json:"item_name"`
+	SerialNumber *string   `db:"serial_number"  json:"serial_number"`
+	AssetTag     *string   `db:"asset_tag"      json:"asset_tag"`
+	Condition    string    `db:"unit_condition" json:"condition"`
+	Status       string    `db:"status"         json:"status"`
+	HolderUserID *int64    `db:"holder_user_id" json:"holder_user_id"`
+	BorrowID     *int64    `db:"borrow_id"      json:"borrow_id"`
+	Notes        *string   `db:"notes"          json:"notes"`
+	CreatedAt    time.Time `db:"created_at"     json:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at"     json:"updated_at"`
+}
+
+const unitSelect = `SELECT u.id, u.item_id, e.sku, e.name AS item_name, u.serial_number, u.asset_tag,
+	u.unit_condition, u.status, u.holder_user_id, u.borrow_id, u.notes, u.created_at, u.updated_at
+	FROM equipment_units u JOIN log_lab_equipment_master e ON e.id = u.item_id`
+
+// unitCounts returns the item's units that are not retired and those available.
+func unitCounts(q sqlGetter, itemID int64) (active, available int, err error) {
+	var c struct {
+		Active    int `db:"active"`
+		Available int `db:"available"`
+	}
+	err = q.Get(&c, `SELECT COALESCE(SUM(status<>'retired'),0) AS active, COALESCE(SUM(status='available'),0) AS available
+		FROM equipment_units WHERE item_id=?`, itemID)
+	return c.Active, c.Available, err
+}
+
+// checkUnitsFit is the quantity check for PATCH and import: the new counters
+// must still cover the tracked units. It returns a client message or "".
+func checkUnitsFit(q sqlGetter, itemID int64, qty, avail int) (string, error) {
+	active, available, err := unitCounts(q, itemID)
+	if err != nil {
+		return "", err
+	}
+	if qty < active {
+		return fmt.Sprintf("quantity cannot be less than the %d tracked unit(s) in service; retire units first", active), nil
+	}
+	if avail < available {
+		return fmt.Sprintf("available quantity would drop below the %d tracked unit(s) on the shelf", available), nil
+	}
+	return "", nil
+}
+
+// lockAvailableUnits reads the item's units on the shelf, locked.
+func lockAvailableUnits(tx *sqlx.Tx, itemID int64) ([]unitRow, error) {
+	var avail []unitRow
+	err := tx.Select(&avail, `SELECT id, item_id, serial_number, asset_tag FROM equipment_units
+		WHERE item_id=? AND status='available' ORDER BY id FOR UPDATE`, itemID)
+	return avail, err
+}
+
+// pickUnits chooses which of the available units leave the shelf when qty
+// of an item with availBefore on the shelf is taken. Requested units (ids,
+// serial numbers or asset tags) must be among avail; the rest comes from
+// untracked stock first and only then from other available units, so the
+// counters stay consistent. A non-empty message is a client error.
+func pickUnits(avail []unitRow, qty, availBefore int, ids []int64, refs []string) ([]int64, string) {
+	if len(ids)+len(refs) > qty {
+		return nil, "more units listed than the quantity"
+	}
+	taken := map[int64]bool{}
+	var picked []int64
+	pick := func(match func(u unitRow) bool, what string) string {
+		for _, u := range avail {
+			if match(u) {
+				if taken[u.ID] {
+					return what + " is listed twice"
+				}
+				taken[u.ID] = true
+				picked = append(picked, u.ID)
+				return ""
+			}
+		}
+		return what + " is not an available unit of this item"
+	}
+	for _, id := range ids {
+		id := id
+		if msg := pick(func(u unitRow) bool { return u.ID == id }, fmt.Sprintf("unit #%d", id)); msg != "" {
+			return nil, msg
+		}
+	}
+	for _, ref := range refs {
+		ref = strings.TrimSpace(ref)
+		if msg := pick(func(u unitRow) bool {
+			return strings.EqualFold(strVal(u.SerialNumber), ref) || strings.EqualFold(strVal(u.AssetTag), ref)
+		}, fmt.Sprintf("unit %q", ref)); msg != "" {
+			return nil, msg
+		}
+	}
+	untracked := availBefore - len(avail)
+	for _, u := range avail {
+		if qty-len(picked) <= untracked {
+			break
+		}
+		if !taken[u.ID] {
+			taken[u.ID] = true
+			picked = append(picked, u.ID)
+		}
+	}
+	return picked, ""
+}
+
+// takeUnits attaches units to a new borrow of qty (see pickUnits).
+func takeUnits(tx *sqlx.Tx, itemID, borrowID, userID int64, qty, availBefore int, ids []int64, refs []string) ([]int64, string, error) {
+	avail, err := lockAvailableUnits(tx, itemID)
+	if err != nil {
+		return nil, "", err
+	}
+	picked, msg := pickUnits(avail, qty, availBefore, ids, refs)
+	if msg != "" || len(picked) == 0 {
+		return nil, msg, nil
+	}
+
+	q, args, err := sqlx.In(`UPDATE equipment_units SET status='borrowed', holder_user_id=?, borrow_id=?, updated_at=? WHERE id IN (?)`,
+		userID, borrowID, time.Now().UTC(), picked)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := tx.Exec(q, args...); err != nil {
+		return nil, "", err
+	}
+	for _, id := range picked {
+		if _, err := tx.Exec(`INSERT INTO borrow_record_units (borrow_id, unit_id) VALUES (?,?)`, borrowID, id); err != nil {
+			return nil, "", err
+		}
+	}
+	return picked, "", nil
+}
+
+// unitReturn is one unit's report in a return request.
+type unitReturn struct {
+	UnitID    int64  `json:"unit_id"`
+	Condition string `json:"condition"`
+}
+
+// PartialReturnMsg is the client error for returning qty of a borrow's
+// outstanding pieces, tracked of which are units, while naming listed
+// units, or "". Pieces not named must come from the untracked stock.
+func PartialReturnMsg(qty, outstanding, listed, tracked int) string {
+	switch {
+	case listed > qty:
+		return "more units listed than the quantity returned"
+	case qty-listed > outstanding-tracked:
+		return fmt.Sprintf("list the units being returned: %d of the %d still out are tracked units", tracked, outstanding)
+	}
+	return ""
+}
+
+// releaseUnits takes back the units of borrowID when qty of its outstanding
+// quantity is returned. When that is everything, every unit still out comes
+// back; on a partial return only the units reported do, and the rest of qty
+// must be stock without units. Units reported damaged or broken go to
+// maintenance; their count is returned so the caller puts only the rest
+// back into available_quantity.
+func releaseUnits(tx *sqlx.Tx, borrowID int64, reports []unitReturn, qty, outstanding int, at time.Time) (int, string, error) {
+	var out []struct {
+		ID        int64  `db:"id"`
+		Condition string `db:"unit_condition"`
+	}
+	if err := tx.Select(&out, `SELECT u.id, u.unit_condition FROM borrow_record_units bu
+		JOIN equipment_units u ON u.id = bu.unit_id
+		WHERE bu.borrow_id=? AND bu.returned_at IS NULL FOR UPDATE`, borrowID); err != nil {
+		return 0, "", err
+	}
+	conds := map[int64]string{}
+	for _, r := range reports {
+		c := strings.ToLower(strings.TrimSpace(r.Condition))
+		if c != "" && !validUnitCondition(c) {
+			return 0, "condition must be one of: " + strings.Join(unitConditions, ", "), nil
+		}
+		conds[r.UnitID] = c
+	}
+	for id := range conds {
+		found := false
+		for _, u := range out {
+			found = found || u.ID == id
+		}
+		if !found {
+			return 0, fmt.Sprintf("unit #%d is not out on this borrow", id), nil
+		}
+	}
+	if qty < outstanding {
+		if msg := PartialReturnMsg(qty, outstanding, len(conds), len(out)); msg != "" {
+			return 0, msg, nil
+		}
+		back := out[:0:0]
+		for _, u := range out {
+			if _, ok := conds[u.ID]; ok {
+				back = append(back, u)
+			}
+		}
+		out = back
+	}
+	held := 0
+	for _, u := range out {
+		cond := u.Condition
+		if c := conds[u.ID]; c != "" {
+			cond = c
+		}
+		status := ReturnedUnitStatus(cond)
+		if status != UnitAvailable {
+			held++
+		}
+		if _, err := tx.Exec(`UPDATE equipment_units SET status=?, unit_condition=?, holder_user_id=NULL, borrow_id=NULL, updated_at=? WHERE id=?`,
+			status, cond, at, u.ID); err != nil {
+			return 0, "", err
+		}
+		if _, err := tx.Exec(`UPDATE borrow_record_units SET returned_at=?, condition_on_return=NULLIF(?, '') WHERE borrow_id=? AND unit_id=?`,
+			at, conds[u.ID], borrowID, u.ID); err != nil {
+			return 0, "", err
+		}
+	}
+	return held, "", nil
+}
+
+// UnitController serves /api/items/:id/units and /api/units.
+type UnitController struct{ web.Controller }
+
+func (c *UnitController) loadUnit(q sqlGetter, id int64) (unitRow, bool) {
+	var u unitRow
+	if err := q.Get(&u, unitSelect+` WHERE u.id=? LIMIT 1`, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "unit not found")
+		} else {
+			log.Printf("[units] load id=%d: %v", id, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		}
+		return u, false
+	}
+	return u, true
+}
+
+// GET /api/items/:id/units?status=available
+// Any signed-in user may list an item's units; who holds a unit, and under
+// which borrow, is left out except for staff (item.update) and the holder.
+func (c *UnitController) ListForItem() {
+	itemID, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	where := ` WHERE u.item_id=?`
+	args := []interface{}{itemID}
+	if s := strings.TrimSpace(c.GetString("status")); s != "" {
+		where += ` AND u.status=?`
+		args = append(args, s)
+	}
+	rows := make([]unitRow, 0)
+	if err := srv.DB.Select(&rows, unitSelect+where+` ORDER BY u.id`, args...); err != nil {
+		log.Printf("[units] list item=%d: %v", itemID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if !RoleAllows(currentRole(c.Ctx), PermItemUpdate) {
+		uid := currentUserID(c.Ctx)
+		for i := range rows {
+			if rows[i].HolderUserID == nil || *rows[i].HolderUserID != uid {
+				rows[i].HolderUserID, rows[i].BorrowID = nil, nil
+			}
+		}
+	}
+	jsonOK(c.Ctx, rows)
+}
+
+// GET /api/units?q=<serial or asset tag>&holder_user_id=
+func (c *UnitController) Search() {
+	q := strings.TrimSpace(c.GetString("q"))
+	holder, _ := c.GetInt64("holder_user_id")
+	if q == "" && holder <= 0 {
+		jsonErr(c.Ctx, http.StatusBadRequest, "provide q or holder_user_id")
+		return
+	}
+	where := ` WHERE 1=1`
+	args := []interface{}{}
+	if q != "" {
+		where += ` AND (u.serial_number LIKE ? OR u.asset_tag LIKE ?)`
+		p := "%" + q + "%"
+		args = append(args, p, p)
+	}
+	if holder > 0 {
+		where += ` AND u.holder_user_id=?`
+		args = append(args, holder)
+	}
+	rows := make([]unitRow, 0)
+	if err := srv.DB.Select(&rows, unitSelect+where+` ORDER BY u.id LIMIT 200`, args...); err != nil {
+		log.Printf("[units] search: %v", err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	jsonOK(c.Ctx, rows)
+}
+
+// GET /api/units/:id
+func (c *UnitController) Get() {
+	id, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	if u, ok := c.loadUnit(srv.DB, id); ok {
+		jsonOK(c.Ctx, u)
+	}
+}
+
+type unitFields struct {
+	SerialNumber *string `json:"serial_number"`
+	AssetTag     *string `json:"asset_tag"`
+	Condition    *string `json:"condition"`
+	Status       *string `json:"status"` // PATCH only
+	Notes        *string `json:"notes"`
+}
+
+func (f *unitFields) validate() string {
+	for _, p := range []*string{f.SerialNumber, f.AssetTag, f.Condition, f.Status, f.Notes} {
+		if p != nil {
+			*p = strings.TrimSpace(*p)
+		}
+	}
+	if f.Condition != nil {
+		*f.Condition = strings.ToLower(*f.Condition)
+		if !validUnitCondition(*f.Condition) {
+			return "condition must be one of: " + strings.Join(unitConditions, ", ")
+		}
+	}
+	if f.SerialNumber != nil && len(*f.SerialNumber) > 100 {
+		return "serial_number is too long (max 100)"
+	}
+	if f.AssetTag != nil && len(*f.AssetTag) > 64 {
+		return "asset_tag is too long (max 64)"
+	}
+	if f.Notes != nil && len(*f.Notes) > 255 {
+		return "notes are too long (max 255)"
+	}
+	return ""
+}
+
+func isDuplicateKey(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && me.Number == 1062
+}
+
+// POST /api/items/:id/units
+//
+//	{ "serial_number": "58940123", "asset_tag": "VLU-EE-0042", "condition": "good" }
+//	or { "units": [ {...}, {...} ] } to register several at once
+//
+// New units are taken from the item's untracked stock on the shelf.
+func (c *UnitController) Create() {
+	itemID, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var body json.RawMessage
+	if err := readJSON(c.Ctx, &body); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	var batch struct {
+		Units []unitFields `json:"units"`
+	}
+	_ = json.Unmarshal(body, &batch)
+	if batch.Units == nil {
+		var one unitFields
+		if err := json.Unmarshal(body, &one); err != nil {
+			jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+			return
+		}
+		batch.Units = []unitFields{one}
+	}
+	if len(batch.Units) == 0 || len(batch.Units) > 500 {
+		jsonErr(c.Ctx, http.StatusBadRequest, "provide 1 to 500 units")
+		return
+	}
+	for i := range batch.Units {
+		f := &batch.Units[i]
+		if msg := f.validate(); msg != "" {
+			jsonErr(c.Ctx, http.StatusBadRequest, fmt.Sprintf("units[%d]: %s", i, msg))
+			return
+		}
+		if f.Status != nil {
+			jsonErr(c.Ctx, http.StatusBadRequest, "new units are always available; change the status afterwards")
+			return
+		}
+		if strVal(f.SerialNumber) == "" && strVal(f.AssetTag) == "" {
+			jsonErr(c.Ctx, http.StatusBadRequest, fmt.Sprintf("units[%d]: serial_number or asset_tag is required", i))
+			return
+		}
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var item struct {
+		Name     string     `db:"name"`
+		SKU      string     `db:"sku"`
+		Qty      int        `db:"quantity"`
+		Avail    int        `db:"available_quantity"`
+		Archived *time.Time `db:"archived_at"`
+		ItemType string     `db:"item_type"`
+	}
+	if err := tx.Get(&item, `SELECT name, sku, quantity, available_quantity, archived_at, item_type FROM log_lab_equipment_master WHERE id=? FOR UPDATE`, itemID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonErr(c.Ctx, http.StatusNotFound, "not found")
+			return
+		}
+		log.Printf("[units] lock item=%d: %v", itemID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if item.ItemType == ItemConsumable {
+		jsonErr(c.Ctx, http.StatusConflict, "consumable items are not tracked as units")
+		return
+	}
+	if item.Archived != nil {
+		jsonErr(c.Ctx, http.StatusConflict, "item is archived")
+		return
+	}
+	active, available, err := unitCounts(tx, itemID)
+	if err != nil {
+		log.Printf("[units] count item=%d: %v", itemID, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	n := len(batch.Units)
+	if active+n > item.Qty || available+n > item.Avail {
+		jsonErr(c.Ctx, http.StatusConflict, fmt.Sprintf("only %d untracked unit(s) on the shelf to register; raise the quantity first",
+			minInt(item.Qty-active, item.Avail-available)))
+		return
+	}
+
+	now := time.Now().UTC()
+	ids := make([]int64, 0, n)
+	for _, f := range batch.Units {
+		cond := strVal(f.Condition)
+		if cond == "" {
+			cond = "good"
+		}
+		res, err := tx.Exec(`INSERT INTO equipment_units (item_id, serial_number, asset_tag, unit_condition, status, notes, created_at, updated_at)
+			VALUES (?,?,?,?,'available',?,?,?)`,
+			itemID, nullableStr(strVal(f.SerialNumber)), nullableStr(strVal(f.AssetTag)), cond, nullableStr(strVal(f.Notes)), now, now)
+		if err != nil {
+			if isDuplicateKey(err) {
+				jsonErr(c.Ctx, http.StatusConflict, "serial number or asset tag is already registered")
+				return
+			}
+			log.Printf("[units] insert item=%d: %v", itemID, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "insert error")
+			return
+		}
+		id, _ := res.LastInsertId()
+		ids = append(ids, id)
+	}
+	logActivityTX(tx.Tx, int(currentUserID(c.Ctx)), fmt.Sprintf("Registered %d unit(s) of %s (%s)", n, item.Name, item.SKU))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	rows := make([]unitRow, 0, n)
+	q, args, _ := sqlx.In(unitSelect+` WHERE u.id IN (?) ORDER BY u.id`, ids)
+	if err := srv.DB.Select(&rows, q, args...); err != nil {
+		jsonOK(c.Ctx, map[string]interface{}{"ok": true, "ids": ids})
+		return
+	}
+	jsonOK(c.Ctx, rows)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// PATCH /api/units/:id  { "serial_number", "asset_tag", "condition", "notes", "status" }
+// status moves between available, maintenance and retired (retiring needs
+// item.archive) and adjusts the item's counters to match.
+func (c *UnitController) Update() {
+	id, ok := pathID(c.Ctx, ":id")
+	if !ok {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var in unitFields
+	if err := readJSON(c.Ctx, &in); err != nil {
+		jsonErr(c.Ctx, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if msg := in.validate(); msg != "" {
+		jsonErr(c.Ctx, http.StatusBadRequest, msg)
+		return
+	}
+	if in.Status != nil && *in.Status == UnitRetired && !RoleAllows(currentRole(c.Ctx), PermItemArchive) {
+		jsonErr(c.Ctx, http.StatusForbidden, "retiring a unit requires "+string(PermItemArchive))
+		return
+	}
+	cur, ok := c.loadUnit(srv.DB, id)
+	if !ok {
+		return
+	}
+
+	tx, err := srv.DB.Beginx()
+	if err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// item first, then the unit: the same order Borrow locks them in
+	var locked int64
+	if err := tx.Get(&locked, `SELECT id FROM log_lab_equipment_master WHERE id=? FOR UPDATE`, cur.ItemID); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+	if err := tx.Get(&cur, unitSelect+` WHERE u.id=? FOR UPDATE`, id); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "query error")
+		return
+	}
+
+	var u itemUpdate // reused for the unit's own columns
+	changed := []string{}
+	str := func(col string, p *string, old *string) {
+		if p != nil && *p != strVal(old) {
+			u.set(col, nullableStr(*p))
+			changed = append(changed, col)
+		}
+	}
+	str("serial_number", in.SerialNumber, cur.SerialNumber)
+	str("asset_tag", in.AssetTag, cur.AssetTag)
+	str("notes", in.Notes, cur.Notes)
+	if in.Condition != nil && *in.Condition != cur.Condition {
+		u.set("unit_condition", *in.Condition)
+		changed = append(changed, "condition")
+	}
+	if in.Status != nil && *in.Status != cur.Status {
+		availDelta, qtyDelta, err := UnitStatusChange(cur.Status, *in.Status)
+		if err != nil {
+			jsonErr(c.Ctx, http.StatusConflict, err.Error())
+			return
+		}
+		if _, err := tx.Exec(`UPDATE log_lab_equipment_master SET available_quantity=available_quantity+?, quantity=quantity+? WHERE id=?`,
+			availDelta, qtyDelta, cur.ItemID); err != nil {
+			log.Printf("[units] adjust item=%d: %v", cur.ItemID, err)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+			return
+		}
+		if msg, err := syncStock(tx, cur.ItemID, qtyDelta, nil, stockMove{Reason: "unit_retired", RefType: "unit", RefID: cur.ID, UserID: currentUserID(c.Ctx)}); err != nil || msg != "" {
+			log.Printf("[units] stock item=%d: %v %s", cur.ItemID, err, msg)
+			jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+			return
+		}
+		u.set("status", *in.Status)
+		changed = append(changed, "status "+cur.Status+" -> "+*in.Status)
+	}
+	if len(changed) == 0 {
+		jsonOK(c.Ctx, cur)
+		return
+	}
+	u.sets = append(u.sets, "updated_at=?")
+	u.args = append(u.args, time.Now().UTC())
+	if _, err := tx.Exec("UPDATE equipment_units SET "+strings.Join(u.sets, ", ")+" WHERE id=?", append(u.args, id)...); err != nil {
+		if isDuplicateKey(err) {
+			jsonErr(c.Ctx, http.StatusConflict, "serial number or asset tag is already registered")
+			return
+		}
+		log.Printf("[units] update id=%d: %v", id, err)
+		jsonErr(c.Ctx, http.StatusInternalServerError, "update error")
+		return
+	}
+	logActivityTX(tx.Tx, int(currentUserID(c.Ctx)), fmt.Sprintf("Updated unit #%d of %s (%s): %s", id, cur.ItemName, cur.SKU, strings.Join(changed, ", ")))
+	if err := tx.Commit(); err != nil {
+		jsonErr(c.Ctx, http.StatusInternalServerError, "commit error")
+		return
+	}
+	if row, ok := c.loadUnit(srv.DB, id); ok {
+		jsonOK(c.Ctx, row)
+	}
+}
@@ -4,14 +4,18 @@ import "time"
 
 // ----- users -----
 type User struct {
-	ID           uint64     `db:"id"            json:"id"`
-	Username     string     `db:"username"      json:"username"`
-	PasswordHash []byte     `db:"password_hash" json:"-"`
-	FullName     string     `db:"full_name"     json:"full_name"`
-	Email        string     `db:"email"         json:"email"`
-	Role         string     `db:"role"          json:"role"`
-	LastLogin    *time.Time `db:"last_login"    json:"last_login,omitempty"`
-	CreatedAt    time.Time  `db:"create_at"     json:"create_at"`
+	ID                 uint64     `db:"id"                   json:"id"`
+	Username           string     `db:"username"             json:"username"`
+	PasswordHash       []byte     `db:"password_hash"        json:"-"`
+	FullName           string     `db:"full_name"            json:"full_name"`
+	Email              string     `db:"email"                json:"email"`
+	Role               string     `db:"role"                 json:"role"`
+	LastLogin          *time.Time `db:"last_login"           json:"last_login,omitempty"`
+	CreatedAt          time.Time  `db:"create_at"            json:"create_at"`
+	DisabledAt         *time.Time `db:"disabled_at"          json:"disabled_at,omitempty"`
+	MustChangePassword bool       `db:"must_change_password" json:"must_change_password"`
+	LockedUntil        *time.Time `db:"locked_until"         json:"locked_until,omitempty"`
+	TOTPEnabled        bool       `db:"totp_enabled"         json:"totp_enabled"`
 }
 
 // ----- log_lab_equipment_master -----
@@ -41,7 +45,7 @@ type BorrowRecord struct {
 	BorrowedAt   time.Time  `db:"borrowed_at" json:"borrowed_at"`
 	DueAt        *time.Time `db:"due_at" json:"due_at,omitempty"`
 	ReturnedAt   *time.Time `db:"returned_at" json:"returned_at,omitempty"`
-	Status       string     `db:"status" json:"status"` // active|returned|overdue
+	Status       string     `db:"status" json:"status"` // pending|borrowed|overdue|returned|rejected
 }
 
 // ----- log_lab_maintenance_records -----
@@ -10,18 +10,178 @@ func init() {
 	beego.InsertFilter("/api/*", beego.BeforeRouter, controllers.SessionAuthFilter)
 	beego.Post("/api/auth/login", controllers.AuthLogin)
 	beego.Post("/api/auth/logout", controllers.AuthLogout)
+	beego.Get("/api/auth/me", controllers.AuthMe)
 	beego.Post("/api/auth/register", controllers.AuthRegister)
+	beego.Post("/api/auth/password/forgot", controllers.AuthPasswordForgot)
+	beego.Post("/api/auth/password/reset", controllers.AuthPasswordReset)
+	beego.Post("/api/auth/password/change", controllers.AuthPasswordChange)
+	beego.Post("/api/auth/mfa/verify", controllers.AuthMFAVerify)
+	beego.Get("/api/auth/oidc/login", controllers.AuthOIDCLogin)
+	beego.Get("/api/auth/oidc/callback", controllers.AuthOIDCCallback)
+	beego.Post("/api/auth/mfa/enroll", controllers.AuthMFAEnroll)
+	beego.Post("/api/auth/mfa/confirm", controllers.AuthMFAConfirm)
+	beego.Post("/api/auth/mfa/recovery-codes", controllers.AuthMFARecoveryCodes)
+	beego.Post("/api/auth/mfa/disable", controllers.AuthMFADisable)
+	beego.Get("/api/auth/tokens", controllers.AuthTokensList)
+	beego.Post("/api/auth/tokens", controllers.AuthTokenCreate)
+	beego.Delete("/api/auth/tokens/:id([0-9]+)", controllers.AuthTokenRevoke)
+	beego.Get("/api/auth/sessions", controllers.AuthSessionsList)
+	beego.Delete("/api/auth/sessions", controllers.AuthSessionsRevokeAll)
+	beego.Delete("/api/auth/sessions/:id([0-9]+)", controllers.AuthSessionRevoke)
+	beego.Router("/api/admin/users", &controllers.AdminUserController{}, "get:List;post:Create")
+	beego.Router("/api/admin/users/:id([0-9]+)", &controllers.AdminUserController{}, "get:Get;patch:Update;delete:Delete")
+	beego.Router("/api/admin/users/:id([0-9]+)/role", &controllers.AdminUserController{}, "put:SetRole")
+	beego.Router("/api/admin/users/:id([0-9]+)/disable", &controllers.AdminUserController{}, "post:Disable")
+	beego.Router("/api/admin/users/:id([0-9]+)/enable", &controllers.AdminUserController{}, "post:Enable")
+	beego.Router("/api/admin/users/:id([0-9]+)/reset-password", &controllers.AdminUserController{}, "post:ResetPassword")
+	beego.Router("/api/admin/users/:id([0-9]+)/unlock", &controllers.AdminUserController{}, "post:Unlock")
+	beego.Router("/api/admin/users/:id([0-9]+)/mfa/reset", &controllers.AdminUserController{}, "post:ResetMFA")
+	beego.Router("/api/admin/failed-logins", &controllers.FailedLoginController{}, "get:List")
+	beego.Get("/api/admin/users/:id([0-9]+)/sessions", controllers.AdminUserSessionsList)
+	beego.Delete("/api/admin/users/:id([0-9]+)/sessions", controllers.AdminUserSessionsRevokeAll)
+	beego.Delete("/api/admin/users/:id([0-9]+)/sessions/:sid([0-9]+)", controllers.AdminUserSessionRevoke)
 	beego.Router("/api/dashboard-stat", &controllers.Api{}, "get:GetAllEquipment")
 	beego.Router("/api/items", &controllers.ItemController{}, "get:GetAll;post:Add")
 	beego.Router("/api/items/borrow", &controllers.ItemController{}, "post:Borrow")
 	beego.Router("/api/items/return", &controllers.ItemController{}, "post:Return")
+	beego.Router("/api/items/issue", &controllers.ItemController{}, "post:Issue")
+	beego.Router("/api/stock-issues", &controllers.ItemController{}, "get:Issues")
+	beego.Get("/api/inventory/low-stock", controllers.LowStock)
+	beego.Router("/api/items/import", &controllers.ItemController{}, "post:Import")
+	beego.Router("/api/items/export", &controllers.ItemController{}, "get:Export")
 	beego.Router("/api/instructions", &controllers.InstructionController{}, "get:GetByItem;post:Add")
 	beego.Router("/api/instructions/:id([0-9]+)", &controllers.InstructionController{}, "get:GetOne")
 	beego.Router("/api/equipment-notes", &controllers.EquipmentNoteController{}, "get:GetByItem;post:Add")
 	beego.Router("/api/items/:id([0-9]+)/image", &controllers.ItemController{}, "put:UpdateImageURL")
-	beego.Router("/api/items/:id([0-9]+)", &controllers.ItemController{}, "get:GetOne")
+	beego.Router("/api/items/:id([0-9]+)", &controllers.ItemController{}, "get:GetOne;patch:Update;delete:Delete")
+	beego.Router("/api/items/:id([0-9]+)/archive", &controllers.ItemController{}, "post:Archive")
+	beego.Router("/api/items/:id([0-9]+)/restore", &controllers.ItemController{}, "post:Restore")
+	beego.Router("/api/items/:id([0-9]+)/label.png", &controllers.ItemController{}, "get:LabelPNG")
+	beego.Post("/api/labels", controllers.LabelsPDF)
+	beego.Router("/api/items/:id([0-9]+)/units", &controllers.UnitController{}, "get:ListForItem;post:Create")
+	beego.Router("/api/units", &controllers.UnitController{}, "get:Search")
+	beego.Router("/api/units/:id([0-9]+)", &controllers.UnitController{}, "get:Get;patch:Update")
+	beego.Router("/api/items/:id([0-9]+)/stock", &controllers.ItemController{}, "get:Stock;put:SetStock")
+	beego.Get("/api/locations", controllers.Locations)
+	beego.Get("/api/locations/stock", controllers.LocationStock)
+	beego.Router("/api/transfers", &controllers.TransferController{}, "get:List;post:Create")
+	beego.Router("/api/transfers/:id([0-9]+)", &controllers.TransferController{}, "get:Get")
+	beego.Router("/api/transfers/:id([0-9]+)/send", &controllers.TransferController{}, "post:Send")
+	beego.Router("/api/transfers/:id([0-9]+)/receive", &controllers.TransferController{}, "post:Receive")
+	beego.Router("/api/transfers/:id([0-9]+)/cancel", &controllers.TransferController{}, "post:Cancel")
+	beego.Router("/api/stock-movements", &controllers.TransferController{}, "get:Movements")
+	beego.Router("/api/purchase-requests", &controllers.PurchaseController{}, "get:List;post:Create")
+	beego.Router("/api/purchase-requests/:id([0-9]+)", &controllers.PurchaseController{}, "get:Get")
+	beego.Router("/api/purchase-requests/:id([0-9]+)/approve", &controllers.PurchaseController{}, "post:Approve")
+	beego.Router("/api/purchase-requests/:id([0-9]+)/reject", &controllers.PurchaseController{}, "post:Reject")
+	beego.Router("/api/purchase-requests/:id([0-9]+)/order", &controllers.PurchaseController{}, "post:Order")
+	beego.Router("/api/purchase-requests/:id([0-9]+)/receive", &controllers.PurchaseController{}, "post:Receive")
+	beego.Router("/api/purchase-requests/:id([0-9]+)/cancel", &controllers.PurchaseController{}, "post:Cancel")
+	beego.Router("/api/items/:id([0-9]+)/availability", &controllers.ItemController{}, "get:Availability")
+	beego.Router("/api/reservations", &controllers.ReservationController{}, "get:List;post:Create")
+	beego.Router("/api/reservations/:id([0-9]+)", &controllers.ReservationController{}, "get:Get")
+	beego.Router("/api/reservations/:id([0-9]+)/cancel", &controllers.ReservationController{}, "post:Cancel")
+	beego.Router("/api/reservations/:id([0-9]+)/pickup", &controllers.ReservationController{}, "post:Pickup")
+	beego.Router("/api/borrows/pending", &controllers.BorrowApprovalController{}, "get:Pending")
+	beego.Get("/api/borrows/overdue", controllers.OverdueBorrows)
+	beego.Router("/api/borrows/:id([0-9]+)/approve", &controllers.BorrowApprovalController{}, "post:Approve")
+	beego.Router("/api/borrows/:id([0-9]+)/reject", &controllers.BorrowApprovalController{}, "post:Reject")
+	beego.Get("/api/borrows/:id([0-9]+)/returns", controllers.BorrowReturns)
+	beego.Router("/api/borrows/:id([0-9]+)/renew", &controllers.RenewalController{}, "post:Renew")
+	beego.Router("/api/borrows/renewals", &controllers.RenewalController{}, "get:List")
+	beego.Router("/api/borrows/renewals/:id([0-9]+)/approve", &controllers.RenewalController{}, "post:Approve")
+	beego.Router("/api/borrows/renewals/:id([0-9]+)/reject", &controllers.RenewalController{}, "post:Reject")
+	beego.Get("/api/category-policies", controllers.CategoryPolicies)
+	beego.Put("/api/category-policies", controllers.SetCategoryPolicy)
 	beego.Router("/api/items/open-borrows", &controllers.ItemController{}, "get:GetOpenBorrows")
 
+	// ----- Permissions (checked by SessionAuthFilter once the caller is authenticated) -----
+	controllers.Policy("POST", "/api/items", controllers.PermItemCreate)
+	controllers.Policy("POST", "/api/items/import", controllers.PermItemCreate)
+	controllers.Policy("GET", "/api/items/export", controllers.PermItemUpdate)
+	controllers.Policy("PUT", "/api/items/:id/image", controllers.PermItemUpdate)
+	controllers.Policy("PATCH", "/api/items/:id", controllers.PermItemUpdate)
+	controllers.Policy("POST", "/api/items/:id/archive", controllers.PermItemArchive)
+	controllers.Policy("POST", "/api/items/:id/restore", controllers.PermItemArchive)
+	controllers.Policy("DELETE", "/api/items/:id", controllers.PermItemDelete)
+	controllers.Policy("POST", "/api/labels", controllers.PermItemUpdate)
+	controllers.Policy("GET", "/api/items/:id/units", controllers.PermAuthenticated)
+	controllers.Policy("POST", "/api/items/:id/units", controllers.PermItemUpdate)
+	controllers.Policy("PATCH", "/api/units/:id", controllers.PermItemUpdate)
+	controllers.Policy("GET", "/api/items/:id/stock", controllers.PermStockTransfer)
+	controllers.Policy("PUT", "/api/items/:id/stock", controllers.PermItemUpdate)
+	controllers.Policy("GET", "/api/units", controllers.PermItemUpdate)
+	controllers.Policy("GET", "/api/units/:id", controllers.PermItemUpdate)
+	controllers.Policy("GET", "/api/locations", controllers.PermAuthenticated)
+	controllers.Policy("GET", "/api/locations/stock", controllers.PermStockTransfer)
+	controllers.Policy("GET", "/api/stock-movements", controllers.PermStockTransfer)
+	controllers.Policy("GET", "/api/transfers", controllers.PermStockTransfer)
+	controllers.Policy("GET", "/api/transfers/:id", controllers.PermStockTransfer)
+	controllers.Policy("POST", "/api/transfers", controllers.PermStockTransfer)
+	controllers.Policy("POST", "/api/transfers/:id/send", controllers.PermStockTransfer)
+	controllers.Policy("POST", "/api/transfers/:id/receive", controllers.PermStockTransfer)
+	controllers.Policy("POST", "/api/transfers/:id/cancel", controllers.PermStockTransfer)
+	controllers.Policy("GET", "/api/inventory/low-stock", controllers.PermPurchaseRequest)
+	controllers.Policy("GET", "/api/purchase-requests", controllers.PermPurchaseRequest)
+	controllers.Policy("GET", "/api/purchase-requests/:id", controllers.PermPurchaseRequest)
+	controllers.Policy("POST", "/api/purchase-requests", controllers.PermPurchaseRequest)
+	controllers.Policy("POST", "/api/purchase-requests/:id/approve", controllers.PermPurchaseApprove)
+	controllers.Policy("POST", "/api/purchase-requests/:id/reject", controllers.PermPurchaseApprove)
+	controllers.Policy("POST", "/api/purchase-requests/:id/order", controllers.PermPurchaseApprove)
+	controllers.Policy("POST", "/api/purchase-requests/:id/receive", controllers.PermPurchaseReceive)
+	controllers.Policy("POST", "/api/purchase-requests/:id/cancel", controllers.PermPurchaseApprove)
+	controllers.Policy("POST", "/api/items/borrow", controllers.PermBorrowCreate)
+	controllers.Policy("GET", "/api/borrows/pending", controllers.PermBorrowCreate) // own requests unless borrow.approve
+	controllers.Policy("GET", "/api/borrows/overdue", controllers.PermBorrowCreate)
+	controllers.Policy("GET", "/api/borrows/:id/returns", controllers.PermBorrowCreate)
+	controllers.Policy("GET", "/api/borrows/renewals", controllers.PermBorrowCreate)
+	controllers.Policy("POST", "/api/items/return", controllers.PermBorrowReturn)
+	controllers.Policy("POST", "/api/borrows/:id/approve", controllers.PermBorrowApprove)
+	controllers.Policy("POST", "/api/borrows/:id/reject", controllers.PermBorrowApprove)
+	controllers.Policy("POST", "/api/borrows/:id/renew", controllers.PermBorrowCreate)
+	controllers.Policy("POST", "/api/borrows/renewals/:id/approve", controllers.PermBorrowApprove)
+	controllers.Policy("POST", "/api/borrows/renewals/:id/reject", controllers.PermBorrowApprove)
+	controllers.Policy("GET", "/api/category-policies", controllers.PermBorrowApprove)
+	controllers.Policy("PUT", "/api/category-policies", controllers.PermBorrowApprove)
+	controllers.Policy("GET", "/api/stock-issues", controllers.PermStockIssue)
+	controllers.Policy("POST", "/api/items/issue", controllers.PermStockIssue)
+	controllers.Policy("GET", "/api/items/:id/availability", controllers.PermAuthenticated)
+	controllers.Policy("GET", "/api/reservations", controllers.PermBorrowCreate)
+	controllers.Policy("GET", "/api/reservations/:id", controllers.PermBorrowCreate)
+	controllers.Policy("POST", "/api/reservations", controllers.PermBorrowCreate)
+	controllers.Policy("POST", "/api/reservations/:id/cancel", controllers.PermBorrowCreate)
+	controllers.Policy("POST", "/api/reservations/:id/pickup", controllers.PermBorrowCreate)
+	controllers.Policy("GET", "/api/instructions/:id", controllers.PermAuthenticated)
+	controllers.Policy("POST", "/api/instructions", controllers.PermInstructionEdit)
+	controllers.Policy("POST", "/api/equipment-notes", controllers.PermNoteCreate)
+	controllers.Policy("GET", "/api/auth/me", controllers.PermAuthenticated)
+	controllers.Policy("POST", "/api/auth/password/change", controllers.PermAuthenticated)
+	controllers.Policy("POST", "/api/auth/mfa/enroll", controllers.PermAuthenticated)
+	controllers.Policy("POST", "/api/auth/mfa/confirm", controllers.PermAuthenticated)
+	controllers.Policy("POST", "/api/auth/mfa/recovery-codes", controllers.PermAuthenticated)
+	controllers.Policy("POST", "/api/auth/mfa/disable", controllers.PermAuthenticated)
+	controllers.Policy("GET", "/api/auth/tokens", controllers.PermAuthenticated)
+	controllers.Policy("POST", "/api/auth/tokens", controllers.PermAuthenticated)
+	controllers.Policy("DELETE", "/api/auth/tokens/:id", controllers.PermAuthenticated)
+	controllers.Policy("GET", "/api/auth/sessions", controllers.PermAuthenticated)
+	controllers.Policy("DELETE", "/api/auth/sessions", controllers.PermAuthenticated)
+	controllers.Policy("DELETE", "/api/auth/sessions/:id", controllers.PermAuthenticated)
+	controllers.Policy("GET", "/api/admin/users", controllers.PermUserManage)
+	controllers.Policy("POST", "/api/admin/users", controllers.PermUserManage)
+	controllers.Policy("GET", "/api/admin/users/:id", controllers.PermUserManage)
+	controllers.Policy("PATCH", "/api/admin/users/:id", controllers.PermUserManage)
+	controllers.Policy("DELETE", "/api/admin/users/:id", controllers.PermUserManage)
+	controllers.Policy("PUT", "/api/admin/users/:id/role", controllers.PermUserManage)
+	controllers.Policy("POST", "/api/admin/users/:id/disable", controllers.PermUserManage)
+	controllers.Policy("POST", "/api/admin/users/:id/enable", controllers.PermUserManage)
+	controllers.Policy("POST", "/api/admin/users/:id/reset-password", controllers.PermUserManage)
+	controllers.Policy("POST", "/api/admin/users/:id/unlock", controllers.PermUserManage)
+	controllers.Policy("POST", "/api/admin/users/:id/mfa/reset", controllers.PermUserManage)
+	controllers.Policy("GET", "/api/admin/failed-logins", controllers.PermUserManage)
+	controllers.Policy("GET", "/api/admin/users/:id/sessions", controllers.PermSessionManage)
+	controllers.Policy("DELETE", "/api/admin/users/:id/sessions", controllers.PermSessionManage)
+	controllers.Policy("DELETE", "/api/admin/users/:id/sessions/:sid", controllers.PermSessionManage)
+
 	// ----- Pages (SPA shell) -----
 	beego.Router("/", &controllers.MainController{}, "get:Home")     // server decides: /dashboard or /login
 	beego.Router("/login", &controllers.MainController{}, "get:Get") // SPA handles /login view
@@ -24,6 +24,8 @@ export default function AddItem() {
         supplier: '',
         date_purchased: '', // yyyy-mm-dd
         status: 'active',
+        item_type: 'durable',
+        requires_approval: false,
     });
     const [submitting, setSubmitting] = useState(false);
     const [error, setError] = useState('');
@@ -72,6 +74,8 @@ export default function AddItem() {
                     supplier: form.supplier.trim(),
                     date_purchased: form.date_purchased.trim(), // optional
                     status: form.status.trim() || 'active',
+                    item_type: form.item_type,
+                    requires_approval: form.requires_approval,
                 }),
             });
             if (!res.ok) {
@@ -142,6 +146,13 @@ export default function AddItem() {
                         <label className="imx-label">Phân loại</label>
                         <input className="imx-input" value={form.category} onChange={e=>setField('category', e.target.value)} placeholder="equipment / tool / material" />
                     </div>
+                    <div style={{flex:1}}>
+                        <label className="imx-label">Loại vật tư</label>
+                        <select className="imx-input" value={form.item_type} onChange={e=>setField('item_type', e.target.value)}>
+                            <option value="durable">Thiết bị (mượn / trả)</option>
+                            <option value="consumable">Tiêu hao (cấp phát)</option>
+                        </select>
+                    </div>
                     <div style={{flex:1}}>
                         <label className="imx-label">Vị trí</label>
                         <input className="imx-input" value={form.location} onChange={e=>setField('location', e.target.value)} placeholder="shelf_A1" />
@@ -182,6 +193,13 @@ export default function AddItem() {
                     </div>
                 </div>
 
+                <div className="imx-row" style={{gap:12}}>
+                    <label className="imx-label">
+                        <input type="checkbox" checked={form.requires_approval} onChange={e=>setField('requires_approval', e.target.checked)} />
+                        {' '}Cần quản lý phòng lab duyệt khi mượn
+                    </label>
+                </div>
+
                 <div className="imx-row" style={{gap:10, justifyContent:'flex-end'}}>
                     <Link className="imx-btn" to="/dashboard">Huỷ</Link>
                     <button className="imx-btn imx-btn--primary" type="submit" disabled={submitting}>
@@ -201,6 +201,8 @@ export default function BorrowItem() {
 
     // Push decoded text into the corresponding input
     function onScan(region, text) {
+        // printed labels encode "SKU\nname\nlocation"; the SKU is the first line
+        text = text.split(/\r?\n/)[0].trim();
         if (!text) return;
         const found = equip.find(e => String(e.sku) === text);
         if (region === 'borrow') {
@@ -11,6 +11,7 @@ export default class Dashboard extends Component {
         loading: true,
         error: null,
         data: null,              // full JSON from /api/dashboard-stat
+        lowStock: [],            // /api/inventory/low-stock
         sortKey: 'id',
         sortDir: 'asc',
         query: '',
@@ -49,7 +50,9 @@ export default class Dashboard extends Component {
             const res = await fetch('/api/dashboard-stat', { headers: { ...this.tokenHeader() } });
             if (!res.ok) throw new Error(`HTTP ${res.status}`);
             const data = await res.json();
-            this.setState({ data, loading: false });
+            const low = await fetch('/api/inventory/low-stock', { headers: { ...this.tokenHeader() } });
+            const lowStock = low.ok ? await low.json() : [];
+            this.setState({ data, lowStock, loading: false });
         } catch (err) {
             this.setState({ error: String(err), loading: false });
         }
@@ -71,13 +74,9 @@ export default class Dashboard extends Component {
         const total = eq.length;
         const available = eq.reduce((acc, e) => acc + (Number(e.available_quantity || 0) > 0 ? 1 : 0), 0);
 
-        const now = Date.now();
         const borrowedActive = br.filter(r => !r.actual_return_date && (r.status || '').toLowerCase() !== 'returned').length;
-        const overdue = br.filter(r => {
-            if (r.actual_return_date) return false;
-            if (!r.return_date) return false;
-            return new Date(r.return_date).getTime() < now;
-        }).length;
+        // marked by the server's overdue job
+        const overdue = br.filter(r => !r.actual_return_date && (r.status || '').toLowerCase() === 'overdue').length;
 
         const maintenanceOpen = mt.filter(m => !m.date_fixed).length;
         const totalQty = eq.reduce(
@@ -268,23 +267,16 @@ export default class Dashboard extends Component {
         };
     }
 
-    // Low stock (Top 10)
+    // Low stock (Top 10): items at or below their reorder point, from the server
     buildLowStockBars() {
-        const eq = this.state.data?.log_lab_equipment_master || [];
-        const rows = [...eq]
-            .map(e => ({
-                label: e.name || e.sku || String(e.id),
-                available: Number(e.available_quantity || 0),
-                total: Number(e.quantity || 0),
-            }))
-            .sort((a,b)=> a.available - b.available)
-            .slice(0, 10);
+        const rows = (this.state.lowStock || []).slice(0, 10);
 
         return {
-            categories: rows.map(r => r.label),
+            categories: rows.map(r => r.name || r.sku || String(r.id)),
             series: [
-                { name: 'Available', data: rows.map(r => r.available) },
-                { name: 'Total', data: rows.map(r => r.total) },
+                { name: 'Available', data: rows.map(r => Number(r.available_quantity || 0)) },
+                { name: 'Reorder point', data: rows.map(r => Number(r.reorder_point || 0)) },
+                { name: 'Suggested order', data: rows.map(r => Number(r.suggested_order_qty || 0)) },
             ]
         };
     }
@@ -346,7 +338,7 @@ export default class Dashboard extends Component {
                 ...r,
                 item_sku: item?.sku || '-',
                 item_name: item?.name || '-',
-                overdue_flag: (!r.actual_return_date && r.return_date && Date.parse(r.return_date) < Date.now()) ? 'QUÁ HẠN' : '',
+                overdue_flag: (!r.actual_return_date && (r.status || '').toLowerCase() === 'overdue') ? 'QUÁ HẠN' : '',
             };
         });
 
@@ -389,7 +381,7 @@ export default class Dashboard extends Component {
 
         const lowOptions = {
             chart: { type: 'bar', backgroundColor: 'transparent', height: 300 },
-            title: { text: 'Xếp hạn tồn kho (top 10)', style: { color: text, fontSize: '14px' } },
+            title: { text: 'Sắp hết hàng (top 10)', style: { color: text, fontSize: '14px' } },
             xAxis: { categories: low.categories, labels: { style: { color: text } }, lineColor: grid, tickColor: grid },
             yAxis: { min: 0, title: { text: 'Vật tư', style: { color: text } }, labels: { style: { color: text } }, gridLineColor: grid },
             tooltip: { shared: true, backgroundColor: '#0b1120', borderColor: grid, style: { color: text } },
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var userCols = []string{"id", "username", "full_name", "email", "role", "last_login", "create_at", "disabled_at", "must_change_password", "locked_until"}
+
+func userRow(id int64, username, role string) *sqlmock.Rows {
+	return sqlmock.NewRows(userCols).AddRow(id, username, "Full Name", username+"@vlu.edu.vn", role, nil, time.Now(), nil, false, nil)
+}
+
+func TestAdminUsers(t *testing.T) {
+	Convey("Subject: user administration\n", t, func() {
+		mock := mockServer(t)
+		expectSession(mock, "admin", 1, controllers.RoleAdmin, false)
+
+		Convey("Only admins manage users", func() {
+			mock = mockServer(t)
+			expectSession(mock, "manager", 2, controllers.RoleLabManager, false)
+			So(serve("POST", "/api/admin/users/5/disable", "manager", "").Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Admins cannot disable, delete or demote themselves", func() {
+			So(serve("POST", "/api/admin/users/1/disable", "admin", "").Code, ShouldEqual, http.StatusConflict)
+			So(serve("DELETE", "/api/admin/users/1", "admin", "").Code, ShouldEqual, http.StatusConflict)
+			mock.ExpectQuery(`FROM users WHERE id=\?`).WithArgs(1).WillReturnRows(userRow(1, "root", controllers.RoleAdmin))
+			w := serve("PUT", "/api/admin/users/1/role", "admin", `{"role":"technician"}`)
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "demote your own account")
+		})
+		Convey("Unknown roles are rejected", func() {
+			So(serve("POST", "/api/admin/users", "admin", `{"username":"newbie","full_name":"N","email":"n@vlu.edu.vn","role":"janitor"}`).Code,
+				ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Disabling a user ends their sessions", func() {
+			mock.ExpectQuery(`FROM users WHERE id=\?`).WithArgs(5).WillReturnRows(userRow(5, "student5", controllers.RoleStudent))
+			mock.ExpectExec(`UPDATE users SET disabled_at=IFNULL\(disabled_at, NOW\(\)\) WHERE id=\?`).WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`DELETE FROM sessions WHERE user_id=\? AND id<>\?`).WithArgs(5, 0).WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WithArgs(1, "Disabled user #5 student5 (2 sessions revoked)").WillReturnResult(sqlmock.NewResult(1, 1))
+			So(serve("POST", "/api/admin/users/5/disable", "admin", "").Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("Users with borrow history are kept", func() {
+			mock.ExpectQuery(`FROM users WHERE id=\?`).WithArgs(5).WillReturnRows(userRow(5, "student5", controllers.RoleStudent))
+			mock.ExpectQuery(`SELECT COUNT\(1\) FROM log_lab_borrow_records WHERE user_id=\?`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(3))
+			w := serve("DELETE", "/api/admin/users/5", "admin", "")
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "disable the account instead")
+		})
+		Convey("A password reset forces a change and signs the user out", func() {
+			mock.ExpectQuery(`FROM users WHERE id=\?`).WithArgs(5).WillReturnRows(userRow(5, "student5", controllers.RoleStudent))
+			mock.ExpectExec(`UPDATE users SET password_hash=\?, must_change_password=1 WHERE id=\?`).WithArgs(sqlmock.AnyArg(), 5).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`DELETE FROM sessions WHERE user_id=\? AND id<>\?`).WithArgs(5, 0).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WillReturnResult(sqlmock.NewResult(1, 1))
+			w := serve("POST", "/api/admin/users/5/reset-password", "admin", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out struct {
+				Temporary string `json:"temporary_password"`
+			}
+			So(decode(w, &out), ShouldBeNil)
+			So(len(out.Temporary), ShouldEqual, 16)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
+
+// expectPasswordChangeDue signs token in as uid, whose password an admin has reset.
+func expectPasswordChangeDue(mock sqlmock.Sqlmock, token string, uid int64, role string) {
+	now := time.Now().UTC()
+	mock.ExpectQuery(`FROM sessions s`).WithArgs(tokenHash(token)).WillReturnRows(sqlmock.NewRows(append(sessionCols, "must_change_password")).
+		AddRow(uid*10, uid, "user@vlu.edu.vn", role, now, now, now.Add(time.Hour), "", "", false, true))
+}
+
+func TestMustChangePassword(t *testing.T) {
+	Convey("Subject: a password change an admin asked for\n", t, func() {
+		mock := mockServer(t)
+		expectPasswordChangeDue(mock, "reset", 5, controllers.RoleTechnician)
+
+		Convey("Nothing else is served until the password is changed", func() {
+			for _, r := range [][2]string{{"GET", "/api/items/4/units"}, {"POST", "/api/items/borrow"}, {"GET", "/api/auth/sessions"}} {
+				w := serve(r[0], r[1], "reset", `{}`)
+				So(w.Code, ShouldEqual, http.StatusForbidden)
+				So(w.Body.String(), ShouldContainSubstring, `"error":"password_change_required"`)
+			}
+		})
+		Convey("The client can still ask who is signed in and why", func() {
+			mock.ExpectQuery(`FROM users\s+WHERE id=\?`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"id", "username", "full_name", "email", "role", "must_change_password"}).
+				AddRow(5, "tech5", "Lê Văn C", "tech5@vlu.edu.vn", controllers.RoleTechnician, true))
+			w := serve("GET", "/api/auth/me", "reset", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"must_change_password":true`)
+			So(w.Body.String(), ShouldContainSubstring, `"username":"tech5"`)
+		})
+		Convey("Changing the password lifts the block on the same session", func() {
+			hash, err := bcrypt.GenerateFromPassword([]byte("temporary1"), bcrypt.MinCost)
+			So(err, ShouldBeNil)
+			mock.ExpectQuery(`SELECT password_hash FROM users WHERE id=\?`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(hash))
+			mock.ExpectExec(`UPDATE users SET password_hash=\?, must_change_password=0 WHERE id=\?`).WithArgs(sqlmock.AnyArg(), 5).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`DELETE FROM sessions WHERE user_id=\? AND id<>\?`).WithArgs(5, 50).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WithArgs(5, "Changed password").WillReturnResult(sqlmock.NewResult(1, 1))
+			w := serve("POST", "/api/auth/password/change", "reset", `{"current_password":"temporary1","new_password":"mine-now-2024"}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			expectSession(mock, "reset", 5, controllers.RoleTechnician, false)
+			w = serve("POST", "/api/items/borrow", "reset", `{}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "quantity must be")
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// expectToken lets token act for uid; lastUsed nil means first use, which
+// records last_used_at.
+func expectToken(mock sqlmock.Sqlmock, token string, uid int64, role, scope string, lastUsed interface{}) {
+	mock.ExpectQuery(`FROM api_tokens t JOIN users u`).WithArgs(tokenHash(token)).WillReturnRows(sqlmock.NewRows(
+		[]string{"id", "user_id", "name", "hint", "scope", "created_at", "expires_at", "last_used_at", "last_used_ip", "role"}).
+		AddRow(uid*100, uid, "kiosk", token[:12], scope, time.Now(), nil, lastUsed, nil, role))
+}
+
+func TestAPITokens(t *testing.T) {
+	Convey("Subject: personal API tokens\n", t, func() {
+		mock := mockServer(t)
+		recent := time.Now().UTC()
+
+		Convey("Revoked, expired and disabled users' tokens are not accepted", func() {
+			mock.ExpectQuery(`WHERE t\.token_hash=\? AND t\.revoked_at IS NULL AND \(t\.expires_at IS NULL OR t\.expires_at > UTC_TIMESTAMP\(\)\) AND u\.disabled_at IS NULL`).
+				WithArgs(tokenHash("imx_pat_gone")).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			So(serve("GET", "/api/stock-movements", "imx_pat_gone", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("First use of a token records when and from where", func() {
+			expectToken(mock, "imx_pat_kiosk", 3, controllers.RoleTechnician, controllers.ScopeRead, nil)
+			mock.ExpectExec(`UPDATE api_tokens SET last_used_at=\?, last_used_ip=\? WHERE id=\?`).WithArgs(sqlmock.AnyArg(), "192.0.2.1", 300).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			So(serve("POST", "/api/items/borrow", "imx_pat_kiosk", `{}`).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Read tokens cannot write even for admins", func() {
+			expectToken(mock, "imx_pat_read", 1, controllers.RoleAdmin, controllers.ScopeRead, recent)
+			w := serve("POST", "/api/items", "imx_pat_read", `{}`)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Body.String(), ShouldContainSubstring, `"permission":"item.create"`)
+		})
+		Convey("Borrow tokens cannot edit inventory", func() {
+			expectToken(mock, "imx_pat_borrow", 3, controllers.RoleTechnician, controllers.ScopeBorrow, recent)
+			So(serve("PATCH", "/api/items/4", "imx_pat_borrow", `{"name":"x"}`).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Admin tokens still only have their owner's role", func() {
+			expectToken(mock, "imx_pat_admin", 7, controllers.RoleStudent, controllers.ScopeAdmin, recent)
+			w := serve("POST", "/api/items", "imx_pat_admin", `{}`)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Body.String(), ShouldContainSubstring, `"permission":"item.create"`)
+		})
+		Convey("Tokens cannot manage tokens", func() {
+			expectToken(mock, "imx_pat_root", 1, controllers.RoleAdmin, controllers.ScopeAdmin, recent)
+			So(serve("POST", "/api/auth/tokens", "imx_pat_root", `{"name":"more","scope":"admin"}`).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("A new token is shown once and only its hash is stored", func() {
+			expectSession(mock, "web", 3, controllers.RoleTechnician, false)
+			var stored string
+			mock.ExpectExec(`INSERT INTO api_tokens`).WithArgs(3, "kiosk B2.04", hashArg{&stored}, sqlmock.AnyArg(), controllers.ScopeBorrow, sqlmock.AnyArg(),
+				near{time.Now().UTC().AddDate(0, 0, 30)}).WillReturnResult(sqlmock.NewResult(8, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WillReturnResult(sqlmock.NewResult(1, 1))
+			w := serve("POST", "/api/auth/tokens", "web", `{"name":" kiosk B2.04 ","scope":"Borrow","expires_in_days":30}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out struct {
+				Token string `json:"token"`
+				Hint  string `json:"hint"`
+			}
+			So(decode(w, &out), ShouldBeNil)
+			So(out.Token, ShouldStartWith, "imx_pat_")
+			So(strings.HasPrefix(out.Token, out.Hint), ShouldBeTrue)
+			So(stored, ShouldEqual, tokenHash(out.Token))
+		})
+		Convey("Lifetimes are capped by API_TOKEN_MAX_DAYS", func() {
+			expectSession(mock, "web", 3, controllers.RoleTechnician, false)
+			So(serve("POST", "/api/auth/tokens", "web", `{"name":"forever","scope":"read","expires_in_days":0}`).Code, ShouldEqual, http.StatusBadRequest)
+			So(serve("POST", "/api/auth/tokens", "web", `{"name":"long","scope":"read","expires_in_days":400}`).Code, ShouldEqual, http.StatusBadRequest)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
+
+// hashArg matches any string and keeps it.
+type hashArg struct{ into *string }
+
+func (h hashArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*h.into = s
+	return ok
+}
@@ -0,0 +1,142 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var borrowRequestCols = []string{"id", "item_id", "sku", "item_name", "user_id", "user_name", "quantity", "borrow_date", "return_date",
+	"status", "decided_by", "decided_at", "decision_note"}
+
+// borrowRequestRow is borrow 55: one oscilloscope (item 5) asked for by user 7.
+func borrowRequestRow(status string) *sqlmock.Rows {
+	return sqlmock.NewRows(borrowRequestCols).
+		AddRow(55, 5, "OSC-01", "Oscilloscope", 7, "Nguyễn Văn A", 1, time.Now(), nil, status, nil, nil, nil)
+}
+
+// expectNoHolds answers itemAvailability for itemID with nothing lent or reserved.
+func expectNoHolds(mock sqlmock.Sqlmock, itemID int64) {
+	mock.ExpectQuery(`FROM log_lab_borrow_records`).WithArgs(itemID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "quantity", "borrow_date", "return_date"}))
+	mock.ExpectQuery(`FROM reservations WHERE item_id=\?`).
+		WillReturnRows(sqlmock.NewRows([]string{"kind", "id", "user_id", "quantity", "start_at", "end_at", "purpose", "course"}))
+}
+
+func TestBorrowApprovals(t *testing.T) {
+	Convey("Subject: borrowing restricted items\n", t, func() {
+		mock := mockServer(t)
+
+		Convey("A student's borrow of a restricted item waits with 202 and leaves the stock alone", func() {
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT available_quantity, archived_at, item_type, category, requires_approval\s+FROM log_lab_equipment_master WHERE id=\? FOR UPDATE`).
+				WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"available_quantity", "archived_at", "item_type", "category", "requires_approval"}).
+				AddRow(1, nil, controllers.ItemDurable, "Electronics", true))
+			expectNoHolds(mock, 5)
+			mock.ExpectExec(`INSERT INTO log_lab_borrow_records`).WithArgs(7, 5, 1, nil, controllers.BorrowPending).
+				WillReturnResult(sqlmock.NewResult(55, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WithArgs(7, "Requested approval to borrow item #5 x1 (borrow #55)").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			w := serve("POST", "/api/items/borrow", "student", `{"item_id":5,"quantity":1}`)
+			So(w.Code, ShouldEqual, http.StatusAccepted)
+			var out struct {
+				ID     int64  `json:"id"`
+				Status string `json:"status"`
+			}
+			So(decode(w, &out), ShouldBeNil)
+			So(out.ID, ShouldEqual, 55)
+			So(out.Status, ShouldEqual, controllers.BorrowPending)
+		})
+		Convey("Approving lends the request: a unit goes out and the stock comes off the shelf", func() {
+			expectSession(mock, "manager", 2, controllers.RoleLabManager, true)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`WHERE br\.id=\? LIMIT 1$`).WithArgs(55).WillReturnRows(borrowRequestRow(controllers.BorrowPending))
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? FOR UPDATE`).WithArgs(5).WillReturnRows(itemRows(5, 1, 1))
+			mock.ExpectQuery(`WHERE br\.id=\? LIMIT 1 FOR UPDATE`).WithArgs(55).WillReturnRows(borrowRequestRow(controllers.BorrowPending))
+			expectNoHolds(mock, 5)
+			mock.ExpectQuery(`FROM equipment_units\s+WHERE item_id=\? AND status='available'`).WithArgs(5).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "item_id", "serial_number", "asset_tag"}).AddRow(31, 5, "SN31", "VLU-31"))
+			mock.ExpectExec(`UPDATE equipment_units SET status='borrowed', holder_user_id=\?, borrow_id=\?`).WithArgs(7, 55, sqlmock.AnyArg(), 31).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO borrow_record_units`).WithArgs(55, 31).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET available_quantity = available_quantity - \? WHERE id=\?`).WithArgs(1, 5).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`UPDATE log_lab_borrow_records SET status=\?, borrow_date=NOW\(\), decided_by=\?`).
+				WithArgs(controllers.BorrowBorrowed, 2, sqlmock.AnyArg(), "induction done", 55).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WithArgs(2, "Approved borrow #55: Oscilloscope (OSC-01) x1").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectQuery(`WHERE br\.id=\? LIMIT 1$`).WithArgs(55).WillReturnRows(borrowRequestRow(controllers.BorrowBorrowed))
+			w := serve("POST", "/api/borrows/55/approve", "manager", `{"note":"induction done"}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out struct {
+				Borrow struct {
+					Status string `json:"status"`
+				} `json:"borrow"`
+				UnitIDs []int64 `json:"unit_ids"`
+			}
+			So(decode(w, &out), ShouldBeNil)
+			So(out.Borrow.Status, ShouldEqual, controllers.BorrowBorrowed)
+			So(out.UnitIDs, ShouldResemble, []int64{31})
+		})
+		Convey("Approving waits for the stock to be back", func() {
+			expectSession(mock, "manager", 2, controllers.RoleLabManager, true)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`WHERE br\.id=\? LIMIT 1$`).WithArgs(55).WillReturnRows(borrowRequestRow(controllers.BorrowPending))
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? FOR UPDATE`).WithArgs(5).WillReturnRows(itemRows(5, 1, 0))
+			mock.ExpectQuery(`WHERE br\.id=\? LIMIT 1 FOR UPDATE`).WithArgs(55).WillReturnRows(borrowRequestRow(controllers.BorrowPending))
+			mock.ExpectRollback()
+			w := serve("POST", "/api/borrows/55/approve", "manager", "")
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "only 0 available now")
+		})
+		Convey("Rejecting records the reason and does not touch the stock", func() {
+			expectSession(mock, "manager", 2, controllers.RoleLabManager, true)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`WHERE br\.id=\? LIMIT 1 FOR UPDATE`).WithArgs(55).WillReturnRows(borrowRequestRow(controllers.BorrowPending))
+			mock.ExpectExec(`UPDATE log_lab_borrow_records SET status=\?, decided_by=\?`).
+				WithArgs(controllers.BorrowRejected, 2, sqlmock.AnyArg(), "book the safety induction first", 55).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).
+				WithArgs(2, "Rejected borrow #55 of Oscilloscope (OSC-01): book the safety induction first").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectQuery(`WHERE br\.id=\? LIMIT 1$`).WithArgs(55).WillReturnRows(borrowRequestRow(controllers.BorrowRejected))
+			w := serve("POST", "/api/borrows/55/reject", "manager", `{"reason":"book the safety induction first"}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"status":"rejected"`)
+		})
+		Convey("A decided request cannot be rejected again", func() {
+			expectSession(mock, "manager", 2, controllers.RoleLabManager, true)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`WHERE br\.id=\? LIMIT 1 FOR UPDATE`).WithArgs(55).WillReturnRows(borrowRequestRow(controllers.BorrowBorrowed))
+			mock.ExpectRollback()
+			w := serve("POST", "/api/borrows/55/reject", "manager", `{"reason":"too late"}`)
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "borrow is borrowed, not pending")
+		})
+		Convey("Students cannot approve their own requests", func() {
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			So(serve("POST", "/api/borrows/55/approve", "student", "").Code, ShouldEqual, http.StatusForbidden)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+
+	Convey("Subject: importing the approval flag\n", t, func() {
+		Convey("The approval flag can be imported in English or Vietnamese", func() {
+			csv := "sku,name,Cần duyệt\nLC-01,Laser cutter,có\nDB-01,Dobot arm,yes\nTS-01,Table saw,maybe\nMM-01,Multimeter,\n"
+			imp, err := controllers.ParseItemImport("items.csv", []byte(csv), "", nil, 0)
+			So(err, ShouldBeNil)
+			So(imp.Columns["Cần duyệt"], ShouldEqual, "requires_approval")
+			So(imp.Rows[0].Errors, ShouldBeEmpty)
+			So(imp.Rows[1].Errors, ShouldBeEmpty)
+			So(imp.Rows[2].Errors[0].Field, ShouldEqual, "requires_approval")
+			So(imp.Rows[3].Errors, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConsumables(t *testing.T) {
+	Convey("Subject: durable and consumable items\n", t, func() {
+		Convey("Item types accept English and Vietnamese spellings", func() {
+			for in, want := range map[string]string{
+				"":                controllers.ItemDurable,
+				"Durable":         controllers.ItemDurable,
+				"thiết bị":        controllers.ItemDurable,
+				"consumable":      controllers.ItemConsumable,
+				" Tiêu  hao ":     controllers.ItemConsumable,
+				"vat tu tieu hao": controllers.ItemConsumable,
+			} {
+				got, ok := controllers.NormalizeItemType(in)
+				So(ok, ShouldBeTrue)
+				So(got, ShouldEqual, want)
+			}
+			_, ok := controllers.NormalizeItemType("spare part")
+			So(ok, ShouldBeFalse)
+		})
+		Convey("The import understands an item type column", func() {
+			csv := "SKU,Name,Loại vật tư,Quantity\nPLA-1KG,PLA filament 1kg,tiêu hao,12\nCNC-01,Router,durable,1\nX,Thing,spare,1\n"
+			imp, err := controllers.ParseItemImport("items.csv", []byte(csv), "", nil, 0)
+			So(err, ShouldBeNil)
+			So(imp.Columns["Loại vật tư"], ShouldEqual, "item_type")
+			So(imp.Rows[0].Errors, ShouldBeEmpty)
+			So(imp.Rows[1].Errors, ShouldBeEmpty)
+			So(imp.Rows[2].Errors[0].Field, ShouldEqual, "item_type")
+		})
+	})
+}
+
+func TestIssueConsumables(t *testing.T) {
+	const issue = `{"item_id":6,"quantity":3,"user_id":7,"course":"ME3012"}`
+
+	Convey("Subject: issuing consumables\n", t, func() {
+		mock := mockServer(t)
+		expectSession(mock, "tech", 3, controllers.RoleTechnician, false)
+		expectIssue := func(item *sqlmock.Rows) {
+			mock.ExpectQuery(`SELECT full_name FROM users WHERE id=\? AND disabled_at IS NULL`).WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"full_name"}).AddRow("Nguyễn Văn A"))
+			mock.ExpectBegin()
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? LIMIT 1 FOR UPDATE`).WithArgs(6).WillReturnRows(item)
+		}
+
+		Convey("Durable items are borrowed, not issued", func() {
+			expectIssue(itemRows(6, 10, 10))
+			mock.ExpectRollback()
+			w := serve("POST", "/api/items/issue", "tech", issue)
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "durable items are borrowed")
+		})
+		Convey("No more than is in stock can be issued", func() {
+			expectIssue(consumableRows(6, 2, 2))
+			mock.ExpectRollback()
+			w := serve("POST", "/api/items/issue", "tech", issue)
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "only 2 in stock")
+		})
+		Convey("Issuing takes the stock out for good and records who got it at what cost", func() {
+			expectIssue(consumableRows(6, 12, 12))
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET quantity=quantity-\?, available_quantity=available_quantity-\? WHERE id=\?`).
+				WithArgs(3, 3, 6).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO stock_issues`).WithArgs(6, 7, 3, 3, 350.0, "Store room", "ME3012", nil, nil, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(41, 1))
+			mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(6).WillReturnRows(sqlmock.NewRows(storageCols).AddRow(2, 6, "Store room", 12, time.Now()))
+			mock.ExpectExec(`UPDATE log_lab_storage SET location=\?, quantity=\?, updated_at=\? WHERE id=\?`).WithArgs("Store room", 9, sqlmock.AnyArg(), 2).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO stock_movements`).WithArgs(6, "Store room", -3, 9, "issue", "issue", 41, 3, "ME3012", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET location=\? WHERE id=\?`).WithArgs("Store room", 6).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WithArgs(3, "Issued 3 x PLA filament 1kg (PLA-1KG) to Nguyễn Văn A for ME3012").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectQuery(`FROM stock_issues i`).WithArgs(41).WillReturnError(errTest)
+			w := serve("POST", "/api/items/issue", "tech", issue)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"id":41`)
+		})
+		Convey("Students cannot issue", func() {
+			mock = mockServer(t)
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			So(serve("POST", "/api/items/issue", "student", issue).Code, ShouldEqual, http.StatusForbidden)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,91 @@
+package test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xuri/excelize/v2"
+)
+
+func TestItemExport(t *testing.T) {
+	Convey("Subject: inventory export\n", t, func() {
+		mock := mockServer(t)
+		expectRows := func() {
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE 1=1 AND archived_at IS NULL ORDER BY id`).WillReturnRows(
+				itemRows(4, 10, 7).AddRow(5, "PSU-01", "Power supply", "", nil, "Electronics", "B2.05", 4, 4,
+					350.5, "", nil, "good", time.Now(), nil, nil, "equipment", 0, 0, true))
+		}
+
+		Convey("Guests cannot export", func() {
+			So(serve("GET", "/api/items/export", "", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Students cannot export", func() {
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			So(serve("GET", "/api/items/export", "student", "").Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("The CSV totals sit under their columns", func() {
+			expectSession(mock, "tech", 3, controllers.RoleTechnician, false)
+			expectRows()
+			w := serve("GET", "/api/items/export?format=csv", "tech", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			recs, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(w.Body.String(), "\ufeff"))).ReadAll()
+			So(err, ShouldBeNil)
+			So(len(recs), ShouldEqual, 4)
+			head, total := recs[0], recs[3]
+			So(total[0], ShouldEqual, "TOTAL")
+			for i, want := range map[string]string{"quantity": "14", "available_quantity": "11", "total_value": "13402", "unit_cost": ""} {
+				So(total[indexOf(head, i)], ShouldEqual, want)
+			}
+			So(recs[1][indexOf(head, "requires_approval")], ShouldEqual, "no")
+			So(recs[2][indexOf(head, "requires_approval")], ShouldEqual, "yes")
+		})
+		Convey("The XLSX file opens and ends with the totals row", func() {
+			expectSession(mock, "tech", 3, controllers.RoleTechnician, false)
+			expectRows()
+			w := serve("GET", "/api/items/export?format=xlsx&lang=vi", "tech", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			f, err := excelize.OpenReader(bytes.NewReader(w.Body.Bytes()))
+			So(err, ShouldBeNil)
+			defer f.Close()
+			rows, err := f.GetRows(f.GetSheetName(0))
+			So(err, ShouldBeNil)
+			So(len(rows), ShouldEqual, 4)
+			So(rows[3][0], ShouldEqual, "TỔNG CỘNG")
+			So(rows[3][indexOf(rows[0], "Số lượng")], ShouldEqual, "14")
+			So(rows[3][indexOf(rows[0], "Thành tiền")], ShouldEqual, "13402")
+			So(rows[1][indexOf(rows[0], "Cần duyệt")], ShouldEqual, "không")
+			So(rows[2][indexOf(rows[0], "Cần duyệt")], ShouldEqual, "có")
+		})
+		Convey("JSONL keeps English keys and JSON booleans whatever the language", func() {
+			expectSession(mock, "tech", 3, controllers.RoleTechnician, false)
+			expectRows()
+			w := serve("GET", "/api/items/export?format=jsonl&lang=vi", "tech", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			dec := json.NewDecoder(w.Body)
+			var first, second map[string]interface{}
+			So(dec.Decode(&first), ShouldBeNil)
+			So(dec.Decode(&second), ShouldBeNil)
+			So(first["requires_approval"], ShouldEqual, false)
+			So(second["requires_approval"], ShouldEqual, true)
+			So(second["sku"], ShouldEqual, "PSU-01")
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
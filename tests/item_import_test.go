@@ -0,0 +1,177 @@
+package test
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	beego "github.com/beego/beego/v2/server/web"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xuri/excelize/v2"
+)
+
+// serveImport posts file as the multipart upload of /api/items/import.
+func serveImport(token, mode, filename, file string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("mode", mode)
+	fw, _ := mw.CreateFormFile("file", filename)
+	_, _ = fw.Write([]byte(file))
+	_ = mw.Close()
+	req := httptest.NewRequest("POST", "/api/items/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	beego.BeeApp.Handlers.ServeHTTP(w, req)
+	return w
+}
+
+func TestItemImportParse(t *testing.T) {
+	Convey("Subject: parsing item import files\n", t, func() {
+		Convey("Vietnamese headers, a BOM and semicolons are understood", func() {
+			csv := "\ufeffMã thiết bị;Tên thiết bị;Số lượng;Đơn giá;Ngày mua;Ghi chú\n" +
+				"OSC-01;Oscilloscope;3;12.500.000;31/12/2023;tầng 2\n" +
+				"\n" +
+				"OSC-02;Probe;2,5;abc;2023-13-01;\n"
+			imp, err := controllers.ParseItemImport("kho.csv", []byte(csv), "", nil, 0)
+			So(err, ShouldBeNil)
+			So(imp.Columns["Mã thiết bị"], ShouldEqual, "sku")
+			So(imp.Columns["Đơn giá"], ShouldEqual, "unit_cost")
+			So(imp.Ignored, ShouldResemble, []string{"Ghi chú"})
+			So(imp.Rows, ShouldHaveLength, 2)
+			So(imp.Rows[0].SKU, ShouldEqual, "OSC-01")
+			So(imp.Rows[0].Errors, ShouldBeEmpty)
+			So(imp.Rows[1].Line, ShouldEqual, 4)
+			So(imp.Rows[1].Action, ShouldEqual, "error")
+			fields := []string{}
+			for _, e := range imp.Rows[1].Errors {
+				fields = append(fields, e.Field)
+			}
+			So(fields, ShouldResemble, []string{"quantity", "unit_cost", "date_purchased"})
+		})
+		Convey("Duplicate and missing SKUs are row errors", func() {
+			csv := "sku,name,quantity\nA1,One,1\na1,Again,2\n,No sku,3\n"
+			imp, err := controllers.ParseItemImport("items.csv", []byte(csv), "", nil, 0)
+			So(err, ShouldBeNil)
+			So(imp.Rows[0].Errors, ShouldBeEmpty)
+			So(imp.Rows[1].Errors[0].Msg, ShouldEqual, "duplicate sku (also on line 2)")
+			So(imp.Rows[2].Errors[0].Msg, ShouldEqual, "sku is required")
+		})
+		Convey("An explicit mapping overrides header detection", func() {
+			csv := "Code,Label,Qty\nX1,Thing,4\n"
+			imp, err := controllers.ParseItemImport("items.csv", []byte(csv), "", map[string]string{"Label": "name", "Qty": ""}, 0)
+			So(err, ShouldBeNil)
+			So(imp.Columns, ShouldResemble, map[string]string{"Code": "sku", "Label": "name"})
+			So(imp.Ignored, ShouldResemble, []string{"Qty"})
+
+			_, err = controllers.ParseItemImport("items.csv", []byte(csv), "", map[string]string{"Qty": "available_quantity"}, 0)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Files without a sku column, unknown types and oversized files are rejected", func() {
+			_, err := controllers.ParseItemImport("items.csv", []byte("name\nx\n"), "", nil, 0)
+			So(err, ShouldNotBeNil)
+			_, err = controllers.ParseItemImport("items.ods", []byte("sku\nx\n"), "", nil, 0)
+			So(err, ShouldNotBeNil)
+			_, err = controllers.ParseItemImport("items.csv", []byte("sku\na\nb\nc\n"), "", nil, 2)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("XLSX sheets are read with raw numbers and serial dates", func() {
+			f := excelize.NewFile()
+			_ = f.SetSheetRow("Sheet1", "A1", &[]interface{}{"SKU", "Name", "Quantity", "Unit cost", "Date purchased"})
+			_ = f.SetSheetRow("Sheet1", "A2", &[]interface{}{"MM-7", "Multimeter", 10, 1250000.5, 45291})
+			style, _ := f.NewStyle(&excelize.Style{NumFmt: 14})
+			_ = f.SetCellStyle("Sheet1", "E2", "E2", style)
+			buf, err := f.WriteToBuffer()
+			So(err, ShouldBeNil)
+
+			imp, err := controllers.ParseItemImport("items.xlsx", buf.Bytes(), "", nil, 0)
+			So(err, ShouldBeNil)
+			So(imp.Rows, ShouldHaveLength, 1)
+			So(imp.Rows[0].SKU, ShouldEqual, "MM-7")
+			So(imp.Rows[0].Errors, ShouldBeEmpty)
+
+			_, err = controllers.ParseItemImport("items.xlsx", buf.Bytes(), "Nope", nil, 0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestItemImport(t *testing.T) {
+	// OSC-01 exists as item 4 and gets a new name; MM-7 is new.
+	const upsert = "sku,name,quantity\nOSC-01,Oscilloscope MSO,\nMM-7,Multimeter,5\n"
+
+	Convey("Subject: importing items\n", t, func() {
+		mock := mockServer(t)
+		expectSession(mock, "manager", 3, controllers.RoleLabManager, true)
+
+		Convey("A dry run reports the plan and writes nothing", func() {
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE sku IN \(\?, \?\)$`).
+				WithArgs("OSC-01", "MM-7").WillReturnRows(itemRows(4, 10, 7))
+			w := serveImport("manager", "dry_run", "items.csv", upsert)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out struct {
+				Committed bool                        `json:"committed"`
+				Summary   map[string]int              `json:"summary"`
+				Rows      []controllers.ItemImportRow `json:"rows"`
+			}
+			So(decode(w, &out), ShouldBeNil)
+			So(out.Committed, ShouldBeFalse)
+			So(out.Summary["insert"], ShouldEqual, 1)
+			So(out.Summary["update"], ShouldEqual, 1)
+			So(out.Rows[0].ItemID, ShouldEqual, 4)
+			So(out.Rows[0].Changes, ShouldResemble, []string{"name"})
+			So(out.Rows[1].Action, ShouldEqual, "insert")
+		})
+		Convey("A commit upserts by SKU in one transaction", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE sku IN \(\?, \?\) FOR UPDATE`).
+				WithArgs("OSC-01", "MM-7").WillReturnRows(itemRows(4, 10, 7))
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET name=\? WHERE id=\?`).
+				WithArgs("Oscilloscope MSO", 4).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(4).WillReturnRows(sqlmock.NewRows(storageCols))
+			mock.ExpectExec(`INSERT INTO log_lab_equipment_master`).
+				WithArgs("Multimeter", "", "", nil, "", 5, 5, nil, "", nil, "MM-7", "active", controllers.ItemDurable, 0, 0, false).
+				WillReturnResult(sqlmock.NewResult(9, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).
+				WithArgs(3, "Imported items from items.csv: 1 new, 1 updated").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			w := serveImport("manager", "commit", "items.csv", upsert)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out struct {
+				Committed bool                        `json:"committed"`
+				Rows      []controllers.ItemImportRow `json:"rows"`
+			}
+			So(decode(w, &out), ShouldBeNil)
+			So(out.Committed, ShouldBeTrue)
+			So(out.Rows[1].ItemID, ShouldEqual, 9)
+		})
+		Convey("A row error aborts the whole commit", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`WHERE sku IN \(\?, \?\) FOR UPDATE`).
+				WithArgs("OSC-01", "NEW-1").WillReturnRows(itemRows(4, 10, 7))
+			mock.ExpectRollback()
+			w := serveImport("manager", "commit", "items.csv", "sku,name,quantity\nOSC-01,Oscilloscope MSO,\nNEW-1,,3\n")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "1 row(s) have errors; nothing was imported")
+			So(w.Body.String(), ShouldContainSubstring, "name is required for new items")
+		})
+		Convey("A failed write rolls back the rows already written", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`WHERE sku IN \(\?, \?\) FOR UPDATE`).WillReturnRows(itemRows(4, 10, 7))
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET name=\?`).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(4).WillReturnRows(sqlmock.NewRows(storageCols))
+			mock.ExpectExec(`INSERT INTO log_lab_equipment_master`).WillReturnError(errTest)
+			mock.ExpectRollback()
+			w := serveImport("manager", "commit", "items.csv", upsert)
+			So(w.Code, ShouldEqual, http.StatusInternalServerError)
+			So(w.Body.String(), ShouldContainSubstring, "line 3: write error; nothing was imported")
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
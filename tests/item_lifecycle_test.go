@@ -0,0 +1,115 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var itemCols = []string{"id", "sku", "name", "description", "image_url", "category", "location", "quantity", "available_quantity",
+	"unit_cost", "supplier", "date_purchased", "status", "create_at", "archived_at", "archived_reason", "item_type",
+	"reorder_point", "reorder_qty", "requires_approval"}
+
+// itemRows is log_lab_equipment_master row id: an oscilloscope, qty of which avail are on the shelf.
+func itemRows(id int64, qty, avail int) *sqlmock.Rows {
+	return sqlmock.NewRows(itemCols).AddRow(id, "OSC-01", "Oscilloscope", "2 channel", nil, "Electronics", "B2.04", qty, avail,
+		1200.0, "Rigol", nil, "good", time.Now(), nil, nil, controllers.ItemDurable, 0, 0, false)
+}
+
+// consumableRows is item id as a consumable: PLA filament at 350 a spool.
+func consumableRows(id int64, qty, avail int) *sqlmock.Rows {
+	return sqlmock.NewRows(itemCols).AddRow(id, "PLA-1KG", "PLA filament 1kg", "", nil, "3D printing", "Store room", qty, avail,
+		350.0, "", nil, "good", time.Now(), nil, nil, controllers.ItemConsumable, 5, 20, false)
+}
+
+func expectItem(mock sqlmock.Sqlmock, id int64, qty, avail int) {
+	mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? LIMIT 1 FOR UPDATE`).WithArgs(id).WillReturnRows(itemRows(id, qty, avail))
+}
+
+func count(n int) *sqlmock.Rows { return sqlmock.NewRows([]string{"n"}).AddRow(n) }
+
+func TestItemLifecycle(t *testing.T) {
+	Convey("Subject: editing and deleting items\n", t, func() {
+		mock := mockServer(t)
+		expectSession(mock, "admin", 1, controllers.RoleAdmin, false)
+
+		Convey("A PATCH writes only the fields that changed", func() {
+			mock.ExpectBegin()
+			expectItem(mock, 4, 10, 7)
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET description=\?, supplier=\? WHERE id=\?`).
+				WithArgs("4 channel", "Keysight", 4).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WithArgs(1, "Updated item #4 Oscilloscope (OSC-01): description, supplier").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? LIMIT 1$`).WithArgs(4).WillReturnRows(itemRows(4, 10, 7))
+			w := serve("PATCH", "/api/items/4", "admin", `{"name":"Oscilloscope","description":"4 channel","supplier":"Keysight","location":"B2.04"}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("A PATCH that changes nothing writes nothing", func() {
+			mock.ExpectBegin()
+			expectItem(mock, 4, 10, 7)
+			mock.ExpectRollback()
+			So(serve("PATCH", "/api/items/4", "admin", `{"name":"Oscilloscope","quantity":10}`).Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("Quantity cannot drop below the units on loan", func() {
+			mock.ExpectBegin()
+			expectItem(mock, 4, 10, 7)
+			mock.ExpectRollback()
+			w := serve("PATCH", "/api/items/4", "admin", `{"quantity":2}`)
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "the 3 unit(s) currently borrowed")
+		})
+		Convey("Available quantity follows quantity", func() {
+			mock.ExpectBegin()
+			expectItem(mock, 4, 10, 7)
+			mock.ExpectQuery(`FROM equipment_units WHERE item_id=\?`).WithArgs(4).
+				WillReturnRows(sqlmock.NewRows([]string{"active", "available"}).AddRow(0, 0))
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET quantity=\?, available_quantity=\? WHERE id=\?`).
+				WithArgs(12, 9, 4).WillReturnError(errTest)
+			mock.ExpectRollback()
+			So(serve("PATCH", "/api/items/4", "admin", `{"quantity":12}`).Code, ShouldEqual, http.StatusInternalServerError)
+		})
+
+		history := []struct{ table, msg string }{
+			{"log_lab_borrow_records", "borrow history"},
+			{"stock_movements", "stock movements"},
+			{"stock_issues", "consumable issues"},
+		}
+		for i, h := range history {
+			h, before := h, history[:i]
+			Convey("Items with "+h.msg+" are archived, not deleted", func() {
+				mock.ExpectBegin()
+				expectItem(mock, 4, 10, 10)
+				for _, b := range before {
+					mock.ExpectQuery(`SELECT COUNT\(1\) FROM ` + b.table + ` WHERE item_id=\?`).WithArgs(4).WillReturnRows(count(0))
+				}
+				mock.ExpectQuery(`SELECT COUNT\(1\) FROM ` + h.table + ` WHERE item_id=\?`).WithArgs(4).WillReturnRows(count(2))
+				mock.ExpectRollback()
+				w := serve("DELETE", "/api/items/4", "admin", "")
+				So(w.Code, ShouldEqual, http.StatusConflict)
+				So(w.Body.String(), ShouldContainSubstring, h.msg+"; archive it instead")
+			})
+		}
+		Convey("Deleting an item without history keeps the stock ledger untouched", func() {
+			mock.ExpectBegin()
+			expectItem(mock, 4, 10, 10)
+			for _, table := range []string{"log_lab_borrow_records", "stock_movements", "stock_issues", "stock_transfers", "reservations", "purchase_request_lines"} {
+				mock.ExpectQuery(`SELECT COUNT\(1\) FROM ` + table + ` WHERE item_id=\?`).WillReturnRows(count(0))
+			}
+			for _, table := range []string{"log_lab_equipment_notes", "log_lab_equipment_instructions", "log_lab_storage", "reservations", "equipment_units"} {
+				mock.ExpectExec(`DELETE FROM ` + table + ` WHERE item_id=\?`).WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			mock.ExpectExec(`DELETE FROM log_lab_equipment_master WHERE id=\?`).WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(serve("DELETE", "/api/items/4", "admin", "").Code, ShouldEqual, http.StatusOK)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"bytes"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vlu_infrastructure_management/controllers"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+func TestAssetLabels(t *testing.T) {
+	osc := controllers.Label{SKU: "OSC-01", Name: "Máy hiện sóng số Rigol DS1054Z", Location: "Phòng B2.04"}
+
+	Convey("Subject: printable asset labels\n", t, func() {
+		Convey("The QR payload starts with the SKU", func() {
+			So(osc.Payload(), ShouldEqual, "OSC-01\nMáy hiện sóng số Rigol DS1054Z\nPhòng B2.04")
+			So(controllers.Label{SKU: "X1"}.Payload(), ShouldEqual, "X1")
+		})
+		Convey("Single labels render as square-ish PNGs", func() {
+			b, err := controllers.LabelPNG(osc, 300, false)
+			So(err, ShouldBeNil)
+			img, err := png.Decode(bytes.NewReader(b))
+			So(err, ShouldBeNil)
+			So(img.Bounds().Dx(), ShouldEqual, img.Bounds().Dy())
+			So(img.Bounds().Dx(), ShouldBeLessThanOrEqualTo, 300)
+
+			b, err = controllers.LabelPNG(osc, 300, true)
+			So(err, ShouldBeNil)
+			img, _ = png.Decode(bytes.NewReader(b))
+			So(img.Bounds().Dy(), ShouldBeGreaterThan, img.Bounds().Dx())
+		})
+		Convey("Sheets fill pages in order, after any skipped positions", func() {
+			labels := make([]controllers.Label, 30)
+			for i := range labels {
+				labels[i] = osc
+			}
+			var buf bytes.Buffer
+			pages, err := controllers.RenderLabelSheet(&buf, labels, controllers.LabelSheetOptions{Layout: controllers.LabelLayouts["a4-3x8"]})
+			So(err, ShouldBeNil)
+			So(pages, ShouldEqual, 2)
+			So(bytes.HasPrefix(buf.Bytes(), []byte("%PDF-")), ShouldBeTrue)
+
+			pages, err = controllers.RenderLabelSheet(&bytes.Buffer{}, labels[:4], controllers.LabelSheetOptions{Layout: controllers.LabelLayouts["a4-3x8"], Skip: 21})
+			So(err, ShouldBeNil)
+			So(pages, ShouldEqual, 2)
+
+			_, err = controllers.RenderLabelSheet(&bytes.Buffer{}, labels, controllers.LabelSheetOptions{Layout: controllers.LabelLayouts["a4-3x8"], Skip: 24})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Every preset fits A4 and custom layouts are checked", func() {
+			for name, lay := range controllers.LabelLayouts {
+				_, err := controllers.RenderLabelSheet(&bytes.Buffer{}, []controllers.Label{osc}, controllers.LabelSheetOptions{Layout: lay, Outline: true})
+				So(err, ShouldBeNil)
+				So(name, ShouldStartWith, "a4-")
+			}
+			custom := controllers.LabelLayout{Cols: 2, Rows: 5, LabelW: 90, LabelH: 50}
+			_, err := controllers.RenderLabelSheet(&bytes.Buffer{}, []controllers.Label{osc}, controllers.LabelSheetOptions{Layout: custom})
+			So(err, ShouldBeNil)
+			custom.LabelW = 120
+			_, err = controllers.RenderLabelSheet(&bytes.Buffer{}, []controllers.Label{osc}, controllers.LabelSheetOptions{Layout: custom})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("A configured TTF is embedded for UTF-8 text", func() {
+			path := filepath.Join(t.TempDir(), "label.ttf")
+			So(os.WriteFile(path, goregular.TTF, 0o600), ShouldBeNil)
+			var buf bytes.Buffer
+			_, err := controllers.RenderLabelSheet(&buf, []controllers.Label{osc}, controllers.LabelSheetOptions{Layout: controllers.LabelLayouts["a4-2x7"], FontPath: path})
+			So(err, ShouldBeNil)
+			So(bytes.Contains(buf.Bytes(), []byte("FontFile2")), ShouldBeTrue)
+
+			_, err = controllers.RenderLabelSheet(&bytes.Buffer{}, []controllers.Label{osc}, controllers.LabelSheetOptions{Layout: controllers.LabelLayouts["a4-2x7"], FontPath: path + ".missing"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,85 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/jimlambrt/gldap"
+	"github.com/jimlambrt/gldap/testdirectory"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPBind(t *testing.T) {
+	users := testdirectory.NewUsers(t, []string{"svc", "bob"})
+	users = append(users, testdirectory.NewUsers(t, []string{"alice"},
+		testdirectory.WithMembersOf(t, "lab-managers"))...)
+	d := testdirectory.Start(t,
+		testdirectory.WithNoTLS(t),
+		testdirectory.WithDefaults(t, &testdirectory.Defaults{
+			Users:  users,
+			Groups: []*gldap.Entry{testdirectory.NewGroup(t, "lab-techs", []string{"bob"})},
+		}),
+	)
+
+	cfg := controllers.LDAPConfig{
+		URL:          fmt.Sprintf("ldap://%s:%d", d.Host(), d.Port()),
+		BindDN:       "cn=svc," + testdirectory.DefaultUserDN,
+		BindPassword: "password",
+		BaseDN:       testdirectory.DefaultUserDN,
+		UserFilter:   "(cn={username})",
+		AttrUsername: "name",
+		AttrEmail:    "email",
+		AttrName:     "name",
+		GroupBaseDN:  testdirectory.DefaultGroupDN,
+		GroupFilter:  "(member={dn})",
+		GroupRoleMap: map[string]string{
+			"lab-managers": controllers.RoleLabManager,
+			"lab-techs":    controllers.RoleTechnician,
+		},
+		DefaultRole: controllers.RoleStudent,
+	}
+	a := controllers.NewLDAPAuthenticator(cfg)
+
+	Convey("Subject: LDAP bind authentication\n", t, func() {
+		Convey("A valid bind resolves the entry and maps memberOf groups to a role", func() {
+			u, err := a.Bind("alice", "password")
+			So(err, ShouldBeNil)
+			So(u.DN, ShouldEqual, "cn=alice,"+testdirectory.DefaultUserDN)
+			So(u.Username, ShouldEqual, "alice")
+			So(u.Email, ShouldEqual, "alice@example.com")
+			So(u.Role, ShouldEqual, controllers.RoleLabManager)
+		})
+		Convey("Groups found by the group search are mapped too", func() {
+			u, err := a.Bind("bob", "password")
+			So(err, ShouldBeNil)
+			So(u.Groups, ShouldContain, "cn=lab-techs,"+testdirectory.DefaultGroupDN)
+			So(u.Role, ShouldEqual, controllers.RoleTechnician)
+		})
+		Convey("Users in no mapped group get the default role", func() {
+			u, err := a.Bind("svc", "password")
+			So(err, ShouldBeNil)
+			So(u.Role, ShouldEqual, controllers.RoleStudent)
+		})
+		Convey("Wrong and empty passwords and unknown users are rejected", func() {
+			var f *controllers.AuthFailure
+			_, err := a.Bind("alice", "wrong")
+			So(err, ShouldHaveSameTypeAs, f)
+			So(err.(*controllers.AuthFailure).Reason, ShouldEqual, "ldap_bad_password")
+			_, err = a.Bind("alice", "")
+			So(err, ShouldHaveSameTypeAs, f)
+			_, err = a.Bind("mallory", "password")
+			So(err, ShouldHaveSameTypeAs, f)
+			So(err.(*controllers.AuthFailure).Reason, ShouldEqual, "ldap_unknown_user")
+		})
+		Convey("A bad service account is a backend error, not a rejection", func() {
+			bad := cfg
+			bad.BindPassword = "nope"
+			_, err := controllers.NewLDAPAuthenticator(bad).Bind("alice", "password")
+			So(err, ShouldNotBeNil)
+			_, isFailure := err.(*controllers.AuthFailure)
+			So(isFailure, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// near matches a time argument within a second of at.
+type near struct{ at time.Time }
+
+func (n near) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	if !ok {
+		return false
+	}
+	d := t.Sub(n.at)
+	return d > -time.Second && d < time.Second
+}
+
+func expectWindow(mock sqlmock.Sqlmock, col string, arg interface{}, n int, oldest interface{}) {
+	mock.ExpectQuery(`FROM failed_logins WHERE `+col+`=\? AND cleared_at IS NULL AND created_at > \?`).
+		WithArgs(arg, near{time.Now().UTC().Add(-15 * time.Minute)}).
+		WillReturnRows(sqlmock.NewRows([]string{"n", "oldest"}).AddRow(n, oldest))
+}
+
+func TestLoginLimiter(t *testing.T) {
+	const login = `{"identifier":"Student@VLU.edu.vn","password":"wrong-password"}`
+
+	Convey("Subject: login lockout\n", t, func() {
+		mock := mockServer(t)
+
+		Convey("A locked account gets 429 with Retry-After until locked_until", func() {
+			mock.ExpectQuery(`SELECT locked_until FROM users WHERE email=\? OR username=\?`).
+				WithArgs("student@vlu.edu.vn", "student@vlu.edu.vn").
+				WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().UTC().Add(10 * time.Minute)))
+			w := serve("POST", "/api/auth/login", "", login)
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "600")
+		})
+		Convey("Failures in the window past the threshold are refused until the oldest leaves it", func() {
+			mock.ExpectQuery(`SELECT locked_until FROM users`).WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(nil))
+			expectWindow(mock, "ip", sqlmock.AnyArg(), 3, time.Now().UTC().Add(-14*time.Minute))
+			expectWindow(mock, "identifier", "student@vlu.edu.vn", 5, time.Now().UTC().Add(-10*time.Minute))
+			w := serve("POST", "/api/auth/login", "", login)
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "300")
+		})
+		Convey("Too many failures from one address are refused whatever the account", func() {
+			mock.ExpectQuery(`SELECT locked_until FROM users`).WillReturnRows(sqlmock.NewRows([]string{"locked_until"}))
+			expectWindow(mock, "ip", sqlmock.AnyArg(), 20, time.Now().UTC().Add(-13*time.Minute))
+			w := serve("POST", "/api/auth/login", "", `{"identifier":"someone-else","password":"x"}`)
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "120")
+		})
+		Convey("The failure that reaches the threshold locks the account", func() {
+			mock.ExpectExec(`INSERT INTO failed_logins`).WithArgs("student@vlu.edu.vn", 5, "10.0.0.9", nil, "bad_password", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			expectWindow(mock, "identifier", "student@vlu.edu.vn", 5, time.Now().UTC())
+			mock.ExpectExec(`UPDATE users SET locked_until=\? WHERE id=\?`).WithArgs(near{time.Now().UTC().Add(15 * time.Minute)}, 5).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			controllers.GetServer().Limiter.RecordFailure(" Student@VLU.edu.vn", 5, "10.0.0.9", "", "bad_password")
+		})
+		Convey("Failures below the threshold, or for unknown accounts, lock nothing", func() {
+			mock.ExpectExec(`INSERT INTO failed_logins`).WillReturnResult(sqlmock.NewResult(1, 1))
+			expectWindow(mock, "identifier", "student@vlu.edu.vn", 4, time.Now().UTC())
+			controllers.GetServer().Limiter.RecordFailure("student@vlu.edu.vn", 5, "10.0.0.9", "", "bad_password")
+			mock.ExpectExec(`INSERT INTO failed_logins`).WithArgs("nobody", nil, "10.0.0.9", nil, "unknown_user", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(2, 1))
+			controllers.GetServer().Limiter.RecordFailure("nobody", 0, "10.0.0.9", "", "unknown_user")
+		})
+		Convey("Unlocking clears the counted failures and the lock", func() {
+			expectSession(mock, "admin", 1, controllers.RoleAdmin, false)
+			mock.ExpectQuery(`FROM users WHERE id=\?`).WithArgs(5).WillReturnRows(userRow(5, "student5", controllers.RoleStudent))
+			mock.ExpectExec(`UPDATE failed_logins SET cleared_at=\? WHERE cleared_at IS NULL AND \(user_id=\? OR identifier=\? OR identifier=\?\)`).
+				WithArgs(sqlmock.AnyArg(), 5, "student5", "student5@vlu.edu.vn").WillReturnResult(sqlmock.NewResult(0, 5))
+			mock.ExpectExec(`UPDATE users SET locked_until=NULL WHERE id=\?`).WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WillReturnResult(sqlmock.NewResult(1, 1))
+			So(serve("POST", "/api/admin/users/5/unlock", "admin", "").Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("Responses slow down after repeated failures", func() {
+			l := controllers.GetServer().Limiter
+			So(l.Delay(1), ShouldEqual, 0)
+			So(l.Delay(2), ShouldEqual, time.Second)
+			So(l.Delay(4), ShouldEqual, 4*time.Second)
+			So(l.Delay(9), ShouldEqual, 8*time.Second)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLowStockSuggestions(t *testing.T) {
+	Convey("Subject: reorder suggestions\n", t, func() {
+		Convey("Items above their reorder point, or without one, need nothing", func() {
+			So(controllers.SuggestReorder(11, 10, 5), ShouldEqual, 0)
+			So(controllers.SuggestReorder(0, 0, 5), ShouldEqual, 0)
+		})
+		Convey("Orders come in multiples of the reorder quantity and clear the point", func() {
+			So(controllers.SuggestReorder(10, 10, 5), ShouldEqual, 5)
+			So(controllers.SuggestReorder(3, 10, 5), ShouldEqual, 10)
+			So(controllers.SuggestReorder(0, 10, 25), ShouldEqual, 25)
+		})
+		Convey("Without a reorder quantity stock is topped up to twice the point", func() {
+			So(controllers.SuggestReorder(4, 10, 0), ShouldEqual, 16)
+			So(controllers.SuggestReorder(-2, 10, 0), ShouldEqual, 20)
+		})
+	})
+}
+
+func TestLowStockList(t *testing.T) {
+	Convey("Subject: the low-stock list\n", t, func() {
+		mock := mockServer(t)
+		expectSession(mock, "tech", 3, controllers.RoleTechnician, false)
+
+		Convey("Stock already on order is taken off the suggestion", func() {
+			mock.ExpectQuery(`WHERE archived_at IS NULL AND reorder_point > 0 AND available_quantity <= reorder_point AND item_type=\? ORDER BY available_quantity - reorder_point, name`).
+				WithArgs(controllers.ItemConsumable).WillReturnRows(sqlmock.NewRows([]string{"id", "sku", "name", "category", "item_type", "location",
+				"quantity", "available_quantity", "reorder_point", "reorder_qty", "low_stock_since", "on_order"}).
+				AddRow(6, "PLA-1KG", "PLA filament 1kg", "3D printing", "consumable", "Store room", 2, 2, 5, 20, nil, 0).
+				AddRow(8, "ABS-1KG", "ABS filament 1kg", "3D printing", "consumable", "Store room", 4, 4, 5, 20, nil, 20))
+			w := serve("GET", "/api/inventory/low-stock?item_type=tiêu%20hao", "tech", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var rows []struct {
+				ID        int `json:"id"`
+				Shortfall int `json:"shortfall"`
+				Suggested int `json:"suggested_order_qty"`
+			}
+			So(decode(w, &rows), ShouldBeNil)
+			So(rows[0].Shortfall, ShouldEqual, 3)
+			So(rows[0].Suggested, ShouldEqual, 20)
+			So(rows[1].Shortfall, ShouldEqual, 1)
+			So(rows[1].Suggested, ShouldEqual, 0)
+		})
+		Convey("Unknown item types are rejected", func() {
+			So(serve("GET", "/api/inventory/low-stock?item_type=spare", "tech", "").Code, ShouldEqual, http.StatusBadRequest)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,39 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vlu_infrastructure_management/controllers"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &controllers.LogMailer{From: "no-reply@vlu.local", Dir: dir, Keep: true}
+	err := m.Send("sv@vlu.edu.vn", "Đặt lại mật khẩu / Password reset", "line 1\nline 2")
+	quiet := &controllers.LogMailer{From: "no-reply@vlu.local"}
+	_ = quiet.Send("sv@vlu.edu.vn", "Password reset", "body")
+
+	Convey("Subject: log/file mailer\n", t, func() {
+		So(err, ShouldBeNil)
+		Convey("The message is kept in memory", func() {
+			So(len(m.Sent), ShouldEqual, 1)
+			So(m.Sent[0].To, ShouldEqual, "sv@vlu.edu.vn")
+		})
+		Convey("Without Keep nothing piles up in memory", func() {
+			So(quiet.Sent, ShouldBeEmpty)
+		})
+		Convey("An .eml file with encoded headers is written", func() {
+			files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+			So(len(files), ShouldEqual, 1)
+			raw, _ := os.ReadFile(files[0])
+			So(string(raw), ShouldContainSubstring, "To: sv@vlu.edu.vn\r\n")
+			So(string(raw), ShouldContainSubstring, "Subject: =?utf-8?q?")
+			So(strings.HasSuffix(string(raw), "line 1\r\nline 2"), ShouldBeTrue)
+		})
+	})
+}
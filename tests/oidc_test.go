@@ -0,0 +1,161 @@
+package test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/coreos/go-oidc/v3/oidc/oidctest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// mockIssuer is a local OpenID provider: discovery and JWKS come from
+// oidctest, /token redeems codes issued via authorize().
+type mockIssuer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	codes    map[string]mockGrant
+	claims   map[string]interface{} // merged into every ID token
+}
+
+type mockGrant struct{ challenge, nonce string }
+
+func newMockIssuer(clientID string) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	m := &mockIssuer{key: key, clientID: clientID, codes: map[string]mockGrant{}, claims: map[string]interface{}{}}
+	disc := &oidctest.Server{PublicKeys: []oidctest.PublicKey{{PublicKey: key.Public(), KeyID: "k1", Algorithm: oidc.RS256}}}
+	mux := http.NewServeMux()
+	mux.Handle("/", disc)
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	disc.SetIssuer(m.URL)
+	return m
+}
+
+// authorize plays the provider's login page: it accepts the auth request URL
+// and returns the code the browser would bring back.
+func (m *mockIssuer) authorize(authURL string) (code, state string) {
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	code = fmt.Sprintf("code-%d", len(m.codes)+1)
+	m.codes[code] = mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	return code, q.Get("state")
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	g, ok := m.codes[r.PostForm.Get("code")]
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	delete(m.codes, r.PostForm.Get("code"))
+
+	claims := map[string]interface{}{
+		"iss":   m.URL,
+		"aud":   m.clientID,
+		"sub":   "sv-2174802010001",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": g.nonce,
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	raw, _ := json.Marshal(claims)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "at",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     oidctest.SignIDToken(m.key, "k1", oidc.RS256, string(raw)),
+	})
+}
+
+func TestOIDCProvider(t *testing.T) {
+	m := newMockIssuer("imx")
+	defer m.Close()
+	ctx := context.Background()
+
+	Convey("Subject: OIDC authorization code + PKCE against a mock issuer\n", t, func() {
+		p, err := controllers.NewOIDCProvider(ctx, controllers.OIDCConfig{
+			Issuer: m.URL, ClientID: "imx", ClientSecret: "secret",
+			RedirectURL: "http://localhost:8020/api/auth/oidc/callback",
+			Scopes:      []string{"email", "profile"},
+		})
+		So(err, ShouldBeNil)
+		m.claims = map[string]interface{}{
+			"email": "An.Nguyen@vlu.edu.vn", "email_verified": "true",
+			"name": "Nguyễn Văn An", "preferred_username": "an.nguyen", "amr": []string{"pwd", "mfa"},
+		}
+
+		Convey("The auth URL carries state, nonce and an S256 challenge", func() {
+			r := controllers.NewOIDCAuthRequest()
+			u, _ := url.Parse(p.AuthCodeURL(r))
+			q := u.Query()
+			So(q.Get("state"), ShouldEqual, r.State)
+			So(q.Get("nonce"), ShouldEqual, r.Nonce)
+			So(q.Get("code_challenge_method"), ShouldEqual, "S256")
+			So(q.Get("code_challenge"), ShouldNotEqual, r.Verifier)
+			So(q.Get("scope"), ShouldEqual, "openid email profile")
+		})
+
+		Convey("A valid code is exchanged and the claims are mapped", func() {
+			r := controllers.NewOIDCAuthRequest()
+			code, _ := m.authorize(p.AuthCodeURL(r))
+			c, err := p.Exchange(ctx, code, r)
+			So(err, ShouldBeNil)
+			So(c.Issuer, ShouldEqual, m.URL)
+			So(c.Subject, ShouldEqual, "sv-2174802010001")
+			So(c.Email, ShouldEqual, "an.nguyen@vlu.edu.vn")
+			So(c.EmailVerified, ShouldBeTrue)
+			So(c.Name, ShouldEqual, "Nguyễn Văn An")
+			So(c.PreferredUsername, ShouldEqual, "an.nguyen")
+			So(c.AMR, ShouldResemble, []string{"pwd", "mfa"})
+		})
+
+		Convey("The wrong PKCE verifier is rejected by the token endpoint", func() {
+			r := controllers.NewOIDCAuthRequest()
+			code, _ := m.authorize(p.AuthCodeURL(r))
+			r.Verifier = controllers.NewOIDCAuthRequest().Verifier
+			_, err := p.Exchange(ctx, code, r)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("An ID token minted for another login is rejected (nonce)", func() {
+			r := controllers.NewOIDCAuthRequest()
+			code, _ := m.authorize(p.AuthCodeURL(r))
+			r.Nonce = "replayed"
+			_, err := p.Exchange(ctx, code, r)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Tokens for another client are rejected (audience)", func() {
+			other, err := controllers.NewOIDCProvider(ctx, controllers.OIDCConfig{Issuer: m.URL, ClientID: "someone-else"})
+			So(err, ShouldBeNil)
+			r := controllers.NewOIDCAuthRequest()
+			code, _ := m.authorize(other.AuthCodeURL(r))
+			_, err = other.Exchange(ctx, code, r)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
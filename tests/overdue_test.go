@@ -0,0 +1,96 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOverdue(t *testing.T) {
+	Convey("Subject: overdue loans\n", t, func() {
+		due := time.Date(2024, 10, 10, 0, 0, 0, 0, time.UTC)
+
+		Convey("A loan is not overdue on its due date", func() {
+			So(controllers.DaysOverdue(due, time.Date(2024, 10, 9, 12, 0, 0, 0, time.UTC)), ShouldEqual, 0)
+			So(controllers.DaysOverdue(due, time.Date(2024, 10, 10, 23, 59, 0, 0, time.UTC)), ShouldEqual, 0)
+		})
+		Convey("Days overdue count from the day after", func() {
+			So(controllers.DaysOverdue(due, time.Date(2024, 10, 11, 0, 5, 0, 0, time.UTC)), ShouldEqual, 1)
+			So(controllers.DaysOverdue(due, time.Date(2024, 11, 9, 8, 0, 0, 0, time.UTC)), ShouldEqual, 30)
+		})
+	})
+}
+
+var overdueCols = []string{"id", "item_id", "sku", "item_name", "category", "user_id", "user_name", "email", "quantity",
+	"borrow_date", "return_date", "status", "renewals"}
+
+func TestOverdueList(t *testing.T) {
+	Convey("Subject: listing overdue loans\n", t, func() {
+		mock := mockServer(t)
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		// borrow 60 of user 7 was due three days ago, borrow 61 of user 8 yesterday
+		loans := func(ids ...int64) *sqlmock.Rows {
+			rows := sqlmock.NewRows(overdueCols)
+			for _, id := range ids {
+				if id == 60 {
+					rows.AddRow(60, 4, "OSC-01", "Oscilloscope", "Electronics", 7, "Nguyễn Văn A", "a@vlu.edu.vn", 1,
+						today.AddDate(0, 0, -20), today.AddDate(0, 0, -3), controllers.BorrowOverdue, 1)
+				} else {
+					rows.AddRow(61, 4, "OSC-01", "Oscilloscope", "Electronics", 8, "Trần Thị B", "b@vlu.edu.vn", 2,
+						today.AddDate(0, 0, -9), today.AddDate(0, 0, -1), controllers.BorrowBorrowed, 0)
+				}
+			}
+			return rows
+		}
+		var out []struct {
+			ID          int64 `json:"id"`
+			Quantity    int   `json:"quantity"`
+			DaysOverdue int   `json:"days_overdue"`
+		}
+
+		Convey("Guests cannot list overdue loans", func() {
+			So(serve("GET", "/api/borrows/overdue", "", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Students only see their own, with how many days each is overdue", func() {
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			mock.ExpectQuery(`AND br\.return_date < \? AND br\.user_id=\? ORDER BY br\.return_date, br\.id`).WithArgs(today, 7).WillReturnRows(loans(60))
+			w := serve("GET", "/api/borrows/overdue", "student", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(decode(w, &out), ShouldBeNil)
+			So(len(out), ShouldEqual, 1)
+			So(out[0].ID, ShouldEqual, 60)
+			So(out[0].DaysOverdue, ShouldEqual, 3)
+		})
+		Convey("A student's user_id filter does not reach other borrowers", func() {
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			mock.ExpectQuery(`AND br\.user_id=\? AND br\.user_id=\? ORDER BY`).WithArgs(today, 8, 7).WillReturnRows(loans())
+			w := serve("GET", "/api/borrows/overdue?user_id=8", "student", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "[]")
+		})
+		Convey("Lab managers see everyone's, filtered as asked", func() {
+			expectSession(mock, "manager", 2, controllers.RoleLabManager, true)
+			mock.ExpectQuery(`AND br\.return_date < \? AND br\.item_id=\? AND e\.category=\? ORDER BY`).WithArgs(today, 4, "Electronics").
+				WillReturnRows(loans(60, 61))
+			w := serve("GET", "/api/borrows/overdue?item_id=4&category=Electronics", "manager", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(decode(w, &out), ShouldBeNil)
+			So(len(out), ShouldEqual, 2)
+			So(out[0].DaysOverdue, ShouldEqual, 3)
+			So(out[1].DaysOverdue, ShouldEqual, 1)
+			So(out[1].Quantity, ShouldEqual, 2)
+		})
+		Convey("Filters must be ids", func() {
+			expectSession(mock, "manager", 2, controllers.RoleLabManager, true)
+			w := serve("GET", "/api/borrows/overdue?user_id=abc", "manager", "")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "invalid user_id")
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,154 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPartialReturns(t *testing.T) {
+	Convey("Subject: partial returns of tracked units\n", t, func() {
+		Convey("Untracked pieces may come back without naming units", func() {
+			So(controllers.PartialReturnMsg(3, 5, 0, 0), ShouldEqual, "")
+			So(controllers.PartialReturnMsg(2, 5, 0, 3), ShouldEqual, "")
+		})
+		Convey("Tracked units must be named once the untracked pieces run out", func() {
+			So(controllers.PartialReturnMsg(3, 5, 0, 3), ShouldContainSubstring, "list the units")
+			So(controllers.PartialReturnMsg(3, 5, 1, 3), ShouldEqual, "")
+			So(controllers.PartialReturnMsg(2, 4, 2, 4), ShouldEqual, "")
+		})
+		Convey("No more units than the quantity returned", func() {
+			So(controllers.PartialReturnMsg(1, 4, 2, 4), ShouldEqual, "more units listed than the quantity returned")
+		})
+	})
+}
+
+var openBorrowCols = []string{"id", "item_id", "quantity", "quantity_returned", "name", "sku", "item_type"}
+
+// expectOpenBorrow has student 7 holding borrow 60: qty oscilloscopes (item 4), returned of them back.
+func expectOpenBorrow(mock sqlmock.Sqlmock, qty, returned int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM log_lab_borrow_records br\s+JOIN log_lab_equipment_master em ON em\.id = br\.item_id\s+WHERE br\.id=\? AND br\.user_id=\?`).
+		WithArgs(60, 7).WillReturnRows(sqlmock.NewRows(openBorrowCols).AddRow(60, 4, qty, returned, "Oscilloscope", "OSC-01", controllers.ItemDurable))
+}
+
+// expectUnitsOut lists the tracked units still out on borrow 60.
+func expectUnitsOut(mock sqlmock.Sqlmock, ids ...int64) {
+	rows := sqlmock.NewRows([]string{"id", "unit_condition"})
+	for _, id := range ids {
+		rows.AddRow(id, "good")
+	}
+	mock.ExpectQuery(`FROM borrow_record_units bu\s+JOIN equipment_units u ON u\.id = bu\.unit_id\s+WHERE bu\.borrow_id=\? AND bu\.returned_at IS NULL FOR UPDATE`).
+		WithArgs(60).WillReturnRows(rows)
+}
+
+// expectReturnLine expects qty going back on the shelf, held of them kept for maintenance, and the activity entry.
+func expectReturnLine(mock sqlmock.Sqlmock, qty, held int, action string) {
+	mock.ExpectExec(`UPDATE log_lab_equipment_master SET available_quantity = available_quantity \+ \? WHERE id=\?`).WithArgs(qty-held, 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO borrow_returns`).WithArgs(60, qty, held, sqlmock.AnyArg(), sqlmock.AnyArg(), 7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WithArgs(7, action).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestReturnInParts(t *testing.T) {
+	Convey("Subject: returning a borrow a few pieces at a time\n", t, func() {
+		mock := mockServer(t)
+		expectSession(mock, "student", 7, controllers.RoleStudent, false)
+		var out struct {
+			Returned    int  `json:"returned"`
+			Outstanding int  `json:"outstanding"`
+			Closed      bool `json:"closed"`
+		}
+
+		Convey("A partial return adds to what is back and keeps the borrow open", func() {
+			expectOpenBorrow(mock, 4, 1)
+			mock.ExpectExec(`UPDATE log_lab_borrow_records SET quantity_returned = quantity_returned \+ \? WHERE id=\?`).WithArgs(2, 60).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectUnitsOut(mock)
+			expectReturnLine(mock, 2, 0, "Returned Oscilloscope (OSC-01) x2, 1 still out")
+			w := serve("POST", "/api/items/return", "student", `{"borrow_id":60,"quantity":2}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(decode(w, &out), ShouldBeNil)
+			So(out.Returned, ShouldEqual, 2)
+			So(out.Outstanding, ShouldEqual, 1)
+			So(out.Closed, ShouldBeFalse)
+		})
+		Convey("Without a quantity the rest comes back and the borrow closes", func() {
+			expectOpenBorrow(mock, 4, 3)
+			mock.ExpectExec(`UPDATE log_lab_borrow_records\s+SET quantity_returned = quantity,.*status = 'returned'`).WithArgs(nil, "", 60).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectUnitsOut(mock)
+			expectReturnLine(mock, 1, 0, "Returned Oscilloscope (OSC-01) x1")
+			w := serve("POST", "/api/items/return", "student", `{"borrow_id":60}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(decode(w, &out), ShouldBeNil)
+			So(out.Returned, ShouldEqual, 1)
+			So(out.Outstanding, ShouldEqual, 0)
+			So(out.Closed, ShouldBeTrue)
+		})
+		Convey("No more than is still out can be returned", func() {
+			expectOpenBorrow(mock, 4, 3)
+			mock.ExpectRollback()
+			w := serve("POST", "/api/items/return", "student", `{"borrow_id":60,"quantity":2}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "quantity must be between 1 and 1")
+		})
+		Convey("Tracked units out on the borrow must be named in a partial return", func() {
+			expectOpenBorrow(mock, 2, 0)
+			mock.ExpectExec(`UPDATE log_lab_borrow_records SET quantity_returned = quantity_returned \+ \?`).WithArgs(1, 60).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectUnitsOut(mock, 31, 32)
+			mock.ExpectRollback()
+			w := serve("POST", "/api/items/return", "student", `{"borrow_id":60,"quantity":1}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "list the units being returned")
+		})
+		Convey("A named unit comes back alone, and a broken one stays off the shelf", func() {
+			expectOpenBorrow(mock, 2, 0)
+			mock.ExpectExec(`UPDATE log_lab_borrow_records SET quantity_returned = quantity_returned \+ \?`).WithArgs(1, 60).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectUnitsOut(mock, 31, 32)
+			mock.ExpectExec(`UPDATE equipment_units SET status=\?, unit_condition=\?`).WithArgs(controllers.UnitMaintenance, "broken", sqlmock.AnyArg(), 32).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`UPDATE borrow_record_units SET returned_at=\?`).WithArgs(sqlmock.AnyArg(), "broken", 60, 32).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectReturnLine(mock, 1, 1, "Returned Oscilloscope (OSC-01) x1, 1 still out")
+			w := serve("POST", "/api/items/return", "student", `{"borrow_id":60,"quantity":1,"units":[{"unit_id":32,"condition":"broken"}]}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(decode(w, &out), ShouldBeNil)
+			So(out.Outstanding, ShouldEqual, 1)
+		})
+		Convey("Borrowers see the returns made so far", func() {
+			mock.ExpectQuery(`SELECT user_id, quantity, quantity_returned FROM log_lab_borrow_records WHERE id=\?`).WithArgs(60).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "quantity", "quantity_returned"}).AddRow(7, 4, 3))
+			mock.ExpectQuery(`FROM borrow_returns WHERE borrow_id=\?`).WithArgs(60).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "quantity", "held", "condition_on_return", "returned_at", "recorded_by"}).
+					AddRow(1, 2, 0, nil, time.Now(), 7).AddRow(2, 1, 1, "cracked probe", time.Now(), 3))
+			w := serve("GET", "/api/borrows/60/returns", "student", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var got struct {
+				Outstanding int `json:"outstanding"`
+				Returns     []struct {
+					Held int `json:"held_for_maintenance"`
+				} `json:"returns"`
+			}
+			So(decode(w, &got), ShouldBeNil)
+			So(got.Outstanding, ShouldEqual, 1)
+			So(len(got.Returns), ShouldEqual, 2)
+			So(got.Returns[1].Held, ShouldEqual, 1)
+		})
+		Convey("Other students' returns are not found", func() {
+			mock.ExpectQuery(`SELECT user_id, quantity, quantity_returned FROM log_lab_borrow_records WHERE id=\?`).WithArgs(60).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "quantity", "quantity_returned"}).AddRow(8, 4, 3))
+			So(serve("GET", "/api/borrows/60/returns", "student", "").Code, ShouldEqual, http.StatusNotFound)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordEndpoints(t *testing.T) {
+	t.Setenv("PASSWORD_RESET_TTL_MINUTES", "30")
+	const forgot = `{"identifier":"sv5@vlu.edu.vn"}`
+
+	Convey("Subject: forgotten and changed passwords\n", t, func() {
+		mock := mockServer(t)
+		mailer := &controllers.LogMailer{From: "no-reply@vlu.local", Keep: true}
+		controllers.GetServer().Mailer = mailer
+		expectUser := func() {
+			mock.ExpectQuery(`SELECT id, email, full_name FROM users\s+WHERE \(email = \? OR username = \?\) AND disabled_at IS NULL`).
+				WithArgs("sv5@vlu.edu.vn", "sv5@vlu.edu.vn").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "email", "full_name"}).AddRow(5, "sv5@vlu.edu.vn", "Phạm Thị D"))
+		}
+		// signedIn is a cached session of user 5 that passes the filter without the database
+		signedIn := func(token string) {
+			expectSession(mock, token, 5, controllers.RoleStudent, false)
+			So(serve("POST", "/api/items/borrow", token, `{}`).Code, ShouldEqual, http.StatusBadRequest)
+		}
+
+		Convey("Unknown accounts get the same answer and no mail", func() {
+			mock.ExpectQuery(`FROM users`).WillReturnRows(sqlmock.NewRows([]string{"id", "email", "full_name"}))
+			w := serve("POST", "/api/auth/password/forgot", "", `{"identifier":"nobody"}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, "if the account exists")
+			So(mailer.Sent, ShouldBeEmpty)
+		})
+		Convey("A reset link is mailed once and only its hash is stored", func() {
+			var stored string
+			expectUser()
+			mock.ExpectQuery(`SELECT COUNT\(1\) FROM password_resets WHERE user_id=\? AND used_at IS NULL AND created_at > \?`).
+				WithArgs(5, near{time.Now().UTC().Add(-time.Minute)}).WillReturnRows(count(0))
+			mock.ExpectExec(`INSERT INTO password_resets`).WithArgs(5, hashArg{&stored}, sqlmock.AnyArg(), near{time.Now().UTC().Add(30 * time.Minute)}, "192.0.2.1").
+				WillReturnResult(sqlmock.NewResult(3, 1))
+			So(serve("POST", "/api/auth/password/forgot", "", forgot).Code, ShouldEqual, http.StatusOK)
+			So(len(mailer.Sent), ShouldEqual, 1)
+			So(mailer.Sent[0].To, ShouldEqual, "sv5@vlu.edu.vn")
+			So(mailer.Sent[0].Body, ShouldContainSubstring, "hết hạn sau 30 phút")
+			token := regexp.MustCompile(`reset-password\?token=(\S+)`).FindStringSubmatch(mailer.Sent[0].Body)
+			So(token, ShouldHaveLength, 2)
+			So(tokenHash(token[1]), ShouldEqual, stored)
+		})
+		Convey("Asking again within a minute sends nothing more", func() {
+			expectUser()
+			mock.ExpectQuery(`SELECT COUNT\(1\) FROM password_resets`).WillReturnRows(count(1))
+			So(serve("POST", "/api/auth/password/forgot", "", forgot).Code, ShouldEqual, http.StatusOK)
+			So(mailer.Sent, ShouldBeEmpty)
+		})
+		Convey("A reset sets the password, burns the user's tokens and signs them out everywhere", func() {
+			signedIn("old")
+			mock.ExpectBegin()
+			mock.ExpectQuery(`FROM password_resets WHERE token_hash=\? AND used_at IS NULL AND expires_at > UTC_TIMESTAMP\(\) FOR UPDATE`).
+				WithArgs(tokenHash("mailed")).WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(3, 5))
+			mock.ExpectExec(`UPDATE users SET password_hash=\?, must_change_password=0 WHERE id=\?`).WithArgs(sqlmock.AnyArg(), 5).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`UPDATE password_resets SET used_at=UTC_TIMESTAMP\(\) WHERE user_id=\? AND used_at IS NULL`).WithArgs(5).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			mock.ExpectExec(`DELETE FROM sessions WHERE user_id=\? AND id<>\?`).WithArgs(5, 0).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WithArgs(5, "Password reset via e-mail link").WillReturnResult(sqlmock.NewResult(1, 1))
+			So(serve("POST", "/api/auth/password/reset", "", `{"token":"mailed","password":"brand-new-pass"}`).Code, ShouldEqual, http.StatusOK)
+			So(serve("POST", "/api/items/borrow", "old", `{}`).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Used and expired tokens are refused", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`FROM password_resets WHERE token_hash=\? AND used_at IS NULL AND expires_at > UTC_TIMESTAMP\(\)`).
+				WithArgs(tokenHash("mailed")).WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}))
+			mock.ExpectRollback()
+			w := serve("POST", "/api/auth/password/reset", "", `{"token":"mailed","password":"brand-new-pass"}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "invalid or expired token")
+		})
+		Convey("Changing the password needs the current one", func() {
+			signedIn("web")
+			hash, err := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.MinCost)
+			So(err, ShouldBeNil)
+			mock.ExpectQuery(`SELECT password_hash FROM users WHERE id=\?`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(hash))
+			w := serve("POST", "/api/auth/password/change", "web", `{"current_password":"guess-1234","new_password":"brand-new-pass"}`)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(w.Body.String(), ShouldContainSubstring, "current password is incorrect")
+		})
+		Convey("Changing the password signs out the other sessions and keeps this one", func() {
+			signedIn("web")
+			hash, err := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.MinCost)
+			So(err, ShouldBeNil)
+			mock.ExpectQuery(`SELECT password_hash FROM users WHERE id=\?`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(hash))
+			mock.ExpectExec(`UPDATE users SET password_hash=\?, must_change_password=0 WHERE id=\?`).WithArgs(sqlmock.AnyArg(), 5).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`DELETE FROM sessions WHERE user_id=\? AND id<>\?`).WithArgs(5, 50).WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WithArgs(5, "Changed password").WillReturnResult(sqlmock.NewResult(1, 1))
+			So(serve("POST", "/api/auth/password/change", "web", `{"current_password":"old-password","new_password":"brand-new-pass"}`).Code,
+				ShouldEqual, http.StatusOK)
+			signedIn("web")
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
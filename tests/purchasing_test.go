@@ -0,0 +1,228 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var purchaseCols = []string{"id", "status", "supplier", "order_ref", "note", "requested_by", "requested_at",
+	"decided_by", "decided_at", "decision_note", "ordered_by", "ordered_at", "received_at",
+	"cancelled_by", "cancelled_at", "cancel_reason", "estimated_total"}
+
+var purchaseLineCols = []string{"id", "request_id", "item_id", "sku", "name", "category", "item_type", "location",
+	"quantity", "unit_cost", "received_qty"}
+
+// purchaseRow is purchase request 12 from Hshop, filed by user requestedBy.
+func purchaseRow(status string, requestedBy int64) *sqlmock.Rows {
+	var orderRef interface{}
+	if status != controllers.PurchaseRequested && status != controllers.PurchaseApproved {
+		orderRef = "PO-2024-118"
+	}
+	return sqlmock.NewRows(purchaseCols).AddRow(12, status, "Hshop", orderRef, nil, requestedBy, time.Now(),
+		nil, nil, nil, nil, nil, nil, nil, nil, nil, 1806000.0)
+}
+
+// purchaseLines are the lines of request 12: five more of the oscilloscope
+// (item 4) and ten ESP32 boards the lab does not stock yet.
+func purchaseLines(oscReceived, espReceived int, espItem interface{}) *sqlmock.Rows {
+	return sqlmock.NewRows(purchaseLineCols).
+		AddRow(31, 12, 4, "OSC-01", "Oscilloscope", "Electronics", controllers.ItemDurable, nil, 5, 1200.0, oscReceived).
+		AddRow(32, 12, espItem, "ESP32-S3", "ESP32-S3 DevKit", "", controllers.ItemDurable, "Store room", 10, 180000.0, espReceived)
+}
+
+// expectPurchaseLoad is the locked read of request 12 that every step starts with.
+func expectPurchaseLoad(mock sqlmock.Sqlmock, status string, requestedBy int64) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM purchase_requests p WHERE p.id=\? LIMIT 1 FOR UPDATE`).WithArgs(12).
+		WillReturnRows(purchaseRow(status, requestedBy))
+}
+
+// expectPurchaseResponse is the read-back of request 12 after a change.
+func expectPurchaseResponse(mock sqlmock.Sqlmock, status string) {
+	mock.ExpectQuery(`FROM purchase_requests p WHERE p.id=\? LIMIT 1$`).WithArgs(12).WillReturnRows(purchaseRow(status, 5))
+	mock.ExpectQuery(`FROM purchase_request_lines WHERE request_id=\? ORDER BY id$`).WithArgs(12).
+		WillReturnRows(sqlmock.NewRows(purchaseLineCols))
+	mock.ExpectQuery(`FROM purchase_receipts WHERE request_id=\?`).WithArgs(12).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+}
+
+// expectReceipt books n of the oscilloscope, which holds shelf at B2.04,
+// on line 31 and writes the "receipt" ledger line.
+func expectReceipt(mock sqlmock.Sqlmock, n, shelf int, day interface{}) {
+	mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? FOR UPDATE`).WithArgs(4).
+		WillReturnRows(itemRows(4, shelf, shelf))
+	levels := func() *sqlmock.Rows {
+		return sqlmock.NewRows(storageCols).AddRow(1, 4, "B2.04", shelf, time.Now())
+	}
+	mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(4).WillReturnRows(levels())
+	mock.ExpectExec(`UPDATE log_lab_equipment_master SET quantity=quantity\+\?, available_quantity=available_quantity\+\? WHERE id=\?`).
+		WithArgs(n, n, 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(4).WillReturnRows(levels())
+	mock.ExpectExec(`UPDATE log_lab_storage SET location=\?, quantity=\?, updated_at=\? WHERE id=\?`).
+		WithArgs("B2.04", shelf+n, sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO stock_movements`).
+		WithArgs(4, "B2.04", n, shelf+n, "receipt", "purchase", 12, 5, "PO-2024-118", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE log_lab_equipment_master SET location=\? WHERE id=\?`).WithArgs("B2.04", 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO purchase_receipts`).
+		WithArgs(12, 31, 4, n, 1200.0, nil, nil, 5, day, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE purchase_request_lines SET received_qty=received_qty\+\? WHERE id=\?`).WithArgs(n, 31).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestPurchaseRequests(t *testing.T) {
+	Convey("Subject: purchase requests and goods receipts\n", t, func() {
+		mock := mockServer(t)
+
+		Convey("A technician files a request for an existing item and a new one", func() {
+			expectSession(mock, "tech", 5, controllers.RoleTechnician, false)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\?$`).WithArgs(4).WillReturnRows(itemRows(4, 10, 7))
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE sku=\? LIMIT 1`).WithArgs("ESP32-S3").
+				WillReturnRows(sqlmock.NewRows(itemCols))
+			mock.ExpectExec(`INSERT INTO purchase_requests`).
+				WithArgs(controllers.PurchaseRequested, "Hshop", nil, 5, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(12, 1))
+			mock.ExpectExec(`INSERT INTO purchase_request_lines`).
+				WithArgs(12, 4, "OSC-01", "Oscilloscope", "Electronics", controllers.ItemDurable, nil, 5, 1200.0).
+				WillReturnResult(sqlmock.NewResult(31, 1))
+			mock.ExpectExec(`INSERT INTO purchase_request_lines`).
+				WithArgs(12, nil, "ESP32-S3", "ESP32-S3 DevKit", "", controllers.ItemDurable, "Store room", 10, 180000.0).
+				WillReturnResult(sqlmock.NewResult(32, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).
+				WithArgs(5, "Requested purchase #12: 2 line(s) from Hshop").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			expectPurchaseResponse(mock, controllers.PurchaseRequested)
+
+			w := serve("POST", "/api/purchase-requests", "tech", `{"supplier":"Hshop","lines":[
+				{"item_id":4,"quantity":5},
+				{"sku":"ESP32-S3","name":"ESP32-S3 DevKit","location":"Store room","quantity":10,"unit_cost":180000}]}`)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			So(w.Body.String(), ShouldContainSubstring, `"status":"requested"`)
+		})
+		Convey("Students cannot file requests and technicians cannot approve them", func() {
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			So(serve("POST", "/api/purchase-requests", "student", `{"lines":[{"item_id":4,"quantity":1}]}`).Code,
+				ShouldEqual, http.StatusForbidden)
+			expectSession(mock, "tech", 5, controllers.RoleTechnician, false)
+			So(serve("POST", "/api/purchase-requests/12/approve", "tech", "").Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Another manager approves the request", func() {
+			expectSession(mock, "manager", 3, controllers.RoleLabManager, true)
+			expectPurchaseLoad(mock, controllers.PurchaseRequested, 5)
+			mock.ExpectExec(`UPDATE purchase_requests SET status=\?, decided_by=\?, decided_at=\?, decision_note=\? WHERE id=\?`).
+				WithArgs(controllers.PurchaseApproved, 3, near{time.Now().UTC()}, "within the term budget", 12).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).
+				WithArgs(3, "Purchase request #12 approved").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			expectPurchaseResponse(mock, controllers.PurchaseApproved)
+			w := serve("POST", "/api/purchase-requests/12/approve", "manager", `{"note":"within the term budget"}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("The requester cannot approve their own request", func() {
+			expectSession(mock, "manager", 3, controllers.RoleLabManager, true)
+			expectPurchaseLoad(mock, controllers.PurchaseRequested, 3)
+			mock.ExpectRollback()
+			w := serve("POST", "/api/purchase-requests/12/approve", "manager", "")
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "someone other than the requester")
+		})
+		Convey("An approved request is ordered", func() {
+			expectSession(mock, "manager", 3, controllers.RoleLabManager, true)
+			expectPurchaseLoad(mock, controllers.PurchaseApproved, 5)
+			mock.ExpectExec(`UPDATE purchase_requests SET status=\?, ordered_by=\?, ordered_at=\?, order_ref=\?, supplier=\? WHERE id=\?`).
+				WithArgs(controllers.PurchaseOrdered, 3, near{time.Now().UTC()}, "PO-2024-118", "Hshop", 12).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).
+				WithArgs(3, "Purchase request #12 ordered").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			expectPurchaseResponse(mock, controllers.PurchaseOrdered)
+			w := serve("POST", "/api/purchase-requests/12/order", "manager", `{"order_ref":"PO-2024-118"}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("A request is not ordered before it is approved", func() {
+			expectSession(mock, "manager", 3, controllers.RoleLabManager, true)
+			expectPurchaseLoad(mock, controllers.PurchaseRequested, 5)
+			mock.ExpectRollback()
+			w := serve("POST", "/api/purchase-requests/12/order", "manager", "")
+			So(w.Code, ShouldEqual, http.StatusConflict)
+		})
+		Convey("A request that was never ordered cannot be received", func() {
+			expectSession(mock, "tech", 5, controllers.RoleTechnician, false)
+			expectPurchaseLoad(mock, controllers.PurchaseApproved, 5)
+			mock.ExpectRollback()
+			w := serve("POST", "/api/purchase-requests/12/receive", "tech", "")
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "only ordered requests can be received")
+		})
+		Convey("A partial delivery leaves the request partially received", func() {
+			day := time.Date(2024, 10, 3, 0, 0, 0, 0, time.UTC)
+			expectSession(mock, "tech", 5, controllers.RoleTechnician, false)
+			expectPurchaseLoad(mock, controllers.PurchaseOrdered, 5)
+			mock.ExpectQuery(`FROM purchase_request_lines WHERE request_id=\? ORDER BY id FOR UPDATE`).WithArgs(12).
+				WillReturnRows(purchaseLines(0, 0, nil))
+			expectReceipt(mock, 2, 10, near{day})
+			mock.ExpectExec(`UPDATE purchase_requests SET status=\?, received_at=\? WHERE id=\?`).
+				WithArgs(controllers.PurchasePartial, nil, 12).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			expectPurchaseResponse(mock, controllers.PurchasePartial)
+			w := serve("POST", "/api/purchase-requests/12/receive", "tech",
+				`{"received_on":"2024-10-03","lines":[{"line_id":31,"quantity":2}]}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			Convey("The rest arrives and a new item is created on the day it was received", func() {
+				day := time.Date(2024, 10, 5, 0, 0, 0, 0, time.UTC)
+				expectPurchaseLoad(mock, controllers.PurchasePartial, 5)
+				mock.ExpectQuery(`FROM purchase_request_lines WHERE request_id=\? ORDER BY id FOR UPDATE`).WithArgs(12).
+					WillReturnRows(purchaseLines(2, 0, nil))
+				expectReceipt(mock, 3, 12, near{day})
+
+				mock.ExpectExec(`INSERT INTO log_lab_equipment_master`).
+					WithArgs("ESP32-S3 DevKit", "", "", nil, "Store room", 0, 0, 180000.0, "Hshop", day,
+						"ESP32-S3", "active", controllers.ItemDurable, 0, 0, false).
+					WillReturnResult(sqlmock.NewResult(40, 1))
+				mock.ExpectExec(`UPDATE purchase_request_lines SET item_id=\? WHERE id=\?`).WithArgs(40, 32).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? FOR UPDATE`).WithArgs(40).
+					WillReturnRows(sqlmock.NewRows(itemCols).AddRow(40, "ESP32-S3", "ESP32-S3 DevKit", "", nil, "", "Store room", 0, 0,
+						180000.0, "Hshop", day, "active", time.Now(), nil, nil, controllers.ItemDurable, 0, 0, false))
+				mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(40).WillReturnRows(sqlmock.NewRows(storageCols))
+				mock.ExpectExec(`UPDATE log_lab_equipment_master SET quantity=quantity\+\?, available_quantity=available_quantity\+\? WHERE id=\?`).
+					WithArgs(10, 10, 40).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO log_lab_storage \(item_id, location, quantity, updated_at\)`).
+					WithArgs(40, "Store room", 10, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectExec(`INSERT INTO stock_movements`).
+					WithArgs(40, "Store room", 10, 10, "receipt", "purchase", 12, 5, "PO-2024-118", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectExec(`UPDATE log_lab_equipment_master SET location=\? WHERE id=\?`).WithArgs("Store room", 40).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO purchase_receipts`).
+					WithArgs(12, 32, 40, 10, 180000.0, "Store room", nil, 5, near{day}, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectExec(`UPDATE purchase_request_lines SET received_qty=received_qty\+\? WHERE id=\?`).WithArgs(10, 32).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).
+					WithArgs(5, "Received 10 x ESP32-S3 DevKit (ESP32-S3) on purchase #12").WillReturnResult(sqlmock.NewResult(1, 1))
+
+				mock.ExpectExec(`UPDATE purchase_requests SET status=\?, received_at=\? WHERE id=\?`).
+					WithArgs(controllers.PurchaseReceived, near{time.Now().UTC()}, 12).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectPurchaseResponse(mock, controllers.PurchaseReceived)
+				w := serve("POST", "/api/purchase-requests/12/receive", "tech", `{"received_on":"2024-10-05"}`)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldContainSubstring, `"status":"received"`)
+			})
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
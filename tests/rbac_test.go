@@ -0,0 +1,108 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	beego "github.com/beego/beego/v2/server/web"
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRolePermissions(t *testing.T) {
+	Convey("Subject: role to permission mapping\n", t, func() {
+		Convey("Admins are allowed everything", func() {
+			So(controllers.RoleAllows(controllers.RoleAdmin, controllers.PermItemCreate), ShouldBeTrue)
+			So(controllers.RoleAllows(controllers.RoleAdmin, controllers.PermBorrowApprove), ShouldBeTrue)
+		})
+		Convey("Students can borrow but not manage inventory", func() {
+			So(controllers.RoleAllows(controllers.RoleStudent, controllers.PermBorrowCreate), ShouldBeTrue)
+			So(controllers.RoleAllows(controllers.RoleStudent, controllers.PermItemCreate), ShouldBeFalse)
+			So(controllers.RoleAllows(controllers.RoleStudent, controllers.PermInstructionEdit), ShouldBeFalse)
+		})
+		Convey("Technicians edit items but do not approve loans", func() {
+			So(controllers.RoleAllows(controllers.RoleTechnician, controllers.PermItemUpdate), ShouldBeTrue)
+			So(controllers.RoleAllows(controllers.RoleTechnician, controllers.PermBorrowApprove), ShouldBeFalse)
+		})
+		Convey("Legacy and unknown roles fall back to student", func() {
+			So(controllers.NormalizeRole("user"), ShouldEqual, controllers.RoleStudent)
+			So(controllers.NormalizeRole(" Lab_Manager "), ShouldEqual, controllers.RoleLabManager)
+			So(controllers.RoleAllows("user", controllers.PermItemCreate), ShouldBeFalse)
+		})
+		Convey("Lab managers archive items; only admins hard-delete them", func() {
+			So(controllers.RoleAllows(controllers.RoleLabManager, controllers.PermItemArchive), ShouldBeTrue)
+			So(controllers.RoleAllows(controllers.RoleTechnician, controllers.PermItemArchive), ShouldBeFalse)
+			So(controllers.RoleAllows(controllers.RoleLabManager, controllers.PermItemDelete), ShouldBeFalse)
+			So(controllers.RoleAllows(controllers.RoleAdmin, controllers.PermItemDelete), ShouldBeTrue)
+		})
+	})
+}
+
+func TestRoutePolicies(t *testing.T) {
+	// a read nobody declared a policy for
+	beego.Get("/api/rbac-undeclared", func(ctx *beegoctx.Context) { _ = ctx.Output.Body([]byte("ok")) })
+
+	Convey("Subject: route policies on reads\n", t, func() {
+		mock := mockServer(t)
+
+		Convey("Reads without a declared policy are for admins only", func() {
+			expectSession(mock, "student-1", 7, controllers.RoleStudent, false)
+			So(serve("GET", "/api/rbac-undeclared", "student-1", "").Code, ShouldEqual, http.StatusForbidden)
+			expectSession(mock, "admin-1", 1, controllers.RoleAdmin, false)
+			So(serve("GET", "/api/rbac-undeclared", "admin-1", "").Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("Declared reads check the role", func() {
+			expectSession(mock, "student-2", 7, controllers.RoleStudent, false)
+			w := serve("GET", "/api/stock-movements", "student-2", "")
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Body.String(), ShouldContainSubstring, `"permission":"stock.transfer"`)
+		})
+		Convey("Reads need an MFA session for roles that require one", func() {
+			t.Setenv("MFA_REQUIRED_ROLES", "admin")
+			expectSession(mock, "admin-2", 1, controllers.RoleAdmin, false)
+			w := serve("GET", "/api/rbac-undeclared", "admin-2", "")
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Body.String(), ShouldContainSubstring, "mfa_required")
+			expectSession(mock, "admin-3", 1, controllers.RoleAdmin, true)
+			So(serve("GET", "/api/rbac-undeclared", "admin-3", "").Code, ShouldEqual, http.StatusOK)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
+
+func TestBorrowOnBehalf(t *testing.T) {
+	Convey("Subject: borrowing and returning for someone else\n", t, func() {
+		mock := mockServer(t)
+
+		Convey("Students cannot borrow in another user's name", func() {
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			w := serve("POST", "/api/items/borrow", "student", `{"item_id":4,"quantity":1,"user_id":8}`)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Body.String(), ShouldContainSubstring, `"permission":"borrow.approve"`)
+		})
+		Convey("Technicians cannot return another user's borrow", func() {
+			expectSession(mock, "tech", 3, controllers.RoleTechnician, false)
+			So(serve("POST", "/api/items/return", "tech", `{"borrow_id":60,"user_id":8}`).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Naming yourself is the same as naming nobody", func() {
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`WHERE br\.id=\? AND br\.user_id=\?`).WithArgs(60, 7).WillReturnRows(sqlmock.NewRows(openBorrowCols))
+			mock.ExpectRollback()
+			w := serve("POST", "/api/items/return", "student", `{"borrow_id":60,"user_id":7}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "open borrow not found for this id")
+		})
+		Convey("Lab managers return on a borrower's behalf", func() {
+			expectSession(mock, "manager", 2, controllers.RoleLabManager, true)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`WHERE br\.id=\? AND br\.user_id=\?`).WithArgs(60, 8).WillReturnRows(sqlmock.NewRows(openBorrowCols))
+			mock.ExpectRollback()
+			So(serve("POST", "/api/items/return", "manager", `{"borrow_id":60,"user_id":8}`).Code, ShouldEqual, http.StatusBadRequest)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,143 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRenewals(t *testing.T) {
+	Convey("Subject: loan renewal limits\n", t, func() {
+		lent := time.Date(2024, 10, 1, 9, 30, 0, 0, time.UTC)
+		day := func(d int) time.Time { return time.Date(2024, 10, d, 0, 0, 0, 0, time.UTC) }
+		p := controllers.RenewalPolicy{MaxRenewals: 2, MaxLoanDays: 21}
+
+		Convey("A loan within its limits can be renewed", func() {
+			So(controllers.RenewalMsg(p, 0, lent, day(15)), ShouldEqual, "")
+			So(controllers.RenewalMsg(p, 1, lent, day(22)), ShouldEqual, "")
+		})
+		Convey("No more renewals than the category allows", func() {
+			So(controllers.RenewalMsg(p, 2, lent, day(15)), ShouldContainSubstring, "already been renewed 2 time(s)")
+			p.MaxRenewals = 0
+			So(controllers.RenewalMsg(p, 0, lent, day(15)), ShouldEqual, "loans in this category cannot be renewed")
+		})
+		Convey("The loan length counts from the day it was lent", func() {
+			So(controllers.RenewalMsg(p, 0, lent, day(23)), ShouldContainSubstring, "latest due date is 2024-10-22")
+			p.MaxLoanDays = 0
+			So(controllers.RenewalMsg(p, 0, lent, day(31)), ShouldEqual, "")
+		})
+	})
+}
+
+var renewableCols = []string{"id", "item_id", "user_id", "outstanding", "borrow_date", "return_date", "actual_return_date", "status",
+	"renewals", "sku", "name", "category"}
+
+var renewalCols = []string{"id", "borrow_id", "item_id", "sku", "item_name", "user_id", "user_name", "old_return_date", "new_return_date",
+	"status", "note", "requested_by", "requested_at", "decided_by", "decided_at", "decision_note"}
+
+func TestRenewLoan(t *testing.T) {
+	t.Setenv("BORROW_MAX_RENEWALS", "2")
+	t.Setenv("BORROW_MAX_LOAN_DAYS", "60")
+	t.Setenv("BORROW_RENEWAL_DAYS", "7")
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	lent, old := today.AddDate(0, 0, -10), today.AddDate(0, 0, 2)
+	due := old.AddDate(0, 0, 7)
+
+	Convey("Subject: renewing a loan\n", t, func() {
+		mock := mockServer(t)
+		expectSession(mock, "student", 7, controllers.RoleStudent, false)
+		// borrow 60: one oscilloscope (item 4) lent to owner, renewed renewals times, due in two days
+		expectLoan := func(owner int64, renewals int) {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT item_id FROM log_lab_borrow_records WHERE id=\?`).WithArgs(60).
+				WillReturnRows(sqlmock.NewRows([]string{"item_id"}).AddRow(4))
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? FOR UPDATE`).WithArgs(4).WillReturnRows(itemRows(4, 3, 1))
+			mock.ExpectQuery(`WHERE br\.id=\? FOR UPDATE`).WithArgs(60).WillReturnRows(sqlmock.NewRows(renewableCols).
+				AddRow(60, 4, owner, 1, lent, old, nil, controllers.BorrowBorrowed, renewals, "OSC-01", "Oscilloscope", "Electronics"))
+		}
+		expectPolicy := func(rows *sqlmock.Rows) {
+			mock.ExpectQuery(`SELECT COUNT\(1\) FROM borrow_renewals WHERE borrow_id=\? AND status=\?`).WithArgs(60, controllers.RenewalPending).
+				WillReturnRows(count(0))
+			mock.ExpectQuery(`FROM category_policies WHERE category=\?`).WithArgs("Electronics").WillReturnRows(rows)
+		}
+		noPolicy := func() *sqlmock.Rows {
+			return sqlmock.NewRows([]string{"category", "max_renewals", "max_loan_days", "renewal_requires_approval"})
+		}
+		// expectHolds has the loan itself out and reservations booked of the item after it
+		expectHolds := func(reservations *sqlmock.Rows) {
+			mock.ExpectQuery(`FROM log_lab_borrow_records`).WithArgs(4).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "quantity", "borrow_date", "return_date"}).AddRow(60, 7, 1, lent, old))
+			mock.ExpectQuery(`FROM reservations WHERE item_id=\?`).WillReturnRows(reservations)
+		}
+		reservationCols := []string{"kind", "id", "user_id", "quantity", "start_at", "end_at", "purpose", "course"}
+		renewal := func(status string) *sqlmock.Rows {
+			return sqlmock.NewRows(renewalCols).AddRow(12, 60, 4, "OSC-01", "Oscilloscope", 7, "Nguyễn Văn A", old, due, status,
+				nil, 7, time.Now(), nil, nil, nil)
+		}
+
+		Convey("A renewal within the limits moves the due date at once", func() {
+			expectLoan(7, 0)
+			expectPolicy(noPolicy())
+			expectHolds(sqlmock.NewRows(reservationCols))
+			mock.ExpectExec(`INSERT INTO borrow_renewals`).
+				WithArgs(60, old, due, controllers.RenewalApproved, nil, 7, sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(12, 1))
+			mock.ExpectExec(`UPDATE log_lab_borrow_records SET return_date=\?, renewals=renewals\+1 WHERE id=\?`).WithArgs(due, 60).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectQuery(`FROM borrow_renewals n`).WithArgs(12).WillReturnRows(renewal(controllers.RenewalApproved))
+			w := serve("POST", "/api/borrows/60/renew", "student", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"status":"approved"`)
+		})
+		Convey("No more renewals than the limit", func() {
+			expectLoan(7, 2)
+			expectPolicy(noPolicy())
+			mock.ExpectRollback()
+			w := serve("POST", "/api/borrows/60/renew", "student", "")
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "already been renewed 2 time(s)")
+		})
+		Convey("A category that asks for approval leaves the due date until staff decide", func() {
+			expectLoan(7, 0)
+			expectPolicy(noPolicy().AddRow("Electronics", nil, nil, true))
+			expectHolds(sqlmock.NewRows(reservationCols))
+			mock.ExpectExec(`INSERT INTO borrow_renewals`).
+				WithArgs(60, old, due, controllers.RenewalPending, "thesis runs late", 7, sqlmock.AnyArg(), nil, nil).
+				WillReturnResult(sqlmock.NewResult(12, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).
+				WithArgs(7, "Requested renewal of borrow #60 of Oscilloscope (OSC-01) until "+due.Format("2006-01-02")).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectQuery(`FROM borrow_renewals n`).WithArgs(12).WillReturnRows(renewal(controllers.RenewalPending))
+			w := serve("POST", "/api/borrows/60/renew", "student", `{"note":"thesis runs late"}`)
+			So(w.Code, ShouldEqual, http.StatusAccepted)
+			So(w.Body.String(), ShouldContainSubstring, `"status":"pending"`)
+		})
+		Convey("A reservation that needs the stock before the new due date refuses the renewal", func() {
+			expectLoan(7, 0)
+			expectPolicy(noPolicy())
+			start := old.AddDate(0, 0, 3)
+			expectHolds(sqlmock.NewRows(reservationCols).AddRow("reservation", 90, 8, 2, start, start.AddDate(0, 0, 2), "Lab exam", "EE201"))
+			mock.ExpectRollback()
+			w := serve("POST", "/api/borrows/60/renew", "student", "")
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "reserved by someone else from "+start.Format(time.RFC3339))
+			So(w.Body.String(), ShouldContainSubstring, `"id":90`)
+		})
+		Convey("Students cannot renew someone else's loan", func() {
+			expectLoan(8, 0)
+			mock.ExpectRollback()
+			w := serve("POST", "/api/borrows/60/renew", "student", "")
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Body.String(), ShouldContainSubstring, "not your borrow")
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,130 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReservationAvailability(t *testing.T) {
+	Convey("Subject: availability over time\n", t, func() {
+		day := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+		at := func(h int) time.Time { return day.Add(time.Duration(h) * time.Hour) }
+
+		Convey("Without bookings the whole capacity is free", func() {
+			slots := controllers.Availability(10, nil, at(0), at(24))
+			So(len(slots), ShouldEqual, 1)
+			So(slots[0].Available, ShouldEqual, 10)
+			So(slots[0].From, ShouldEqual, at(0))
+			So(slots[0].To, ShouldEqual, at(24))
+		})
+		Convey("Overlapping bookings add up; back-to-back ones do not", func() {
+			slots := controllers.Availability(10, []controllers.Booking{
+				{Start: at(8), End: at(12), Quantity: 8},
+				{Start: at(12), End: at(16), Quantity: 8},
+				{Start: at(10), End: at(11), Quantity: 1},
+			}, at(0), at(24))
+			least, ok := controllers.TightestSlot(slots)
+			So(ok, ShouldBeTrue)
+			So(least.Available, ShouldEqual, 1)
+			So(least.From, ShouldEqual, at(10))
+			So(least.To, ShouldEqual, at(11))
+			So(slots[len(slots)-1].Available, ShouldEqual, 10)
+		})
+		Convey("Slots with the same booked quantity are merged", func() {
+			slots := controllers.Availability(10, []controllers.Booking{
+				{Start: at(8), End: at(12), Quantity: 8},
+				{Start: at(12), End: at(16), Quantity: 8},
+			}, at(0), at(24))
+			So(len(slots), ShouldEqual, 3)
+			So(slots[1].From, ShouldEqual, at(8))
+			So(slots[1].To, ShouldEqual, at(16))
+		})
+		Convey("Open-ended bookings hold stock to the end of the window", func() {
+			slots := controllers.Availability(3, []controllers.Booking{
+				{Start: at(-48), Quantity: 2},
+				{Start: at(9), End: at(10), Quantity: 2},
+			}, at(0), at(24))
+			So(slots[0].Available, ShouldEqual, 1)
+			least, _ := controllers.TightestSlot(slots)
+			So(least.Available, ShouldEqual, -1)
+			So(slots[len(slots)-1].Available, ShouldEqual, 1)
+		})
+		Convey("Bookings outside the window are ignored", func() {
+			slots := controllers.Availability(5, []controllers.Booking{
+				{Start: at(-10), End: at(0), Quantity: 5},
+				{Start: at(24), End: at(30), Quantity: 5},
+			}, at(0), at(24))
+			So(len(slots), ShouldEqual, 1)
+			So(slots[0].Available, ShouldEqual, 5)
+		})
+	})
+}
+
+func TestItemAvailabilityBookings(t *testing.T) {
+	Convey("Subject: who sees the bookings behind an item's availability\n", t, func() {
+		mock := mockServer(t)
+		expectHolds := func() {
+			start := time.Now().Add(24 * time.Hour)
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? LIMIT 1$`).WithArgs(4).WillReturnRows(itemRows(4, 5, 3))
+			mock.ExpectQuery(`FROM log_lab_borrow_records`).WithArgs(4).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "quantity", "borrow_date", "return_date"}).
+					AddRow(70, 7, 1, time.Now().Add(-time.Hour), nil).
+					AddRow(80, 8, 1, time.Now().Add(-time.Hour), nil))
+			mock.ExpectQuery(`FROM reservations WHERE item_id=\?`).
+				WillReturnRows(sqlmock.NewRows([]string{"kind", "id", "user_id", "quantity", "start_at", "end_at", "purpose", "course"}).
+					AddRow("reservation", 90, 8, 2, start, start.Add(4*time.Hour), "Thesis rig", "EE401"))
+		}
+		var out struct {
+			MinAvailable int `json:"min_available"`
+			Bookings     []struct {
+				Kind     string  `json:"kind"`
+				ID       int64   `json:"id"`
+				UserID   int64   `json:"user_id"`
+				Quantity int     `json:"quantity"`
+				Purpose  *string `json:"purpose"`
+				Course   *string `json:"course"`
+			} `json:"bookings"`
+		}
+
+		Convey("Guests cannot see availability", func() {
+			So(serve("GET", "/api/items/4/availability", "", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Students see only when and how many others hold", func() {
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			expectHolds()
+			w := serve("GET", "/api/items/4/availability", "student", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(decode(w, &out), ShouldBeNil)
+			So(out.MinAvailable, ShouldEqual, 1)
+			So(len(out.Bookings), ShouldEqual, 3)
+			So(out.Bookings[0].ID, ShouldEqual, 70)
+			So(out.Bookings[0].UserID, ShouldEqual, 7)
+			So(out.Bookings[1].ID, ShouldEqual, 0)
+			So(out.Bookings[1].UserID, ShouldEqual, 0)
+			So(out.Bookings[2].Kind, ShouldEqual, "reservation")
+			So(out.Bookings[2].Quantity, ShouldEqual, 2)
+			So(out.Bookings[2].UserID, ShouldEqual, 0)
+			So(out.Bookings[2].Purpose, ShouldBeNil)
+			So(out.Bookings[2].Course, ShouldBeNil)
+			So(w.Body.String(), ShouldNotContainSubstring, "Thesis rig")
+		})
+		Convey("Lab managers see whose bookings they are", func() {
+			expectSession(mock, "manager", 2, controllers.RoleLabManager, true)
+			expectHolds()
+			w := serve("GET", "/api/items/4/availability", "manager", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(decode(w, &out), ShouldBeNil)
+			So(out.Bookings[1].UserID, ShouldEqual, 8)
+			So(out.Bookings[2].ID, ShouldEqual, 90)
+			So(*out.Bookings[2].Purpose, ShouldEqual, "Thesis rig")
+			So(*out.Bookings[2].Course, ShouldEqual, "EE401")
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,129 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	beego "github.com/beego/beego/v2/server/web"
+	beegoctx "github.com/beego/beego/v2/server/web/context"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A request the cache can answer needs no sqlmock expectation; one that
+// reaches the database without an expectation fails the lookup and is a 401.
+func TestSessionStore(t *testing.T) {
+	beego.Get("/api/session-probe", func(ctx *beegoctx.Context) { _ = ctx.Output.Body([]byte("ok")) })
+
+	Convey("Subject: session store and its cache\n", t, func() {
+		mock := mockServer(t)
+
+		Convey("Sessions of disabled users and expired sessions are not found", func() {
+			mock.ExpectQuery(`s\.expires_at > UTC_TIMESTAMP\(\) AND u\.disabled_at IS NULL`).
+				WithArgs(tokenHash("disabled")).WillReturnRows(sqlmock.NewRows(sessionCols))
+			So(serve("GET", "/api/session-probe", "disabled", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("A session is read from the database once, then from the cache", func() {
+			expectSession(mock, "cached", 1, controllers.RoleAdmin, false)
+			So(serve("GET", "/api/session-probe", "cached", "").Code, ShouldEqual, http.StatusOK)
+			So(serve("GET", "/api/session-probe", "cached", "").Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("Cached sessions are looked up again after SESSION_CACHE_SECONDS", func() {
+			t.Setenv("SESSION_CACHE_SECONDS", "1")
+			mock = mockServer(t)
+			expectSession(mock, "short", 1, controllers.RoleAdmin, false)
+			So(serve("GET", "/api/session-probe", "short", "").Code, ShouldEqual, http.StatusOK)
+			time.Sleep(1100 * time.Millisecond)
+			mock.ExpectQuery(`FROM sessions s`).WithArgs(tokenHash("short")).WillReturnRows(sqlmock.NewRows(sessionCols))
+			So(serve("GET", "/api/session-probe", "short", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("The cache does not outlive the session", func() {
+			now := time.Now().UTC()
+			mock.ExpectQuery(`FROM sessions s`).WithArgs(tokenHash("ending")).WillReturnRows(sqlmock.NewRows(sessionCols).
+				AddRow(10, 1, "a@vlu.edu.vn", controllers.RoleAdmin, now, now, now.Add(300*time.Millisecond), "", "", false))
+			So(serve("GET", "/api/session-probe", "ending", "").Code, ShouldEqual, http.StatusOK)
+			time.Sleep(400 * time.Millisecond)
+			So(serve("GET", "/api/session-probe", "ending", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Revoking sessions drops them from the cache", func() {
+			for id, tok := range map[int64]string{10: "phone", 11: "laptop", 12: "tablet"} {
+				mock.ExpectQuery(`FROM sessions s`).WithArgs(tokenHash(tok)).WillReturnRows(sessionRow(id, 1, controllers.RoleAdmin, false))
+				So(serve("GET", "/api/session-probe", tok, "").Code, ShouldEqual, http.StatusOK)
+			}
+			mock.ExpectExec(`DELETE FROM sessions WHERE id=\? AND user_id=\?`).WithArgs(11, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			So(serve("DELETE", "/api/auth/sessions/11", "phone", "").Code, ShouldEqual, http.StatusOK)
+			So(serve("GET", "/api/session-probe", "laptop", "").Code, ShouldEqual, http.StatusUnauthorized)
+			So(serve("GET", "/api/session-probe", "tablet", "").Code, ShouldEqual, http.StatusOK)
+
+			mock.ExpectExec(`DELETE FROM sessions WHERE user_id=\? AND id<>\?`).WithArgs(1, 10).WillReturnResult(sqlmock.NewResult(0, 1))
+			So(serve("DELETE", "/api/auth/sessions?keep_current=1", "phone", "").Code, ShouldEqual, http.StatusOK)
+			So(serve("GET", "/api/session-probe", "tablet", "").Code, ShouldEqual, http.StatusUnauthorized)
+			// the kept session is read again, with whatever came with the revocation
+			mock.ExpectQuery(`FROM sessions s`).WithArgs(tokenHash("phone")).WillReturnRows(sessionRow(10, 1, controllers.RoleAdmin, false))
+			So(serve("GET", "/api/session-probe", "phone", "").Code, ShouldEqual, http.StatusOK)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
+
+func TestSessionEndpoints(t *testing.T) {
+	Convey("Subject: listing and revoking sessions\n", t, func() {
+		mock := mockServer(t)
+		now := time.Now().UTC()
+
+		Convey("Users list their own live sessions, the current one marked", func() {
+			expectSession(mock, "mine", 3, controllers.RoleStudent, false) // session 30
+			mock.ExpectQuery(`WHERE s\.user_id = \? AND s\.expires_at > UTC_TIMESTAMP\(\)`).WithArgs(3).WillReturnRows(sqlmock.NewRows(sessionCols).
+				AddRow(30, 3, "s@vlu.edu.vn", "student", now, now, now.Add(time.Hour), "Mozilla/5.0 (Windows NT 10.0) Chrome/120.0", "10.0.0.1", false).
+				AddRow(31, 3, "s@vlu.edu.vn", "student", now, now, now.Add(time.Hour), "Mozilla/5.0 (iPhone) Safari/605.1", "10.0.0.2", false))
+			w := serve("GET", "/api/auth/sessions", "mine", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var list []struct {
+				ID      int64  `json:"id"`
+				Device  string `json:"device"`
+				Current bool   `json:"current"`
+			}
+			So(decode(w, &list), ShouldBeNil)
+			So(len(list), ShouldEqual, 2)
+			So(list[0].Device, ShouldEqual, "Chrome on Windows")
+			So(list[0].Current, ShouldBeTrue)
+			So(list[1].Device, ShouldEqual, "Safari on iOS")
+			So(list[1].Current, ShouldBeFalse)
+		})
+		Convey("Revoking another user's session is a 404", func() {
+			expectSession(mock, "mine", 3, controllers.RoleStudent, false)
+			mock.ExpectExec(`DELETE FROM sessions WHERE id=\? AND user_id=\?`).WithArgs(99, 3).WillReturnResult(sqlmock.NewResult(0, 0))
+			So(serve("DELETE", "/api/auth/sessions/99", "mine", "").Code, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("Revoking the current session clears the cookie", func() {
+			expectSession(mock, "mine", 3, controllers.RoleStudent, false)
+			mock.ExpectExec(`DELETE FROM sessions WHERE id=\? AND user_id=\?`).WithArgs(30, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+			w := serve("DELETE", "/api/auth/sessions/30", "mine", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Set-Cookie"), ShouldContainSubstring, "imx_token=;")
+		})
+		Convey("Log out everywhere revokes the current session too unless keep_current is set", func() {
+			expectSession(mock, "mine", 3, controllers.RoleStudent, false)
+			mock.ExpectExec(`DELETE FROM sessions WHERE user_id=\? AND id<>\?`).WithArgs(3, 0).WillReturnResult(sqlmock.NewResult(0, 2))
+			w := serve("DELETE", "/api/auth/sessions", "mine", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"revoked":2`)
+			So(w.Header().Get("Set-Cookie"), ShouldContainSubstring, "imx_token=;")
+		})
+		Convey("Only session.manage may revoke other users' sessions", func() {
+			expectSession(mock, "mine", 3, controllers.RoleStudent, false)
+			So(serve("DELETE", "/api/admin/users/4/sessions", "mine", "").Code, ShouldEqual, http.StatusForbidden)
+
+			expectSession(mock, "admin", 1, controllers.RoleAdmin, false)
+			mock.ExpectExec(`DELETE FROM sessions WHERE user_id=\? AND id<>\?`).WithArgs(4, 0).WillReturnResult(sqlmock.NewResult(0, 3))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WithArgs(1, "Revoked all sessions of user #4 (3)").WillReturnResult(sqlmock.NewResult(1, 1))
+			w := serve("DELETE", "/api/admin/users/4/sessions", "admin", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"revoked":3`)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+	"vlu_infrastructure_management/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func stockAt(id uint64, loc string, qty int) models.Storage {
+	return models.Storage{ID: id, Location: &loc, Quantity: qty}
+}
+
+func stockByLocation(levels []models.Storage) map[string]int {
+	out := map[string]int{}
+	for _, s := range levels {
+		out[*s.Location] = s.Quantity
+	}
+	return out
+}
+
+func TestStockLocations(t *testing.T) {
+	levels := []models.Storage{stockAt(1, "Lab 1", 2), stockAt(2, "Store room", 5), stockAt(3, "Bin A-3", 1)}
+
+	Convey("Subject: spreading quantity changes over locations\n", t, func() {
+		Convey("The primary location holds the most stock", func() {
+			So(controllers.PrimaryLocation(levels), ShouldEqual, "Store room")
+			So(controllers.PrimaryLocation(nil), ShouldEqual, "")
+		})
+		Convey("Increases go to the named or the primary location", func() {
+			out, err := controllers.ApplyStockDelta(levels, 3, "")
+			So(err, ShouldBeNil)
+			So(stockByLocation(out)["Store room"], ShouldEqual, 8)
+
+			out, err = controllers.ApplyStockDelta(levels, 2, "  lab   1 ")
+			So(err, ShouldBeNil)
+			So(stockByLocation(out)["Lab 1"], ShouldEqual, 4)
+
+			out, err = controllers.ApplyStockDelta(levels, 1, "Lab 3")
+			So(err, ShouldBeNil)
+			So(out, ShouldHaveLength, 4)
+			So(out[3].ID, ShouldEqual, 0)
+			So(stockByLocation(out)["Lab 3"], ShouldEqual, 1)
+			So(stockByLocation(levels)["Store room"], ShouldEqual, 5)
+		})
+		Convey("Decreases empty the largest holdings first", func() {
+			out, err := controllers.ApplyStockDelta(levels, -6, "")
+			So(err, ShouldBeNil)
+			So(stockByLocation(out), ShouldResemble, map[string]int{"Lab 1": 1, "Store room": 0, "Bin A-3": 1})
+
+			_, err = controllers.ApplyStockDelta(levels, -9, "")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("A named location must cover the whole decrease", func() {
+			out, err := controllers.ApplyStockDelta(levels, -2, "Lab 1")
+			So(err, ShouldBeNil)
+			So(stockByLocation(out)["Lab 1"], ShouldEqual, 0)
+
+			_, err = controllers.ApplyStockDelta(levels, -3, "Lab 1")
+			So(err, ShouldNotBeNil)
+			_, err = controllers.ApplyStockDelta(levels, -1, "Lab 9")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestItemStockRead(t *testing.T) {
+	Convey("Subject: reading an item's stock by location\n", t, func() {
+		mock := mockServer(t)
+
+		Convey("Guests and students cannot read it", func() {
+			So(serve("GET", "/api/items/4/stock", "", "").Code, ShouldEqual, http.StatusUnauthorized)
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			w := serve("GET", "/api/items/4/stock", "student", "")
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Body.String(), ShouldContainSubstring, `"permission":"stock.transfer"`)
+		})
+		Convey("Staff get the locations, largest first", func() {
+			expectSession(mock, "tech", 3, controllers.RoleTechnician, false)
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? LIMIT 1$`).WithArgs(4).WillReturnRows(itemRows(4, 10, 7))
+			mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"id", "item_id", "location", "quantity", "updated_at"}).
+				AddRow(1, 4, "Lab 1", 3, time.Now()).AddRow(2, 4, "Store room", 7, time.Now()))
+			w := serve("GET", "/api/items/4/stock", "tech", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out struct {
+				Locations []models.Storage `json:"locations"`
+			}
+			So(decode(w, &out), ShouldBeNil)
+			So(*out.Locations[0].Location, ShouldEqual, "Store room")
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
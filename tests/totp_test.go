@@ -0,0 +1,225 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RFC 6238 appendix B (SHA1 seed "12345678901234567890"), last 6 digits.
+func TestTOTP(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	Convey("Subject: RFC 6238 TOTP\n", t, func() {
+		Convey("Codes match the RFC test vectors", func() {
+			for ts, want := range vectors {
+				got, err := controllers.GenerateTOTP(secret, time.Unix(ts, 0))
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, want)
+			}
+		})
+		Convey("Verification tolerates one step of clock drift only", func() {
+			at := time.Unix(1234567890, 0)
+			step, ok := controllers.VerifyTOTP(secret, "005924", at.Add(29*time.Second))
+			So(ok, ShouldBeTrue)
+			So(step, ShouldEqual, 1234567890/30)
+			_, ok = controllers.VerifyTOTP(secret, "005924", at.Add(90*time.Second))
+			So(ok, ShouldBeFalse)
+			_, ok = controllers.VerifyTOTP(secret, "12345", at)
+			So(ok, ShouldBeFalse)
+		})
+		Convey("Enrollment URI carries the secret and issuer", func() {
+			uri := controllers.TOTPURI("VLU Lab", "sv@vlu.edu.vn", secret)
+			So(strings.HasPrefix(uri, "otpauth://totp/VLU%20Lab:sv@vlu.edu.vn?"), ShouldBeTrue)
+			So(uri, ShouldContainSubstring, "secret="+secret)
+			So(uri, ShouldContainSubstring, "issuer=VLU+Lab")
+		})
+	})
+}
+
+const mfaSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// recoveryCodes is the stored totp_recovery_codes value for codes.
+func recoveryCodes(codes ...string) string {
+	hashes := make([]string, 0, len(codes))
+	for _, c := range codes {
+		hashes = append(hashes, tokenHash(c))
+	}
+	b, _ := json.Marshal(hashes)
+	return string(b)
+}
+
+// expectChallenge is the lookup of the mfa_token "challenge-<id>".
+func expectChallenge(mock sqlmock.Sqlmock, id int64, attempts int) {
+	mock.ExpectQuery(`SELECT id, user_id, attempts FROM mfa_challenges WHERE token_hash=\? AND expires_at > UTC_TIMESTAMP\(\)`).
+		WithArgs(tokenHash("challenge-" + strconv.FormatInt(id, 10))).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "attempts"}).AddRow(id, 5, attempts))
+}
+
+func expectMFAUser(mock sqlmock.Sqlmock, codes string) {
+	mock.ExpectQuery(`SELECT id, username, email, role, password_hash, totp_secret, totp_enabled, totp_recovery_codes FROM users WHERE id=\?`).
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "role", "password_hash", "totp_secret", "totp_enabled", "totp_recovery_codes"}).
+			AddRow(5, "tech5", "tech5@vlu.edu.vn", controllers.RoleTechnician, []byte("x"), mfaSecret, true, codes))
+}
+
+// expectMFASession is the end of a verified challenge: the challenge is
+// dropped and a session marked mfa=true is issued.
+func expectMFASession(mock sqlmock.Sqlmock, challengeID int64) {
+	mock.ExpectExec(`DELETE FROM mfa_challenges WHERE id=\? OR expires_at <= UTC_TIMESTAMP\(\)`).
+		WithArgs(challengeID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT id, username, email, role, disabled_at, must_change_password FROM users WHERE id=\?`).
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "role", "disabled_at", "must_change_password"}).
+			AddRow(5, "tech5", "tech5@vlu.edu.vn", controllers.RoleTechnician, nil, false))
+	mock.ExpectExec(`INSERT INTO sessions`).
+		WithArgs(sqlmock.AnyArg(), 5, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), true).
+		WillReturnResult(sqlmock.NewResult(50, 1))
+}
+
+// expectBadCode is a refused second factor: the challenge burns an attempt
+// and the failure is counted against the account.
+func expectBadCode(mock sqlmock.Sqlmock, challengeID int64) {
+	mock.ExpectExec(`UPDATE mfa_challenges SET attempts=attempts\+1 WHERE id=\?`).
+		WithArgs(challengeID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO failed_logins`).
+		WithArgs("tech5", int64(5), "192.0.2.1", sqlmock.AnyArg(), "bad_mfa_code", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectWindow(mock, "identifier", "tech5", 1, time.Now().UTC())
+}
+
+func TestMFALogin(t *testing.T) {
+	Convey("Subject: MFA login\n", t, func() {
+		mock := mockServer(t)
+
+		Convey("An enrolled user gets an mfa_token instead of a session", func() {
+			hash, err := bcrypt.GenerateFromPassword([]byte("correct-horse"), bcrypt.MinCost)
+			So(err, ShouldBeNil)
+			mock.ExpectQuery(`SELECT locked_until FROM users`).WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(nil))
+			expectWindow(mock, "ip", sqlmock.AnyArg(), 0, nil)
+			expectWindow(mock, "identifier", "tech5", 0, nil)
+			mock.ExpectQuery(`SELECT id, username, password_hash, email, full_name, role, disabled_at, must_change_password, totp_enabled FROM users`).
+				WithArgs("tech5", "tech5").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "email", "full_name", "role", "disabled_at", "must_change_password", "totp_enabled"}).
+					AddRow(5, "tech5", hash, "tech5@vlu.edu.vn", "Tech Five", controllers.RoleTechnician, nil, false, true))
+			mock.ExpectExec(`UPDATE failed_logins SET cleared_at=\?`).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(`UPDATE users SET locked_until=NULL WHERE id=\?`).WithArgs(int64(5)).WillReturnResult(sqlmock.NewResult(0, 1))
+			var stored string
+			mock.ExpectExec(`INSERT INTO mfa_challenges \(token_hash, user_id, created_at, expires_at\)`).
+				WithArgs(hashArg{&stored}, uint64(5), near{time.Now().UTC()}, near{time.Now().UTC().Add(5 * time.Minute)}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			w := serve("POST", "/api/auth/login", "", `{"identifier":"tech5","password":"correct-horse"}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out map[string]interface{}
+			decode(w, &out)
+			So(out["mfa_required"], ShouldEqual, true)
+			So(out["mfa_token"], ShouldNotBeEmpty)
+			So(stored, ShouldEqual, tokenHash(out["mfa_token"].(string)))
+			So(out, ShouldNotContainKey, "token")
+			So(w.Header().Get("Set-Cookie"), ShouldBeEmpty)
+		})
+		Convey("A valid code issues an MFA session, and the same code is refused afterwards", func() {
+			code, err := controllers.GenerateTOTP(mfaSecret, time.Now())
+			So(err, ShouldBeNil)
+			body := `{"mfa_token":"challenge-1","code":"` + code + `"}`
+
+			expectChallenge(mock, 1, 0)
+			expectMFAUser(mock, "")
+			mock.ExpectExec(`UPDATE users SET totp_last_step=\? WHERE id=\? AND \(totp_last_step IS NULL OR totp_last_step < \?\)`).
+				WithArgs(sqlmock.AnyArg(), int64(5), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectMFASession(mock, 1)
+			w := serve("POST", "/api/auth/mfa/verify", "", body)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out map[string]interface{}
+			decode(w, &out)
+			So(out["token"], ShouldNotBeEmpty)
+			So(out["mfa_setup_required"], ShouldEqual, false)
+
+			// Replaying the code against a fresh challenge: totp_last_step already holds its step.
+			expectChallenge(mock, 2, 0)
+			expectMFAUser(mock, "")
+			mock.ExpectExec(`UPDATE users SET totp_last_step=\?`).WillReturnResult(sqlmock.NewResult(0, 0))
+			expectBadCode(mock, 2)
+			w = serve("POST", "/api/auth/mfa/verify", "", `{"mfa_token":"challenge-2","code":"`+code+`"}`)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(w.Body.String(), ShouldContainSubstring, "invalid code")
+		})
+		Convey("A wrong code burns one of the challenge's attempts", func() {
+			expectChallenge(mock, 1, 0)
+			expectMFAUser(mock, "")
+			expectBadCode(mock, 1)
+			code, _ := controllers.GenerateTOTP(mfaSecret, time.Now().Add(-time.Hour))
+			w := serve("POST", "/api/auth/mfa/verify", "", `{"mfa_token":"challenge-1","code":"`+code+`"}`)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(w.Body.String(), ShouldContainSubstring, "invalid code")
+		})
+		Convey("A challenge is dead after five attempts, even with a valid code", func() {
+			expectChallenge(mock, 1, 5)
+			code, _ := controllers.GenerateTOTP(mfaSecret, time.Now())
+			w := serve("POST", "/api/auth/mfa/verify", "", `{"mfa_token":"challenge-1","code":"`+code+`"}`)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(w.Body.String(), ShouldContainSubstring, "mfa challenge expired")
+		})
+		Convey("An expired or unknown challenge is refused", func() {
+			mock.ExpectQuery(`SELECT id, user_id, attempts FROM mfa_challenges WHERE token_hash=\? AND expires_at > UTC_TIMESTAMP\(\)`).
+				WithArgs(tokenHash("challenge-1")).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "attempts"}))
+			code, _ := controllers.GenerateTOTP(mfaSecret, time.Now())
+			w := serve("POST", "/api/auth/mfa/verify", "", `{"mfa_token":"challenge-1","code":"`+code+`"}`)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(w.Body.String(), ShouldContainSubstring, "mfa challenge expired")
+		})
+		Convey("A recovery code works once", func() {
+			before := recoveryCodes("abcde-12345", "fghij-67890")
+			after := recoveryCodes("fghij-67890")
+
+			expectChallenge(mock, 1, 0)
+			expectMFAUser(mock, before)
+			mock.ExpectExec(`UPDATE users SET totp_recovery_codes=\? WHERE id=\? AND totp_recovery_codes=\?`).
+				WithArgs(after, int64(5), before).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).
+				WithArgs(int64(5), "Used an MFA recovery code (1 left)").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			expectMFASession(mock, 1)
+			w := serve("POST", "/api/auth/mfa/verify", "", `{"mfa_token":"challenge-1","recovery_code":" ABCDE-12345 "}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			expectChallenge(mock, 2, 0)
+			expectMFAUser(mock, after)
+			expectBadCode(mock, 2)
+			w = serve("POST", "/api/auth/mfa/verify", "", `{"mfa_token":"challenge-2","recovery_code":"abcde-12345"}`)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Roles in MFA_REQUIRED_ROLES need an MFA session outside the auth endpoints", func() {
+			t.Setenv("MFA_REQUIRED_ROLES", "admin,lab_manager")
+			expectSession(mock, "manager-1", 3, controllers.RoleLabManager, false)
+			w := serve("GET", "/api/stock-movements", "manager-1", "")
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Body.String(), ShouldContainSubstring, `"error":"mfa_required"`)
+
+			expectSession(mock, "tech-1", 5, controllers.RoleTechnician, false)
+			w = serve("GET", "/api/stock-movements", "tech-1", "")
+			So(w.Body.String(), ShouldNotContainSubstring, "mfa_required")
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// transferRows is transfer 9 moving 3 oscilloscopes (item 4) from B2.04 to Lab 2.
+func transferRows(status string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "item_id", "sku", "item_name", "from_location", "to_location", "quantity", "status", "note",
+		"requested_by", "requested_at", "sent_by", "sent_at", "received_by", "received_at", "cancelled_by", "cancelled_at", "cancel_reason"}).
+		AddRow(9, 4, "OSC-01", "Oscilloscope", "B2.04", "Lab 2", 3, status, nil, 3, time.Now(), nil, nil, nil, nil, nil, nil, nil)
+}
+
+var storageCols = []string{"id", "item_id", "location", "quantity", "updated_at"}
+
+// expectTransferStep is the locking done before every status change.
+func expectTransferStep(mock sqlmock.Sqlmock, status string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM stock_transfers t .* WHERE t\.id=\? LIMIT 1$`).WithArgs(9).WillReturnRows(transferRows(status))
+	mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? FOR UPDATE`).WithArgs(4).WillReturnRows(itemRows(4, 10, 7))
+	mock.ExpectQuery(`FROM stock_transfers t .* WHERE t\.id=\? LIMIT 1 FOR UPDATE`).WithArgs(9).WillReturnRows(transferRows(status))
+}
+
+func TestStockTransfers(t *testing.T) {
+	Convey("Subject: transfer statuses\n", t, func() {
+		Convey("Only open transfers can be cancelled", func() {
+			So(controllers.TransferNext(controllers.TransferInTransit, controllers.TransferCancelled), ShouldBeTrue)
+			So(controllers.TransferNext(controllers.TransferReceived, controllers.TransferCancelled), ShouldBeFalse)
+		})
+	})
+
+	Convey("Subject: stock transfers between locations\n", t, func() {
+		mock := mockServer(t)
+		expectSession(mock, "tech", 3, controllers.RoleTechnician, false)
+
+		Convey("A transfer cannot take more than the source holds", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`FROM log_lab_equipment_master WHERE id=\? FOR UPDATE`).WithArgs(4).WillReturnRows(itemRows(4, 10, 7))
+			mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(4).WillReturnRows(sqlmock.NewRows(storageCols).
+				AddRow(1, 4, "B2.04", 8, time.Now()).AddRow(2, 4, "Lab 1", 2, time.Now()))
+			mock.ExpectRollback()
+			w := serve("POST", "/api/transfers", "tech", `{"item_id":4,"from_location":"Lab 1","to_location":"Lab 2","quantity":3}`)
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "Lab 1 holds 2 of this item, cannot move 3")
+		})
+		Convey("Nothing moves into or out of In transit by hand", func() {
+			w := serve("POST", "/api/transfers", "tech", `{"item_id":4,"from_location":"B2.04","to_location":"in transit","quantity":1}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Sending takes the stock off the shelf into In transit", func() {
+			expectTransferStep(mock, controllers.TransferRequested)
+			mock.ExpectQuery(`FROM equipment_units\s+WHERE item_id=\? AND status='available'`).WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET available_quantity=available_quantity-\? WHERE id=\?`).WithArgs(3, 4).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(4).WillReturnRows(sqlmock.NewRows(storageCols).AddRow(1, 4, "B2.04", 10, time.Now()))
+			mock.ExpectExec(`UPDATE log_lab_storage SET location=\?, quantity=\?, updated_at=\? WHERE id=\?`).WithArgs("B2.04", 7, sqlmock.AnyArg(), 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO stock_movements`).WithArgs(4, "B2.04", -3, 7, "transfer_out", "transfer", 9, 3, nil, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_storage`).WithArgs(4, "In transit", 3, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(3, 1))
+			mock.ExpectExec(`INSERT INTO stock_movements`).WithArgs(4, "In transit", 3, 3, "transfer_out", "transfer", 9, 3, nil, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(2, 1))
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET location=\? WHERE id=\?`).WithArgs("B2.04", 4).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`UPDATE stock_transfers SET status=\?, sent_by=\?, sent_at=\? WHERE id=\?`).
+				WithArgs(controllers.TransferInTransit, 3, sqlmock.AnyArg(), 9).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectQuery(`FROM stock_transfers t`).WithArgs(9).WillReturnRows(transferRows(controllers.TransferInTransit))
+			So(serve("POST", "/api/transfers/9/send", "tech", "").Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("Receiving puts it back on the shelf at the destination", func() {
+			expectTransferStep(mock, controllers.TransferInTransit)
+			mock.ExpectExec(`UPDATE equipment_units u JOIN stock_transfer_units tu`).WithArgs(controllers.UnitAvailable, sqlmock.AnyArg(), 9, controllers.UnitInTransit).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET available_quantity=available_quantity\+\? WHERE id=\?`).WithArgs(3, 4).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(`FROM log_lab_storage`).WithArgs(4).WillReturnRows(sqlmock.NewRows(storageCols).
+				AddRow(1, 4, "B2.04", 7, time.Now()).AddRow(3, 4, "In transit", 3, time.Now()))
+			mock.ExpectExec(`UPDATE log_lab_storage SET location=\?, quantity=\?, updated_at=\? WHERE id=\?`).WithArgs("B2.04", 7, sqlmock.AnyArg(), 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`DELETE FROM log_lab_storage WHERE id=\?`).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO stock_movements`).WithArgs(4, "In transit", -3, 0, "transfer_in", "transfer", 9, 3, nil, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(3, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_storage`).WithArgs(4, "Lab 2", 3, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(4, 1))
+			mock.ExpectExec(`INSERT INTO stock_movements`).WithArgs(4, "Lab 2", 3, 3, "transfer_in", "transfer", 9, 3, nil, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(4, 1))
+			mock.ExpectExec(`UPDATE log_lab_equipment_master SET location=\? WHERE id=\?`).WithArgs("B2.04", 4).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`UPDATE stock_transfers SET status=\?, received_by=\?, received_at=\? WHERE id=\?`).
+				WithArgs(controllers.TransferReceived, 3, sqlmock.AnyArg(), 9).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO log_lab_activity_logs`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectQuery(`FROM stock_transfers t`).WithArgs(9).WillReturnRows(transferRows(controllers.TransferReceived))
+			So(serve("POST", "/api/transfers/9/receive", "tech", "").Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("A transfer is sent before it is received", func() {
+			expectTransferStep(mock, controllers.TransferRequested)
+			mock.ExpectRollback()
+			w := serve("POST", "/api/transfers/9/receive", "tech", "")
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Body.String(), ShouldContainSubstring, "transfer is requested and cannot become received")
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
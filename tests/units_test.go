@@ -0,0 +1,95 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"vlu_infrastructure_management/controllers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUnitStatusChanges(t *testing.T) {
+	Convey("Subject: unit status changes keep the item counters in step\n", t, func() {
+		Convey("Maintenance takes a unit off the shelf and back", func() {
+			a, q, err := controllers.UnitStatusChange(controllers.UnitAvailable, controllers.UnitMaintenance)
+			So(err, ShouldBeNil)
+			So([]int{a, q}, ShouldResemble, []int{-1, 0})
+			a, q, err = controllers.UnitStatusChange(controllers.UnitMaintenance, controllers.UnitAvailable)
+			So(err, ShouldBeNil)
+			So([]int{a, q}, ShouldResemble, []int{1, 0})
+		})
+		Convey("Retiring removes the unit from quantity too", func() {
+			a, q, err := controllers.UnitStatusChange(controllers.UnitAvailable, controllers.UnitRetired)
+			So(err, ShouldBeNil)
+			So([]int{a, q}, ShouldResemble, []int{-1, -1})
+			a, q, err = controllers.UnitStatusChange(controllers.UnitMaintenance, controllers.UnitRetired)
+			So(err, ShouldBeNil)
+			So([]int{a, q}, ShouldResemble, []int{0, -1})
+		})
+		Convey("Borrowed is never set by hand and retired is final", func() {
+			_, _, err := controllers.UnitStatusChange(controllers.UnitAvailable, controllers.UnitBorrowed)
+			So(err, ShouldNotBeNil)
+			_, _, err = controllers.UnitStatusChange(controllers.UnitBorrowed, controllers.UnitAvailable)
+			So(err, ShouldNotBeNil)
+			_, _, err = controllers.UnitStatusChange(controllers.UnitRetired, controllers.UnitAvailable)
+			So(err, ShouldNotBeNil)
+			_, _, err = controllers.UnitStatusChange(controllers.UnitAvailable, "lost")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Damaged returns go to maintenance", func() {
+			So(controllers.ReturnedUnitStatus("good"), ShouldEqual, controllers.UnitAvailable)
+			So(controllers.ReturnedUnitStatus("fair"), ShouldEqual, controllers.UnitAvailable)
+			So(controllers.ReturnedUnitStatus("damaged"), ShouldEqual, controllers.UnitMaintenance)
+			So(controllers.ReturnedUnitStatus("broken"), ShouldEqual, controllers.UnitMaintenance)
+		})
+	})
+}
+
+func TestItemUnitsList(t *testing.T) {
+	Convey("Subject: listing an item's units\n", t, func() {
+		mock := mockServer(t)
+		expectUnits := func() {
+			now := time.Now()
+			mock.ExpectQuery(`FROM equipment_units u JOIN log_lab_equipment_master e ON e\.id = u\.item_id WHERE u\.item_id=\? ORDER BY u\.id`).
+				WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"id", "item_id", "sku", "item_name", "serial_number", "asset_tag",
+				"unit_condition", "status", "holder_user_id", "borrow_id", "notes", "created_at", "updated_at"}).
+				AddRow(1, 4, "OSC-01", "Oscilloscope", "SN1", "VLU-1", "good", "borrowed", 7, 70, nil, now, now).
+				AddRow(2, 4, "OSC-01", "Oscilloscope", "SN2", "VLU-2", "good", "borrowed", 8, 80, nil, now, now).
+				AddRow(3, 4, "OSC-01", "Oscilloscope", "SN3", "VLU-3", "good", "available", nil, nil, nil, now, now))
+		}
+		var units []struct {
+			Serial string `json:"serial_number"`
+			Holder *int64 `json:"holder_user_id"`
+			Borrow *int64 `json:"borrow_id"`
+		}
+
+		Convey("Guests cannot list units", func() {
+			So(serve("GET", "/api/items/4/units", "", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Students see who holds only their own units", func() {
+			expectSession(mock, "student", 7, controllers.RoleStudent, false)
+			expectUnits()
+			w := serve("GET", "/api/items/4/units", "student", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(decode(w, &units), ShouldBeNil)
+			So(*units[0].Holder, ShouldEqual, 7)
+			So(*units[0].Borrow, ShouldEqual, 70)
+			So(units[1].Serial, ShouldEqual, "SN2")
+			So(units[1].Holder, ShouldBeNil)
+			So(units[1].Borrow, ShouldBeNil)
+		})
+		Convey("Staff see every holder", func() {
+			expectSession(mock, "tech", 3, controllers.RoleTechnician, false)
+			expectUnits()
+			w := serve("GET", "/api/items/4/units", "tech", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(decode(w, &units), ShouldBeNil)
+			So(*units[1].Holder, ShouldEqual, 8)
+			So(*units[1].Borrow, ShouldEqual, 80)
+		})
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}